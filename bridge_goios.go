@@ -215,7 +215,7 @@ func (self *GIDev) tunnelOne( pair TunPair, onready func() ) {
         binary: self.bridge.cli,
         args: args,
         stdoutHandler: func( line string, plog *log.Entry ) {
-            fmt.Println( "tunnel:%s", line )
+            fmt.Printf( "tunnel:%s\n", line )
         },
         stderrHandler: func( line string, plog *log.Entry ) {
             //fmt.Println( "tunnel:%s", line )
@@ -377,7 +377,7 @@ func (self *GIDev) KillBid( bid string ) {
 }
 
 func (self *GIDev) Launch( bid string ) {
-    fmt.Printf("Launching bundle id %d\n", bid )
+    fmt.Printf("Launching bundle id %s\n", bid )
     
     exec.Command( self.bridge.cli,
         []string{
@@ -216,7 +216,7 @@ func (self *IIFDev) tunnelOne( pair TunPair, onready func() ) {
     binary: "bin/go-ios",
     args: args,
     stdoutHandler: func( line string, plog *log.Entry ) {
-      fmt.Println( "tunnel:%s", line )
+      fmt.Printf( "tunnel:%s\n", line )
     },
     stderrHandler: func( line string, plog *log.Entry ) {
       
@@ -0,0 +1,351 @@
+package main
+
+import (
+    "time"
+    log "github.com/sirupsen/logrus"
+)
+
+// Shorthands for building parameter lists
+func cfReq( name string, kind int ) CFParam { return CFParam{ name: name, kind: kind, required: true } }
+func cfOpt( name string, kind int ) CFParam { return CFParam{ name: name, kind: kind } }
+
+var cfUdid = cfReq( "udid", CF_PARAM_STR )
+var cfPoint = []CFParam{ cfUdid, cfReq( "x", CF_PARAM_INT ), cfReq( "y", CF_PARAM_INT ) }
+
+// registerCFCommands adds every command ControlFloor sends over the
+// provider websocket.
+func registerCFCommands( router *CFRouter ) {
+    router.register( &CFCommand{
+        name: "ping",
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            return &CFR_Pong{ Text: "pong" }, nil
+        },
+    } )
+
+    // Plain input; coordinates in, "done" or an error out
+    pointInput := func( name string, fn func( dev *Device, x int, y int ) error ) {
+        router.register( &CFCommand{
+            name:     name,
+            params:   cfPoint,
+            device:   true,
+            input:    true,
+            queue:    true,
+            priority: CFA_PRI_NORMAL,
+            run: func( req *CFRequest ) ( CFResponse, error ) {
+                return nil, fn( req.dev, req.int("x"), req.int("y") )
+            },
+        } )
+    }
+    pointInput( "click", func( dev *Device, x int, y int ) error { return dev.clickAt( x, y ) } )
+    pointInput( "mouseDown", func( dev *Device, x int, y int ) error { return dev.mouseDown( x, y ) } )
+    pointInput( "mouseUp", func( dev *Device, x int, y int ) error { return dev.mouseUp( x, y ) } )
+    pointInput( "hardPress", func( dev *Device, x int, y int ) error { return dev.hardPress( x, y ) } )
+
+    router.register( &CFCommand{
+        name:     "longPress",
+        params:   append( []CFParam{ cfReq( "time", CF_PARAM_FLOAT ) }, cfPoint... ),
+        device:   true,
+        input:    true,
+        queue:    true,
+        priority: CFA_PRI_NORMAL,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            return nil, req.dev.longPress( req.int("x"), req.int("y"), req.float("time") )
+        },
+    } )
+
+    // Navigation; jumps ahead of queued input
+    navigation := func( name string, fn func( dev *Device ) error ) {
+        router.register( &CFCommand{
+            name:     name,
+            params:   []CFParam{ cfUdid },
+            device:   true,
+            input:    true,
+            queue:    true,
+            priority: CFA_PRI_HIGH,
+            run: func( req *CFRequest ) ( CFResponse, error ) {
+                return nil, fn( req.dev )
+            },
+        } )
+    }
+    navigation( "home", func( dev *Device ) error { return dev.home() } )
+    navigation( "taskSwitcher", func( dev *Device ) error { return dev.taskSwitcher() } )
+    navigation( "shake", func( dev *Device ) error { return dev.shake() } )
+    navigation( "cc", func( dev *Device ) error { return dev.cc() } )
+    navigation( "assistiveTouch", func( dev *Device ) error { return dev.toggleAssistiveTouch() } )
+
+    router.register( &CFCommand{
+        name:     "iohid",
+        params:   []CFParam{ cfUdid, cfReq( "page", CF_PARAM_INT ), cfReq( "code", CF_PARAM_INT ) },
+        device:   true,
+        input:    true,
+        queue:    true,
+        priority: CFA_PRI_NORMAL,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            return nil, req.dev.iohid( req.int("page"), req.int("code") )
+        },
+    } )
+
+    router.register( &CFCommand{
+        name: "swipe",
+        params: []CFParam{
+            cfUdid,
+            cfReq( "x1", CF_PARAM_INT ), cfReq( "y1", CF_PARAM_INT ),
+            cfReq( "x2", CF_PARAM_INT ), cfReq( "y2", CF_PARAM_INT ),
+            cfOpt( "delay", CF_PARAM_INT ),
+        },
+        device:   true,
+        input:    true,
+        queue:    true,
+        priority: CFA_PRI_NORMAL,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            return nil, req.dev.swipe( req.int("x1"), req.int("y1"), req.int("x2"), req.int("y2"), req.int("delay") )
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:     "gesture",
+        params:   []CFParam{ cfUdid, cfOpt( "kind", CF_PARAM_STR ), cfOpt( "touches", CF_PARAM_ANY ) },
+        device:   true,
+        input:    true,
+        queue:    true,
+        priority: CFA_PRI_NORMAL,
+        check: func( req *CFRequest ) error {
+            gesture, err := parseGesture( req.root )
+            req.data = gesture
+            return err
+        },
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            return nil, req.dev.gesture( req.data.( *Gesture ) )
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:     "keys",
+        params:   []CFParam{ cfUdid, cfReq( "keys", CF_PARAM_STR ) },
+        device:   true,
+        input:    true,
+        queue:    true,
+        priority: CFA_PRI_NORMAL,
+        keys: func( req *CFRequest ) []int {
+            return parseKeyCodes( req.str("keys") )
+        },
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            // keys of later commands may have been merged into this one
+            return nil, req.dev.cfa.keys( req.queued.keys )
+        },
+    } )
+
+    for _, name := range []string{ "keyDown", "keyUp" } {
+        down := name == "keyDown"
+        router.register( &CFCommand{
+            name:     name,
+            params:   []CFParam{ cfUdid, cfReq( "key", CF_PARAM_STR ) },
+            device:   true,
+            input:    true,
+            queue:    true,
+            priority: CFA_PRI_NORMAL,
+            run: func( req *CFRequest ) ( CFResponse, error ) {
+                if down {
+                    return nil, req.dev.keyDown( req.str("key") )
+                }
+                return nil, req.dev.keyUp( req.str("key") )
+            },
+        } )
+    }
+
+    router.register( &CFCommand{
+        name:   "viewerGone",
+        params: []CFParam{ cfOpt( "udid", CF_PARAM_STR ) },
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            // A viewer left; drop whatever it still had queued
+            req.cf.cancelQueued( req.udid, req.session )
+            return nil, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:   "recordStart",
+        params: []CFParam{ cfUdid, cfOpt( "name", CF_PARAM_STR ) },
+        device: true,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            file, err := req.dev.startRecording( req.str("name") )
+            if err != nil {
+                return nil, err
+            }
+            return &CFR_Recording{ File: file }, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:   "recordStop",
+        params: []CFParam{ cfUdid },
+        device: true,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            file, count := req.dev.stopRecording()
+            return &CFR_Recording{ File: file, Events: count }, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:   "videoRecordStart",
+        params: []CFParam{ cfUdid, cfOpt( "name", CF_PARAM_STR ) },
+        device: true,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            id, err := req.dev.startVidRecording( req.str("name") )
+            if err != nil {
+                return nil, err
+            }
+            return &CFR_VidRecording{ Id: id }, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:   "videoRecordStop",
+        params: []CFParam{ cfUdid },
+        device: true,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            info, err := req.dev.stopVidRecording()
+            if err != nil {
+                return nil, err
+            }
+            return &CFR_VidRecording{ Id: info.Id, Frames: info.Frames, Size: info.Size }, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:   "startStream",
+        params: []CFParam{ cfUdid, cfOpt( "viewer", CF_PARAM_STR ) },
+        device: true,
+        async:  true,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            log.WithFields( log.Fields{
+                "type":   "cf_start_stream",
+                "udid":   censorUuid( req.udid ),
+                "viewer": req.str("viewer"),
+            } ).Info("Starting video stream for ControlFloor")
+            return nil, req.dev.startVidStream( req.srv, req.str("viewer") )
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:   "stopStream",
+        params: []CFParam{ cfUdid, cfOpt( "viewer", CF_PARAM_STR ) },
+        device: true,
+        async:  true,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            req.dev.stopVidStream( req.srv, req.str("viewer") )
+            return nil, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:     "source",
+        params:   []CFParam{ cfUdid },
+        device:   true,
+        queue:    true,
+        priority: CFA_PRI_LOW,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            source, err := req.dev.source()
+            if err != nil {
+                return nil, err
+            }
+            return &CFR_Source{ Source: source }, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:     "findElements",
+        params:   []CFParam{ cfUdid, cfReq( "selector", CF_PARAM_STR ), cfOpt( "pid", CF_PARAM_INT ) },
+        device:   true,
+        queue:    true,
+        priority: CFA_PRI_LOW,
+        check: func( req *CFRequest ) error {
+            _, err := parseSelector( req.str("selector") )
+            return err
+        },
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            els, err := req.dev.findElements( req.str("selector"), req.int("pid") )
+            if err != nil {
+                return nil, err
+            }
+            return &CFR_Elements{ Elements: els }, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:     "wifiIp",
+        params:   []CFParam{ cfUdid },
+        device:   true,
+        queue:    true,
+        priority: CFA_PRI_LOW,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            ip, err := req.dev.WifiIp()
+            if err != nil {
+                return nil, err
+            }
+            return &CFR_WifiIp{ Ip: ip, Mac: req.dev.WifiMac() }, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name: "shutdown",
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            // reply before the provider goes away
+            go do_shutdown( req.cf.config, req.cf.DevTracker )
+            return nil, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:   "kill",
+        params: []CFParam{ cfUdid, cfReq( "bid", CF_PARAM_STR ) },
+        device: true,
+        input:  true,
+        async:  true,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            req.dev.killBid( req.str("bid") )
+            return nil, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:   "launch",
+        params: []CFParam{ cfUdid, cfReq( "bid", CF_PARAM_STR ) },
+        device: true,
+        input:  true,
+        async:  true,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            req.dev.launch( req.str("bid") )
+            return nil, nil
+        },
+    } )
+
+    // ControlFloor hands devices out; expires is how many seconds the lease
+    // lasts
+    router.register( &CFCommand{
+        name:   "lease",
+        params: []CFParam{ cfUdid, cfReq( "user", CF_PARAM_STR ), cfReq( "expires", CF_PARAM_INT ) },
+        device: true,
+        check: func( req *CFRequest ) error {
+            if req.user == "" || req.int("expires") <= 0 {
+                return &CFError{ Code: CF_ERR_PARAM, Msg: "lease needs a user and a positive expires" }
+            }
+            return nil
+        },
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            end := req.dev.grantLease( req.user, time.Duration( req.int("expires") ) * time.Second )
+            return &CFR_Lease{ User: req.user, Expires: end.Unix() }, nil
+        },
+    } )
+
+    router.register( &CFCommand{
+        name:   "release",
+        params: []CFParam{ cfUdid, cfOpt( "user", CF_PARAM_STR ) },
+        device: true,
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            // Releasing a device nobody holds is not an error
+            req.dev.endLease( req.user, LEASE_RELEASED )
+            return nil, nil
+        },
+    } )
+}
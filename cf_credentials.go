@@ -0,0 +1,389 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+    uj "github.com/nanoscopic/ujsonin/v2/mod"
+    log "github.com/sirupsen/logrus"
+)
+
+// Where the passwords got by registering are kept
+const CF_CREDS_PATH = "cf.json"
+
+// Read by register when the registration password is not given as an option
+const CF_REGPASS_ENV = "CF_REGPASS"
+
+const CF_DEFAULT_REGPASS = "doreg"
+
+// CFCreds is cf.json as written by writeCFConfig.
+type CFCreds struct {
+    Pass    string                    `json:"pass,omitempty"` // from before servers had names
+    Servers map[string] CFCredsServer `json:"servers"`
+}
+
+type CFCredsServer struct {
+    Pass string `json:"pass"`
+}
+
+// readCFPasses gets the password for each server from cf.json. A bare pass
+// from before servers had names is the password of "default". Files saved
+// before cf.json was plain JSON are read with ujsonin.
+func readCFPasses( configPath string ) ( map[string] string, error ) {
+    fh, err := os.Stat( configPath )
+    if err != nil {
+        return nil, err
+    }
+    configFile := configPath
+    switch mode := fh.Mode(); {
+        case mode.IsDir(): configFile = fmt.Sprintf("%s/config.json", configPath)
+    }
+    content, err := ioutil.ReadFile( configFile )
+    if err != nil {
+        return nil, err
+    }
+
+    creds := CFCreds{}
+    if err := json.Unmarshal( content, &creds ); err != nil {
+        root, _, perr := uj.ParseFull( content )
+        if perr != nil {
+            return nil, fmt.Errorf( "%s is invalid: %s", configFile, perr )
+        }
+        creds = CFCreds{ Servers: make( map[string] CFCredsServer ) }
+        if passNode := root.Get("pass"); passNode != nil {
+            creds.Pass = passNode.String()
+        }
+        if serversNode := root.Get("servers"); serversNode != nil {
+            serversNode.ForEachKeyed( func( name string, serverNode uj.JNode ) {
+                if passNode := serverNode.Get("pass"); passNode != nil {
+                    creds.Servers[ name ] = CFCredsServer{ Pass: passNode.String() }
+                }
+            } )
+        }
+    }
+
+    passes := make( map[string] string )
+    if creds.Pass != "" {
+        passes[ "default" ] = creds.Pass
+    }
+    for name, server := range creds.Servers {
+        passes[ name ] = server.Pass
+    }
+    return passes, nil
+}
+
+// cfPassFor finds the password of server name. When it is the only server
+// a password saved before servers had names will do.
+func cfPassFor( passes map[string] string, name string, only bool ) ( string, bool ) {
+    pass, ok := passes[ name ]
+    if !ok && only {
+        pass, ok = passes[ "default" ]
+    }
+    return pass, ok
+}
+
+// dropLegacyPass forgets a password saved before servers had names once the
+// only server, name, has been dealt with.
+func dropLegacyPass( config *Config, name string, passes map[string] string ) {
+    if len( config.cfServers ) == 1 && name != "default" {
+        delete( passes, "default" )
+    }
+}
+
+// writeCFConfig saves passes where only the provider's user can read them,
+// as they let anyone log in as the provider.
+func writeCFConfig( configPath string, passes map[string] string ) error {
+    creds := CFCreds{ Servers: make( map[string] CFCredsServer ) }
+    for name, pass := range passes {
+        creds.Servers[ name ] = CFCredsServer{ Pass: pass }
+    }
+    text, err := json.MarshalIndent( creds, "", "    " )
+    if err != nil {
+        return err
+    }
+
+    tmp := configPath + ".tmp"
+    os.Remove( tmp )
+    if err := ioutil.WriteFile( tmp, append( text, '\n' ), 0600 ); err != nil {
+        return err
+    }
+    return os.Rename( tmp, configPath )
+}
+
+// cfServersNamed is the configured server called name, or all of them when
+// name is empty.
+func cfServersNamed( config *Config, name string ) ( []CFServerConfig, error ) {
+    if name == "" {
+        return config.cfServers, nil
+    }
+    for _, conf := range config.cfServers {
+        if conf.name == name {
+            return []CFServerConfig{ conf }, nil
+        }
+    }
+    return nil, fmt.Errorf( "no ControlFloor server named %s", name )
+}
+
+// regPassFrom gets the registration password without asking for it: from
+// pass, else the file passFile, else CF_REGPASS_ENV. It is empty when none
+// of those are set.
+func regPassFrom( pass string, passFile string ) ( string, error ) {
+    if pass != "" {
+        return pass, nil
+    }
+    if passFile != "" {
+        content, err := ioutil.ReadFile( passFile )
+        if err != nil {
+            return "", err
+        }
+        pass = strings.TrimSpace( string( content ) )
+        if pass == "" {
+            return "", fmt.Errorf( "%s is empty", passFile )
+        }
+        return pass, nil
+    }
+    return os.Getenv( CF_REGPASS_ENV ), nil
+}
+
+func promptRegPass( reader *bufio.Reader, conf CFServerConfig, named bool ) string {
+    if named {
+        fmt.Printf("Enter registration password for %s:", conf.name )
+    } else {
+        fmt.Print("Enter registration password:")
+    }
+    regPass, _ := reader.ReadString('\n')
+    regPass = strings.TrimSpace( regPass )
+    if regPass == "" {
+        regPass = CF_DEFAULT_REGPASS
+        fmt.Printf("Using default registration password of %s\n", regPass)
+    }
+    return regPass
+}
+
+// doregister registers with each configured ControlFloor, or only the one
+// named by server, and saves the passwords got in cf.json. When regPass is
+// empty the registration password is asked for.
+func doregister( config *Config, server string, regPass string ) error {
+    servers, err := cfServersNamed( config, server )
+    if err != nil {
+        return err
+    }
+    passes := make( map[string] string )
+    if saved, err := readCFPasses( CF_CREDS_PATH ); err == nil {
+        passes = saved
+    }
+
+    reader := bufio.NewReader( os.Stdin )
+    for _, conf := range servers {
+        pass := regPass
+        if pass == "" {
+            pass = promptRegPass( reader, conf, len( config.cfServers ) > 1 )
+        }
+        newPass, err := registerServer( conf, pass )
+        if err != nil {
+            return fmt.Errorf( "%s: %s", conf.name, err )
+        }
+        passes[ conf.name ] = newPass
+        dropLegacyPass( config, conf.name, passes )
+        // Saved as we go, so a later failure does not lose the password
+        if err := writeCFConfig( CF_CREDS_PATH, passes ); err != nil {
+            return err
+        }
+    }
+
+    reloadProvider( config )
+    return nil
+}
+
+func registerServer( conf CFServerConfig, regPass string ) ( string, error ) {
+    srv := NewCFServer( nil, conf, "", "" )
+    resp, err := srv.client.PostForm( srv.base + "/provider/register",
+        url.Values{
+            "regPass": {regPass},
+            "username": {conf.username},
+        },
+    )
+    if err != nil {
+        return "", err
+    }
+    root, err := cfJsonResult( resp )
+    if err != nil {
+        return "", fmt.Errorf( "registration failed: %s", err )
+    }
+
+    pass := ""
+    if passNode := root.Get("Password"); passNode != nil {
+        pass = passNode.String()
+    }
+    if pass == "" {
+        return "", errors.New("registration gave no password")
+    }
+    fmt.Printf("Registered with %s\n", conf.name )
+    if existed := root.Get("Existed"); existed != nil && existed.Bool() {
+        fmt.Printf("User %s existed so password was renewed\n", conf.username )
+    }
+    return pass, nil
+}
+
+// dounregister removes the provider from each configured ControlFloor, or
+// only the one named by server, and forgets its password.
+func dounregister( config *Config, server string ) error {
+    return updateCreds( config, server, func( srv *CFServer, passes map[string] string ) error {
+        if _, err := srv.call( "/provider/unregister", url.Values{} ); err != nil {
+            return err
+        }
+        delete( passes, srv.name )
+        fmt.Printf("Unregistered from %s\n", srv.name )
+        return nil
+    } )
+}
+
+// dorotate gets a new password from each configured ControlFloor, or only
+// the one named by server, in place of the current one.
+func dorotate( config *Config, server string ) error {
+    err := updateCreds( config, server, func( srv *CFServer, passes map[string] string ) error {
+        root, err := srv.call( "/provider/rotatePass", url.Values{} )
+        if err != nil {
+            return err
+        }
+        pass := ""
+        if passNode := root.Get("Password"); passNode != nil {
+            pass = passNode.String()
+        }
+        if pass == "" {
+            return errors.New("no password given")
+        }
+        passes[ srv.name ] = pass
+        fmt.Printf("Rotated password for %s\n", srv.name )
+        return nil
+    } )
+    if err != nil {
+        return err
+    }
+    reloadProvider( config )
+    return nil
+}
+
+// updateCreds logs in to the chosen servers with the saved passwords and
+// runs change for each, saving cf.json after every change that works.
+func updateCreds( config *Config, server string, change func( *CFServer, map[string] string ) error ) error {
+    servers, err := cfServersNamed( config, server )
+    if err != nil {
+        return err
+    }
+    passes, err := readCFPasses( CF_CREDS_PATH )
+    if err != nil {
+        return fmt.Errorf( "could not read %s: %s", CF_CREDS_PATH, err )
+    }
+
+    for _, conf := range servers {
+        pass, ok := cfPassFor( passes, conf.name, len( config.cfServers ) == 1 )
+        if !ok {
+            return fmt.Errorf( "%s: not registered", conf.name )
+        }
+        srv := NewCFServer( nil, conf, pass, "" )
+        if err := change( srv, passes ); err != nil {
+            return fmt.Errorf( "%s: %s", conf.name, err )
+        }
+        dropLegacyPass( config, conf.name, passes )
+        if err := writeCFConfig( CF_CREDS_PATH, passes ); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// call logs in and posts vals to path, returning the JSON reply.
+func (self *CFServer) call( path string, vals url.Values ) ( uj.JNode, error ) {
+    if !self.login() {
+        return nil, errors.New("could not login")
+    }
+    resp, err := self.httpClient().PostForm( self.base + path, vals )
+    if err != nil {
+        return nil, err
+    }
+    return cfJsonResult( resp )
+}
+
+// cfJsonResult reads a reply of the form {Success:true,...}, turning
+// anything else into an error.
+func cfJsonResult( resp *http.Response ) ( uj.JNode, error ) {
+    defer resp.Body.Close()
+    body, err := ioutil.ReadAll( resp.Body )
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode != 200 {
+        return nil, fmt.Errorf( "status %d", resp.StatusCode )
+    }
+    root, _, perr := uj.ParseFull( body )
+    if perr != nil || root == nil {
+        return nil, errors.New("reply is not JSON")
+    }
+    if sNode := root.Get("Success"); sNode == nil || !sNode.Bool() {
+        if errNode := root.Get("Error"); errNode != nil {
+            return nil, errors.New( errNode.String() )
+        }
+        return nil, errors.New("not successful")
+    }
+    return root, nil
+}
+
+// reloadProvider asks a provider running here to pick up the passwords
+// just saved.
+func reloadProvider( config *Config ) {
+    client := &http.Client{ Timeout: 5 * time.Second }
+    resp, err := client.Post( fmt.Sprintf( "http://127.0.0.1:%d/cfReload", config.httpPort ), "text/plain", nil )
+    if err != nil {
+        fmt.Printf("No running provider to update; it will use the new password when started\n")
+        return
+    }
+    defer resp.Body.Close()
+    body, _ := ioutil.ReadAll( resp.Body )
+    if resp.StatusCode != 200 {
+        fmt.Printf("Running provider could not load the new password: %s\n", strings.TrimSpace( string( body ) ) )
+        return
+    }
+    fmt.Printf("Running provider is now using the new password\n")
+}
+
+// reloadCreds reads cf.json again, so that passwords changed by register or
+// rotate-password are used without a restart. Servers whose password
+// changed log in again when next needed; an open websocket is left alone.
+func (self *ControlFloor) reloadCreds() error {
+    passes, err := readCFPasses( CF_CREDS_PATH )
+    if err != nil {
+        return err
+    }
+
+    changed := []string{}
+    for _, srv := range self.servers {
+        pass, ok := cfPassFor( passes, srv.name, len( self.servers ) == 1 )
+        if !ok {
+            log.WithFields( log.Fields{
+                "type":   "cf_creds_missing",
+                "server": srv.name,
+            } ).Warn( "No password for ControlFloor server; keeping the current one" )
+            continue
+        }
+        srv.lock.Lock()
+        if srv.pass != pass {
+            srv.pass = pass
+            srv.ready = false
+            changed = append( changed, srv.name )
+        }
+        srv.lock.Unlock()
+    }
+    log.WithFields( log.Fields{
+        "type":    "cf_creds_reload",
+        "changed": changed,
+    } ).Info( "Reloaded ControlFloor passwords" )
+    return nil
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    ws "github.com/gorilla/websocket"
+    uj "github.com/nanoscopic/ujsonin/v2/mod"
+    log "github.com/sirupsen/logrus"
+)
+
+// CFMockNote is one status update or heartbeat a provider posted.
+type CFMockNote struct {
+    Variant string
+    Udid    string
+    Vals    url.Values
+    At      time.Time
+}
+
+// CFMockVid is a video channel the provider opened.
+type CFMockVid struct {
+    Udid   string
+    Viewer string
+    Frames int // binary messages received
+    conn   *ws.Conn
+}
+
+type cfMockFail struct {
+    path   string
+    status int
+    count  int
+}
+
+/*
+CFMock is a stand-in for ControlFloor that implements the endpoints a
+provider uses: login, registration, device status, heartbeat, the command
+websocket and video channels. It keeps every notification, lets commands be
+sent down the websocket and their replies awaited, and can be told to fail
+in the ways a real ControlFloor does, so the provider can be exercised
+without a ControlFloor checkout.
+
+Like ControlFloor, requests without a session are redirected to the login
+page, and a rejected login redirects with fail=1.
+*/
+type CFMock struct {
+    lock       *sync.Mutex
+    writeLock  *sync.Mutex
+    listener   net.Listener
+    server     *http.Server
+    host       string
+    regPass    string
+    users      map[string] string // password by username
+    sessions   map[string] string // username by session cookie
+    seq        int
+    notes      []*CFMockNote
+    conn       *ws.Conn
+    conns      int
+    nextId     int
+    waiting    map[int] chan uj.JNode
+    unmatched  []string
+    vids       []*CFMockVid
+    loginFails int
+    fails      []*cfMockFail
+    changed    chan bool // closed whenever anything above changes
+    onNote     func( *CFMockNote )
+}
+
+const CF_MOCK_COOKIE = "session"
+
+// NewCFMock starts a mock ControlFloor listening on addr; "127.0.0.1:0"
+// picks a free port.
+func NewCFMock( addr string ) ( *CFMock, error ) {
+    listener, err := net.Listen( "tcp", addr )
+    if err != nil {
+        return nil, err
+    }
+    self := &CFMock{
+        lock:      &sync.Mutex{},
+        writeLock: &sync.Mutex{},
+        listener:  listener,
+        host:      listener.Addr().String(),
+        regPass:   CF_DEFAULT_REGPASS,
+        users:     make( map[string] string ),
+        sessions:  make( map[string] string ),
+        waiting:   make( map[int] chan uj.JNode ),
+        changed:   make( chan bool ),
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc( "/provider/login", self.onLogin )
+    mux.HandleFunc( "/provider/register", self.onRegister )
+    mux.HandleFunc( "/provider/rotatePass", self.onRotatePass )
+    mux.HandleFunc( "/provider/unregister", self.onUnregister )
+    mux.HandleFunc( "/provider/device/status/", self.onStatus )
+    mux.HandleFunc( "/provider/heartbeat", self.onHeartbeat )
+    mux.HandleFunc( "/provider/ws", self.onWs )
+    mux.HandleFunc( "/provider/imgStream", self.onImgStream )
+    self.server = &http.Server{ Handler: self.failing( mux ) }
+
+    go self.server.Serve( listener )
+    return self, nil
+}
+
+// addUser lets username log in with pass.
+func (self *CFMock) addUser( username string, pass string ) {
+    self.lock.Lock()
+    self.users[ username ] = pass
+    self.lock.Unlock()
+}
+
+// failLogins makes the next count logins fail as if the password was wrong.
+func (self *CFMock) failLogins( count int ) {
+    self.lock.Lock()
+    self.loginFails = count
+    self.lock.Unlock()
+}
+
+// fail answers the next count requests to paths starting with path with
+// status instead of handling them.
+func (self *CFMock) fail( path string, status int, count int ) {
+    self.lock.Lock()
+    self.fails = append( self.fails, &cfMockFail{ path: path, status: status, count: count } )
+    self.lock.Unlock()
+}
+
+// expireSessions forgets every login, as a restarted ControlFloor would.
+func (self *CFMock) expireSessions() {
+    self.lock.Lock()
+    self.sessions = make( map[string] string )
+    self.lock.Unlock()
+}
+
+// dropSocket closes the command websocket from the ControlFloor end.
+func (self *CFMock) dropSocket() {
+    self.lock.Lock()
+    conn := self.conn
+    self.lock.Unlock()
+    if conn != nil {
+        conn.Close()
+    }
+}
+
+func (self *CFMock) close() {
+    self.dropSocket()
+    self.lock.Lock()
+    for _, vid := range self.vids {
+        vid.conn.Close()
+    }
+    self.lock.Unlock()
+    self.server.Close()
+}
+
+// received returns the notifications of one variant, or all of them when
+// variant is empty.
+func (self *CFMock) received( variant string ) []*CFMockNote {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.notesOf( variant )
+}
+
+func (self *CFMock) notesOf( variant string ) []*CFMockNote {
+    notes := []*CFMockNote{}
+    for _, note := range self.notes {
+        if variant == "" || note.Variant == variant {
+            notes = append( notes, note )
+        }
+    }
+    return notes
+}
+
+// waitNotes waits until count notifications of variant have arrived.
+func (self *CFMock) waitNotes( variant string, count int, timeout time.Duration ) ( []*CFMockNote, error ) {
+    var notes []*CFMockNote
+    err := self.waitFor( timeout, func() bool {
+        notes = self.notesOf( variant )
+        return len( notes ) >= count
+    } )
+    if err != nil {
+        return notes, fmt.Errorf( "got %d of %d %s notifications", len( notes ), count, variant )
+    }
+    return notes, nil
+}
+
+// waitConnected waits until the provider has opened count command
+// websockets in all, and the last is still open.
+func (self *CFMock) waitConnected( count int, timeout time.Duration ) error {
+    conns := 0
+    err := self.waitFor( timeout, func() bool {
+        conns = self.conns
+        return conns >= count && self.conn != nil
+    } )
+    if err != nil {
+        return fmt.Errorf( "provider connected %d of %d times", conns, count )
+    }
+    return nil
+}
+
+// waitVid waits for a video channel for udid and viewer.
+func (self *CFMock) waitVid( udid string, viewer string, timeout time.Duration ) ( *CFMockVid, error ) {
+    var found *CFMockVid
+    err := self.waitFor( timeout, func() bool {
+        for _, vid := range self.vids {
+            if vid.Udid == udid && vid.Viewer == viewer {
+                found = vid
+                return true
+            }
+        }
+        return false
+    } )
+    if err != nil {
+        return nil, fmt.Errorf( "no video channel for %s", viewer )
+    }
+    return found, nil
+}
+
+// frames is how many frames have come down vid.
+func (self *CFMock) frames( vid *CFMockVid ) int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return vid.Frames
+}
+
+// waitFor calls check, with lock held, until it is true or timeout passes.
+func (self *CFMock) waitFor( timeout time.Duration, check func() bool ) error {
+    deadline := time.After( timeout )
+    for {
+        self.lock.Lock()
+        done := check()
+        changed := self.changed
+        self.lock.Unlock()
+        if done {
+            return nil
+        }
+        select {
+            case <- changed:
+            case <- deadline:
+                return errors.New("timed out")
+        }
+    }
+}
+
+// touch wakes waiters. Called with lock held.
+func (self *CFMock) touch() {
+    close( self.changed )
+    self.changed = make( chan bool )
+}
+
+// command sends a command to the provider and waits for its reply.
+func (self *CFMock) command( mType string, params map[string] interface{}, timeout time.Duration ) ( uj.JNode, error ) {
+    msg := map[string] interface{}{}
+    for key, val := range params {
+        msg[ key ] = val
+    }
+
+    self.lock.Lock()
+    self.nextId++
+    id := self.nextId
+    replyCh := make( chan uj.JNode, 1 )
+    self.waiting[ id ] = replyCh
+    self.lock.Unlock()
+
+    defer func() {
+        self.lock.Lock()
+        delete( self.waiting, id )
+        self.lock.Unlock()
+    }()
+
+    msg["id"] = id
+    msg["type"] = mType
+    text, _ := json.Marshal( msg )
+    if err := self.send( string( text ) ); err != nil {
+        return nil, err
+    }
+
+    select {
+        case reply := <- replyCh:
+            return reply, nil
+        case <- time.After( timeout ):
+            return nil, fmt.Errorf( "no reply to %s", mType )
+    }
+}
+
+// send writes text to the provider as it is, for messages command cannot
+// make. Replies that match no command are kept; see replies.
+func (self *CFMock) send( text string ) error {
+    self.lock.Lock()
+    conn := self.conn
+    self.lock.Unlock()
+    if conn == nil {
+        return errors.New("provider is not connected")
+    }
+    self.writeLock.Lock()
+    defer self.writeLock.Unlock()
+    return conn.WriteMessage( ws.TextMessage, []byte( text ) )
+}
+
+// waitReplies waits for count replies that matched no command.
+func (self *CFMock) waitReplies( count int, timeout time.Duration ) ( []string, error ) {
+    var replies []string
+    err := self.waitFor( timeout, func() bool {
+        replies = append( []string{}, self.unmatched... )
+        return len( replies ) >= count
+    } )
+    return replies, err
+}
+
+// failing answers requests that fail was told about.
+func (self *CFMock) failing( next http.Handler ) http.Handler {
+    return http.HandlerFunc( func( w http.ResponseWriter, r *http.Request ) {
+        status := 0
+        self.lock.Lock()
+        for _, fail := range self.fails {
+            if fail.count > 0 && strings.HasPrefix( r.URL.Path, fail.path ) {
+                fail.count--
+                status = fail.status
+                break
+            }
+        }
+        self.lock.Unlock()
+        if status != 0 {
+            http.Error( w, "mock failure", status )
+            return
+        }
+        next.ServeHTTP( w, r )
+    } )
+}
+
+// user is who the request's session belongs to. When there is none the
+// request is sent to the login page, as ControlFloor does.
+func (self *CFMock) user( w http.ResponseWriter, r *http.Request ) ( string, bool ) {
+    if cookie, err := r.Cookie( CF_MOCK_COOKIE ); err == nil {
+        self.lock.Lock()
+        user, ok := self.sessions[ cookie.Value ]
+        self.lock.Unlock()
+        if ok {
+            return user, true
+        }
+    }
+    http.Redirect( w, r, "/login", http.StatusFound )
+    return "", false
+}
+
+func (self *CFMock) onLogin( w http.ResponseWriter, r *http.Request ) {
+    r.ParseForm()
+    user := r.Form.Get("user")
+    pass := r.Form.Get("pass")
+
+    self.lock.Lock()
+    ok := self.users[ user ] == pass && pass != ""
+    if self.loginFails > 0 {
+        self.loginFails--
+        ok = false
+    }
+    session := ""
+    if ok {
+        self.seq++
+        session = fmt.Sprintf( "s%d", self.seq )
+        self.sessions[ session ] = user
+    }
+    self.lock.Unlock()
+
+    if !ok {
+        http.Redirect( w, r, "/login?fail=1", http.StatusFound )
+        return
+    }
+    http.SetCookie( w, &http.Cookie{ Name: CF_MOCK_COOKIE, Value: session, Path: "/" } )
+    http.Redirect( w, r, "/", http.StatusFound )
+}
+
+func (self *CFMock) onRegister( w http.ResponseWriter, r *http.Request ) {
+    r.ParseForm()
+    user := r.Form.Get("username")
+
+    self.lock.Lock()
+    if r.Form.Get("regPass") != self.regPass || user == "" {
+        self.lock.Unlock()
+        w.Write( []byte(`{"Success":false,"Error":"bad registration password"}`) )
+        return
+    }
+    _, existed := self.users[ user ]
+    self.seq++
+    pass := fmt.Sprintf( "pass%d", self.seq )
+    self.users[ user ] = pass
+    self.lock.Unlock()
+
+    text, _ := json.Marshal( map[string] interface{}{ "Success": true, "Existed": existed, "Password": pass } )
+    w.Write( text )
+}
+
+func (self *CFMock) onRotatePass( w http.ResponseWriter, r *http.Request ) {
+    user, ok := self.user( w, r )
+    if !ok {
+        return
+    }
+    self.lock.Lock()
+    self.seq++
+    pass := fmt.Sprintf( "pass%d", self.seq )
+    self.users[ user ] = pass
+    self.lock.Unlock()
+
+    text, _ := json.Marshal( map[string] interface{}{ "Success": true, "Password": pass } )
+    w.Write( text )
+}
+
+func (self *CFMock) onUnregister( w http.ResponseWriter, r *http.Request ) {
+    user, ok := self.user( w, r )
+    if !ok {
+        return
+    }
+    self.lock.Lock()
+    delete( self.users, user )
+    self.lock.Unlock()
+    w.Write( []byte(`{"Success":true}`) )
+}
+
+func (self *CFMock) onStatus( w http.ResponseWriter, r *http.Request ) {
+    if _, ok := self.user( w, r ); !ok {
+        return
+    }
+    r.ParseForm()
+    self.addNote( strings.TrimPrefix( r.URL.Path, "/provider/device/status/" ), r.Form )
+    w.Write( []byte("ok") )
+}
+
+func (self *CFMock) onHeartbeat( w http.ResponseWriter, r *http.Request ) {
+    if _, ok := self.user( w, r ); !ok {
+        return
+    }
+    r.ParseForm()
+    self.addNote( "heartbeat", r.Form )
+    w.Write( []byte("ok") )
+}
+
+func (self *CFMock) addNote( variant string, vals url.Values ) {
+    note := &CFMockNote{
+        Variant: variant,
+        Udid:    vals.Get("udid"),
+        Vals:    vals,
+        At:      time.Now(),
+    }
+    self.lock.Lock()
+    self.notes = append( self.notes, note )
+    onNote := self.onNote
+    self.touch()
+    self.lock.Unlock()
+
+    if onNote != nil {
+        onNote( note )
+    }
+}
+
+func (self *CFMock) onWs( w http.ResponseWriter, r *http.Request ) {
+    if _, ok := self.user( w, r ); !ok {
+        return
+    }
+    upgrader := ws.Upgrader{}
+    conn, err := upgrader.Upgrade( w, r, nil )
+    if err != nil {
+        return
+    }
+
+    self.lock.Lock()
+    old := self.conn
+    self.conn = conn
+    self.conns++
+    self.touch()
+    self.lock.Unlock()
+    if old != nil {
+        old.Close()
+    }
+    log.WithFields( log.Fields{
+        "type": "cfmock_ws_open",
+    } ).Info("Provider connected to mock ControlFloor")
+
+    for {
+        _, msg, err := conn.ReadMessage()
+        if err != nil {
+            break
+        }
+        self.onReply( string( msg ) )
+    }
+
+    self.lock.Lock()
+    if self.conn == conn {
+        self.conn = nil
+    }
+    self.touch()
+    self.lock.Unlock()
+    conn.Close()
+    log.WithFields( log.Fields{
+        "type": "cfmock_ws_close",
+    } ).Info("Provider left mock ControlFloor")
+}
+
+func (self *CFMock) onReply( text string ) {
+    id := -1
+    root, _, perr := uj.ParseFull( []byte( text ) )
+    if perr == nil && root != nil {
+        if idNode := root.Get("id"); idNode != nil {
+            id = idNode.Int()
+        }
+    }
+
+    self.lock.Lock()
+    replyCh := self.waiting[ id ]
+    if replyCh == nil {
+        self.unmatched = append( self.unmatched, text )
+    }
+    self.touch()
+    self.lock.Unlock()
+
+    if replyCh != nil {
+        replyCh <- root
+    }
+}
+
+func (self *CFMock) onImgStream( w http.ResponseWriter, r *http.Request ) {
+    if _, ok := self.user( w, r ); !ok {
+        return
+    }
+    upgrader := ws.Upgrader{}
+    conn, err := upgrader.Upgrade( w, r, nil )
+    if err != nil {
+        return
+    }
+    vid := &CFMockVid{
+        Udid:   r.URL.Query().Get("udid"),
+        Viewer: r.URL.Query().Get("viewer"),
+        conn:   conn,
+    }
+    self.lock.Lock()
+    self.vids = append( self.vids, vid )
+    self.touch()
+    self.lock.Unlock()
+
+    for {
+        t, _, err := conn.ReadMessage()
+        if err != nil {
+            break
+        }
+        if t == ws.BinaryMessage {
+            self.lock.Lock()
+            vid.Frames++
+            self.touch()
+            self.lock.Unlock()
+        }
+    }
+    conn.Close()
+}
+
+/*
+console runs commands typed by a person driving the mock, one per line:
+
+    drop                        close the command websocket
+    expire                      forget every login
+    failLogin [count]           fail the next logins
+    fail path status [count]    answer requests to path with status
+    notes [variant]             list notifications received
+    type [json]                 send a command, eg. click {"udid":"...","x":1,"y":2}
+*/
+func (self *CFMock) console( in io.Reader, out io.Writer ) {
+    scanner := bufio.NewScanner( in )
+    for scanner.Scan() {
+        line := strings.TrimSpace( scanner.Text() )
+        if line == "" {
+            continue
+        }
+        parts := strings.Fields( line )
+        count := func( pos int ) int {
+            if len( parts ) > pos {
+                if n, err := strconv.Atoi( parts[ pos ] ); err == nil {
+                    return n
+                }
+            }
+            return 1
+        }
+        switch parts[0] {
+            case "drop":
+                self.dropSocket()
+            case "expire":
+                self.expireSessions()
+            case "failLogin":
+                self.failLogins( count( 1 ) )
+            case "fail":
+                if len( parts ) < 3 {
+                    fmt.Fprintf( out, "usage: fail path status [count]\n" )
+                    continue
+                }
+                status, _ := strconv.Atoi( parts[2] )
+                self.fail( parts[1], status, count( 3 ) )
+            case "notes":
+                variant := ""
+                if len( parts ) > 1 {
+                    variant = parts[1]
+                }
+                for _, note := range self.received( variant ) {
+                    fmt.Fprintf( out, "%s %s %s\n", note.At.Format( time.RFC3339 ), note.Variant, note.Vals.Encode() )
+                }
+            default:
+                params := map[string] interface{}{}
+                if rest := strings.TrimSpace( strings.TrimPrefix( line, parts[0] ) ); rest != "" {
+                    if err := json.Unmarshal( []byte( rest ), &params ); err != nil {
+                        fmt.Fprintf( out, "bad params: %s\n", err )
+                        continue
+                    }
+                }
+                reply, err := self.command( parts[0], params, 30 * time.Second )
+                if err != nil {
+                    fmt.Fprintf( out, "%s\n", err )
+                    continue
+                }
+                fmt.Fprintf( out, "%s\n", reply.JsonSave() )
+        }
+    }
+}
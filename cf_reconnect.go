@@ -0,0 +1,227 @@
+package main
+
+import (
+    "math/rand"
+    "net/http/cookiejar"
+    "time"
+    log "github.com/sirupsen/logrus"
+)
+
+// Bounds of the wait between attempts to reach ControlFloor
+const (
+    CF_RECONNECT_MIN = time.Second
+    CF_RECONNECT_MAX = time.Second * 60
+)
+
+// cfBackoff is the wait before reconnect attempt n ( counting from 0 ). It
+// doubles each attempt up to CF_RECONNECT_MAX, and half of it is random so
+// that providers which lost the same ControlFloor do not all return at once.
+func cfBackoff( attempt int ) time.Duration {
+    wait := CF_RECONNECT_MIN
+    for i := 0; i < attempt && wait < CF_RECONNECT_MAX; i++ {
+        wait *= 2
+    }
+    if wait > CF_RECONNECT_MAX {
+        wait = CF_RECONNECT_MAX
+    }
+    half := wait / 2
+    return half + time.Duration( rand.Int63n( int64( half ) + 1 ) )
+}
+
+/*
+connectLoop keeps the provider connected to one of servers, which are in
+order of preference, until the provider stops. Each attempt starts a fresh
+login session, then opens the command websocket. When a server cannot be
+reached the next one is tried straight away; the wait between attempts
+comes after every server has failed. cfReady is signalled after the first
+login to any server.
+
+When a server's websocket has been up before, or the provider has moved to
+it from another server, the server is resynced: it may have restarted and
+forgotten the provider, or never heard of it, so it is told again about
+every device.
+
+While on a backup server the preferred ones are checked every
+controlfloor.failback, and the provider moves back as soon as one is up.
+*/
+func (self *ControlFloor) connectLoop( servers []*CFServer, cfReady chan bool ) {
+    attempt := 0
+    next := 0
+    for {
+        if attempt > 0 && next == 0 {
+            wait := cfBackoff( attempt - 1 )
+            log.WithFields( log.Fields{
+                "type":    "cf_reconnect_wait",
+                "attempt": attempt,
+                "wait":    wait.String(),
+            } ).Info( "Waiting to reconnect to ControlFloor" )
+            select {
+                case <- self.stopCh: return
+                case <- time.After( wait ):
+            }
+        } else {
+            select {
+                case <- self.stopCh: return
+                default:
+            }
+        }
+
+        srv := servers[ next ]
+        // Try the next server if this one fails; after the last, start over
+        next = ( next + 1 ) % len( servers )
+        if next == 0 {
+            attempt++
+        }
+
+        srv.refreshSession()
+        if !srv.login() {
+            log.WithFields( log.Fields{
+                "type":    "cf_login_fail",
+                "server":  srv.name,
+                "attempt": attempt,
+            } ).Warn( "Could not login to ControlFloor" )
+            continue
+        }
+        log.WithFields( log.Fields{
+            "type":   "cf_login_success",
+            "server": srv.name,
+        } ).Info( "Logged in to control floor" )
+
+        resync := srv.wasConnected
+        if len( servers ) > 1 && self.activate( srv ) {
+            resync = true
+        }
+
+        self.started.Do( func() {
+            cfReady <- true
+        } )
+        // Devices that attached while logged out were held back
+        if self.DevTracker != nil {
+            self.DevTracker.cfReady()
+        }
+
+        var stopProbe chan bool
+        if srv != servers[0] && self.config.cfFailback > 0 {
+            stopProbe = make( chan bool )
+            go self.probeFailback( servers, srv, stopProbe )
+        }
+        err := srv.openWebsocket( resync )
+        if stopProbe != nil {
+            close( stopProbe )
+        }
+        if err != nil {
+            log.WithFields( log.Fields{
+                "type":    "cf_ws_dial_fail",
+                "server":  srv.name,
+                "attempt": attempt,
+                "error":   err,
+            } ).Warn( "Could not connect ControlFloor WebSocket" )
+            continue
+        }
+
+        attempt = 1
+        next = 0
+        log.WithFields( log.Fields{
+            "type":   "cf_ws_lost",
+            "server": srv.name,
+        } ).Warn( "Lost ControlFloor WebSocket" )
+    }
+}
+
+/*
+activate makes srv the server in use in CF_MODE_FAILOVER, returning true
+when that is a change from another server. Updates still waiting for the
+previous server are dropped, as are video channels it asked for, since the
+new server is resynced and will ask for what it wants.
+*/
+func (self *ControlFloor) activate( srv *CFServer ) bool {
+    self.lock.Lock()
+    prev := self.active
+    self.active = srv
+    self.lock.Unlock()
+
+    if prev == nil || prev == srv {
+        return false
+    }
+    log.WithFields( log.Fields{
+        "type": "cf_failover",
+        "from": prev.name,
+        "to":   srv.name,
+    } ).Warn( "Switched ControlFloor server" )
+
+    prev.notifyQueue.clear()
+    if self.DevTracker != nil {
+        for _, dev := range self.DevTracker.devices() {
+            dev.dropViewers( prev )
+        }
+    }
+    return true
+}
+
+// probeFailback checks every controlfloor.failback whether a server
+// preferred over current can be logged in to, and if so drops current so
+// that connectLoop moves back.
+func (self *ControlFloor) probeFailback( servers []*CFServer, current *CFServer, stop chan bool ) {
+    for {
+        select {
+            case <- stop: return
+            case <- self.stopCh: return
+            case <- time.After( self.config.cfFailback ):
+        }
+        for _, srv := range servers {
+            if srv == current {
+                break
+            }
+            srv.refreshSession()
+            if !srv.login() {
+                continue
+            }
+            log.WithFields( log.Fields{
+                "type":   "cf_failback",
+                "server": srv.name,
+                "from":   current.name,
+            } ).Info( "Preferred ControlFloor is back; moving to it" )
+            current.disconnect()
+            return
+        }
+    }
+}
+
+// refreshSession drops the login cookie, so that the next login starts a
+// new session rather than trusting one ControlFloor may have forgotten.
+// Until that login works devices are held back as at startup.
+func (self *CFServer) refreshSession() {
+    jar, err := cookiejar.New( &cookiejar.Options{} )
+    if err != nil {
+        return
+    }
+    self.lock.Lock()
+    self.ready = false
+    self.cookiejar = jar
+    // Requests in flight still hold the old client, so it is not changed
+    client := *self.client
+    client.Jar = jar
+    self.client = &client
+    self.lock.Unlock()
+}
+
+// resync tells srv everything it has been told before about each attached
+// device.
+func (self *ControlFloor) resync( srv *CFServer ) {
+    if self.DevTracker == nil {
+        return
+    }
+    count := 0
+    for _, dev := range self.DevTracker.devices() {
+        if !dev.connected || dev.shuttingDown {
+            continue
+        }
+        dev.resync( srv )
+        count++
+    }
+    log.WithFields( log.Fields{
+        "type":    "cf_resync",
+        "server":  srv.name,
+        "devices": count,
+    } ).Info( "Resynced device state to ControlFloor" )
+}
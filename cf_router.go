@@ -0,0 +1,319 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "time"
+    uj "github.com/nanoscopic/ujsonin/v2/mod"
+    log "github.com/sirupsen/logrus"
+)
+
+const (
+    CF_PARAM_STR = iota // a string; numbers are accepted as their text
+    CF_PARAM_INT
+    CF_PARAM_FLOAT      // a number or a string holding one
+    CF_PARAM_BOOL
+    CF_PARAM_ANY        // any value, including objects and arrays
+)
+
+const (
+    CF_ERR_MESSAGE = "bad_message"     // not JSON, or no id / type
+    CF_ERR_UNKNOWN = "unknown_command"
+    CF_ERR_PARAM   = "bad_param"
+    CF_ERR_NODEV   = "no_device"
+    CF_ERR_NOCFA   = "cfa_unavailable" // the device has no CFA to run the command
+    CF_ERR_OWNER   = "not_owner"       // the device is leased to someone else
+)
+
+type CFParam struct {
+    name     string
+    kind     int
+    required bool
+}
+
+/*
+CFCommand describes one websocket message type. params is checked before
+anything else happens. When device is set the message must carry the udid
+of a known device. Commands that set input drive the device, and are
+refused unless the user of the message holds its lease, if it has one.
+Commands that talk to CFA set queue so that they run in order on the
+device's CFA queue. Others run right away in the websocket reader, so
+they must not block, unless async is set to give them their own goroutine.
+
+Every command gets exactly one reply: the handler's response, "done" when
+it has none, or an error.
+*/
+type CFCommand struct {
+    name     string
+    params   []CFParam
+    device   bool
+    input    bool
+    queue    bool
+    async    bool
+    priority int                                   // on the CFA queue
+    check    func( req *CFRequest ) error          // validation beyond params
+    keys     func( req *CFRequest ) []int          // typed keys that may be coalesced
+    run      func( req *CFRequest ) ( CFResponse, error )
+}
+
+// CFRequest is one received message on its way through the router.
+type CFRequest struct {
+    id      int
+    mType   string
+    udid    string
+    user    string
+    session string
+    root    uj.JNode
+    cf      *ControlFloor
+    srv     *CFServer   // the server the command came from
+    dev     *Device
+    queued  *CFACommand // the queue entry, for queued commands
+    data    interface{} // whatever check wants to hand to run
+}
+
+func (self *CFRequest) node( name string ) uj.JNode {
+    return self.root.Get( name )
+}
+
+func (self *CFRequest) str( name string ) string {
+    if node := self.root.Get( name ); node != nil {
+        return node.String()
+    }
+    return ""
+}
+
+func (self *CFRequest) int( name string ) int {
+    if node := self.root.Get( name ); node != nil {
+        return node.Int()
+    }
+    return 0
+}
+
+func (self *CFRequest) float( name string ) float64 {
+    val, _ := strconv.ParseFloat( self.str( name ), 64 )
+    return val
+}
+
+func (self *CFRequest) bool( name string ) bool {
+    if node := self.root.Get( name ); node != nil {
+        return node.Bool()
+    }
+    return false
+}
+
+// CFError is a failure detected by the router itself rather than by the
+// command it would have run.
+type CFError struct {
+    Code string
+    Msg  string
+}
+
+func (self *CFError) Error() string {
+    return self.Msg
+}
+
+type CFRouter struct {
+    commands map[string] *CFCommand
+}
+
+func NewCFRouter() *CFRouter {
+    return &CFRouter{
+        commands: make( map[string] *CFCommand ),
+    }
+}
+
+// register adds a command; registering a name twice replaces the first.
+func (self *CFRouter) register( cmd *CFCommand ) {
+    self.commands[ cmd.name ] = cmd
+}
+
+// dispatch handles one websocket text message from srv. Every reply,
+// including errors about the message itself, goes through respondChan.
+// Replies still to come when doneChan is closed are dropped.
+func (self *CFRouter) dispatch( srv *CFServer, msg []byte, wsSession string, respondChan chan CFResponse, doneChan chan bool ) {
+    respond := func( resp CFResponse ) {
+        select {
+            case respondChan <- resp:
+            case <- doneChan:
+        }
+    }
+    cf := srv.cf
+    root, _, perr := uj.ParseFull( msg )
+    if perr != nil || root == nil || root.Type() != uj.TYPE_HASH {
+        respond( cfError( 0, CF_ERR_MESSAGE, "message is not a JSON object" ) )
+        return
+    }
+
+    idNode := root.Get("id")
+    if idNode == nil || ( idNode.Type() != uj.TYPE_POS && idNode.Type() != uj.TYPE_NEG ) {
+        respond( cfError( 0, CF_ERR_MESSAGE, "message has no numeric id" ) )
+        return
+    }
+    id := idNode.Int()
+
+    typeNode := root.Get("type")
+    if typeNode == nil || typeNode.Type() != uj.TYPE_STR {
+        respond( cfError( id, CF_ERR_MESSAGE, "message has no type" ) )
+        return
+    }
+    mType := typeNode.String()
+
+    cmd := self.commands[ mType ]
+    if cmd == nil {
+        log.WithFields( log.Fields{
+            "type":    "cf_unknown_command",
+            "command": mType,
+        } ).Warn("Unknown command from ControlFloor")
+        respond( cfError( id, CF_ERR_UNKNOWN, fmt.Sprintf( "unknown command %s", mType ) ) )
+        return
+    }
+
+    if err := checkCFParams( root, cmd.params ); err != nil {
+        respond( cfError( id, CF_ERR_PARAM, fmt.Sprintf( "%s: %s", mType, err ) ) )
+        return
+    }
+
+    req := &CFRequest{
+        id:      id,
+        mType:   mType,
+        session: wsSession,
+        root:    root,
+        cf:      cf,
+        srv:     srv,
+    }
+    if udidNode := root.Get("udid"); udidNode != nil {
+        req.udid = udidNode.String()
+    }
+    if userNode := root.Get("user"); userNode != nil {
+        req.user = userNode.String()
+    }
+    if sessNode := root.Get("session"); sessNode != nil {
+        req.session = wsSession + ":" + sessNode.String()
+    }
+    if req.udid != "" && cf.DevTracker != nil {
+        req.dev = cf.DevTracker.getDevice( req.udid )
+    }
+    if cmd.device && req.dev == nil {
+        respond( cfError( id, CF_ERR_NODEV, fmt.Sprintf( "%s: no device %s", mType, req.udid ) ) )
+        return
+    }
+
+    if cmd.check != nil {
+        if err := cmd.check( req ); err != nil {
+            respond( cfResult( id, err ) )
+            return
+        }
+    }
+
+    if cmd.input && !req.dev.mayUse( req.user ) {
+        respond( cfError( id, CF_ERR_OWNER, fmt.Sprintf( "%s: %s is leased to another user", mType, req.udid ) ) )
+        return
+    }
+
+    if cmd.queue && req.dev.cfa == nil {
+        respond( cfError( id, CF_ERR_NOCFA, fmt.Sprintf( "%s: CFA is not running on %s", mType, req.udid ) ) )
+        return
+    }
+
+    if req.dev != nil {
+        req.dev.recordInput( mType, root )
+    }
+
+    if !cmd.queue {
+        if cmd.async {
+            go func() { respond( cfRun( req, cmd ) ) }()
+            return
+        }
+        respond( cfRun( req, cmd ) )
+        return
+    }
+
+    var resp CFResponse
+    qcmd := &CFACommand{
+        name:     mType,
+        priority: cmd.priority,
+        session:  req.session,
+        run: func( qcmd *CFACommand ) error {
+            req.queued = qcmd
+            // The lease may have changed hands while this waited
+            if cmd.input && !req.dev.mayUse( req.user ) {
+                resp = cfError( id, CF_ERR_OWNER, fmt.Sprintf( "%s: %s is leased to another user", mType, req.udid ) )
+                return &CFError{ Code: CF_ERR_OWNER, Msg: resp.ack().Error }
+            }
+            resp = cfRun( req, cmd )
+            if resp.ack().Ok {
+                return nil
+            }
+            return &CFError{ Code: resp.ack().Code, Msg: resp.ack().Error }
+        },
+    }
+    if cmd.input {
+        qcmd.user = req.user
+    }
+    if cmd.keys != nil {
+        qcmd.keys = cmd.keys( req )
+    }
+    done := req.dev.cfaQueue.submit( qcmd )
+    go func() {
+        // A command dropped from the queue, or merged into an earlier
+        // one, never ran so has no response of its own
+        err := <- done
+        if resp == nil {
+            resp = cfResult( id, err )
+        }
+        respond( resp )
+    }()
+}
+
+// cfRun runs the handler of cmd and fills in the acknowledgement of what
+// it returns.
+func cfRun( req *CFRequest, cmd *CFCommand ) CFResponse {
+    start := time.Now()
+    resp, err := cmd.run( req )
+    if err != nil || resp == nil {
+        resp = cfResult( req.id, err )
+    }
+    ack := resp.ack()
+    ack.Id = req.id
+    ack.Ok = err == nil
+    ack.Ms = time.Since( start ).Milliseconds()
+    return resp
+}
+
+func checkCFParams( root uj.JNode, params []CFParam ) error {
+    for _, param := range params {
+        node := root.Get( param.name )
+        if node == nil || node.Type() == uj.TYPE_NULL {
+            if param.required {
+                return fmt.Errorf( "%s is required", param.name )
+            }
+            continue
+        }
+        typ := node.Type()
+        isNum := typ == uj.TYPE_POS || typ == uj.TYPE_NEG
+        ok := true
+        switch param.kind {
+            case CF_PARAM_STR:
+                ok = typ == uj.TYPE_STR || isNum
+            case CF_PARAM_INT:
+                ok = isNum
+            case CF_PARAM_FLOAT:
+                if typ == uj.TYPE_STR {
+                    _, err := strconv.ParseFloat( node.String(), 64 )
+                    ok = err == nil
+                } else {
+                    ok = isNum
+                }
+            case CF_PARAM_BOOL:
+                ok = typ == uj.TYPE_TRUE || typ == uj.TYPE_FALSE
+        }
+        if !ok {
+            return fmt.Errorf( "%s has the wrong type", param.name )
+        }
+    }
+    return nil
+}
+
+func cfError( id int, code string, msg string ) CFResponse {
+    return &CFR_Error{ CFAck{ Id: id, Code: code, Error: msg } }
+}
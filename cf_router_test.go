@@ -0,0 +1,240 @@
+package main
+
+import (
+    "errors"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    ws "github.com/gorilla/websocket"
+    uj "github.com/nanoscopic/ujsonin/v2/mod"
+)
+
+// fakeWsConn stands in for the ControlFloor websocket. Messages put on in
+// are read by the provider; closing in ends the connection. Whatever the
+// provider writes shows up on out.
+type fakeWsConn struct {
+    in  chan []byte
+    out chan string
+}
+
+func newFakeWsConn() *fakeWsConn {
+    return &fakeWsConn{
+        in:  make( chan []byte ),
+        out: make( chan string, 100 ),
+    }
+}
+
+func (self *fakeWsConn) ReadMessage() ( int, []byte, error ) {
+    msg, ok := <- self.in
+    if !ok {
+        return 0, nil, errors.New("closed")
+    }
+    return ws.TextMessage, msg, nil
+}
+
+func (self *fakeWsConn) WriteMessage( t int, data []byte ) error {
+    self.out <- string( data )
+    return nil
+}
+
+// reply waits for the next message written by the provider.
+func (self *fakeWsConn) reply( t *testing.T ) uj.JNode {
+    t.Helper()
+    select {
+        case text := <- self.out:
+            root, _, perr := uj.ParseFull( []byte( text ) )
+            if perr != nil {
+                t.Fatalf( "unparsable reply %s", text )
+            }
+            return root
+        case <- time.After( 3 * time.Second ):
+            t.Fatalf( "no reply" )
+    }
+    return nil
+}
+
+// newTestCF returns a ControlFloor serving a fake websocket, with one device
+// whose CFA is a stub.
+func newTestCF( t *testing.T ) ( *ControlFloor, *fakeWsConn, *CFAStub ) {
+    t.Helper()
+    cfa, stub, _ := newTestCFA( t, time.Second )
+    dev := cfa.dev
+    dev.cfa = cfa
+    dev.lock = &sync.Mutex{}
+    dev.cfaQueue = NewCFAQueue( dev.udid )
+    dev.cfaQueue.start()
+
+    cf := &ControlFloor{
+        lock:   &sync.Mutex{},
+        router: NewCFRouter(),
+        DevTracker: &DeviceTracker{
+            lock:   &sync.Mutex{},
+            DevMap: map[string] *Device{ dev.udid: dev },
+        },
+    }
+    registerCFCommands( cf.router )
+    srv := &CFServer{
+        cf:   cf,
+        name: "test",
+        lock: &sync.Mutex{},
+    }
+    cf.servers = []*CFServer{ srv }
+
+    conn := newFakeWsConn()
+    go srv.serveWebsocket( conn, "test/ws1" )
+    t.Cleanup( func() {
+        close( conn.in )
+        dev.cfaQueue.stop()
+    } )
+    return cf, conn, stub
+}
+
+func TestRouterReplies( t *testing.T ) {
+    _, conn, stub := newTestCF( t )
+    stub.reply( "sourcej", `{"type":"application"}` )
+
+    tests := []struct {
+        name string
+        msg  string
+        id   int
+        text string // expected text of a plain reply
+        code string // expected error code
+        key  string // a key the reply must have instead
+    }{
+        { "ping", `{id:1,type:"ping"}`, 1, "pong", "", "" },
+        { "click", `{id:2,type:"click",udid:"00000000-TEST",x:10,y:20}`, 2, "done", "", "" },
+        { "swipe without delay", `{id:3,type:"swipe",udid:"00000000-TEST",x1:1,y1:2,x2:3,y2:4}`, 3, "done", "", "" },
+        { "keys", `{id:4,type:"keys",udid:"00000000-TEST",keys:"104,105"}`, 4, "done", "", "" },
+        { "home", `{id:5,type:"home",udid:"00000000-TEST"}`, 5, "done", "", "" },
+        { "source", `{id:6,type:"source",udid:"00000000-TEST"}`, 6, "", "", "source" },
+        { "findElements", `{id:7,type:"findElements",udid:"00000000-TEST",selector:"application"}`, 7, "", "", "elements" },
+        { "viewerGone without udid", `{id:8,type:"viewerGone"}`, 8, "done", "", "" },
+
+        { "not an object", `[1,2]`, 0, "", CF_ERR_MESSAGE, "" },
+        { "not json", `{id:9,type:`, 0, "", CF_ERR_MESSAGE, "" },
+        { "no id", `{type:"ping"}`, 0, "", CF_ERR_MESSAGE, "" },
+        { "string id", `{id:"10",type:"ping"}`, 0, "", CF_ERR_MESSAGE, "" },
+        { "no type", `{id:11}`, 11, "", CF_ERR_MESSAGE, "" },
+        { "unknown type", `{id:12,type:"teleport",udid:"00000000-TEST"}`, 12, "", CF_ERR_UNKNOWN, "" },
+        { "missing param", `{id:13,type:"click",udid:"00000000-TEST",x:10}`, 13, "", CF_ERR_PARAM, "" },
+        { "wrong param type", `{id:14,type:"click",udid:"00000000-TEST",x:"ten",y:20}`, 14, "", CF_ERR_PARAM, "" },
+        { "bad float", `{id:15,type:"longPress",udid:"00000000-TEST",x:1,y:2,time:"long"}`, 15, "", CF_ERR_PARAM, "" },
+        { "missing udid", `{id:16,type:"home"}`, 16, "", CF_ERR_PARAM, "" },
+        { "unknown device", `{id:17,type:"click",udid:"nope",x:1,y:2}`, 17, "", CF_ERR_NODEV, "" },
+        { "bad gesture", `{id:18,type:"gesture",udid:"00000000-TEST",kind:"twirl"}`, 18, "", CFA_ERR_REQUEST, "" },
+        { "bad selector", `{id:19,type:"findElements",udid:"00000000-TEST",selector:"button:shiny"}`, 19, "", CFA_ERR_REQUEST, "" },
+        { "kill unknown device", `{id:20,type:"kill",udid:"nope",bid:"com.x"}`, 20, "", CF_ERR_NODEV, "" },
+    }
+
+    for _, test := range tests {
+        conn.in <- []byte( test.msg )
+        reply := conn.reply( t )
+
+        if id := reply.Get("id"); id == nil || id.Int() != test.id {
+            t.Errorf( "%s: reply has wrong id: %s", test.name, reply.JsonSave() )
+        }
+        if ok := reply.Get("ok"); ok == nil || ok.Bool() != ( test.code == "" ) {
+            t.Errorf( "%s: reply has wrong ok: %s", test.name, reply.JsonSave() )
+        }
+        if reply.Get("ms") == nil {
+            t.Errorf( "%s: reply has no ms: %s", test.name, reply.JsonSave() )
+        }
+        if test.code != "" {
+            if code := reply.Get("code"); code == nil || code.String() != test.code {
+                t.Errorf( "%s: expected %s, got %s", test.name, test.code, reply.JsonSave() )
+            }
+            if errNode := reply.Get("error"); errNode == nil || errNode.String() == "" {
+                t.Errorf( "%s: error has no message: %s", test.name, reply.JsonSave() )
+            }
+            continue
+        }
+        if reply.Get("code") != nil {
+            t.Errorf( "%s: unexpected error %s", test.name, reply.JsonSave() )
+            continue
+        }
+        if test.text != "" {
+            if text := reply.Get("text"); text == nil || text.String() != test.text {
+                t.Errorf( "%s: expected %s, got %s", test.name, test.text, reply.JsonSave() )
+            }
+        }
+        if test.key != "" && reply.Get( test.key ) == nil {
+            t.Errorf( "%s: reply has no %s: %s", test.name, test.key, reply.JsonSave() )
+        }
+    }
+
+    reqs := stub.received()
+    if len( reqs ) == 0 || !strings.Contains( reqs[0], `"action":"tap"` ) || !strings.Contains( reqs[0], `"x":10` ) {
+        t.Errorf( "click did not reach CFA: %q", reqs )
+    }
+}
+
+func TestRouterAlwaysReplies( t *testing.T ) {
+    cf, conn, stub := newTestCF( t )
+
+    // A failing hardPress carries the CFA error code
+    stub.handle( "tapFirm", func( uj.JNode ) []byte { return nil } )
+    conn.in <- []byte( `{id:1,type:"hardPress",udid:"00000000-TEST",x:5,y:6}` )
+    reply := conn.reply( t )
+    if reply.Get("id").Int() != 1 || reply.Get("code") == nil || reply.Get("code").String() != CFA_ERR_TIMEOUT {
+        t.Fatalf( "expected a timeout for id 1, got %s", reply.JsonSave() )
+    }
+    if reply.Get("ok").Bool() || reply.Get("ms").Int() < 900 {
+        t.Errorf( "timeout should not be ok and should take a second: %s", reply.JsonSave() )
+    }
+
+    // and one that works says so
+    stub.reply( "tapFirm", "{}" )
+    conn.in <- []byte( `{id:2,type:"hardPress",udid:"00000000-TEST",x:5,y:6}` )
+    reply = conn.reply( t )
+    if reply.Get("id").Int() != 2 || !reply.Get("ok").Bool() || reply.Get("text").String() != "done" {
+        t.Fatalf( "unexpected reply %s", reply.JsonSave() )
+    }
+
+    // A device whose CFA is not running refuses CFA commands up front
+    cf.DevTracker.DevMap["00000000-NOCFA"] = &Device{ udid: "00000000-NOCFA", lock: &sync.Mutex{}, cfaQueue: NewCFAQueue( "00000000-NOCFA" ) }
+    conn.in <- []byte( `{id:3,type:"click",udid:"00000000-NOCFA",x:1,y:2}` )
+    reply = conn.reply( t )
+    if reply.Get("id").Int() != 3 || reply.Get("code") == nil || reply.Get("code").String() != CF_ERR_NOCFA {
+        t.Fatalf( "expected %s, got %s", CF_ERR_NOCFA, reply.JsonSave() )
+    }
+}
+
+func TestRouterPluggable( t *testing.T ) {
+    cf, conn, _ := newTestCF( t )
+
+    cf.router.register( &CFCommand{
+        name:   "echo",
+        params: []CFParam{ cfReq( "text", CF_PARAM_STR ), cfOpt( "times", CF_PARAM_INT ) },
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            times := req.int("times")
+            if times == 0 {
+                times = 1
+            }
+            return &CFR_Pong{ Text: strings.Repeat( req.str("text"), times ) }, nil
+        },
+    } )
+    cf.router.register( &CFCommand{
+        name: "fail",
+        run: func( req *CFRequest ) ( CFResponse, error ) {
+            return nil, &CFError{ Code: "custom", Msg: "no luck" }
+        },
+    } )
+
+    tests := []struct {
+        msg  string
+        want string
+    }{
+        { `{id:1,type:"echo",text:"ab",times:2}`, `"abab"` },
+        { `{id:2,type:"echo",text:"ab"}`, `"ab"` },
+        { `{id:3,type:"echo",times:2}`, CF_ERR_PARAM },
+        { `{id:4,type:"fail"}`, "custom" },
+    }
+    for _, test := range tests {
+        conn.in <- []byte( test.msg )
+        reply := conn.reply( t )
+        if !strings.Contains( reply.JsonSave(), test.want ) {
+            t.Errorf( "%s: expected %s in %s", test.msg, test.want, reply.JsonSave() )
+        }
+    }
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+    "crypto/tls"
+    "net/http"
+    "net/http/cookiejar"
+    "sync"
+    ws "github.com/gorilla/websocket"
+)
+
+// Values of controlfloor.mode
+const (
+    CF_MODE_FAILOVER = "failover" // one server at a time, by priority
+    CF_MODE_ALL      = "all"      // every server at once
+)
+
+/*
+CFServer is the connection to one ControlFloor: its login session, command
+websocket and queue of status updates. ControlFloor decides which servers
+are in use and routes device updates to them; commands arriving on a
+server's websocket are answered there, and video asked for by a server is
+streamed to that server.
+*/
+type CFServer struct {
+    cf           *ControlFloor
+    name         string
+    priority     int
+    username     string
+    pass         string
+    base         string
+    wsBase       string
+    selfSigned   bool
+    cookiejar    *cookiejar.Jar
+    client       *http.Client
+    lock         *sync.Mutex
+    ready        bool
+    wsCount      int
+    wasConnected bool
+    conn         *ws.Conn // the command websocket while it is open
+    notifyQueue  *NotifyQueue
+}
+
+func NewCFServer( cf *ControlFloor, conf CFServerConfig, pass string, persist string ) *CFServer {
+    jar, err := cookiejar.New(&cookiejar.Options{})
+    if err != nil {
+        panic( err )
+    }
+
+    self := &CFServer{
+        cf:         cf,
+        name:       conf.name,
+        priority:   conf.priority,
+        username:   conf.username,
+        pass:       pass,
+        base:       "http://" + conf.host,
+        wsBase:     "ws://" + conf.host,
+        selfSigned: conf.https && conf.selfSigned,
+        cookiejar:  jar,
+        client:     cfHttpClient( conf, jar ),
+        lock:       &sync.Mutex{},
+    }
+    if conf.https {
+        self.base = "https://" + conf.host
+        self.wsBase = "wss://" + conf.host
+    }
+    self.notifyQueue = NewNotifyQueue( persist, self.postNotify )
+    return self
+}
+
+// cfHttpClient makes a client for talking to the server conf describes.
+// Redirects are not followed, as login reports its result through one.
+func cfHttpClient( conf CFServerConfig, jar http.CookieJar ) *http.Client {
+    client := &http.Client{
+        Jar: jar,
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+    if conf.https && conf.selfSigned {
+        client.Transport = &http.Transport{
+            TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+            ForceAttemptHTTP2: false,
+        }
+    }
+    return client
+}
+
+// httpClient is the client to make requests with. refreshSession replaces
+// it.
+func (self *CFServer) httpClient() *http.Client {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.client
+}
+
+// sessionJar holds the login cookie for websockets to send.
+func (self *CFServer) sessionJar() *cookiejar.Jar {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.cookiejar
+}
+
+func (self *CFServer) isReady() bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.ready
+}
+
+// disconnect closes the command websocket, if open, so that the connect
+// loop moves on.
+func (self *CFServer) disconnect() {
+    self.lock.Lock()
+    conn := self.conn
+    self.lock.Unlock()
+    if conn != nil {
+        conn.Close()
+    }
+}
+
+// targets are the servers that device updates go to: every server in
+// CF_MODE_ALL, otherwise the one in use, or the preferred one before any
+// has been reached.
+func (self *ControlFloor) targets() []*CFServer {
+    if self.only != nil {
+        return []*CFServer{ self.only }
+    }
+    if self.mode == CF_MODE_ALL {
+        return self.servers
+    }
+    self.lock.Lock()
+    active := self.active
+    self.lock.Unlock()
+    if active == nil {
+        active = self.servers[0]
+    }
+    return []*CFServer{ active }
+}
+
+// forServer is a view of ControlFloor that sends device updates to srv
+// alone.
+func (self *ControlFloor) forServer( srv *CFServer ) *ControlFloor {
+    view := *self
+    view.only = srv
+    return &view
+}
+
+// isReady reports whether the provider is logged in to any server.
+func (self *ControlFloor) isReady() bool {
+    for _, srv := range self.servers {
+        if srv.isReady() {
+            return true
+        }
+    }
+    return false
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
+    "errors"
     "fmt"
     //"io/ioutil"
     "net/http"
     "strings"
     "os"
+    "sync"
     "time"
     log "github.com/sirupsen/logrus"
     uj "github.com/nanoscopic/ujsonin/v2/mod"
-    "go.nanomsg.org/mangos/v3"
-    nanoReq  "go.nanomsg.org/mangos/v3/protocol/req"
 )
 
 type CFA struct {
@@ -22,24 +22,33 @@ type CFA struct {
     base          string
     //sessionId     string
     startChan     chan int
-    js2hid        map[int]int
+    keyLayout     *KeyLayout
+    heldMods      int
     transport     *http.Transport
     client        *http.Client
     nngPort       int
     nngPort2      int
-    nngSocket     mangos.Socket
-    nngSocket2    mangos.Socket
+    nngClient     *CFAClient
+    nngClient2    *CFAClient
     disableUpdate bool
     sessionMade   bool
+    stateLock     *sync.Mutex
+    state         int
+    lastBundle    string
+    lastApp       string
+    kickChan      chan bool
+    doneChan      chan bool
+    beat          *CFAHeartbeat
 }
 
 func NewCFA( config *Config, devTracker *DeviceTracker, dev *Device ) (*CFA) {
     self := NewCFANoStart( config, devTracker, dev )
+    go self.heartbeat()
     if config.cfaMethod != "manual" {
         self.start( nil )
     } else {
-        self.startCfaNng( func( err int, stopChan chan bool ) {
-            if err != 0 {
+        self.startCfaNng( func( err error, stopChan chan bool ) {
+            if err != nil {
                 dev.EventCh <- DevEvent{ action: DEV_CFA_START_ERR }
             } else {
                 dev.EventCh <- DevEvent{ action: DEV_CFA_START }
@@ -49,15 +58,7 @@ func NewCFA( config *Config, devTracker *DeviceTracker, dev *Device ) (*CFA) {
     return self
 }
 
-func addrange( amap map[int]int, from1 int, to1 int, from2 int ) {
-    for i:=from1; i<=to1; i++ {
-        amap[ i ] = i - from1 + from2
-    }
-}
-
 func NewCFANoStart( config *Config, devTracker *DeviceTracker, dev *Device ) (*CFA) {
-    jh := make( map[int]int )  
-  
     self := CFA{
         udid:          dev.udid,
         nngPort:       dev.cfaNngPort,
@@ -66,125 +67,61 @@ func NewCFANoStart( config *Config, devTracker *DeviceTracker, dev *Device ) (*C
         dev:           dev,
         config:        config,
         //base:          fmt.Sprintf("http://127.0.0.1:%d",dev.wdaPort),
-        js2hid:        jh,
+        keyLayout:     keyLayoutFor( config, dev.devConfig, dev.info["RegionInfo"] ),
         transport:     &http.Transport{},
+        nngClient:     NewCFAClient( fmt.Sprintf( "tcp://127.0.0.1:%d", dev.cfaNngPort ), config.cfaTimeout ),
+        nngClient2:    NewCFAClient( fmt.Sprintf( "tcp://127.0.0.1:%d", dev.cfaNngPort2 ), config.cfaTimeout ),
+        stateLock:     &sync.Mutex{},
+        state:         CFA_DOWN,
+        kickChan:      make( chan bool, 1 ),
+        doneChan:      make( chan bool ),
+        beat:          &CFAHeartbeat{ lock: &sync.Mutex{} },
     }
     //self.client = &http.Client{
     //    Transport: self.transport,
     //}
     
-    /*
-    The following generates a map of "JS keycodes" to Apple IO Hid event numbers.
-    At least, for everything accessible without using Shift...
-    At least for US keyboards.
-    
-    TODO: Modify this to read in information from configuration and also pay attention
-    to the region of the device. In other regions keyboards will have different keys.
-    
-    The positive numbers here are the normal character set codes; in this case they are
-    ASCII.
-    
-    The negative numbers are JS keyCodes for non-printable characters.
-    */
-    addrange( jh, 97, 122, 4 ) // a-z
-    addrange( jh, 49, 57, 0x1e ) // 1-9
-    jh[32] = 0x2c // space
-    jh[39] = 0x34 // '
-    jh[44] = 0x36 // ,
-    jh[45] = 0x2d // -
-    jh[46] = 0x37 // .
-    jh[47] = 0x38 // /
-    jh[48] = 0x27 // 0
-    jh[59] = 0x33 // ;
-    jh[61] = 0x2e // =
-    jh[91] = 0x2f // [
-    jh[92] = 0x31 // \
-    jh[93] = 0x30 // ]
-    //jh[96] = // `
-    
-    jh[-8] = 0x2a // backspace
-    jh[-9] = 0x2b // tab
-    jh[-13] = 0x28 // enter
-    jh[-27] = 0x29 // esc
-    jh[-33] = 0x4b // pageup
-    jh[-34] = 0x4e // pagedown
-    jh[-35] = 0x4d // end
-    jh[-36] = 0x4a // home
-    
-    jh[-37] = 0x50 // left
-    jh[-38] = 0x52 // up
-    jh[-39] = 0x4f // right
-    jh[-40] = 0x51 // down
-    jh[-46] = 0x4c // delete
-      
     return &self
 }
 
-func (self *CFA) dialNng( port int ) ( mangos.Socket, int, chan bool ) {
-    spec := fmt.Sprintf( "tcp://127.0.0.1:%d", port )
-    
-    var err error
-    var reqSock mangos.Socket
-    
-    if reqSock, err = nanoReq.NewSocket(); err != nil {
-        log.WithFields( log.Fields{
-            "type":     "err_socket_new",
-            "zmq_spec": spec,
-            "err":      err,
-        } ).Info("Socket new error")
-        return nil, 1, nil
+func (self *CFA) dialNng() ( chan bool, error ) {
+    stopChan, err := self.nngClient.dial()
+    if err != nil {
+        return nil, err
     }
     
-    if err = reqSock.Dial( spec ); err != nil {
-        log.WithFields( log.Fields{
-            "type": "err_socket_dial",
-            "spec": spec,
-            "err":  err,
-        } ).Info("Socket dial error")
-        return nil, 2, nil
+    _, err = self.nngClient2.dial()
+    if err != nil {
+        self.nngClient.close()
+        return nil, err
     }
     
-    stopChan := make( chan bool )
-    
-    reqSock.SetPipeEventHook( func( action mangos.PipeEvent, pipe mangos.Pipe ) {
-        //fmt.Printf("Pipe action %d\n", action )
-        if action == 2 {
-            stopChan <- true
-        }
-    } )
-    
-    return reqSock, 0, stopChan
+    return stopChan, nil
 }
 
-func (self *CFA) startCfaNng( onready func( int, chan bool ) ) {
+func (self *CFA) startCfaNng( onready func( error, chan bool ) ) {
     pairs := []TunPair{
         TunPair{ from: self.nngPort, to: 8101 },
         TunPair{ from: self.nngPort2, to: 8102 },
     }
     
     self.dev.bridge.tunnel( pairs, func() {
-        nngSocket, err, stopChan := self.dialNng( self.nngPort )
-        if err != 0 {
-            onready( err, nil )
-            return
-        }
-        self.nngSocket = nngSocket
-        
-        nngSocket2, err, _ := self.dialNng( self.nngPort2 )
-        if err != 0 {
+        stopChan, err := self.dialNng()
+        if err != nil {
             onready( err, nil )
             return
         }
-        self.nngSocket2 = nngSocket2
         
         self.create_session("")
+        self.setState( CFA_UP )
+        go self.supervise( stopChan )
         if onready != nil {
-            onready( 0, stopChan )            
+            onready( nil, stopChan )            
         }
     } )
 }
 
-func (self *CFA) start( started func( int, chan bool ) ) {
+func (self *CFA) start( started func( error, chan bool ) ) {
     pairs := []TunPair{
         TunPair{ from: self.nngPort, to: 8101 },
         TunPair{ from: self.nngPort2, to: 8102 },
@@ -193,6 +130,12 @@ func (self *CFA) start( started func( int, chan bool ) ) {
     self.dev.bridge.tunnel( pairs, func() {
         self.dev.bridge.cfa(
             func() { // onStart
+                if self.getState() != CFA_DOWN {
+                    // CFAgent was restarted; the supervisor re-dials
+                    self.kickReconnect()
+                    return
+                }
+                
                 log.WithFields( log.Fields{
                     "type": "cfa_start",
                     "udid":  censorUuid(self.udid),
@@ -202,34 +145,34 @@ func (self *CFA) start( started func( int, chan bool ) ) {
                 log.WithFields( log.Fields{
                     "type": "cfa_nng_dialing",
                     "port": self.nngPort,
+                    "port2": self.nngPort2,
                 } ).Debug("CFA - Dialing NNG")
                 
-                nngSocket, err1, stopChan := self.dialNng(self.nngPort)
-                if err1 == 0 {
-                    self.nngSocket = nngSocket
+                stopChan, err := self.dialNng()
+                if err != nil {
                     log.WithFields( log.Fields{
-                        "type": "cfa_nng_dialed",
-                        "port": self.nngPort,
-                    } ).Debug("WDA - NNG Dialed")
-                }
-                
-                nngSocket, err2, stopChan := self.dialNng(self.nngPort2)
-                if err2 == 0 {
-                    self.nngSocket2 = nngSocket
-                    log.WithFields( log.Fields{
-                        "type": "cfa_nng2_dialed",
-                        "port": self.nngPort2,
-                    } ).Debug("WDA - NNG2 Dialed")
-                }
-                
-                if err1 != 0 || err2 != 0 {
-                    fmt.Printf("Error starting/connecting to CFA.\n")
+                        "type": "cfa_nng_dial_fail",
+                        "udid": censorUuid(self.udid),
+                        "err":  err,
+                    } ).Error("Error starting/connecting to CFA")
+                    if started != nil {
+                        started( err, nil )
+                    }
                     self.dev.EventCh <- DevEvent{ action: DEV_CFA_START_ERR }
                     return
                 }
                 
+                log.WithFields( log.Fields{
+                    "type": "cfa_nng_dialed",
+                    "port": self.nngPort,
+                    "port2": self.nngPort2,
+                } ).Debug("CFA - NNG Dialed")
+                
+                self.setState( CFA_UP )
+                go self.supervise( stopChan )
+                
                 if started != nil {
-                    started( 0, stopChan )
+                    started( nil, stopChan )
                 }
                 
                 if self.startChan != nil {
@@ -239,28 +182,33 @@ func (self *CFA) start( started func( int, chan bool ) ) {
                 self.dev.EventCh <- DevEvent{ action: DEV_CFA_START }
             },
             func(interface{}) { // onStop
-                self.dev.EventCh <- DevEvent{ action: DEV_CFA_STOP }
+                if self.getState() == CFA_DOWN {
+                    self.dev.EventCh <- DevEvent{ action: DEV_CFA_STOP }
+                    return
+                }
+                self.pipeLost()
             },
         )
     } )
 }
 
 func (self *CFA) stop() {
+    self.stopSupervisor()
     if self.cfaProc != nil {
         self.cfaProc.Kill()
         self.cfaProc = nil
     }
+    self.nngClient.close()
+    self.nngClient2.close()
 }
 
-func (self *CFA) ensureSession() {
+func (self *CFA) ensureSession() error {
     sid := self.get_session()
     if sid == "" {
-        //fmt.Printf("No CFA session exists. Creating\n" )
-        sid = self.create_session( "" )
-        //fmt.Printf("Created cfa session id=%s\n", sid )
-    } else {
-        //fmt.Printf("Session existing; id=%s\n", sid )
+        _, err := self.create_session( "" )
+        return err
     }
+    return nil
 }
 
 func ( self *CFA ) get_session() ( string ) {
@@ -271,7 +219,7 @@ func ( self *CFA ) get_session() ( string ) {
     }
 }
 
-func ( self *CFA ) create_session( bundle string ) ( string ) {
+func ( self *CFA ) create_session( bundle string ) ( string, error ) {
     if bundle == "" {
         //bundle = "com.apple.Preferences"
         log.WithFields( log.Fields{
@@ -286,147 +234,142 @@ func ( self *CFA ) create_session( bundle string ) ( string ) {
     }
     
     self.disableUpdate = true
+    defer func() { self.disableUpdate = false }()
     
-    json := fmt.Sprintf( `{
-        action: "createSession"
-        bundleId: "%s"
-    }`, bundle )
-        
-    err := self.nngSocket.Send([]byte(json))
+    err := self.createSessionOn( self.nngClient, bundle )
     if err != nil {
-        fmt.Printf("Send error: %s\n", err )
+        log.WithFields( log.Fields{
+            "type": "cfa_session_fail",
+            "bi":   bundle,
+            "err":  err,
+        } ).Error("Failed to create CFA session")
+        return "", err
     }
-    //fmt.Printf("Sent; receiving\n" )
-    
-    _, err = self.nngSocket.Recv()
-    sid := ""
-    if err != nil {
-        fmt.Printf( "sessionCreate err: %s\n", err )
-    } else {
-        sid = "1"
-        self.sessionMade = true
-    }    
-    
-    self.disableUpdate = false
+    self.sessionMade = true
+    self.stateLock.Lock()
+    self.lastBundle = bundle
+    self.stateLock.Unlock()
     
     log.WithFields( log.Fields{
         "type": "cfa_session_created",
     } ).Info("Created CFA session")
     
-    return sid
+    return "1", nil
 }
 
-func (self *CFA) clickAt( x int, y int ) {
-    json := fmt.Sprintf( `{
-        action: "tap"
-        x:%d
-        y:%d
-    }`, x, y )
-    
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
+func ( self *CFA ) createSessionOn( client *CFAClient, bundle string ) error {
+    _, err := client.send( &CFAReqBundle{
+        CFAReq:   CFAReq{ Action: "createSession" },
+        BundleId: bundle,
+    } )
+    return err
 }
 
-func (self *CFA) mouseDown( x int, y int ) {
-    json := fmt.Sprintf( `{
-        action: "mouseDown"
-        x:%d
-        y:%d
-    }`, x, y )
-    
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
+func (self *CFA) clickAt( x int, y int ) error {
+    _, err := self.nngClient.send( &CFAReqPoint{
+        CFAReq: CFAReq{ Action: "tap" },
+        X:      x,
+        Y:      y,
+    } )
+    return err
 }
 
-func (self *CFA) mouseUp( x int, y int ) {
-    json := fmt.Sprintf( `{
-        action: "mouseUp"
-        x:%d
-        y:%d
-    }`, x, y )
-    
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
+func (self *CFA) mouseDown( x int, y int ) error {
+    _, err := self.nngClient.send( &CFAReqPoint{
+        CFAReq: CFAReq{ Action: "mouseDown" },
+        X:      x,
+        Y:      y,
+    } )
+    return err
 }
 
-func (self *CFA) hardPress( x int, y int ) {
-    log.Info( "Firm Press:", x, y )
-    json := fmt.Sprintf( `{
-        action: "tapFirm"
-        x:%d
-        y:%d
-        pressure:1
-    }`, x, y )
-    
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
+func (self *CFA) mouseUp( x int, y int ) error {
+    _, err := self.nngClient.send( &CFAReqPoint{
+        CFAReq: CFAReq{ Action: "mouseUp" },
+        X:      x,
+        Y:      y,
+    } )
+    return err
 }
 
-func (self *CFA) longPress( x int, y int, time float64 ) {
-    log.Info( "Press for time:", x, y, time )
-    json := fmt.Sprintf( `{
-        action: "tapTime"
-        x:%d
-        y:%d
-        time:%f
-    }`, x, y, time )
-    
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
+func (self *CFA) hardPress( x int, y int ) error {
+    log.Info( "Firm Press:", x, y )
+    _, err := self.nngClient.send( &CFAReqPoint{
+        CFAReq:   CFAReq{ Action: "tapFirm" },
+        X:        x,
+        Y:        y,
+        Pressure: 1,
+    } )
+    return err
 }
 
-func (self *CFA) home() (string) {
-    json := `{
-      action: "button"
-      name: "home"
-    }`
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
-    
-    return ""
+func (self *CFA) longPress( x int, y int, time float64 ) error {
+    log.Info( "Press for time:", x, y, time )
+    _, err := self.nngClient.sendWait( &CFAReqPoint{
+        CFAReq: CFAReq{ Action: "tapTime" },
+        X:      x,
+        Y:      y,
+        Time:   time,
+    }, secondsToDuration( time ) )
+    return err
+}
+
+func (self *CFA) home() error {
+    _, err := self.nngClient.send( &CFAReqButton{
+        CFAReq: CFAReq{ Action: "button" },
+        Name:   "home",
+    } )
+    return err
 }
 
-func (self *CFA) AT() (string) {
-    json := `{
-      action: "homebtn"
-    }`
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
-    
-    return ""
+func (self *CFA) AT() error {
+    for i := 0; i < 3; i++ {
+        if _, err := self.nngClient.send( &CFAReq{ Action: "homebtn" } ); err != nil {
+            return err
+        }
+    }
+    return nil
 }
 
-func (self *CFA) keys( codes []int ) {
-    if len( codes ) > 1 {
-        self.typeText( codes )
-        return
-    }
-    code := codes[0]
-    
+func (self *CFA) keys( codes []int ) error {
     /*
-    Only some keys are able to be pressed via IoHid, because I cannot
-    figure out how to use 'shift' accessed characters/keys through it.
-    
-    If someone is able to figure it out please let me know as the "ViaKeys"
-    method uses the much slower [application typeType] method.
+    Keys are pressed via IoHid when the device's keyboard layout says how to
+    type them, shifted and option characters included. Only codes the layout
+    cannot produce use the much slower [application typeText] method, in
+    order with the rest.
     */
-    if self.config.cfaKeyMethod == "iohid" {
-        dest, ok := self.js2hid[ code ]
-        if ok {
-            self.keysViaIohid( []int{dest} )
-        } else {
-            self.typeText( codes )
+    if self.config.cfaKeyMethod != "iohid" || self.keyLayout == nil {
+        return self.typeText( codes )
+    }
+    strokes := []KeyStroke{}
+    text := []int{}
+    for _, code := range codes {
+        stroke, ok := self.keyLayout.stroke( code )
+        if !ok {
+            if len( strokes ) > 0 {
+                if err := self.keysViaIohid( strokes ); err != nil {
+                    return err
+                }
+                strokes = []KeyStroke{}
+            }
+            text = append( text, code )
+            continue
         }
-    } else {
-        self.typeText( codes )
+        if len( text ) > 0 {
+            if err := self.typeText( text ); err != nil {
+                return err
+            }
+            text = []int{}
+        }
+        strokes = append( strokes, stroke )
     }
+    if len( text ) > 0 {
+        return self.typeText( text )
+    }
+    return self.keysViaIohid( strokes )
 }
 
-func (self *CFA) keysViaIohid( codes []int ) {
+func (self *CFA) keysViaIohid( strokes []KeyStroke ) error {
     /*
     This loop of making repeated calls is obviously quite garbage.
     A better solution would be to make a call in CFA itself able to handle
@@ -435,322 +378,384 @@ func (self *CFA) keysViaIohid( codes []int ) {
     Despite this the performIoHidEvent call is very fast so it can generally
     keep up with typing speed of a manual user of CF.
     */
-    for _, code := range codes {
-        json := fmt.Sprintf(`{
-          action: "iohid"
-          page: 7
-          usage: %d
-          duration: 0.05
-        }`, code )
+    for _, stroke := range strokes {
+        log.Info( "sending iohid usage ", stroke.usage, " mods ", stroke.mods )
         
-        log.Info( "sending " + json )
-        
-        self.nngSocket.Send([]byte(json))
-        self.nngSocket.Recv()
+        if _, err := self.nngClient.send( &CFAReqIohid{
+            CFAReq:    CFAReq{ Action: "iohid" },
+            Page:      7,
+            Usage:     stroke.usage,
+            Duration:  0.05,
+            Modifiers: stroke.modUsages(),
+        } ); err != nil {
+            return err
+        }
     }
+    return nil
 }
 
-func (self *CFA) ioHid( page int, code int ) {
-    json := fmt.Sprintf(`{
-      action: "iohid"
-      page: %d
-      usage: %d
-      duration: 0.05
-    }`, page, code )
-        
-    log.Info( "sending " + json )
-        
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
+func (self *CFA) ioHid( page int, code int ) error {
+    log.Info( "sending iohid page ", page, " usage ", code )
+    
+    _, err := self.nngClient.send( &CFAReqIohid{
+        CFAReq:   CFAReq{ Action: "iohid" },
+        Page:     page,
+        Usage:    code,
+        Duration: 0.05,
+    } )
+    return err
+}
+
+// releaseKeys lets go of every modifier still held by keyDown.
+func (self *CFA) releaseKeys() error {
+    for _, usage := range keyModUsages {
+        if self.heldMods & keyModForUsage( usage ) == 0 {
+            continue
+        }
+        if err := self.keyUp( usage ); err != nil {
+            return err
+        }
+    }
+    return nil
 }
 
-func (self *CFA) typeText( codes []int ) {
-    strArr := []string{}
+// foregroundApp is the bundle id of the app last reported in front.
+func (self *CFA) foregroundApp() string {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+    return self.lastApp
+}
+
+// keyDown presses a key on the keyboard page and leaves it held until keyUp.
+// Held modifiers apply to every key typed in the meantime.
+func (self *CFA) keyDown( usage int ) error {
+    _, err := self.nngClient.send( &CFAReqIohid{
+        CFAReq: CFAReq{ Action: "iohidDown" },
+        Page:   7,
+        Usage:  usage,
+    } )
+    if err == nil {
+        self.heldMods |= keyModForUsage( usage )
+    }
+    return err
+}
 
+func (self *CFA) keyUp( usage int ) error {
+    _, err := self.nngClient.send( &CFAReqIohid{
+        CFAReq: CFAReq{ Action: "iohidUp" },
+        Page:   7,
+        Usage:  usage,
+    } )
+    if err == nil {
+        self.heldMods &^= keyModForUsage( usage )
+    }
+    return err
+}
+
+func (self *CFA) typeText( codes []int ) error {
+    runes := []rune{}
     for _, code := range codes {
-        // GoLang encodes to utf8 by default. typeText call expects utf8 encoding
-        strArr = append( strArr, fmt.Sprintf("%c", rune( code ) ) )
+        runes = append( runes, rune( code ) )
     }
-    
-    json := fmt.Sprintf(`{
-        action: "typeText"
-        text: "%s"
-    }`, strings.Join( strArr, "" ) )
+    // typeText expects utf8, which is what a Go string converts to
+    text := string( runes )
    
-    log.Info( "sending " + json )
-      
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
+    log.Info( "sending typeText ", len( runes ), " chars" )
+    
+    _, err := self.nngClient.send( &CFAReqText{
+        CFAReq: CFAReq{ Action: "typeText" },
+        Text:   text,
+    } )
+    return err
 }
 
-func ( self *CFA ) swipe( x1 int, y1 int, x2 int, y2 int, delay float64 ) {
+func ( self *CFA ) swipe( x1 int, y1 int, x2 int, y2 int, delay float64 ) error {
     log.Info( "Swiping:", x1, y1, x2, y2, delay )
     
-    json := fmt.Sprintf( `{
-        action: "swipe"
-        x1:%d
-        y1:%d
-        x2:%d
-        y2:%d
-        delay:%.2f
-    }`, x1, y1, x2, y2, delay )
+    _, err := self.nngClient.sendWait( &CFAReqSwipe{
+        CFAReq: CFAReq{ Action: "swipe" },
+        X1:     x1,
+        Y1:     y1,
+        X2:     x2,
+        Y2:     y2,
+        Delay:  delay,
+    }, secondsToDuration( delay ) )
+    return err
+}
+
+func (self *CFA) gesture( gesture *Gesture ) error {
+    log.Info( "Gesture:", gesture.kind, len( gesture.touches ), gesture.duration() )
+    
+    req := &CFAReqGesture{ CFAReq: CFAReq{ Action: "gesture" } }
+    for _, path := range gesture.touches {
+        points := []CFAReqTouchPoint{}
+        for _, point := range path {
+            points = append( points, CFAReqTouchPoint{
+                X:    point.x,
+                Y:    point.y,
+                Time: float64( point.t ) / 1000,
+            } )
+        }
+        req.Touches = append( req.Touches, points )
+    }
     
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
+    _, err := self.nngClient.sendWait( req, time.Duration( gesture.duration() ) * time.Millisecond )
+    return err
 }
 
-func (self *CFA) ElClick( elId string ) {
+func (self *CFA) ElClick( elId string ) error {
     log.Info( "elClick:", elId )
-    json := fmt.Sprintf( `{
-        action: "elClick"
-        id: "%s"
-    }`, elId )
-    
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
+    _, err := self.nngClient.send( &CFAReqEl{
+        CFAReq: CFAReq{ Action: "elClick" },
+        Id:     elId,
+    } )
+    return err
 }
 
-func (self *CFA) ElForceTouch( elId string, pressure int ) {
+func (self *CFA) ElForceTouch( elId string, pressure int ) error {
     log.Info( "elForceTouch:", elId, pressure )
-    json := fmt.Sprintf( `{
-        action: "elForceTouch"
-        id: "%s"
-        time: 2
-        pressure: %d
-    }`, elId, pressure )
-    
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
+    _, err := self.nngClient.sendWait( &CFAReqEl{
+        CFAReq:   CFAReq{ Action: "elForceTouch" },
+        Id:       elId,
+        Time:     2,
+        Pressure: pressure,
+    }, time.Second * 2 )
+    return err
 }
 
-func (self *CFA) ElLongTouch( elId string ) {
+func (self *CFA) ElLongTouch( elId string ) error {
     log.Info( "elTouchAndHold", elId )
-    json := fmt.Sprintf( `{
-        action: "elTouchAndHold"
-        id: "%s"
-        time: 2.0
-    }`, elId )
-    
-    self.nngSocket.Send([]byte(json))
-    self.nngSocket.Recv()
+    _, err := self.nngClient.sendWait( &CFAReqEl{
+        CFAReq: CFAReq{ Action: "elTouchAndHold" },
+        Id:     elId,
+        Time:   2,
+    }, time.Second * 2 )
+    return err
 }
 
-func (self *CFA) GetEl( elType string, elName string, system bool, wait float32 ) string {
+func (self *CFA) GetEl( elType string, elName string, system bool, wait float32 ) ( string, error ) {
     log.Info( "getEl:", elName )
     
-    sysLine := ""
+    req := &CFAReqGetEl{
+        CFAReq: CFAReq{ Action: "getEl" },
+        Type:   elType,
+        Id:     elName,
+    }
     if system {
-        sysLine = "system:1";
+        req.System = 1
     }
-    
-    waitLine := ""
     if wait > 0 {
-        waitLine = fmt.Sprintf("wait:%f",wait)
+        req.Wait = float64( wait )
     }
     
-    json := fmt.Sprintf( `{
-        action: "getEl"
-        type: "%s"
-        id: "%s"
-        %s
-        %s
-    }`, elType, elName, sysLine, waitLine )
-    
-    self.nngSocket.Send([]byte(json))
-    idBytes, _ := self.nngSocket.Recv()
+    idBytes, err := self.nngClient.sendWait( req, secondsToDuration( float64( wait ) ) )
+    if err != nil {
+        return "", err
+    }
     
     log.Info( "getEl-result:", string(idBytes) )
     
-    return string( idBytes )
+    return string( idBytes ), nil
 }
 
-func (self *CFA) WindowSize() (int,int) {
+func (self *CFA) WindowSize() ( int, int, error ) {
     log.Info("windowSize")
-    self.nngSocket.Send([]byte(`{ action: "windowSize" }`))
-    jsonBytes, _ := self.nngSocket.Recv()
-    root, _, _ := uj.ParseFull( jsonBytes )
+    jsonBytes, err := self.nngClient.send( &CFAReq{ Action: "windowSize" } )
+    if err != nil {
+        return 0, 0, err
+    }
+    root, err := cfaParse( "windowSize", jsonBytes )
+    if err != nil {
+        return 0, 0, err
+    }
     width := root.Get("width").Int()
     height := root.Get("height").Int()
     
     log.Info("windowSize-result:",width,height)
-    return width,height
+    return width, height, nil
 }
 
-func (self *CFA) Source(bi string, pid int) string {
-    biLine := ""
-    if bi != "" {
-        biLine = "bi: \"" + bi + "\""
-    }
+func (self *CFA) Source(bi string, pid int) ( string, error ) {
+    req := &CFAReqSource{ CFAReq: CFAReq{ Action: "source" } }
     if pid != 0 {
-        biLine = fmt.Sprintf( "pid: %d", pid )
-    }
-    json := fmt.Sprintf( `{
-        action: "source"
-        %s
-    }`, biLine )
-    self.nngSocket.Send([]byte(json))
-    srcBytes, _ := self.nngSocket.Recv()
-        
-    return string(srcBytes)
+        req.Pid = pid
+    } else {
+        req.Bi = bi
+    }
+    srcBytes, err := self.nngClient.send( req )
+    
+    return string(srcBytes), err
 }
 
-func (self *CFA) ElPos(id string) (int,int,int,int) {
-    json := fmt.Sprintf( `{
-        action: "elPos"
-        id: "%s"
-    }`, id )
-    self.nngSocket.Send([]byte(json))
-    posJson, _ := self.nngSocket.Recv()
+func (self *CFA) ElPos(id string) ( int, int, int, int, error ) {
+    posJson, err := self.nngClient.send( &CFAReqEl{
+        CFAReq: CFAReq{ Action: "elPos" },
+        Id:     id,
+    } )
+    if err != nil {
+        return 0, 0, 0, 0, err
+    }
     
-    root, _, _ := uj.ParseFull( posJson )
+    root, err := cfaParse( "elPos", posJson )
+    if err != nil {
+        return 0, 0, 0, 0, err
+    }
     w := root.Get("w").Int()
     h := root.Get("h").Int()
     x := root.Get("x").Int()
     y := root.Get("y").Int()
     
-    return x,y,w,h
+    return x, y, w, h, nil
 }
 
-func (self *CFA) AlertInfo() ( uj.JNode, string ) {
-    self.ensureSession()
-    self.nngSocket.Send([]byte(`{ action: "alertInfo" }`))
-    jsonBytes, _ := self.nngSocket.Recv()
-    fmt.Printf("alertInfo res: %s\n", string(jsonBytes) )
-    root, _, _ := uj.ParseFull( jsonBytes )
+func (self *CFA) AlertInfo() ( uj.JNode, string, error ) {
+    if err := self.ensureSession(); err != nil {
+        return nil, "", err
+    }
+    jsonBytes, err := self.nngClient.send( &CFAReq{ Action: "alertInfo" } )
+    if err != nil {
+        return nil, "", err
+    }
+    root, err := cfaParse( "alertInfo", jsonBytes )
+    if err != nil {
+        return nil, string(jsonBytes), err
+    }
     presentNode := root.Get("present")
     if presentNode == nil {
-        fmt.Printf("Error reading alertInfo; got back %s\n", string(jsonBytes) )
-        return nil, string(jsonBytes)
-    } else {
-        if presentNode.Bool() == false { return nil, string(jsonBytes) }
-        return root, string(jsonBytes)
+        return nil, string(jsonBytes), &CFAError{ Code: CFA_ERR_RESPONSE, Action: "alertInfo" }
     }
+    if presentNode.Bool() == false { return nil, string(jsonBytes), nil }
+    return root, string(jsonBytes), nil
 }
 
-func (self *CFA) WifiIp() string {
-    self.nngSocket.Send([]byte(`{ action: "wifiIp" }`))
-    srcBytes, _ := self.nngSocket.Recv()
+func (self *CFA) WifiIp() ( string, error ) {
+    srcBytes, err := self.nngClient.send( &CFAReq{ Action: "wifiIp" } )
     
-    return string(srcBytes)
+    return string(srcBytes), err
 }
 
-func (self *CFA) ActiveApps() string {
-    self.nngSocket.Send([]byte(`{ action: "activeApps" }`))
-    srcBytes, _ := self.nngSocket.Recv()
+func (self *CFA) ActiveApps() ( string, error ) {
+    srcBytes, err := self.nngClient.send( &CFAReq{ Action: "activeApps" } )
     
-    return string(srcBytes)
+    return string(srcBytes), err
 }
 
-func (self *CFA) SourceJson() string {
-    self.nngSocket.Send([]byte(`{ action: "sourcej" }`))
-    srcBytes, _ := self.nngSocket.Recv()
+func (self *CFA) SourceJson() ( string, error ) {
+    srcBytes, err := self.nngClient.send( &CFAReq{ Action: "sourcej" } )
     
-    return string(srcBytes)
+    return string(srcBytes), err
 }
 
-func (self *CFA) ToLauncher() string {
-    self.nngSocket.Send([]byte(`{ action: "toLauncher" }`))
-    resp, _ := self.nngSocket.Recv()
+func (self *CFA) ToLauncher() ( string, error ) {
+    resp, err := self.nngClient.send( &CFAReq{ Action: "toLauncher" } )
     
-    return string(resp)
+    return string(resp), err
 }
 
-func (self *CFA) Screenshot() []byte {
-    self.nngSocket2.Send([]byte(`{ action: "screenshot2" }`))
-    imgBytes, _ := self.nngSocket2.Recv()
-    
-    return imgBytes
+func (self *CFA) Screenshot() ( []byte, error ) {
+    return self.nngClient2.send( &CFAReq{ Action: "screenshot2" } )
 }
 
-func (self *CFA) Siri(text string) {
-    self.nngSocket.Send([]byte(fmt.Sprintf(`{ action: "siri", text: "%s" }`, text)))
-    self.nngSocket.Recv()
+func (self *CFA) Siri(text string) error {
+    _, err := self.nngClient.send( &CFAReqText{
+        CFAReq: CFAReq{ Action: "siri" },
+        Text:   text,
+    } )
+    return err
 }
 
-func (self *CFA) ElByPid(pid int,json bool) string {
+func (self *CFA) ElByPid(pid int,json bool) ( string, error ) {
+    req := &CFAReqPid{ CFAReq: CFAReq{ Action: "elByPid" }, Pid: pid }
     if json {
-        self.nngSocket.Send([]byte(fmt.Sprintf(`{ action: "elByPid", pid: %d, json: 1 }`, pid)))
-    } else {
-        self.nngSocket.Send([]byte(fmt.Sprintf(`{ action: "elByPid", pid: %d }`, pid)))
+        req.Json = 1
     }
-    srcBytes, _ := self.nngSocket.Recv()
+    srcBytes, err := self.nngClient.send( req )
     
-    return string(srcBytes)
+    return string(srcBytes), err
 }
 
-func (self *CFA) PidChildWithWidth(pid int,width int) string {
-    self.nngSocket.Send([]byte(fmt.Sprintf(`{ action: "pidChildWithWidth", pid: %d, width: %d }`, pid, width)))
-    srcBytes, _ := self.nngSocket.Recv()
+func (self *CFA) PidChildWithWidth(pid int,width int) ( string, error ) {
+    srcBytes, err := self.nngClient.send( &CFAReqPid{
+        CFAReq: CFAReq{ Action: "pidChildWithWidth" },
+        Pid:    pid,
+        Width:  width,
+    } )
     
-    return string(srcBytes)
+    return string(srcBytes), err
 }
 
-func (self *CFA) AppAtPoint( x int, y int, asjson bool, nopid bool, top bool ) string {
-    jsonLine := ""
-    if asjson { jsonLine = "json: 1" }
-    pidLine := ""
-    if nopid { pidLine = "nopid: 1" }
-    topLine := ""
-    if top { topLine = "top: 1" }
-    json := fmt.Sprintf( `{
-        action: "elementAtPoint"
-        x: %d
-        y: %d
-        %s
-        %s
-        %s
-    }`, x, y, jsonLine, pidLine, topLine )
-    self.nngSocket.Send([]byte(json))
-    srcBytes, _ := self.nngSocket.Recv()
+func (self *CFA) AppAtPoint( x int, y int, asjson bool, nopid bool, top bool ) ( string, error ) {
+    req := &CFAReqAtPoint{ CFAReq: CFAReq{ Action: "elementAtPoint" }, X: x, Y: y }
+    if asjson { req.Json = 1 }
+    if nopid { req.Nopid = 1 }
+    if top { req.Top = 1 }
+    srcBytes, err := self.nngClient.send( req )
     
-    return string(srcBytes)
+    return string(srcBytes), err
 }
 
-func (self *CFA) IsLocked() bool {
-    self.nngSocket.Send([]byte(`{ action: "isLocked" }`))
-    jsonBytes, _ := self.nngSocket.Recv()
-    root, _, _ := uj.ParseFull( jsonBytes )
-    return root.Get("locked").Bool()
+func (self *CFA) IsLocked() ( bool, error ) {
+    jsonBytes, err := self.nngClient.send( &CFAReq{ Action: "isLocked" } )
+    if err != nil {
+        return false, err
+    }
+    root, err := cfaParse( "isLocked", jsonBytes )
+    if err != nil {
+        return false, err
+    }
+    return root.Get("locked").Bool(), nil
 }
 
-func (self *CFA) Unlock () {
-    self.nngSocket.Send([]byte(`{ action: "unlock" }`))
-    res, _ := self.nngSocket.Recv()
-    fmt.Printf("Result:%s\n", string( res ) )
+func (self *CFA) Unlock() error {
+    _, err := self.nngClient.send( &CFAReq{ Action: "unlock" } )
+    return err
 }
 
-func (self *CFA) OpenControlCenter() {
+func (self *CFA) OpenControlCenter() error {
     ccMethod := self.dev.devConfig.controlCenterMethod
   
     fmt.Printf("Opening control center\n")  
-    width, height := self.WindowSize()
+    width, height, err := self.WindowSize()
+    if err != nil {
+        return err
+    }
     
     if ccMethod == "bottomUp" {
         midx := width / 2
         maxy := height - 1
-        self.swipe( midx, maxy, midx, maxy - 200, 0.2 )
+        return self.swipe( midx, maxy, midx, maxy - 200, 0.2 )
     } else if ccMethod == "topDown" {
         maxx := width - 1
-        self.swipe( maxx, 0, maxx, 200, 0.2 )
-    }    
+        return self.swipe( maxx, 0, maxx, 200, 0.2 )
+    }
+    return nil
 }
 
-func (self *CFA) swipeBack() {
-    width, height := self.WindowSize()
+func (self *CFA) swipeBack() error {
+    width, height, err := self.WindowSize()
+    if err != nil {
+        return err
+    }
     midy := height / 2
     midx := width / 2
-    self.swipe( 1, midy, midx, midy, 0.1 )
+    return self.swipe( 1, midy, midx, midy, 0.1 )
 }
 
-func (self *CFA) AddRecordingToCC() {
-    self.create_session("com.apple.Preferences")
+func (self *CFA) AddRecordingToCC() error {
+    if _, err := self.create_session("com.apple.Preferences"); err != nil {
+        return err
+    }
     
     self.AppChanged("com.apple.Preferences")
     
     i := 0
     ccEl := ""
     for {
-        ccEl = self.GetEl("staticText","Control Center", false, 1 )
+        var err error
+        ccEl, err = self.GetEl("staticText","Control Center", false, 1 )
+        if err != nil {
+            return err
+        }
         if ccEl == "" {
             self.swipeBack()
             i++
@@ -761,38 +766,53 @@ func (self *CFA) AddRecordingToCC() {
         }
         break
     }
-    self.ElClick( ccEl )
+    if err := self.ElClick( ccEl ); err != nil {
+        return err
+    }
     
-    customizeEl := self.GetEl("staticText","Customize Controls", false, 2 )
-    self.ElClick( customizeEl )
+    customizeEl, err := self.GetEl("staticText","Customize Controls", false, 2 )
+    if err != nil {
+        return err
+    }
+    if err := self.ElClick( customizeEl ); err != nil {
+        return err
+    }
     
     //x,y,w,h := self.ElPos( addRecEl )
     //fmt.Printf("x:%d,y:%d,w:%d,h:%d\n",x,y,w,h)
     
-    width, height := self.WindowSize()
+    width, height, err := self.WindowSize()
+    if err != nil {
+        return err
+    }
     midy := height / 2
     midx := width / 2
     
-    self.swipe( midx, midy, midx, midy-100, 0.1 )
+    if err := self.swipe( midx, midy, midx, midy-100, 0.1 ); err != nil {
+        return err
+    }
     
-    addRecEl := self.GetEl("button","Insert Screen Recording", false, 2 )
+    addRecEl, err := self.GetEl("button","Insert Screen Recording", false, 2 )
+    if err != nil {
+        return err
+    }
     
-    self.ElClick( addRecEl )
+    return self.ElClick( addRecEl )
 }
 
-func (self *CFA) StartBroadcastStream( appName string, bid string, devConfig *CDevice ) {
+func (self *CFA) StartBroadcastStream( appName string, bid string, devConfig *CDevice ) error {
     method := devConfig.vidStartMethod
     ccRecordingMethod := devConfig.ccRecordingMethod
     
-    sid := self.create_session( bid )
-    if sid == "" {
-        // TODO error creating session
+    if _, err := self.create_session( bid ); err != nil {
+        return err
     }
     
     fmt.Printf("Checking for alerts\n")
     alerts := self.config.vidAlerts
     for {
-        alert, _ := self.AlertInfo()
+        alert, _, err := self.AlertInfo()
+        if err != nil { return err }
         if alert == nil { break }
         text := alert.Get("alert").String()
         
@@ -802,11 +822,12 @@ func (self *CFA) StartBroadcastStream( appName string, bid string, devConfig *CD
             if strings.Contains( text, alert.match ) {
                 fmt.Printf("Alert matching \"%s\" appeared. Autoresponding with \"%s\"\n",
                     alert.match, alert.response )
-                btn := self.GetEl( "button", alert.response, true, 0 )
+                btn, err := self.GetEl( "button", alert.response, true, 0 )
+                if err != nil { return err }
                 if btn == "" {
                     fmt.Printf("Alert does not contain button \"%s\"\n", alert.response )
                 } else {
-                    self.ElClick( btn )
+                    if err := self.ElClick( btn ); err != nil { return err }
                     dismissed = true
                     break
                 }
@@ -825,62 +846,90 @@ func (self *CFA) StartBroadcastStream( appName string, bid string, devConfig *CD
     if method == "app" {
         fmt.Printf("Starting vidApp through the app\n")
         
-        toSelector := self.GetEl( "button", "Broadcast Selector", false, 5 )
-        self.ElClick( toSelector )
+        toSelector, err := self.GetEl( "button", "Broadcast Selector", false, 5 )
+        if err != nil { return err }
+        if err := self.ElClick( toSelector ); err != nil { return err }
         
-        startBtn := self.GetEl( "button", "Start Broadcast", true, 5 )
+        startBtn, err := self.GetEl( "button", "Start Broadcast", true, 5 )
+        if err != nil { return err }
         if startBtn == "" {
-            startBtn := self.GetEl( "staticText", "Start Broadcast", false, 2 )
+            startBtn, err = self.GetEl( "staticText", "Start Broadcast", false, 2 )
+            if err != nil { return err }
             if startBtn == "" {
-                startBtn := self.GetEl( "button", "Start Broadcast", false, 2 )
+                startBtn, err = self.GetEl( "button", "Start Broadcast", false, 2 )
+                if err != nil { return err }
                 if startBtn == "" {
                     fmt.Printf("Error! Could not fetch Start Broadcast button\n")
                 }
             }
         }
-        self.ElClick( startBtn )
+        if err := self.ElClick( startBtn ); err != nil { return err }
     } else if method == "controlCenter" {
         fmt.Printf("Starting vidApp through control center\n")
         time.Sleep( time.Second * 2 )
-        self.OpenControlCenter()
-        //self.Source()
+        if err := self.OpenControlCenter(); err != nil { return err }
         
-        devEl := self.GetEl( "button", "Screen Recording", true, 5 )
+        devEl, err := self.GetEl( "button", "Screen Recording", true, 5 )
+        if err != nil { return err }
         fmt.Printf("Selecting Screen Recording; el=%s\n", devEl )
         if ccRecordingMethod == "longTouch" {
-            self.ElLongTouch( devEl )
+            err = self.ElLongTouch( devEl )
         } else if ccRecordingMethod == "forceTouch" {
-            self.ElForceTouch( devEl, 1 )
+            err = self.ElForceTouch( devEl, 1 )
         } else {
             fmt.Printf("ccRecordingMethod for a device must be either longTouch or forceTouch\n")
             os.Exit(0)
         }
+        if err != nil { return err }
         
-        appEl := self.GetEl( "staticText", appName, true, 5 )
-        self.ElClick( appEl )
+        appEl, err := self.GetEl( "staticText", appName, true, 5 )
+        if err != nil { return err }
+        if err := self.ElClick( appEl ); err != nil { return err }
         
-        startBtn := self.GetEl( "button", "Start Broadcast", true, 5 )
-        self.ElClick( startBtn )
+        startBtn, err := self.GetEl( "button", "Start Broadcast", true, 5 )
+        if err != nil { return err }
+        if err := self.ElClick( startBtn ); err != nil { return err }
         
         time.Sleep( time.Second * 3 )
     } else if method == "manual" {
     }
     
-    self.ToLauncher()
+    if _, err := self.ToLauncher(); err != nil {
+        return err
+    }
     
     time.Sleep( time.Second * 5 )
+    return nil
 }
 
-func (self *CFA) AppChanged( bundleId string ) {
-    if self.disableUpdate { return }
+func (self *CFA) AppChanged( bundleId string ) error {
+    self.stateLock.Lock()
+    self.lastApp = bundleId
+    self.stateLock.Unlock()
     
-    json := fmt.Sprintf( `{
-        action: "updateApplication"
-        bundleId: "%s"
-    }`, bundleId )
+    if self.disableUpdate { return nil }
     
-    if self.nngSocket != nil {
-        self.nngSocket.Send([]byte(json))
-        self.nngSocket.Recv()
+    if !self.nngClient.isConnected() {
+        return nil
+    }
+    _, err := self.nngClient.send( &CFAReqBundle{
+        CFAReq:   CFAReq{ Action: "updateApplication" },
+        BundleId: bundleId,
+    } )
+    return err
+}
+
+func cfaParse( action string, data []byte ) ( uj.JNode, error ) {
+    if len( data ) == 0 {
+        return nil, &CFAError{ Code: CFA_ERR_RESPONSE, Action: action, Err: errors.New("empty response") }
+    }
+    root, _, perr := uj.ParseFull( data )
+    if perr != nil || root == nil {
+        return nil, &CFAError{ Code: CFA_ERR_RESPONSE, Action: action, Err: fmt.Errorf("unparsable response: %s", string( data ) ) }
     }
-}
\ No newline at end of file
+    return root, nil
+}
+
+func secondsToDuration( seconds float64 ) time.Duration {
+    return time.Duration( seconds * float64( time.Second ) )
+}
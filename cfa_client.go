@@ -0,0 +1,227 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+    log "github.com/sirupsen/logrus"
+    "go.nanomsg.org/mangos/v3"
+    nanoReq  "go.nanomsg.org/mangos/v3/protocol/req"
+)
+
+const (
+    CFA_ERR_NOCONN       = "cfa_not_connected"
+    CFA_ERR_SEND         = "cfa_send"
+    CFA_ERR_RECV         = "cfa_recv"
+    CFA_ERR_TIMEOUT      = "cfa_timeout"
+    CFA_ERR_RESPONSE     = "cfa_bad_response"
+    CFA_ERR_RECONNECTING = "cfa_reconnecting"
+    CFA_ERR_REQUEST      = "cfa_bad_request"
+)
+
+// CFAError is returned by every CFA action that fails. Code is one of the
+// CFA_ERR_* values so that callers ( and ControlFloor ) can tell a timeout
+// apart from a dead connection without parsing text.
+type CFAError struct {
+    Code   string
+    Action string
+    Err    error
+}
+
+func (self *CFAError) Error() string {
+    if self.Err == nil {
+        return fmt.Sprintf( "%s: %s", self.Action, self.Code )
+    }
+    return fmt.Sprintf( "%s: %s: %s", self.Action, self.Code, self.Err )
+}
+
+func (self *CFAError) Unwrap() error {
+    return self.Err
+}
+
+// cfaErrCode returns the CFA_ERR_* code of err, or "" if err did not come
+// from a CFA call.
+func cfaErrCode( err error ) string {
+    var cerr *CFAError
+    if errors.As( err, &cerr ) {
+        return cerr.Code
+    }
+    return ""
+}
+
+// CFAClient owns one REQ socket to CFAgent. A REQ socket may only have one
+// request outstanding at a time, so calls are serialized by lock.
+type CFAClient struct {
+    spec    string
+    sock    mangos.Socket
+    timeout time.Duration
+    lock    *sync.Mutex
+    held    string // error code returned while there is no socket
+}
+
+func NewCFAClient( spec string, timeout time.Duration ) (*CFAClient) {
+    return &CFAClient{
+        spec:    spec,
+        timeout: timeout,
+        lock:    &sync.Mutex{},
+    }
+}
+
+// dial connects the socket. The returned channel receives a value when the
+// pipe to CFAgent is lost.
+func (self *CFAClient) dial() ( chan bool, error ) {
+    var err error
+    var reqSock mangos.Socket
+
+    if reqSock, err = nanoReq.NewSocket(); err != nil {
+        log.WithFields( log.Fields{
+            "type":     "err_socket_new",
+            "zmq_spec": self.spec,
+            "err":      err,
+        } ).Info("Socket new error")
+        return nil, &CFAError{ Code: CFA_ERR_NOCONN, Action: "dial", Err: err }
+    }
+
+    if err = reqSock.Dial( self.spec ); err != nil {
+        log.WithFields( log.Fields{
+            "type": "err_socket_dial",
+            "spec": self.spec,
+            "err":  err,
+        } ).Info("Socket dial error")
+        reqSock.Close()
+        return nil, &CFAError{ Code: CFA_ERR_NOCONN, Action: "dial", Err: err }
+    }
+
+    stopChan := make( chan bool, 1 )
+
+    reqSock.SetPipeEventHook( func( action mangos.PipeEvent, pipe mangos.Pipe ) {
+        if action == mangos.PipeEventDetached {
+            select {
+                case stopChan <- true:
+                default:
+            }
+        }
+    } )
+
+    self.lock.Lock()
+    self.sock = reqSock
+    self.held = ""
+    self.lock.Unlock()
+
+    return stopChan, nil
+}
+
+// hold closes the socket and makes calls fail with code until a new
+// socket is dialed or adopted.
+func (self *CFAClient) hold( code string ) {
+    self.lock.Lock()
+    if self.sock != nil {
+        self.sock.Close()
+        self.sock = nil
+    }
+    self.held = code
+    self.lock.Unlock()
+}
+
+// adopt takes over the socket of other, which must be connected. Callers
+// waiting on self see either the old state or the new socket, never a
+// half set up one.
+func (self *CFAClient) adopt( other *CFAClient ) {
+    other.lock.Lock()
+    sock := other.sock
+    other.sock = nil
+    other.lock.Unlock()
+
+    self.lock.Lock()
+    if self.sock != nil {
+        self.sock.Close()
+    }
+    self.sock = sock
+    self.held = ""
+    self.lock.Unlock()
+}
+
+func (self *CFAClient) close() {
+    self.lock.Lock()
+    if self.sock != nil {
+        self.sock.Close()
+        self.sock = nil
+    }
+    self.lock.Unlock()
+}
+
+func (self *CFAClient) isConnected() bool {
+    if self == nil { return false }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.sock != nil
+}
+
+// call sends one request and waits for its reply using the default deadline.
+func (self *CFAClient) call( action string, json string ) ( []byte, error ) {
+    return self.callWait( action, json, 0 )
+}
+
+// callWait is call with the deadline extended by extra. It is used for
+// actions that are expected to take time on the device, such as waiting for
+// an element to appear or holding a press.
+func (self *CFAClient) callWait( action string, json string, extra time.Duration ) ( []byte, error ) {
+    return self.callDeadline( action, json, self.timeout + extra )
+}
+
+// callDeadline is call with an explicit deadline in place of the default.
+func (self *CFAClient) callDeadline( action string, json string, deadline time.Duration ) ( []byte, error ) {
+    res, _, err := self.callTimed( action, json, deadline )
+    return res, err
+}
+
+// callTimed is callDeadline that also says how long CFAgent took to reply.
+// The time spent waiting for another call on the socket to finish is not
+// counted.
+func (self *CFAClient) callTimed( action string, json string, deadline time.Duration ) ( []byte, time.Duration, error ) {
+    if self == nil {
+        return nil, 0, &CFAError{ Code: CFA_ERR_NOCONN, Action: action }
+    }
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    start := time.Now()
+
+    sock := self.sock
+    if sock == nil {
+        code := CFA_ERR_NOCONN
+        if self.held != "" {
+            code = self.held
+        }
+        return nil, 0, &CFAError{ Code: code, Action: action }
+    }
+
+    if err := sock.SetOption( mangos.OptionSendDeadline, deadline ); err != nil {
+        return nil, 0, &CFAError{ Code: CFA_ERR_SEND, Action: action, Err: err }
+    }
+    if err := sock.SetOption( mangos.OptionRecvDeadline, deadline ); err != nil {
+        return nil, 0, &CFAError{ Code: CFA_ERR_RECV, Action: action, Err: err }
+    }
+
+    if err := sock.Send( []byte( json ) ); err != nil {
+        return nil, 0, &CFAError{ Code: cfaSockErrCode( err, CFA_ERR_SEND ), Action: action, Err: err }
+    }
+
+    res, err := sock.Recv()
+    if err != nil {
+        return nil, 0, &CFAError{ Code: cfaSockErrCode( err, CFA_ERR_RECV ), Action: action, Err: err }
+    }
+
+    return res, time.Since( start ), nil
+}
+
+func cfaSockErrCode( err error, def string ) string {
+    if err == mangos.ErrSendTimeout || err == mangos.ErrRecvTimeout {
+        return CFA_ERR_TIMEOUT
+    }
+    if err == mangos.ErrClosed {
+        return CFA_ERR_NOCONN
+    }
+    return def
+}
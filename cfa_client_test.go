@@ -0,0 +1,215 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    uj "github.com/nanoscopic/ujsonin/v2/mod"
+)
+
+var stubNum int32
+
+// newTestCFA returns a CFA whose two sockets are connected to local stubs.
+func newTestCFA( t *testing.T, timeout time.Duration ) ( *CFA, *CFAStub, *CFAStub ) {
+    t.Helper()
+    num := atomic.AddInt32( &stubNum, 1 )
+    spec1 := fmt.Sprintf( "inproc://cfa-test-%d-a", num )
+    spec2 := fmt.Sprintf( "inproc://cfa-test-%d-b", num )
+
+    stub1, err := NewCFAStub( spec1 )
+    if err != nil { t.Fatalf( "stub listen: %s", err ) }
+    stub2, err := NewCFAStub( spec2 )
+    if err != nil { t.Fatalf( "stub listen: %s", err ) }
+
+    config := &Config{ cfaKeyMethod: "iohid", cfaTimeout: timeout }
+    dev := &Device{
+        udid:      "00000000-TEST",
+        devConfig: &CDevice{ controlCenterMethod: "bottomUp" },
+    }
+    cfa := NewCFANoStart( config, nil, dev )
+    cfa.nngClient = NewCFAClient( spec1, timeout )
+    cfa.nngClient2 = NewCFAClient( spec2, timeout )
+    if _, err := cfa.dialNng(); err != nil {
+        t.Fatalf( "dial: %s", err )
+    }
+
+    t.Cleanup( func() {
+        cfa.stop()
+        stub1.close()
+        stub2.close()
+    } )
+    return cfa, stub1, stub2
+}
+
+func TestCFAClickAt( t *testing.T ) {
+    cfa, stub, _ := newTestCFA( t, time.Second )
+
+    if err := cfa.clickAt( 10, 20 ); err != nil {
+        t.Fatalf( "clickAt: %s", err )
+    }
+
+    reqs := stub.received()
+    if len( reqs ) != 1 {
+        t.Fatalf( "expected 1 request, got %d", len( reqs ) )
+    }
+    root, _ := uj.Parse( []byte( reqs[0] ) )
+    if root.Get("action").String() != "tap" || root.Get("x").Int() != 10 || root.Get("y").Int() != 20 {
+        t.Errorf( "unexpected request: %s", reqs[0] )
+    }
+}
+
+func TestCFAWindowSize( t *testing.T ) {
+    cfa, stub, _ := newTestCFA( t, time.Second )
+    stub.reply( "windowSize", `{"width":375,"height":667}` )
+
+    w, h, err := cfa.WindowSize()
+    if err != nil {
+        t.Fatalf( "windowSize: %s", err )
+    }
+    if w != 375 || h != 667 {
+        t.Errorf( "got %dx%d, want 375x667", w, h )
+    }
+}
+
+func TestCFABadResponse( t *testing.T ) {
+    cfa, stub, _ := newTestCFA( t, time.Second )
+    stub.reply( "isLocked", `` )
+
+    _, err := cfa.IsLocked()
+    if code := cfaErrCode( err ); code != CFA_ERR_RESPONSE {
+        t.Fatalf( "expected %s, got %v", CFA_ERR_RESPONSE, err )
+    }
+}
+
+func TestCFATimeout( t *testing.T ) {
+    cfa, stub, _ := newTestCFA( t, time.Millisecond * 200 )
+    stub.handle( "tap", func( uj.JNode ) []byte { return nil } )
+
+    start := time.Now()
+    err := cfa.clickAt( 1, 1 )
+    if code := cfaErrCode( err ); code != CFA_ERR_TIMEOUT {
+        t.Fatalf( "expected %s, got %v", CFA_ERR_TIMEOUT, err )
+    }
+    if elapsed := time.Since( start ); elapsed > time.Second {
+        t.Errorf( "timeout took %s", elapsed )
+    }
+
+    // The socket must still be usable once a request has timed out
+    if err := cfa.home(); err != nil {
+        t.Fatalf( "home after timeout: %s", err )
+    }
+}
+
+func TestCFAWaitExtendsDeadline( t *testing.T ) {
+    cfa, stub, _ := newTestCFA( t, time.Millisecond * 200 )
+    stub.reply( "getEl", `abc123` )
+    stub.setDelay( time.Millisecond * 400 )
+
+    id, err := cfa.GetEl( "button", "OK", false, 1 )
+    if err != nil {
+        t.Fatalf( "getEl: %s", err )
+    }
+    if id != "abc123" {
+        t.Errorf( "got id %q", id )
+    }
+}
+
+func TestCFAScreenshotUsesSecondSocket( t *testing.T ) {
+    cfa, stub1, stub2 := newTestCFA( t, time.Second )
+    stub2.reply( "screenshot2", "JPEGDATA" )
+
+    img, err := cfa.Screenshot()
+    if err != nil {
+        t.Fatalf( "screenshot: %s", err )
+    }
+    if string( img ) != "JPEGDATA" {
+        t.Errorf( "got %q", string( img ) )
+    }
+    if len( stub1.received() ) != 0 {
+        t.Errorf( "screenshot was sent on the control socket" )
+    }
+}
+
+func TestCFAKeysUseLayout( t *testing.T ) {
+    cfa, stub, _ := newTestCFA( t, time.Second )
+    cfa.keyLayout = &KeyLayout{ name: "test", keys: map[int] KeyStroke{} }
+    cfa.keyLayout.add( 'a', KeyStroke{ usage: 4 } )
+    cfa.keyLayout.add( 'A', KeyStroke{ usage: 4, mods: KEY_MOD_SHIFT } )
+
+    // Several keys at once, as the queue sends them after coalescing
+    if err := cfa.keys( []int{ 'a', 'A', 0x20ac, 'a' } ); err != nil {
+        t.Fatalf( "keys: %s", err )
+    }
+
+    want := []string{ "iohid 4 0", "iohid 4 1", "typeText \u20ac", "iohid 4 0" }
+    reqs := stub.received()
+    if len( reqs ) != len( want ) {
+        t.Fatalf( "expected %d requests, got %d: %v", len( want ), len( reqs ), reqs )
+    }
+    for i, req := range reqs {
+        root, _ := uj.Parse( []byte( req ) )
+        got := root.Get("action").String()
+        if got == "iohid" {
+            mods := 0
+            if modsNode := root.Get("modifiers"); modsNode != nil {
+                modsNode.ForEach( func( uj.JNode ) { mods++ } )
+            }
+            got = fmt.Sprintf( "%s %d %d", got, root.Get("usage").Int(), mods )
+        } else {
+            got = got + " " + root.Get("text").String()
+        }
+        if got != want[ i ] {
+            t.Errorf( "request %d: got %q, want %q", i, got, want[ i ] )
+        }
+    }
+}
+
+func TestCFANotConnected( t *testing.T ) {
+    config := &Config{ cfaTimeout: time.Second }
+    dev := &Device{ udid: "00000000-TEST" }
+    cfa := NewCFANoStart( config, nil, dev )
+
+    err := cfa.clickAt( 1, 1 )
+    if code := cfaErrCode( err ); code != CFA_ERR_NOCONN {
+        t.Fatalf( "expected %s, got %v", CFA_ERR_NOCONN, err )
+    }
+}
+
+func TestCFAPipeLoss( t *testing.T ) {
+    num := atomic.AddInt32( &stubNum, 1 )
+    spec := fmt.Sprintf( "inproc://cfa-test-%d-loss", num )
+    stub, err := NewCFAStub( spec )
+    if err != nil { t.Fatalf( "stub listen: %s", err ) }
+
+    client := NewCFAClient( spec, time.Millisecond * 200 )
+    stopChan, err := client.dial()
+    if err != nil { t.Fatalf( "dial: %s", err ) }
+    defer client.close()
+
+    stub.close()
+
+    select {
+        case <- stopChan:
+        case <- time.After( time.Second ):
+            t.Fatalf( "pipe loss was not reported" )
+    }
+
+    if _, err := client.call( "tap", `{ action: "tap" }` ); err == nil {
+        t.Fatalf( "call succeeded without CFAgent" )
+    }
+}
+
+func TestCFResultError( t *testing.T ) {
+    res := cfResult( 7, &CFAError{ Code: CFA_ERR_TIMEOUT, Action: "tap" } )
+    text := res.asText()
+    if !strings.Contains( text, `"code":"cfa_timeout"` ) || !strings.Contains( text, `"id":7` ) {
+        t.Errorf( "unexpected response: %s", text )
+    }
+
+    done := cfResult( 8, nil ).asText()
+    if !strings.Contains( done, "done" ) {
+        t.Errorf( "unexpected response: %s", done )
+    }
+}
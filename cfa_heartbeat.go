@@ -0,0 +1,142 @@
+package main
+
+import (
+    "sync"
+    "time"
+    log "github.com/sirupsen/logrus"
+)
+
+const CFA_PING_MISSES_DEFAULT = 3
+
+// CFAHealth is the liveness of CFAgent as seen by the heartbeat.
+type CFAHealth struct {
+    Latency     time.Duration `json:"latencyNs"`
+    AvgLatency  time.Duration `json:"avgLatencyNs"`
+    LastOk      time.Time     `json:"lastOk"`
+    Misses      int           `json:"misses"` // in a row
+    TotalMisses int           `json:"totalMisses"`
+    Restarts    int           `json:"restarts"`
+    Degraded    bool          `json:"degraded"`
+}
+
+type CFAHeartbeat struct {
+    lock   *sync.Mutex
+    health CFAHealth
+}
+
+func (self *CFA) health() CFAHealth {
+    self.beat.lock.Lock()
+    defer self.beat.lock.Unlock()
+    return self.beat.health
+}
+
+/*
+heartbeat pings CFAgent on the second socket so that a CFAgent which is
+running but no longer answering ( a wedged XCTest ) is noticed before a
+user runs into it. Pings are only sent while connected; the reconnect
+logic covers the time in between.
+*/
+func (self *CFA) heartbeat() {
+    interval := self.config.cfaPingInterval
+    if interval <= 0 {
+        return
+    }
+    ticker := time.NewTicker( interval )
+    defer ticker.Stop()
+    for {
+        select {
+            case <- ticker.C:
+            case <- self.doneChan:
+                return
+        }
+        if self.getState() != CFA_UP {
+            continue
+        }
+        self.ping()
+    }
+}
+
+func (self *CFA) ping() {
+    timeout := self.config.cfaPingTimeout
+    if timeout <= 0 {
+        timeout = self.config.cfaPingInterval
+    }
+    maxMisses := self.config.cfaPingMisses
+    if maxMisses <= 0 {
+        maxMisses = CFA_PING_MISSES_DEFAULT
+    }
+
+    // Timed from when the socket is free, as screenshots share it
+    json, _ := cfaEncode( &CFAReq{ Action: "ping" } )
+    _, latency, err := self.nngClient2.callTimed( "ping", json, timeout )
+
+    beat := self.beat
+    beat.lock.Lock()
+    health := &beat.health
+    if err == nil {
+        wasDegraded := health.Degraded
+        health.Latency = latency
+        if health.AvgLatency == 0 {
+            health.AvgLatency = latency
+        } else {
+            health.AvgLatency = ( health.AvgLatency * 7 + latency ) / 8
+        }
+        health.LastOk = time.Now()
+        health.Misses = 0
+        health.Degraded = false
+        beat.lock.Unlock()
+
+        if wasDegraded {
+            log.WithFields( log.Fields{
+                "type":       "cfa_healthy",
+                "udid":       censorUuid( self.udid ),
+                "latency_ms": latency.Milliseconds(),
+            } ).Info("CFA is answering again")
+            self.dev.EventCh <- DevEvent{ action: DEV_CFA_HEALTHY }
+        }
+        return
+    }
+
+    code := cfaErrCode( err )
+    if code == CFA_ERR_RECONNECTING {
+        // The pipe went down between the state check and the ping
+        beat.lock.Unlock()
+        return
+    }
+    health.Misses++
+    health.TotalMisses++
+    misses := health.Misses
+    if misses < maxMisses {
+        beat.lock.Unlock()
+        log.WithFields( log.Fields{
+            "type":   "cfa_ping_miss",
+            "udid":   censorUuid( self.udid ),
+            "misses": misses,
+            "err":    err,
+        } ).Warn("CFA missed a ping")
+        return
+    }
+    wasDegraded := health.Degraded
+    health.Misses = 0
+    health.Degraded = true
+    health.Restarts++
+    lastOk := health.LastOk
+    beat.lock.Unlock()
+
+    log.WithFields( log.Fields{
+        "type":    "cfa_wedged",
+        "udid":    censorUuid( self.udid ),
+        "misses":  misses,
+        "last_ok": lastOk,
+        "err":     err,
+    } ).Error("CFA stopped answering; restarting it")
+
+    if !wasDegraded {
+        self.dev.EventCh <- DevEvent{ action: DEV_CFA_DEGRADED, data: code }
+    }
+
+    if !self.dev.restartProc( "cfa" ) {
+        // Nothing to restart when CFA is started by hand; dial it afresh
+        self.pipeLost()
+    }
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "time"
+)
+
+// Requests to CFAgent and the video app are built from these structs and
+// encoded with encoding/json. Text arriving from ControlFloor ( typed keys,
+// element names, bundle ids ) can therefore contain quotes, backslashes,
+// newlines or any other unicode without changing the shape of the message.
+
+type CFARequest interface {
+    action() string
+}
+
+type CFAReq struct {
+    Action string `json:"action"`
+}
+
+func (self *CFAReq) action() string {
+    return self.Action
+}
+
+type CFAReqPoint struct {
+    CFAReq
+    X        int     `json:"x"`
+    Y        int     `json:"y"`
+    Pressure int     `json:"pressure,omitempty"`
+    Time     float64 `json:"time,omitempty"`
+}
+
+type CFAReqSwipe struct {
+    CFAReq
+    X1    int     `json:"x1"`
+    Y1    int     `json:"y1"`
+    X2    int     `json:"x2"`
+    Y2    int     `json:"y2"`
+    Delay float64 `json:"delay"`
+}
+
+type CFAReqButton struct {
+    CFAReq
+    Name string `json:"name"`
+}
+
+type CFAReqIohid struct {
+    CFAReq
+    Page      int     `json:"page"`
+    Usage     int     `json:"usage"`
+    Duration  float64 `json:"duration,omitempty"`
+    Modifiers []int   `json:"modifiers,omitempty"`
+}
+
+type CFAReqText struct {
+    CFAReq
+    Text string `json:"text"`
+}
+
+type CFAReqBundle struct {
+    CFAReq
+    BundleId string `json:"bundleId"`
+}
+
+type CFAReqEl struct {
+    CFAReq
+    Id       string  `json:"id"`
+    Time     float64 `json:"time,omitempty"`
+    Pressure int     `json:"pressure,omitempty"`
+}
+
+type CFAReqGetEl struct {
+    CFAReq
+    Type   string  `json:"type"`
+    Id     string  `json:"id"`
+    System int     `json:"system,omitempty"`
+    Wait   float64 `json:"wait,omitempty"`
+}
+
+type CFAReqSource struct {
+    CFAReq
+    Bi  string `json:"bi,omitempty"`
+    Pid int    `json:"pid,omitempty"`
+}
+
+type CFAReqPid struct {
+    CFAReq
+    Pid   int `json:"pid"`
+    Json  int `json:"json,omitempty"`
+    Width int `json:"width,omitempty"`
+}
+
+type CFAReqAtPoint struct {
+    CFAReq
+    X     int `json:"x"`
+    Y     int `json:"y"`
+    Json  int `json:"json,omitempty"`
+    Nopid int `json:"nopid,omitempty"`
+    Top   int `json:"top,omitempty"`
+}
+
+// CFAReqGesture carries every finger of a gesture so that CFAgent can
+// synthesize them as one event.
+type CFAReqGesture struct {
+    CFAReq
+    Touches [][]CFAReqTouchPoint `json:"touches"`
+}
+
+type CFAReqTouchPoint struct {
+    X    int     `json:"x"`
+    Y    int     `json:"y"`
+    Time float64 `json:"t"` // seconds since the gesture began
+}
+
+// AppStreamReq is a command on the video app control socket.
+type AppStreamReq struct {
+    Action  string `json:"action"`
+    Fps     int    `json:"fps,omitempty"`
+    Quality int    `json:"quality,omitempty"`
+    Scale   int    `json:"scale,omitempty"` // percent
+}
+
+// encodeJson encodes msg without escaping <, > and &. They are legal as-is
+// and there is no reason to send CFAgent \u003c in place of a typed <.
+func encodeJson( msg interface{} ) ( []byte, error ) {
+    buf := &bytes.Buffer{}
+    enc := json.NewEncoder( buf )
+    enc.SetEscapeHTML( false )
+    if err := enc.Encode( msg ); err != nil {
+        return nil, err
+    }
+    return bytes.TrimRight( buf.Bytes(), "\n" ), nil
+}
+
+func cfaEncode( req CFARequest ) ( string, error ) {
+    data, err := encodeJson( req )
+    if err != nil {
+        return "", &CFAError{ Code: CFA_ERR_REQUEST, Action: req.action(), Err: err }
+    }
+    return string( data ), nil
+}
+
+func appStreamMsg( action string ) []byte {
+    data, _ := encodeJson( &AppStreamReq{ Action: action } )
+    return data
+}
+
+// appStreamLevelMsg tells the video app what to send frames at.
+func appStreamLevelMsg( level VidLevel ) []byte {
+    data, _ := encodeJson( &AppStreamReq{
+        Action:  "level",
+        Fps:     level.Fps,
+        Quality: level.Quality,
+        Scale:   level.Scale,
+    } )
+    return data
+}
+
+// send encodes req and sends it to CFAgent.
+func (self *CFAClient) send( req CFARequest ) ( []byte, error ) {
+    return self.sendWait( req, 0 )
+}
+
+func (self *CFAClient) sendWait( req CFARequest, extra time.Duration ) ( []byte, error ) {
+    json, err := cfaEncode( req )
+    if err != nil {
+        return nil, err
+    }
+    return self.callWait( req.action(), json, extra )
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "encoding/json"
+    "math"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+var hostileStrings = []string{
+    ``,
+    `plain`,
+    `"`,
+    `\`,
+    `\"`,
+    `"}`,
+    `", action: "home`,
+    `"}, {"action":"unlock`,
+    "line1\nline2",
+    "tab\there\r\n",
+    "nul\x00byte",
+    "bell\x07esc\x1b[0m",
+    "del\x7f",
+    `<script>&amp;</script>`,
+    "  ",
+    "😀👍🏽🇯🇵",
+    "👨‍👩‍👧‍👦",
+    "日本語のテキスト",
+    "Ünïcödé ß",
+    "\ufeffbom",
+    `%s %d %v`,
+    `{}[]:,`,
+}
+
+func TestEncodeRoundTrip( t *testing.T ) {
+    for _, str := range hostileStrings {
+        reqs := []CFARequest{
+            &CFAReqText{ CFAReq: CFAReq{ Action: "typeText" }, Text: str },
+            &CFAReqText{ CFAReq: CFAReq{ Action: "siri" }, Text: str },
+            &CFAReqBundle{ CFAReq: CFAReq{ Action: "createSession" }, BundleId: str },
+            &CFAReqBundle{ CFAReq: CFAReq{ Action: "updateApplication" }, BundleId: str },
+            &CFAReqEl{ CFAReq: CFAReq{ Action: "elClick" }, Id: str },
+            &CFAReqGetEl{ CFAReq: CFAReq{ Action: "getEl" }, Type: str, Id: str, System: 1, Wait: 1.5 },
+            &CFAReqSource{ CFAReq: CFAReq{ Action: "source" }, Bi: str },
+        }
+        for _, req := range reqs {
+            text, err := cfaEncode( req )
+            if err != nil {
+                t.Fatalf( "encode %q: %s", str, err )
+            }
+            for _, c := range []byte( text ) {
+                if c < 0x20 {
+                    t.Errorf( "raw control character %#x in %q", c, text )
+                }
+            }
+
+            back := reflect.New( reflect.TypeOf( req ).Elem() ).Interface()
+            if err := json.Unmarshal( []byte( text ), back ); err != nil {
+                t.Fatalf( "decode %q: %s", text, err )
+            }
+            if !reflect.DeepEqual( back, req ) {
+                t.Errorf( "round trip of %q changed: %+v != %+v", str, back, req )
+            }
+
+            var generic map[string]interface{}
+            json.Unmarshal( []byte( text ), &generic )
+            if generic["action"] != req.action() {
+                t.Errorf( "action changed to %v by %q", generic["action"], str )
+            }
+        }
+    }
+}
+
+func TestEncodeNoHtmlEscape( t *testing.T ) {
+    text, _ := cfaEncode( &CFAReqText{ CFAReq: CFAReq{ Action: "typeText" }, Text: "<&>" } )
+    if !strings.Contains( text, `"text":"<&>"` ) {
+        t.Errorf( "unexpected encoding: %s", text )
+    }
+}
+
+func TestEncodeOmitsUnsetOptions( t *testing.T ) {
+    text, _ := cfaEncode( &CFAReqGetEl{ CFAReq: CFAReq{ Action: "getEl" }, Type: "button", Id: "OK" } )
+    if strings.Contains( text, "system" ) || strings.Contains( text, "wait" ) {
+        t.Errorf( "unset options were sent: %s", text )
+    }
+}
+
+func TestEncodeBadRequest( t *testing.T ) {
+    cfa, stub, _ := newTestCFA( t, time.Second )
+
+    err := cfa.longPress( 1, 1, math.NaN() )
+    if code := cfaErrCode( err ); code != CFA_ERR_REQUEST {
+        t.Fatalf( "expected %s, got %v", CFA_ERR_REQUEST, err )
+    }
+    if len( stub.received() ) != 0 {
+        t.Errorf( "unencodable request was sent" )
+    }
+}
+
+func TestCFATypeTextHostile( t *testing.T ) {
+    cfa, stub, _ := newTestCFA( t, time.Second )
+
+    for _, str := range hostileStrings {
+        if str == "" {
+            continue
+        }
+        codes := []int{}
+        for _, r := range str {
+            codes = append( codes, int( r ) )
+        }
+        if err := cfa.typeText( codes ); err != nil {
+            t.Fatalf( "typeText %q: %s", str, err )
+        }
+    }
+
+    reqs := stub.received()
+    i := 0
+    for _, str := range hostileStrings {
+        if str == "" {
+            continue
+        }
+        req := CFAReqText{}
+        if err := json.Unmarshal( []byte( reqs[i] ), &req ); err != nil {
+            t.Fatalf( "CFAgent got invalid json %q: %s", reqs[i], err )
+        }
+        if req.Action != "typeText" || req.Text != str {
+            t.Errorf( "sent %q, CFAgent got %+v", str, req )
+        }
+        i++
+    }
+}
+
+func TestCFAGetElHostile( t *testing.T ) {
+    cfa, stub, _ := newTestCFA( t, time.Second )
+
+    name := "Don't \"Allow\"\n\\ 🙅"
+    if _, err := cfa.GetEl( "button", name, true, 0 ); err != nil {
+        t.Fatalf( "getEl: %s", err )
+    }
+
+    req := CFAReqGetEl{}
+    reqs := stub.received()
+    if err := json.Unmarshal( []byte( reqs[0] ), &req ); err != nil {
+        t.Fatalf( "CFAgent got invalid json %q: %s", reqs[0], err )
+    }
+    if req.Id != name || req.Type != "button" || req.System != 1 {
+        t.Errorf( "CFAgent got %+v", req )
+    }
+}
+
+func TestAppStreamMsg( t *testing.T ) {
+    for _, action := range []string{ "oneframe", "ping", "start", "stop" } {
+        req := AppStreamReq{}
+        if err := json.Unmarshal( appStreamMsg( action ), &req ); err != nil || req.Action != action {
+            t.Errorf( "bad message for %s: %s", action, string( appStreamMsg( action ) ) )
+        }
+    }
+}
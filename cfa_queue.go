@@ -0,0 +1,278 @@
+package main
+
+import (
+    "strings"
+    "sync"
+    "time"
+    log "github.com/sirupsen/logrus"
+)
+
+const (
+    CFA_PRI_HIGH = iota // navigation that should preempt queued input; home, cc, ...
+    CFA_PRI_NORMAL      // user input; clicks, swipes, keys. Always kept in order
+    CFA_PRI_LOW         // queries that can wait for input; source, wifiIp
+    cfaPriCount
+)
+
+const (
+    CFA_ERR_CANCELLED = "cfa_cancelled"
+    CFA_ERR_STOPPED   = "cfa_queue_stopped"
+)
+
+// CFACommand is one unit of work for the CFA queue. Commands submitted with
+// the same session can be cancelled together when that viewer goes away.
+type CFACommand struct {
+    name     string
+    priority int
+    session  string
+    user     string // whose input this is; blank for anything but input
+    run      func( cmd *CFACommand ) error
+    keys     []int
+    waiters  []chan error
+    queued   time.Time
+}
+
+type CFAQueueMetrics struct {
+    Depth      int     `json:"depth"`
+    MaxDepth   int     `json:"maxDepth"`
+    Processed  int     `json:"processed"`
+    Failed     int     `json:"failed"`
+    Cancelled  int     `json:"cancelled"`
+    Coalesced  int     `json:"coalesced"`
+    LastWaitMs float64 `json:"lastWaitMs"`
+    LastRunMs  float64 `json:"lastRunMs"`
+    Running    string  `json:"running"`
+}
+
+// CFAQueue serializes everything ControlFloor asks a device's CFA to do.
+// CFA commands go over a single REQ socket, so running them one at a time
+// in a known order is the only way to keep replies matched to requests.
+type CFAQueue struct {
+    udid    string
+    lock    *sync.Mutex
+    cond    *sync.Cond
+    pending [cfaPriCount][]*CFACommand
+    stopped bool
+    metrics CFAQueueMetrics
+    onRun   func( cmd *CFACommand ) // called after each command has run
+}
+
+func NewCFAQueue( udid string ) *CFAQueue {
+    lock := &sync.Mutex{}
+    return &CFAQueue{
+        udid: udid,
+        lock: lock,
+        cond: sync.NewCond( lock ),
+    }
+}
+
+func (self *CFAQueue) start() {
+    go func() {
+        for {
+            cmd := self.next()
+            if cmd == nil {
+                return
+            }
+            self.runOne( cmd )
+        }
+    }()
+}
+
+// stop fails every pending command and ends the worker once the running
+// command, if any, has finished.
+func (self *CFAQueue) stop() {
+    self.lock.Lock()
+    self.stopped = true
+    var dropped []*CFACommand
+    for pri := range self.pending {
+        dropped = append( dropped, self.pending[ pri ]... )
+        self.pending[ pri ] = nil
+    }
+    self.metrics.Depth = 0
+    self.cond.Broadcast()
+    self.lock.Unlock()
+
+    for _, cmd := range dropped {
+        cmd.finish( &CFAError{ Code: CFA_ERR_STOPPED, Action: cmd.name } )
+    }
+}
+
+// submit queues cmd and returns a channel that receives its result.
+func (self *CFAQueue) submit( cmd *CFACommand ) chan error {
+    done := make( chan error, 1 )
+    cmd.waiters = append( cmd.waiters, done )
+    cmd.queued = time.Now()
+
+    self.lock.Lock()
+    if self.stopped {
+        self.lock.Unlock()
+        cmd.finish( &CFAError{ Code: CFA_ERR_STOPPED, Action: cmd.name } )
+        return done
+    }
+
+    queue := self.pending[ cmd.priority ]
+    if len( cmd.keys ) > 0 && len( queue ) > 0 {
+        last := queue[ len( queue ) - 1 ]
+        if last.canCoalesce( cmd ) {
+            last.keys = append( last.keys, cmd.keys... )
+            last.waiters = append( last.waiters, done )
+            self.metrics.Coalesced++
+            self.lock.Unlock()
+            return done
+        }
+    }
+
+    self.pending[ cmd.priority ] = append( queue, cmd )
+    self.metrics.Depth++
+    if self.metrics.Depth > self.metrics.MaxDepth {
+        self.metrics.MaxDepth = self.metrics.Depth
+    }
+    self.cond.Signal()
+    self.lock.Unlock()
+
+    return done
+}
+
+// cancelSession drops every queued command belonging to session, including
+// those of sub-sessions ( "ws1:viewer" belongs to "ws1" ). The command
+// currently running, if any, is allowed to finish.
+func (self *CFAQueue) cancelSession( session string ) int {
+    if session == "" {
+        return 0
+    }
+    return self.cancel( "session", session, func( cmd *CFACommand ) bool {
+        return sessionMatches( cmd.session, session )
+    } )
+}
+
+// cancelUser drops every queued input command of user, for when the device
+// is no longer theirs.
+func (self *CFAQueue) cancelUser( user string ) int {
+    if user == "" {
+        return 0
+    }
+    return self.cancel( "user", user, func( cmd *CFACommand ) bool {
+        return cmd.user == user
+    } )
+}
+
+// cancel drops every queued command that matches. by and value are what
+// the commands were picked by, for the log.
+func (self *CFAQueue) cancel( by string, value string, match func( cmd *CFACommand ) bool ) int {
+    self.lock.Lock()
+    var dropped []*CFACommand
+    for pri, queue := range self.pending {
+        kept := queue[:0]
+        for _, cmd := range queue {
+            if match( cmd ) {
+                dropped = append( dropped, cmd )
+            } else {
+                kept = append( kept, cmd )
+            }
+        }
+        self.pending[ pri ] = kept
+    }
+    self.metrics.Depth -= len( dropped )
+    self.metrics.Cancelled += len( dropped )
+    self.lock.Unlock()
+
+    for _, cmd := range dropped {
+        cmd.finish( &CFAError{ Code: CFA_ERR_CANCELLED, Action: cmd.name } )
+    }
+
+    if len( dropped ) > 0 {
+        log.WithFields( log.Fields{
+            "type":      "cfa_queue_cancel",
+            "udid":      censorUuid( self.udid ),
+            by:          value,
+            "cancelled": len( dropped ),
+        } ).Info("Cancelled queued CFA commands")
+    }
+    return len( dropped )
+}
+
+func (self *CFAQueue) getMetrics() CFAQueueMetrics {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.metrics
+}
+
+func (self *CFAQueue) next() *CFACommand {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    for {
+        if self.stopped {
+            return nil
+        }
+        for pri, queue := range self.pending {
+            if len( queue ) > 0 {
+                cmd := queue[0]
+                self.pending[ pri ] = queue[1:]
+                self.metrics.Depth--
+                self.metrics.Running = cmd.name
+                self.metrics.LastWaitMs = msSince( cmd.queued )
+                return cmd
+            }
+        }
+        self.cond.Wait()
+    }
+}
+
+func (self *CFAQueue) runOne( cmd *CFACommand ) {
+    start := time.Now()
+    err := cmd.run( cmd )
+
+    self.lock.Lock()
+    self.metrics.Running = ""
+    self.metrics.LastRunMs = msSince( start )
+    self.metrics.Processed++
+    if err != nil {
+        self.metrics.Failed++
+    }
+    self.lock.Unlock()
+
+    if err != nil {
+        log.WithFields( log.Fields{
+            "type": "cfa_queue_fail",
+            "udid": censorUuid( self.udid ),
+            "cmd":  cmd.name,
+            "err":  err,
+        } ).Warn("CFA command failed")
+    }
+
+    cmd.finish( err )
+
+    if self.onRun != nil {
+        self.onRun( cmd )
+    }
+}
+
+// canCoalesce reports whether other can be typed as part of this command.
+// Only printable characters are merged since control keys such as
+// backspace must be sent individually.
+func (self *CFACommand) canCoalesce( other *CFACommand ) bool {
+    if len( self.keys ) == 0 || self.session != other.session || self.user != other.user || self.name != other.name {
+        return false
+    }
+    for _, code := range self.keys {
+        if code < 32 { return false }
+    }
+    for _, code := range other.keys {
+        if code < 32 { return false }
+    }
+    return true
+}
+
+func (self *CFACommand) finish( err error ) {
+    for _, waiter := range self.waiters {
+        waiter <- err
+    }
+}
+
+func sessionMatches( cmdSession string, session string ) bool {
+    return cmdSession == session || strings.HasPrefix( cmdSession, session + ":" )
+}
+
+func msSince( start time.Time ) float64 {
+    return float64( time.Since( start ) ) / float64( time.Millisecond )
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "sync"
+    "time"
+    uj "github.com/nanoscopic/ujsonin/v2/mod"
+    "go.nanomsg.org/mangos/v3"
+    nanoRep "go.nanomsg.org/mangos/v3/protocol/rep"
+
+    // register transports
+    _ "go.nanomsg.org/mangos/v3/transport/all"
+)
+
+// CFAStubHandler answers one request. Returning nil sends no reply at all,
+// which looks to the client like a wedged CFAgent.
+type CFAStubHandler func( req uj.JNode ) []byte
+
+// CFAStub is a stand-in for CFAgent listening on a mangos REP socket. It
+// lets the CFA client be exercised on a host with no device attached.
+type CFAStub struct {
+    spec     string
+    sock     mangos.Socket
+    lock     *sync.Mutex
+    handlers map[string] CFAStubHandler
+    requests []string
+    delay    time.Duration
+}
+
+func NewCFAStub( spec string ) ( *CFAStub, error ) {
+    sock, err := nanoRep.NewSocket()
+    if err != nil {
+        return nil, err
+    }
+    if err = sock.Listen( spec ); err != nil {
+        sock.Close()
+        return nil, err
+    }
+
+    self := &CFAStub{
+        spec:     spec,
+        sock:     sock,
+        lock:     &sync.Mutex{},
+        handlers: make( map[string] CFAStubHandler ),
+    }
+    go self.serve()
+    return self, nil
+}
+
+// handle registers the reply for an action. Actions without a handler are
+// answered with "{}".
+func (self *CFAStub) handle( action string, handler CFAStubHandler ) {
+    self.lock.Lock()
+    self.handlers[ action ] = handler
+    self.lock.Unlock()
+}
+
+// reply is a shortcut for a handler that always answers with the same text.
+func (self *CFAStub) reply( action string, text string ) {
+    self.handle( action, func( uj.JNode ) []byte { return []byte( text ) } )
+}
+
+// setDelay makes the stub wait before every reply.
+func (self *CFAStub) setDelay( delay time.Duration ) {
+    self.lock.Lock()
+    self.delay = delay
+    self.lock.Unlock()
+}
+
+// received returns the raw text of every request seen so far.
+func (self *CFAStub) received() []string {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return append( []string{}, self.requests... )
+}
+
+func (self *CFAStub) close() {
+    self.sock.Close()
+}
+
+func (self *CFAStub) serve() {
+    for {
+        msg, err := self.sock.Recv()
+        if err != nil {
+            return
+        }
+
+        action := ""
+        root, _, perr := uj.ParseFull( msg )
+        if perr == nil && root != nil {
+            if actionNode := root.Get("action"); actionNode != nil {
+                action = actionNode.String()
+            }
+        }
+
+        self.lock.Lock()
+        self.requests = append( self.requests, string( msg ) )
+        handler := self.handlers[ action ]
+        delay := self.delay
+        self.lock.Unlock()
+
+        res := []byte("{}")
+        if handler != nil {
+            res = handler( root )
+        }
+        if res == nil {
+            continue
+        }
+        if delay > 0 {
+            time.Sleep( delay )
+        }
+        if err := self.sock.Send( res ); err != nil {
+            return
+        }
+    }
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+    "time"
+    log "github.com/sirupsen/logrus"
+)
+
+const (
+    CFA_DOWN = iota // not yet connected
+    CFA_UP
+    CFA_RECONNECTING
+    CFA_STOPPED
+)
+
+const (
+    CFA_REDIAL_MIN = time.Second
+    CFA_REDIAL_MAX = time.Second * 15
+)
+
+func (self *CFA) getState() int {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+    return self.state
+}
+
+func (self *CFA) setState( state int ) {
+    self.stateLock.Lock()
+    if self.state != CFA_STOPPED {
+        self.state = state
+    }
+    self.stateLock.Unlock()
+}
+
+// supervise waits for the pipe behind stopChan to drop and then starts
+// reconnecting. One supervisor runs per successful dial.
+func (self *CFA) supervise( stopChan chan bool ) {
+    select {
+        case <- stopChan:
+        case <- self.doneChan:
+            return
+    }
+    self.pipeLost()
+}
+
+/*
+pipeLost is called when the NNG pipe drops or the CFAgent process exits,
+whichever is noticed first. Calls made until the session is restored fail
+right away with CFA_ERR_RECONNECTING rather than waiting out their deadline.
+*/
+func (self *CFA) pipeLost() {
+    self.stateLock.Lock()
+    if self.state != CFA_UP {
+        self.stateLock.Unlock()
+        return
+    }
+    self.state = CFA_RECONNECTING
+    self.stateLock.Unlock()
+
+    log.WithFields( log.Fields{
+        "type": "cfa_pipe_lost",
+        "udid": censorUuid( self.udid ),
+    } ).Warn("Lost connection to CFA; reconnecting")
+
+    self.sessionMade = false
+    self.nngClient.hold( CFA_ERR_RECONNECTING )
+    self.nngClient2.hold( CFA_ERR_RECONNECTING )
+
+    self.dev.EventCh <- DevEvent{ action: DEV_CFA_STOP }
+
+    go self.reconnect()
+}
+
+// kickReconnect makes a waiting reconnect try again immediately, such as
+// when CFAgent reports that it is ready again.
+func (self *CFA) kickReconnect() {
+    select {
+        case self.kickChan <- true:
+        default:
+    }
+}
+
+func (self *CFA) stopSupervisor() {
+    self.stateLock.Lock()
+    if self.state != CFA_STOPPED {
+        self.state = CFA_STOPPED
+        close( self.doneChan )
+    }
+    self.stateLock.Unlock()
+}
+
+func (self *CFA) reconnect() {
+    delay := CFA_REDIAL_MIN
+    tries := 0
+    for {
+        if self.getState() != CFA_RECONNECTING {
+            return
+        }
+        tries++
+
+        stopChan, err := self.restore()
+        if err == nil {
+            self.setState( CFA_UP )
+            if self.getState() != CFA_UP { // stopped meanwhile
+                self.nngClient.close()
+                self.nngClient2.close()
+                return
+            }
+            log.WithFields( log.Fields{
+                "type":  "cfa_reconnected",
+                "udid":  censorUuid( self.udid ),
+                "tries": tries,
+            } ).Info("Reconnected to CFA")
+
+            go self.supervise( stopChan )
+            self.dev.EventCh <- DevEvent{ action: DEV_CFA_RECONNECT }
+            return
+        }
+
+        log.WithFields( log.Fields{
+            "type":  "cfa_reconnect_fail",
+            "udid":  censorUuid( self.udid ),
+            "tries": tries,
+            "err":   err,
+        } ).Debug("CFA reconnect attempt failed")
+
+        select {
+            case <- time.After( delay ):
+            case <- self.kickChan:
+            case <- self.doneChan:
+                return
+        }
+        delay *= 2
+        if delay > CFA_REDIAL_MAX {
+            delay = CFA_REDIAL_MAX
+        }
+    }
+}
+
+/*
+restore dials fresh sockets and brings the new CFAgent back to where the
+old one was: a session on the last bundle with the last foreground app.
+Only once that is done are the sockets handed to the clients everyone else
+uses, so no command can reach CFAgent before its session exists.
+*/
+func (self *CFA) restore() ( chan bool, error ) {
+    fresh := NewCFAClient( self.nngClient.spec, self.nngClient.timeout )
+    stopChan, err := fresh.dial()
+    if err != nil {
+        return nil, err
+    }
+    fresh2 := NewCFAClient( self.nngClient2.spec, self.nngClient2.timeout )
+    if _, err = fresh2.dial(); err != nil {
+        fresh.close()
+        return nil, err
+    }
+
+    self.stateLock.Lock()
+    bundle := self.lastBundle
+    app := self.lastApp
+    self.stateLock.Unlock()
+
+    if err = self.createSessionOn( fresh, bundle ); err != nil {
+        fresh.close()
+        fresh2.close()
+        return nil, err
+    }
+    if app != "" {
+        // Not fatal; the app may simply be gone after the restart
+        _, err := fresh.send( &CFAReqBundle{
+            CFAReq:   CFAReq{ Action: "updateApplication" },
+            BundleId: app,
+        } )
+        if err != nil {
+            log.WithFields( log.Fields{
+                "type": "cfa_reconnect_app_fail",
+                "udid": censorUuid( self.udid ),
+                "bi":   app,
+                "err":  err,
+            } ).Warn("Could not restore foreground app after reconnect")
+        }
+    }
+
+    self.nngClient.adopt( fresh )
+    self.nngClient2.adopt( fresh2 )
+    self.sessionMade = true
+    return stopChan, nil
+}
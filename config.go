@@ -6,6 +6,9 @@ import (
     "io/ioutil"
     "net/http"
     "os"
+    "sort"
+    "strings"
+    "time"
     uj "github.com/nanoscopic/ujsonin/v2/mod"
     log "github.com/sirupsen/logrus"
 )
@@ -22,6 +25,34 @@ type CDevice struct {
     controlCenterMethod string
     ccRecordingMethod   string
     videoMode           string
+    keyLayout           string
+    vidAdapt            VidAdaptConfig
+    vidSources          []string // nil for the chain in video.sources
+}
+
+// VidAdaptConfig bounds how far video is turned down when viewers cannot
+// keep up, and how the links to them are judged.
+type VidAdaptConfig struct {
+    enabled       bool
+    interval      time.Duration // between checks of the viewers' links
+    minFps        int
+    maxFps        int
+    minQuality    int           // JPEG quality
+    maxQuality    int
+    minScale      int           // percent of full resolution
+    targetBitrate int           // kbit/s per viewer; 0 for no limit
+    maxLatency    time.Duration // a frame write taking longer marks the link slow
+}
+
+// CFServerConfig is one ControlFloor the provider can connect to. Lower
+// priority numbers are tried first.
+type CFServerConfig struct {
+    name       string
+    host       string
+    username   string
+    https      bool
+    selfSigned bool
+    priority   int
 }
 
 type AlertConfig struct {
@@ -35,6 +66,9 @@ type Config struct {
     httpPort     int
     cfHost       string
     cfUsername   string
+    cfServers    []CFServerConfig
+    cfMode       string
+    cfFailback   time.Duration
     devs         map [string] CDevice
     //cfaXcPath       string
     https        bool
@@ -48,6 +82,31 @@ type Config struct {
     wdaPrefix    string
     cfaPrefix    string
     cfaSanityCheck bool
+    cfaTimeout   time.Duration
+    cfaPingInterval time.Duration
+    cfaPingTimeout  time.Duration
+    cfaPingMisses   int
+    uiEvents     bool
+    uiSettle     time.Duration
+    uiMaxChanges int
+    recordPath   string
+    vidRecPath    string
+    vidRecSegment time.Duration
+    vidRecMaxSize int64 // bytes; 0 for no limit
+    vidRecMaxAge  time.Duration
+    vidRecPreroll time.Duration
+    notifyPersist string
+    leaseCleanup []string
+    vidViewerQueue int
+    vidAdapt     VidAdaptConfig
+    vidDedup     bool
+    vidKeyframe  time.Duration
+    vidSources   []string
+    vidStall     time.Duration
+    vidProbe     time.Duration
+    heartbeatInterval time.Duration
+    keyLayout    string
+    keyLayouts   map[string] *KeyLayout
     //wdaSanityCheck bool
     vidAppName   string
     vidAppBid    string
@@ -86,6 +145,18 @@ func GetInt( root uj.JNode, path string ) int {
     return node.Int()
 }
 
+// splitList splits a comma separated config value, dropping blanks.
+func splitList( text string ) []string {
+    list := []string{}
+    for _, part := range strings.Split( text, "," ) {
+        part = strings.TrimSpace( part )
+        if part != "" {
+            list = append( list, part )
+        }
+    }
+    return list
+}
+
 func NewConfig( configPath string, defaultsPath string, calculatedPath string ) (*Config) {
     config := Config{}
     
@@ -94,11 +165,18 @@ func NewConfig( configPath string, defaultsPath string, calculatedPath string )
     config.iosIfPath  = GetStr(  root, "bin_paths.iosif" )
     config.goIosPath  = GetStr(  root, "bin_paths.goios" )
     config.httpPort   = GetInt(  root, "port" )
-    config.cfHost     = GetStr(  root, "controlfloor.host" )
-    config.cfUsername = GetStr(  root, "controlfloor.username" )
     //config.xcPath     = GetStr(  root, "wdaXctestRunFolder" )
     config.https      = GetBool( root, "controlfloor.https" )
     config.selfSigned = GetBool( root, "controlfloor.selfSigned" )
+    config.cfServers  = readCFServers( root, config.https, config.selfSigned )
+    config.cfHost     = config.cfServers[0].host
+    config.cfUsername = config.cfServers[0].username
+    config.cfMode     = GetStr(  root, "controlfloor.mode" )
+    config.cfFailback = time.Duration( GetInt( root, "controlfloor.failback" ) ) * time.Second
+    if config.cfMode != CF_MODE_FAILOVER && config.cfMode != CF_MODE_ALL {
+        fmt.Fprintf( os.Stderr, "controlfloor.mode must be %s or %s", CF_MODE_FAILOVER, CF_MODE_ALL )
+        os.Exit(1)
+    }
     config.wdaPath    = GetStr(  root, "bin_paths.wda" )
     config.cfaPath    = GetStr(  root, "bin_paths.cfa" )
     config.cfaMethod  = GetStr(  root, "cfa.startMethod" )
@@ -107,10 +185,35 @@ func NewConfig( configPath string, defaultsPath string, calculatedPath string )
     config.cfaPrefix       = GetStr( root, "cfa.bundleIdPrefix" )
     config.wdaPrefix       = GetStr( root, "wda.bundleIdPrefix" )
     config.cfaSanityCheck  = GetBool( root, "cfa.sanityCheck" )
+    config.cfaTimeout      = time.Duration( GetInt( root, "cfa.timeout" ) ) * time.Second
+    config.cfaPingInterval = time.Duration( GetInt( root, "cfa.heartbeat.interval" ) ) * time.Second
+    config.cfaPingTimeout  = time.Duration( GetInt( root, "cfa.heartbeat.timeout" ) ) * time.Second
+    config.cfaPingMisses   = GetInt( root, "cfa.heartbeat.misses" )
+    config.uiEvents        = GetBool( root, "uiEvents.enabled" )
+    config.uiSettle        = time.Duration( GetInt( root, "uiEvents.settle" ) ) * time.Millisecond
+    config.uiMaxChanges    = GetInt( root, "uiEvents.maxChanges" )
+    config.recordPath      = GetStr( root, "recording.path" )
+    config.vidRecPath      = GetStr( root, "recording.video.path" )
+    config.vidRecSegment   = time.Duration( GetInt( root, "recording.video.segment" ) ) * time.Second
+    config.vidRecMaxSize   = int64( GetInt( root, "recording.video.maxSize" ) ) * 1024 * 1024
+    config.vidRecMaxAge    = time.Duration( GetInt( root, "recording.video.maxAge" ) ) * time.Hour
+    config.vidRecPreroll   = time.Duration( GetInt( root, "recording.video.preroll" ) ) * time.Second
+    config.notifyPersist   = GetStr( root, "notify.persist" )
+    config.leaseCleanup    = splitList( GetStr( root, "lease.cleanup" ) )
+    config.vidViewerQueue  = GetInt( root, "video.viewerQueue" )
+    config.vidAdapt        = readVidAdapt( root.Get( "video.adapt" ), VidAdaptConfig{} )
+    config.vidDedup        = GetBool( root, "video.dedup" )
+    config.vidKeyframe     = time.Duration( GetInt( root, "video.keyframe" ) ) * time.Second
+    config.vidSources      = splitList( GetStr( root, "video.sources" ) )
+    config.vidStall        = time.Duration( GetInt( root, "video.stallTimeout" ) ) * time.Millisecond
+    config.vidProbe        = time.Duration( GetInt( root, "video.probe" ) ) * time.Second
+    config.heartbeatInterval = time.Duration( GetInt( root, "heartbeat.interval" ) ) * time.Second
     config.vidAppName      = GetStr( root, "vidapp.name" )
     config.vidAppBid       = GetStr( root, "vidapp.bundleId" )
     config.vidAppExtBid    = GetStr( root, "vidapp.extBundleId" )
     config.vidAppBidPrefix = GetStr( root, "vidapp.bundleIdPrefix" )
+    config.keyLayout       = GetStr( root, "keyboard.layout" )
+    config.keyLayouts      = loadKeyLayouts( GetStr( root, "keyboard.path" ) )
     config.portRange = GetStr( root, "portRange" )
     config.bridge    = GetStr( root, "bridge" )
     config.idList = []string{}
@@ -122,8 +225,8 @@ func NewConfig( configPath string, defaultsPath string, calculatedPath string )
         config.tidevicePath = ""
     }
     
-    if config.https {
-        if config.selfSigned {
+    if config.https || config.cfServers[0].https {
+        if config.selfSigned || config.cfServers[0].selfSigned {
             http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{
               InsecureSkipVerify: true,
             }
@@ -131,7 +234,7 @@ func NewConfig( configPath string, defaultsPath string, calculatedPath string )
         }
     }
     
-    config.devs = readDevs( root )
+    config.devs = readDevs( root, config.vidAdapt )
     
     config.alerts = readAlerts( root, "alerts" )
     config.vidAlerts = readAlerts( root, "vidStartAlerts" )
@@ -139,6 +242,75 @@ func NewConfig( configPath string, defaultsPath string, calculatedPath string )
     return &config
 }
 
+/*
+readCFServers reads the ControlFloor servers to use. Each entry of
+controlfloor.servers needs a name and host; username, https and selfSigned
+default to the values directly under controlfloor. Without a server list
+controlfloor.host is the only server, named "default".
+*/
+func readCFServers( root uj.JNode, https bool, selfSigned bool ) []CFServerConfig {
+    username := ""
+    if userNode := root.Get("controlfloor.username"); userNode != nil {
+        username = userNode.String()
+    }
+
+    servers := []CFServerConfig{}
+    serversNode := root.Get("controlfloor.servers")
+    if serversNode == nil {
+        servers = append( servers, CFServerConfig{
+            name:       "default",
+            host:       GetStr( root, "controlfloor.host" ),
+            username:   GetStr( root, "controlfloor.username" ),
+            https:      https,
+            selfSigned: selfSigned,
+        } )
+        return servers
+    }
+
+    names := make( map[string] bool )
+    serversNode.ForEach( func( serverNode uj.JNode ) {
+        server := CFServerConfig{
+            name:       GetStr( serverNode, "name" ),
+            host:       GetStr( serverNode, "host" ),
+            username:   username,
+            https:      https,
+            selfSigned: selfSigned,
+            priority:   len( servers ),
+        }
+        if node := serverNode.Get("username"); node != nil {
+            server.username = node.String()
+        }
+        if node := serverNode.Get("https"); node != nil {
+            server.https = node.Bool()
+        }
+        if node := serverNode.Get("selfSigned"); node != nil {
+            server.selfSigned = node.Bool()
+        }
+        if node := serverNode.Get("priority"); node != nil {
+            server.priority = node.Int()
+        }
+        if server.username == "" {
+            fmt.Fprintf( os.Stderr, "ControlFloor server %s has no username", server.name )
+            os.Exit(1)
+        }
+        if names[ server.name ] {
+            fmt.Fprintf( os.Stderr, "ControlFloor server %s is listed twice", server.name )
+            os.Exit(1)
+        }
+        names[ server.name ] = true
+        servers = append( servers, server )
+    } )
+    if len( servers ) == 0 {
+        fmt.Fprintf( os.Stderr, "controlfloor.servers is empty" )
+        os.Exit(1)
+    }
+
+    sort.SliceStable( servers, func( i, j int ) bool {
+        return servers[i].priority < servers[j].priority
+    } )
+    return servers
+}
+
 func readAlerts( root uj.JNode, nodeName string ) []AlertConfig {
     res := []AlertConfig{}
     
@@ -154,7 +326,26 @@ func readAlerts( root uj.JNode, nodeName string ) []AlertConfig {
     return res
 }
 
-func readDevs( root uj.JNode ) ( map[string]CDevice ) {
+// readVidAdapt overlays the adaptive video settings in node on def. node
+// may be nil.
+func readVidAdapt( node uj.JNode, def VidAdaptConfig ) VidAdaptConfig {
+    conf := def
+    if node == nil {
+        return conf
+    }
+    if n := node.Get("enabled"); n != nil { conf.enabled = n.Bool() }
+    if n := node.Get("interval"); n != nil { conf.interval = time.Duration( n.Int() ) * time.Millisecond }
+    if n := node.Get("minFps"); n != nil { conf.minFps = n.Int() }
+    if n := node.Get("maxFps"); n != nil { conf.maxFps = n.Int() }
+    if n := node.Get("minQuality"); n != nil { conf.minQuality = n.Int() }
+    if n := node.Get("maxQuality"); n != nil { conf.maxQuality = n.Int() }
+    if n := node.Get("minScale"); n != nil { conf.minScale = n.Int() }
+    if n := node.Get("targetBitrate"); n != nil { conf.targetBitrate = n.Int() }
+    if n := node.Get("maxLatency"); n != nil { conf.maxLatency = time.Duration( n.Int() ) * time.Millisecond }
+    return conf
+}
+
+func readDevs( root uj.JNode, vidAdapt VidAdaptConfig ) ( map[string]CDevice ) {
     devs := make( map[string]CDevice )
     
     devsNode := root.Get("devices")
@@ -172,6 +363,7 @@ func readDevs( root uj.JNode ) ( map[string]CDevice ) {
             ccRecordingMethod := "longTouch"
             tunnelMethod := "go-ios"
             videoMode := "cfagent"
+            keyLayout := ""
             if widthNode != nil {
                 uiWidth = widthNode.Int()
             }
@@ -211,6 +403,17 @@ func readDevs( root uj.JNode ) ( map[string]CDevice ) {
             if videoModeNode != nil {
                 videoMode = videoModeNode.String()
             }
+            keyboardNode := devNode.Get("keyboard")
+            if keyboardNode != nil {
+                keyLayout = keyboardNode.String()
+            }
+            // Limits for this device's video, over those in video.adapt
+            devVidAdapt := readVidAdapt( devNode.Get("video"), vidAdapt )
+            var vidSources []string
+            vidSourcesNode := devNode.Get("video.sources")
+            if vidSourcesNode != nil {
+                vidSources = splitList( vidSourcesNode.String() )
+            }
             
             dev := CDevice{
                 udid: udid,
@@ -224,6 +427,9 @@ func readDevs( root uj.JNode ) ( map[string]CDevice ) {
                 ccRecordingMethod: ccRecordingMethod,
                 tunnelMethod: tunnelMethod,
                 videoMode: videoMode,
+                keyLayout: keyLayout,
+                vidAdapt: devVidAdapt,
+                vidSources: vidSources,
             }
             devs[ udid ] = dev
         } )
@@ -1,7 +1,6 @@
 package main
 
 import (
-    "bufio"
     "crypto/tls"
     "encoding/json"
     "errors"
@@ -9,9 +8,7 @@ import (
     "io/ioutil"
     "net"
     "net/http"
-    "net/http/cookiejar"
     "net/url"
-    "os"
     "strconv"
     "strings"
     "sync"
@@ -24,122 +21,99 @@ import (
 
 type ControlFloor struct {
     config     *Config
-    ready      bool
-    base       string
-    wsBase     string
-    cookiejar  *cookiejar.Jar
-    client     *http.Client
-    root       uj.JNode
-    pass       string
     lock       *sync.Mutex
     DevTracker *DeviceTracker
-    vidConns   map[string] *ws.Conn
-    selfSigned bool
+    router     *CFRouter
+    mode       string
+    servers    []*CFServer // by priority
+    active     *CFServer   // the server in use, in CF_MODE_FAILOVER
+    only       *CFServer   // set on views made by forServer
+    stopCh     chan bool
+    started    *sync.Once
 }
 
 func NewControlFloor( config *Config ) (*ControlFloor, chan bool, chan bool) {
-    jar, err := cookiejar.New(&cookiejar.Options{})
-    if err != nil {
-        panic( err )
-    }
-    
-    root := loadCFConfig( "cf.json" )
-    passNode := root.Get("pass")
-    if passNode == nil {
-    }
-    
-    pass := passNode.String()
-    
-    client := &http.Client{
-        Jar: jar,
-        CheckRedirect: func(req *http.Request, via []*http.Request) error {
-            return http.ErrUseLastResponse
-        },
-    }
-    
-    self := ControlFloor{
+    return newControlFloor( config, loadCFPasses( CF_CREDS_PATH ) )
+}
+
+func newControlFloor( config *Config, passes map[string] string ) (*ControlFloor, chan bool, chan bool) {
+    self := &ControlFloor{
         config: config,
-        ready: false,
-        base: "http://" + config.cfHost,
-        wsBase: "ws://" + config.cfHost,
-        cookiejar: jar,
-        client: client,
-        pass: pass,
         lock: &sync.Mutex{},
-        vidConns: make( map[string] *ws.Conn ),
-    }
-    if config.https {
-        self.base = "https://" + config.cfHost
-        self.wsBase = "wss://" + config.cfHost
-        if config.selfSigned {
-            self.selfSigned = true
-            tr := &http.Transport{
-                TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-                ForceAttemptHTTP2: false,
-            }
-            client.Transport = tr
+        router: NewCFRouter(),
+        mode: config.cfMode,
+        stopCh: make( chan bool ),
+        started: &sync.Once{},
+    }
+    registerCFCommands( self.router )
+    
+    for _, conf := range config.cfServers {
+        pass, ok := cfPassFor( passes, conf.name, len( config.cfServers ) == 1 )
+        if !ok {
+            log.WithFields( log.Fields{
+                "type":   "err_cf_pass",
+                "server": conf.name,
+            } ).Fatal( "No ControlFloor password for server. Have you run `./main register`?" )
         }
-    } else {
-        self.base = "http://" + config.cfHost
-        self.wsBase = "ws://" + config.cfHost
+        persist := config.notifyPersist
+        if persist != "" && len( config.cfServers ) > 1 {
+            persist += "." + conf.name
+        }
+        srv := NewCFServer( self, conf, pass, persist )
+        srv.notifyQueue.start()
+        self.servers = append( self.servers, srv )
     }
     
     stopCf := make( chan bool )
     cfReady := make( chan bool )
-    
     go func() {
-        exit := false
-        delayed := false
-        for {
-            select {
-              case <- stopCf:
-                exit = true
-                break
-              default:
-            }
-            if exit { break }
-            
-            success := self.login()
-            if success {
-                log.WithFields( log.Fields{
-                    "type": "cf_login_success",
-                } ).Info( "Logged in to control floor" )
-                cfReady <- true
-            } else {
-                fmt.Println("Could not login to control floor")
-                fmt.Println("Waiting 10 seconds to retry...")
-                time.Sleep( time.Second * 10 )
-                fmt.Println("trying again\n")
-                delayed = true
-                continue
-            }
-            
-            if delayed {
-                self.DevTracker.cfReady()
-            }
-            
-            self.openWebsocket()
-        }
+        <- stopCf
+        close( self.stopCh )
     }()
     
-    return &self, stopCf, cfReady
+    if self.mode == CF_MODE_ALL {
+        for _, srv := range self.servers {
+            go self.connectLoop( []*CFServer{ srv }, cfReady )
+        }
+    } else {
+        go self.connectLoop( self.servers, cfReady )
+    }
+    
+    return self, stopCf, cfReady
 }
 
 type CFResponse interface {
     asText() (string)
+    ack() *CFAck
+}
+
+// CFAck is the part of every reply that says how the command went. Code is
+// set when it failed; one of the CF_ERR_* or CFA_ERR_* values. Ms is how
+// long the handler ran.
+type CFAck struct {
+    Id    int    `json:"id"`
+    Ok    bool   `json:"ok"`
+    Code  string `json:"code,omitempty"`
+    Error string `json:"error,omitempty"`
+    Ms    int64  `json:"ms"`
+}
+
+func (self *CFAck) ack() *CFAck {
+    return self
 }
 
 type CFR_Pong struct {
-    id   int
-    text string
+    CFAck
+    Text string `json:"text"`
 }
 
 func (self *CFR_Pong) asText() string {
-    return fmt.Sprintf("{id:%d,text:\"%s\"}\n",self.id, self.text)
+    text, _ := json.Marshal( self )
+    return string(text)
 }
 
 type CFR_Source struct {
-    Id     int    `json:"id"`
+    CFAck
     Source string `json:"source"`
 }
 
@@ -148,8 +122,18 @@ func (self *CFR_Source) asText() string {
     return string(text)
 }
 
+type CFR_Elements struct {
+    CFAck
+    Elements []*SourceNode `json:"elements"`
+}
+
+func (self *CFR_Elements) asText() string {
+    text, _ := json.Marshal( self )
+    return string(text)
+}
+
 type CFR_WifiIp struct {
-    Id int     `json:"id"`
+    CFAck
     Ip string  `json:"ip"`
     Mac string `json:"mac"`
 }
@@ -159,20 +143,70 @@ func (self *CFR_WifiIp) asText() string {
     return string(text)
 }
 
-func ( self *ControlFloor ) startVidStream( udid string ) {
-    dev := self.DevTracker.getDevice( udid )
-    dev.startVidStream()
+type CFR_Lease struct {
+    CFAck
+    User    string `json:"user"`
+    Expires int64  `json:"expires"` // unix time
+}
+
+func (self *CFR_Lease) asText() string {
+    text, _ := json.Marshal( self )
+    return string(text)
 }
 
-func ( self *ControlFloor ) stopVidStream( udid string ) {
-    dev := self.DevTracker.getDevice( udid )
-    dev.stopVidStream()
+type CFR_Recording struct {
+    CFAck
+    File   string `json:"file"`
+    Events int    `json:"events"`
+}
+
+func (self *CFR_Recording) asText() string {
+    text, _ := json.Marshal( self )
+    return string(text)
+}
+
+type CFR_VidRecording struct {
+    CFAck
+    Id     string `json:"id"`
+    Frames int    `json:"frames"`
+    Size   int64  `json:"size"`
+}
+
+func (self *CFR_VidRecording) asText() string {
+    text, _ := json.Marshal( self )
+    return string(text)
+}
+
+// CFR_Error reports a failed command back to ControlFloor.
+type CFR_Error struct {
+    CFAck
+}
+
+func (self *CFR_Error) asText() string {
+    text, _ := json.Marshal( self )
+    return string(text)
+}
+
+// cfResult turns the outcome of a device action into a response; "done"
+// when it succeeded, otherwise a CFR_Error describing why it did not.
+func cfResult( id int, err error ) CFResponse {
+    if err == nil {
+        return &CFR_Pong{ CFAck: CFAck{ Id: id, Ok: true }, Text: "done" }
+    }
+    if cerr, ok := err.( *CFError ); ok {
+        return cfError( id, cerr.Code, cerr.Msg )
+    }
+    code := cfaErrCode( err )
+    if code == "" {
+        code = "error"
+    }
+    return cfError( id, code, err.Error() )
 }
 
 // Called from the device object
-func ( self *ControlFloor ) connectVidChannel( udid string ) *ws.Conn {
+func ( self *CFServer ) connectVidChannel( udid string, viewer string ) *ws.Conn {
     dialer := ws.Dialer{
-        Jar: self.cookiejar,
+        Jar: self.sessionJar(),
     }
     
     if self.selfSigned {
@@ -181,90 +215,129 @@ func ( self *ControlFloor ) connectVidChannel( udid string ) *ws.Conn {
         //ws.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
     }
     
-    fmt.Printf("Connecting to CF imgStream\n")
+    link := self.wsBase + "/provider/imgStream?udid=" + udid
+    if viewer != "" {
+        link += "&viewer=" + url.QueryEscape( viewer )
+    }
+    
+    fmt.Printf("Connecting to CF imgStream on %s\n", self.name )
     var conn *ws.Conn
-    var resp *http.Response
     for i:=0; i<5; i++ {
         var err error
-        conn, resp, err = dialer.Dial( self.wsBase + "/provider/imgStream?udid=" + udid, nil )
+        var resp *http.Response
+        conn, resp, err = dialer.Dial( link, nil )
         if err != nil {
             fmt.Printf( "Error dialing:%s\n", err )
-            fmt.Printf( "Status code: %d", resp.StatusCode )
-            resp.Body.Close()
-            bytes, err := ioutil.ReadAll( resp.Body )
-            if err == nil && len( bytes ) > 0 {
-                fmt.Printf("Body: %s\n", string(bytes) )
+            if resp != nil {
+                fmt.Printf( "Status code: %d\n", resp.StatusCode )
+                bytes, err := ioutil.ReadAll( resp.Body )
+                resp.Body.Close()
+                if err == nil && len( bytes ) > 0 {
+                    fmt.Printf("Body: %s\n", string(bytes) )
+                }
             }
             time.Sleep( time.Millisecond * 100 )
             continue
         }
         break
     }
+    if conn == nil {
+        log.WithFields( log.Fields{
+            "type":   "cf_vid_connect_fail",
+            "server": self.name,
+            "udid":   censorUuid( udid ),
+        } ).Error( "Could not connect CF imgStream" )
+        return nil
+    }
     
     fmt.Printf("Connected CF imgStream\n")
     
-    //dev := self.DevTracker.getDevice( udid )
-    
-    self.lock.Lock()
-    self.vidConns[ udid ] = conn
-    self.lock.Unlock()
-    
     return conn
-    //dev.startStream( conn )
 }
 
-// Called from the device object
-func ( self *ControlFloor ) destroyVidChannel( udid string ) {
-    vidConn := self.vidConns[ udid ]
-    
-    self.lock.Lock()
-    delete( self.vidConns, udid )
-    self.lock.Unlock()
-    
-    vidConn.Close()
-}
-
-func ( self *ControlFloor ) openWebsocket() {
+// openWebsocket connects the command websocket and serves it until it
+// drops. When resync is set ControlFloor is told the state of every device
+// once the connection is up.
+func ( self *CFServer ) openWebsocket( resync bool ) error {
     dialer := ws.Dialer{
-        Jar: self.cookiejar,
+        Jar: self.sessionJar(),
     }
     
     if self.selfSigned {
         log.WithFields( log.Fields{
-            "type": "cf_ws_selfsign",
+            "type":   "cf_ws_selfsign",
+            "server": self.name,
         } ).Warn( "ControlFloor connection is self signed" )
         dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
         //ws.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
     }
     
     log.WithFields( log.Fields{
-        "type": "cf_ws_connect",
-        "link": ( self.wsBase + "/provider/ws" ),
+        "type":   "cf_ws_connect",
+        "server": self.name,
+        "link":   ( self.wsBase + "/provider/ws" ),
     } ).Info( "Connecting ControlFloor WebSocket" )
     
-    conn, _, err := dialer.Dial( self.wsBase + "/provider/ws", nil )
+    conn, resp, err := dialer.Dial( self.wsBase + "/provider/ws", nil )
     if err != nil {
-        panic( err )
+        if resp != nil {
+            resp.Body.Close()
+            return fmt.Errorf( "%s (status %d)", err, resp.StatusCode )
+        }
+        return err
+    }
+    defer conn.Close()
+    
+    // Commands queued through this connection are tagged with its session so
+    // they can be dropped if the connection goes away before they run.
+    self.lock.Lock()
+    self.wsCount++
+    wsSession := fmt.Sprintf( "%s/ws%d", self.name, self.wsCount )
+    self.conn = conn
+    self.wasConnected = true
+    self.lock.Unlock()
+    
+    if resync {
+        go self.cf.resync( self )
     }
     
+    self.serveWebsocket( conn, wsSession )
+    
+    self.lock.Lock()
+    self.conn = nil
+    self.lock.Unlock()
+    return nil
+}
+
+// CFConn is the part of a websocket connection the command loop uses.
+type CFConn interface {
+    ReadMessage() ( int, []byte, error )
+    WriteMessage( int, []byte ) error
+}
+
+// serveWebsocket reads commands from conn until it fails, handing each to
+// the router.
+func ( self *CFServer ) serveWebsocket( conn CFConn, wsSession string ) {
     respondChan := make( chan CFResponse )
     doneChan := make( chan bool )
     // response channel exists so that multiple threads can queue
     //   responses. WriteMessage is not thread safe
-    go func() { for {
-        select {
-            case <- doneChan:
-                break
-            case resp := <- respondChan:
-                rText := resp.asText()
-                err := conn.WriteMessage( ws.TextMessage, []byte(rText) )
-                //fmt.Printf( "Wrote response back: %s\n", rText )
-                if err != nil {
-                    fmt.Printf("Error writing to ws\n")
-                    break
-                }
+    go func() {
+        for {
+            select {
+                case <- doneChan:
+                    // Late replies see doneChan closed and are dropped
+                    return
+                case resp := <- respondChan:
+                    rText := resp.asText()
+                    err := conn.WriteMessage( ws.TextMessage, []byte(rText) )
+                    //fmt.Printf( "Wrote response back: %s\n", rText )
+                    if err != nil {
+                        fmt.Printf("Error writing to ws\n")
+                    }
+            }
         }
-    } }()
+    }()
         
     // There is only a single websocket connection between a provider and controlfloor
     // As a result, all messages sent here ought to be small, because if they aren't
@@ -276,269 +349,111 @@ func ( self *ControlFloor ) openWebsocket() {
             break
         }
         if t == ws.TextMessage {
-            //tMsg := string( msg )
-            b1 := []byte{ msg[0] }
-            if string(b1) == "{" {
-                root, _ := uj.Parse( msg )
-                id := root.Get("id").Int()
-                mType := root.Get("type").String()
-                if mType == "ping" {
-                    respondChan <- &CFR_Pong{ id: id, text: "pong" }
-                } else if mType == "click" {
-                    udid := root.Get("udid").String()
-                    x := root.Get("x").Int()
-                    y := root.Get("y").Int()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.clickAt( x, y )
-                        }
-                        respondChan <- &CFR_Pong{ id: id, text: "done" }
-                    } ()
-                } else if mType == "mouseDown" {
-                    udid := root.Get("udid").String()
-                    x := root.Get("x").Int()
-                    y := root.Get("y").Int()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.mouseDown( x, y )
-                        }
-                        respondChan <- &CFR_Pong{ id: id, text: "done" }
-                    } ()
-                } else if mType == "mouseUp" {
-                    udid := root.Get("udid").String()
-                    x := root.Get("x").Int()
-                    y := root.Get("y").Int()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.mouseUp( x, y )
-                        }
-                        respondChan <- &CFR_Pong{ id: id, text: "done" }
-                    } ()
-                } else if mType == "hardPress" {
-                    udid := root.Get("udid").String()
-                    x := root.Get("x").Int()
-                    y := root.Get("y").Int()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.hardPress( x, y )
-                        }
-                    } ()
-                } else if mType == "longPress" {
-                    udid := root.Get("udid").String()
-                    x := root.Get("x").Int()
-                    y := root.Get("y").Int()
-                    time, _ := strconv.ParseFloat( root.Get("time").String(), 64 )
-                    
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.longPress( x, y, time )
-                        }
-                    } ()
-                } else if mType == "home" {
-                    udid := root.Get("udid").String()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.home()
-                        }
-                        respondChan <- &CFR_Pong{ id: id, text: "done" }
-                    } ()
-                } else if mType == "taskSwitcher" {
-                    udid := root.Get("udid").String()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.taskSwitcher()
-                        }
-                        respondChan <- &CFR_Pong{ id: id, text: "done" }
-                    } ()
-                } else if mType == "shake" {
-                    udid := root.Get("udid").String()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.shake()
-                        }
-                        respondChan <- &CFR_Pong{ id: id, text: "done" }
-                    } ()
-                } else if mType == "cc" {
-                    udid := root.Get("udid").String()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.cc()
-                        }
-                        respondChan <- &CFR_Pong{ id: id, text: "done" }
-                    } ()
-                } else if mType == "assistiveTouch" {
-                    udid := root.Get("udid").String()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.toggleAssistiveTouch()
-                        }
-                        respondChan <- &CFR_Pong{ id: id, text: "done" }
-                    } ()
-                } else if mType == "iohid" {
-                    udid := root.Get("udid").String()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            page := root.Get("page").Int()
-                            code := root.Get("code").Int()
-                            dev.iohid( page, code )
-                        }
-                    } ()
-                } else if mType == "swipe" {
-                    udid := root.Get("udid").String()
-                    x1 := root.Get("x1").Int()
-                    y1 := root.Get("y1").Int()
-                    x2 := root.Get("x2").Int()
-                    y2 := root.Get("y2").Int()
-                    delay := root.Get("delay").Int()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.swipe( x1, y1, x2, y2, delay )
-                        }
-                        respondChan <- &CFR_Pong{ id: id, text: "done" }
-                    } ()
-                } else if mType == "keys" {
-                    udid := root.Get("udid").String()
-                    keys := root.Get("keys").String()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            dev.keys( keys )
-                        }
-                        respondChan <- &CFR_Pong{ id: id, text: "done" }
-                    } ()
-                } else if mType == "startStream" {
-                    udid := root.Get("udid").String()
-                    fmt.Printf("Got request to start video stream for %s\n", udid )
-                    go func() { self.startVidStream( udid ) }()
-                } else if mType == "stopStream" {
-                    udid := root.Get("udid").String()
-                    go func() { self.stopVidStream( udid ) }()
-                } else if mType == "source" {
-                    udid := root.Get("udid").String()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            source := dev.source()
-                            respondChan <- &CFR_Source{ Id: id, Source: source } 
-                        } else  {
-                            respondChan <- &CFR_Pong{ id: id, text: "done" }
-                        }
-                    } ()
-                } else if mType == "wifiIp" {
-                    udid := root.Get("udid").String()
-                    go func() {
-                        dev := self.DevTracker.getDevice( udid )
-                        if dev != nil {
-                            ip := dev.WifiIp()
-                            mac := dev.WifiMac()
-                            respondChan <- &CFR_WifiIp{ Id: id, Ip: ip, Mac: mac } 
-                        } else  {
-                            respondChan <- &CFR_Pong{ id: id, text: "done" }
-                        }
-                    } ()
-                } else if mType == "shutdown" {
-                    do_shutdown( self.config, self.DevTracker )
-                } else if mType == "kill" {
-                    udid := root.Get("udid").String()
-                    bid := root.Get("bid").String()
-                    dev := self.DevTracker.getDevice( udid )
-                    dev.killBid( bid )
-                    respondChan <- &CFR_Pong{ id: id, text: "done" }
-                } else if mType == "launch" {
-                    udid := root.Get("udid").String()
-                    bid := root.Get("bid").String()
-                    dev := self.DevTracker.getDevice( udid )
-                    dev.launch( bid )
-                    respondChan <- &CFR_Pong{ id: id, text: "done" }
-                }
-            }
+            self.cf.router.dispatch( self, msg, wsSession, respondChan, doneChan )
         }
     }
     
-    doneChan <- true
+    self.cf.cancelQueued( "", wsSession )
+    
+    close( doneChan )
+}
+
+// cancelQueued drops queued commands for session on one device, or on all
+// devices when udid is empty.
+func ( self *ControlFloor ) cancelQueued( udid string, session string ) {
+    if self.DevTracker == nil {
+        return
+    }
+    if udid != "" {
+        dev := self.DevTracker.getDevice( udid )
+        if dev != nil {
+            dev.cfaQueue.cancelSession( session )
+        }
+        return
+    }
+    for _, dev := range self.DevTracker.devices() {
+        dev.cfaQueue.cancelSession( session )
+    }
 }
 
-func loadCFConfig( configPath string ) (uj.JNode) {
-    fh, serr := os.Stat( configPath )
-    if serr != nil {
+func loadCFPasses( configPath string ) map[string] string {
+    passes, err := readCFPasses( configPath )
+    if err != nil {
         log.WithFields( log.Fields{
             "type":        "err_read_config",
-            "error":       serr,
+            "error":       err,
             "config_path": configPath,
         } ).Fatal(
             "Could not read ControlFloor auth token. Have you run `./main register`?",
         )
     }
-    configFile := configPath
-    switch mode := fh.Mode(); {
-        case mode.IsDir(): configFile = fmt.Sprintf("%s/config.json", configPath)
-    }
-    content, err := ioutil.ReadFile( configFile )
-    if err != nil { log.Fatal( err ) }
-	
-    root, _, perr := uj.ParseFull( content )
-    if perr != nil {
-        log.WithFields( log.Fields{
-            "error": perr,
-        } ).Fatal(
-            "ControlFloor auth token is invalid. Rerun `./main register`",
-        )
+    return passes
+}
+
+// baseNotify queues a state update for ControlFloor, replacing any update
+// of the same variant for the device that has not been sent yet.
+func (self *ControlFloor) baseNotify( name string, udid string, variant string, vals url.Values ) {
+    for _, srv := range self.targets() {
+        srv.notifyQueue.add( name, udid, variant, vals, true )
     }
-    
-    return root
 }
 
-func writeCFConfig( configPath string, pass string ) {
-    bytes := []byte(fmt.Sprintf("{pass:\"%s\"}\n",pass))
-    err := ioutil.WriteFile( configPath, bytes, 0644)
-    if err != nil {
-        panic( err )
+// eventNotify queues an update that is sent even if another of the same
+// variant follows it.
+func (self *ControlFloor) eventNotify( name string, udid string, variant string, vals url.Values ) {
+    for _, srv := range self.targets() {
+        srv.notifyQueue.add( name, udid, variant, vals, false )
     }
 }
 
-func (self *ControlFloor) baseNotify( name string, udid string, variant string, vals url.Values ) {
-    ok := self.checkLogin()
-    if ok == false {
-        panic("Could not login when attempting '" + name + "' notify")
+// postNotify sends one queued update. An error other than NotifyRejected
+// means it should be tried again later.
+func (self *CFServer) postNotify( item *NotifyItem ) error {
+    if !self.checkLogin() {
+        return errors.New("could not login")
     }
     
-    resp, err := self.client.PostForm( self.base + "/provider/device/status/" + variant, vals )
+    resp, err := self.httpClient().PostForm( self.base + "/provider/device/status/" + item.Variant, item.Vals )
     if err != nil {
-        panic( err )
+        return err
     }
     
     // Ensure the request is closed out
     defer resp.Body.Close()
     ioutil.ReadAll(resp.Body)
     
-    if resp.StatusCode != 200 {
+    status := resp.StatusCode
+    if status == 302 || status == 401 || status == 403 {
+        // Sent to the login page; the session is gone
+        self.lock.Lock()
+        self.ready = false
+        self.lock.Unlock()
+        return fmt.Errorf( "not logged in (status %d)", status )
+    }
+    if status >= 500 {
+        return fmt.Errorf( "server error (status %d)", status )
+    }
+    if status != 200 {
         log.WithFields( log.Fields{
             "type": "cf_notify_fail",
-            "variant": variant,
-            "udid": censorUuid( udid ),
-            "values": vals,
-            "httpStatus": resp.StatusCode,
-        } ).Error( fmt.Sprintf("Failure notifying CF of %s", name) )
-    } else {
-        log.WithFields( log.Fields{
-            "type": "cf_notify",
-            "name": name,
-            "udid": censorUuid( udid ),
-            "values": vals,
-        } ).Info( fmt.Sprintf("Notifying CF of %s", name) )
+            "server": self.name,
+            "variant": item.Variant,
+            "udid": censorUuid( item.Udid ),
+            "values": item.Vals,
+            "httpStatus": status,
+        } ).Error( fmt.Sprintf("Failure notifying CF of %s", item.Name) )
+        return &NotifyRejected{ status: status }
     }
+    
+    log.WithFields( log.Fields{
+        "type": "cf_notify",
+        "server": self.name,
+        "name": item.Name,
+        "udid": censorUuid( item.Udid ),
+        "values": item.Vals,
+        "queued": time.Since( item.Queued ).Milliseconds(),
+    } ).Info( fmt.Sprintf("Notifying CF of %s", item.Name) )
+    return nil
 }
 
 func productTypeToCleanName( prodType string ) string {
@@ -654,6 +569,41 @@ func (self *ControlFloor) notifyCfaStarted( udid string ) {
     } )
 }
 
+func (self *ControlFloor) notifyCfaDegraded( udid string, reason string ) {
+    self.baseNotify("CFA degraded", udid, "cfaDegraded", url.Values{
+        "udid":   {udid},
+        "reason": {reason},
+    } )
+}
+
+func (self *ControlFloor) notifyCfaHealthy( udid string ) {
+    self.baseNotify("CFA healthy", udid, "cfaHealthy", url.Values{
+        "udid": {udid},
+    } )
+}
+
+func (self *ControlFloor) notifyUiChanged( udid string, bundleId string, reason string, changes string, truncated bool ) {
+    self.eventNotify("UI change", udid, "uiChanged", url.Values{
+        "udid":      {udid},
+        "bundleId":  {bundleId},
+        "reason":    {reason},
+        "changes":   {changes},
+        "truncated": {strconv.FormatBool( truncated )},
+    } )
+}
+
+func (self *ControlFloor) notifyLease( udid string, user string, state string, end time.Time ) {
+    vals := url.Values{
+        "udid":  {udid},
+        "user":  {user},
+        "state": {state},
+    }
+    if !end.IsZero() {
+        vals.Set( "expires", strconv.FormatInt( end.Unix(), 10 ) )
+    }
+    self.eventNotify("lease " + state, udid, "lease", vals )
+}
+
 func (self *ControlFloor) notifyVideoStopped( udid string ) {
     self.baseNotify("video stop", udid, "videoStopped", url.Values{
         "udid": {udid},
@@ -666,7 +616,19 @@ func (self *ControlFloor) notifyVideoStarted( udid string ) {
     } )
 }
 
-func (self *ControlFloor) checkLogin() (bool) {
+// notifyVideoSource tells of a change in where a device's video comes from.
+// source is blank when state is "dark".
+func (self *ControlFloor) notifyVideoSource( udid string, source string, from string, state string, reason string ) {
+    self.eventNotify("video source " + state, udid, "videoSource", url.Values{
+        "udid":   {udid},
+        "source": {source},
+        "from":   {from},
+        "state":  {state},
+        "reason": {reason},
+    } )
+}
+
+func (self *CFServer) checkLogin() (bool) {
     self.lock.Lock()
     ready := self.ready
     self.lock.Unlock()
@@ -674,10 +636,10 @@ func (self *ControlFloor) checkLogin() (bool) {
     return self.login()
 }
 
-func (self *ControlFloor) login() (bool) {
+func (self *CFServer) login() (bool) {
     self.lock.Lock()
     
-    user := self.config.cfUsername
+    user := self.username
     pass := self.pass
     
     resp, err := self.client.PostForm( self.base + "/provider/login",
@@ -693,7 +655,7 @@ func (self *ControlFloor) login() (bool) {
             if errors.As( urlError, &netOpError ) {
                 rootErr := netOpError.Err
                 if( rootErr.Error() == "connect: connection refused" ) {
-                    fmt.Printf("Could not connect to ControlFarm; is it running?\n")
+                    fmt.Printf("Could not connect to ControlFloor %s; is it running?\n", self.name )
                 } else {
                     fmt.Printf("Err type:%s - %s\n", reflect.TypeOf(err), err )
                     fmt.Printf("urlError type:%s - %s\n", reflect.TypeOf(urlError), urlError );
@@ -718,7 +680,7 @@ func (self *ControlFloor) login() (bool) {
     success := false
     if resp.StatusCode != 302 {
         success = false
-        fmt.Printf("StatusCode from controlfloor login:'%d'\n", resp.StatusCode )
+        fmt.Printf("StatusCode from controlfloor %s login:'%d'\n", self.name, resp.StatusCode )
     } else {
         loc, _ := resp.Location()
         
@@ -726,7 +688,7 @@ func (self *ControlFloor) login() (bool) {
         if q != "fail=1" {
             success = true
         } else {
-            fmt.Printf("Location from redirect of controlfloor login:'%s'\n", loc )
+            fmt.Printf("Location from redirect of controlfloor %s login:'%s'\n", self.name, loc )
         }
     }
     
@@ -739,62 +701,3 @@ func (self *ControlFloor) login() (bool) {
     self.lock.Unlock()
     return true
 }
-
-func doregister( config *Config ) (string) {
-    // query cli for registration password
-    reader := bufio.NewReader( os.Stdin )
-    fmt.Print("Enter registration password:")
-    regPass, _ := reader.ReadString('\n')
-    if regPass == "\n" {
-        regPass = "doreg"
-        fmt.Printf("Using default registration password of %s\n", regPass)
-    }
-    
-    username := config.cfUsername
-    // send registration to control floor with id and public key
-    protocol := "http"
-    if config.https {
-        protocol = "https"
-    }
-    resp, err := http.PostForm( protocol + "://" + config.cfHost + "/provider/register",
-        url.Values{
-            "regPass": {regPass},
-            "username": {username},
-        },
-    )
-    if err != nil {
-        panic( err )
-    }
-    if resp.Body == nil {
-        panic("registration respond body is empty")
-    }
-    defer resp.Body.Close()
-    
-    body, readErr := ioutil.ReadAll( resp.Body )
-    if readErr != nil {
-        panic( readErr )
-    }
-    
-    //fmt.Println( string(body) )
-    root, _ := uj.Parse( body )
-    
-    sNode := root.Get("Success")
-    if sNode == nil {
-        panic( "No Success node in registration result" )
-    }
-    success := sNode.Bool()
-    if !success {
-        panic("Registration failed")
-    }
-    
-    existed := root.Get("Existed").Bool()
-    pass := root.Get("Password").String()
-    fmt.Printf("Registered and got password %s\n", pass)
-    if existed {
-        fmt.Printf("User %s existed so password was renewed\n", username )
-    }
-    
-    writeCFConfig( "cf.json", pass )
-            
-    return pass
-}
@@ -0,0 +1,247 @@
+package main
+
+import (
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// newMockedCF starts a mock ControlFloor and a provider connection to it.
+func newMockedCF( t *testing.T ) ( *CFMock, *ControlFloor ) {
+    t.Helper()
+    mock, err := NewCFMock( "127.0.0.1:0" )
+    if err != nil {
+        t.Fatal( err )
+    }
+    mock.addUser( "first", "secret" )
+
+    config := &Config{
+        cfMode: CF_MODE_FAILOVER,
+        cfServers: []CFServerConfig{
+            { name: "mock", host: mock.host, username: "first" },
+        },
+    }
+    cf, stopCf, cfReady := newControlFloor( config, map[string] string{ "mock": "secret" } )
+    cf.DevTracker = &DeviceTracker{ lock: &sync.Mutex{}, DevMap: map[string] *Device{} }
+    select {
+        case <- cfReady:
+        case <- time.After( 5 * time.Second ):
+            t.Fatal( "provider never logged in" )
+    }
+    if err := mock.waitConnected( 1, 5 * time.Second ); err != nil {
+        t.Fatal( err )
+    }
+
+    t.Cleanup( func() {
+        stopCf <- true
+        mock.close()
+        for _, srv := range cf.servers {
+            srv.notifyQueue.stop()
+        }
+    } )
+    return mock, cf
+}
+
+func TestCFLogin( t *testing.T ) {
+    mock, cf := newMockedCF( t )
+    srv := cf.servers[0]
+
+    if !srv.login() {
+        t.Fatal( "login with the right password failed" )
+    }
+
+    mock.failLogins( 1 )
+    if srv.login() {
+        t.Error( "login succeeded through fail=1" )
+    }
+    if srv.isReady() {
+        t.Error( "still ready after a failed login" )
+    }
+    if !srv.login() {
+        t.Error( "login failed after the failure passed" )
+    }
+
+    mock.addUser( "first", "changed" )
+    if srv.login() {
+        t.Error( "login succeeded with the wrong password" )
+    }
+}
+
+func TestCFNotify( t *testing.T ) {
+    mock, cf := newMockedCF( t )
+    udid := "00000000-0000-0000-0000-000000000001"
+
+    cf.notifyCfaStarted( udid )
+    notes, err := mock.waitNotes( "cfaStarted", 1, 3 * time.Second )
+    if err != nil {
+        t.Fatal( err )
+    }
+    if notes[0].Udid != udid {
+        t.Errorf( "notification for %s, expected %s", notes[0].Udid, udid )
+    }
+
+    // Server errors are retried
+    mock.fail( "/provider/device/status/", 500, 2 )
+    cf.notifyCfaStopped( udid )
+    if _, err := mock.waitNotes( "cfaStopped", 1, 8 * time.Second ); err != nil {
+        t.Error( err )
+    }
+
+    // A forgotten session is logged in again
+    mock.expireSessions()
+    cf.notifyWdaStopped( udid )
+    if _, err := mock.waitNotes( "wdaStopped", 1, 5 * time.Second ); err != nil {
+        t.Error( err )
+    }
+
+    // A refusal is not retried
+    mock.fail( "/provider/device/status/videoStarted", 400, 1 )
+    cf.notifyVideoStarted( udid )
+    cf.notifyVideoStopped( udid )
+    if _, err := mock.waitNotes( "videoStopped", 1, 5 * time.Second ); err != nil {
+        t.Error( err )
+    }
+    if notes := mock.received( "videoStarted" ); len( notes ) != 0 {
+        t.Errorf( "refused notification was sent %d times", len( notes ) )
+    }
+    // The last send is taken off the queue just after the mock has it
+    metrics := cf.servers[0].notifyQueue.getMetrics()
+    for i := 0; i < 50 && metrics.Depth > 0; i++ {
+        time.Sleep( 20 * time.Millisecond )
+        metrics = cf.servers[0].notifyQueue.getMetrics()
+    }
+    if metrics.Dropped != 1 || metrics.Depth != 0 {
+        t.Errorf( "unexpected queue metrics %+v", metrics )
+    }
+}
+
+func TestCFCommands( t *testing.T ) {
+    mock, _ := newMockedCF( t )
+
+    reply, err := mock.command( "ping", nil, 3 * time.Second )
+    if err != nil {
+        t.Fatal( err )
+    }
+    if reply.Get("text").String() != "pong" || !reply.Get("ok").Bool() {
+        t.Errorf( "bad ping reply %s", reply.JsonSave() )
+    }
+
+    reply, err = mock.command( "click", map[string] interface{}{ "udid": "nope", "x": 1, "y": 2 }, 3 * time.Second )
+    if err != nil {
+        t.Fatal( err )
+    }
+    if reply.Get("ok").Bool() || reply.Get("code").String() != CF_ERR_NODEV {
+        t.Errorf( "click on a missing device gave %s", reply.JsonSave() )
+    }
+
+    if err := mock.send( "not json" ); err != nil {
+        t.Fatal( err )
+    }
+    replies, err := mock.waitReplies( 1, 3 * time.Second )
+    if err != nil {
+        t.Fatal( err )
+    }
+    if !strings.Contains( replies[0], CF_ERR_MESSAGE ) {
+        t.Errorf( "bad message gave %s", replies[0] )
+    }
+}
+
+func TestCFReconnect( t *testing.T ) {
+    mock, _ := newMockedCF( t )
+
+    // The first attempt to log back in is refused
+    mock.failLogins( 1 )
+    mock.dropSocket()
+    if err := mock.waitConnected( 2, 10 * time.Second ); err != nil {
+        t.Fatal( err )
+    }
+
+    // A socket refused outright is retried
+    mock.fail( "/provider/ws", 500, 1 )
+    mock.dropSocket()
+    if err := mock.waitConnected( 3, 10 * time.Second ); err != nil {
+        t.Fatal( err )
+    }
+
+    if _, err := mock.command( "ping", nil, 3 * time.Second ); err != nil {
+        t.Error( err )
+    }
+}
+
+func TestCFVideoChannel( t *testing.T ) {
+    mock, cf := newMockedCF( t )
+    udid := "00000000-0000-0000-0000-000000000001"
+
+    conn := cf.servers[0].connectVidChannel( udid, "viewer1" )
+    if conn == nil {
+        t.Fatal( "could not open a video channel" )
+    }
+    defer conn.Close()
+
+    vid, err := mock.waitVid( udid, "viewer1", 3 * time.Second )
+    if err != nil {
+        t.Fatal( err )
+    }
+    sub := &VidSubscriber{ conn: conn, lock: &sync.Mutex{} }
+    if err := sub.write( &VidFrame{ text: "{}", data: []byte{ 1, 2, 3 } } ); err != nil {
+        t.Fatal( err )
+    }
+    err = mock.waitFor( 3 * time.Second, func() bool { return vid.Frames == 1 } )
+    if err != nil {
+        t.Errorf( "mock got %d frames", mock.frames( vid ) )
+    }
+}
+
+func TestCFHeartbeat( t *testing.T ) {
+    mock, cf := newMockedCF( t )
+
+    if err := cf.sendHeartbeat( &ProviderHealth{ Version: "test" } ); err != nil {
+        t.Fatal( err )
+    }
+    notes, err := mock.waitNotes( "heartbeat", 1, 3 * time.Second )
+    if err != nil {
+        t.Fatal( err )
+    }
+    if !strings.Contains( notes[0].Vals.Get("health"), `"version":"test"` ) {
+        t.Errorf( "heartbeat sent %s", notes[0].Vals.Get("health") )
+    }
+
+    mock.fail( "/provider/heartbeat", 500, 1 )
+    if err := cf.sendHeartbeat( &ProviderHealth{} ); err == nil {
+        t.Error( "failed heartbeat gave no error" )
+    }
+}
+
+func TestCFRegister( t *testing.T ) {
+    mock, err := NewCFMock( "127.0.0.1:0" )
+    if err != nil {
+        t.Fatal( err )
+    }
+    defer mock.close()
+    conf := CFServerConfig{ name: "mock", host: mock.host, username: "second" }
+
+    if _, err := registerServer( conf, "wrong" ); err == nil {
+        t.Error( "registered with the wrong registration password" )
+    }
+    pass, err := registerServer( conf, CF_DEFAULT_REGPASS )
+    if err != nil {
+        t.Fatal( err )
+    }
+
+    srv := NewCFServer( nil, conf, pass, "" )
+    if !srv.login() {
+        t.Fatal( "could not login with the registered password" )
+    }
+    root, err := srv.call( "/provider/rotatePass", nil )
+    if err != nil {
+        t.Fatal( err )
+    }
+    if srv.login() {
+        t.Error( "old password still works after rotating" )
+    }
+    srv.pass = root.Get("Password").String()
+    if !srv.login() {
+        t.Error( "rotated password does not work" )
+    }
+}
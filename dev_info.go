@@ -12,7 +12,7 @@ func getDeviceName( bridge BridgeDev ) (string) {
 }
 
 func getAllDeviceInfo( bridge BridgeDev ) map[string] string {
-    mainKeys := "DeviceName,EthernetAddress,ModelNumber,HardwareModel,PhoneNumber,ProductType,ProductVersion,UniqueDeviceID,InternationalCircuitCardIdentity,InternationalMobileEquipmentIdentity,InternationalMobileSubscriberIdentity"
+    mainKeys := "DeviceName,EthernetAddress,ModelNumber,HardwareModel,PhoneNumber,ProductType,ProductVersion,UniqueDeviceID,InternationalCircuitCardIdentity,InternationalMobileEquipmentIdentity,InternationalMobileSubscriberIdentity,RegionInfo"
     keyArr := strings.Split( mainKeys, "," )
     return bridge.info( keyArr )
 }
@@ -1,23 +1,19 @@
 package main
 
 import (
+    "errors"
     "fmt"
     "strings"
     "strconv"
     "sync"
     "time"
-    log "github.com/sirupsen/logrus"
     ws "github.com/gorilla/websocket"
+    log "github.com/sirupsen/logrus"
     uj "github.com/nanoscopic/ujsonin/v2/mod"
 )
 
 const (
-    VID_NONE = iota
-    VID_APP
-    VID_BRIDGE
-    VID_WDA
-    VID_CFA
-    VID_ENABLE
+    VID_ENABLE = iota
     VID_DISABLE
     VID_END
 )
@@ -27,6 +23,9 @@ const (
     DEV_CFA_START
     DEV_CFA_START_ERR
     DEV_CFA_STOP
+    DEV_CFA_RECONNECT
+    DEV_CFA_DEGRADED
+    DEV_CFA_HEALTHY
     DEV_WDA_START
     DEV_WDA_START_ERR
     DEV_WDA_STOP
@@ -55,14 +54,27 @@ type Device struct {
     productNum      string
     vidWidth        int
     vidHeight       int
-    vidMode         int
+    width           int
+    height          int
+    clickWidth      int
+    clickHeight     int
+    artworkTraits   uj.JNode
     process         map[string] *GenericProc
-    owner           string
+    owner           string // user holding the lease, if any
+    leaseEnd        time.Time
+    leaseTimer      *time.Timer
     connected       bool
     EventCh         chan DevEvent
     BackupCh        chan BackupEvent     
     CFAFrameCh      chan BackupEvent
     cfa             *CFA
+    cfaQueue        *CFAQueue
+    uiWatch         *UIWatcher
+    recorder        *InputRecorder
+    vidRec          *VidRecorder
+    vidRecSub       *VidSubscriber
+    vidRecLock      *sync.Mutex
+    preroll         *VidPreroll
     wda             *WDA
     cfaRunning      bool
     wdaRunning      bool
@@ -73,13 +85,19 @@ type Device struct {
     info            map[string] string
     vidStreamer     VideoStreamer
     appStreamStopChan chan bool
-    vidOut          *ws.Conn
+    vidCast         *VidBroadcaster
+    vidAdapt        *VidAdapter
+    vidDedup        *VidDedup
+    vidSource       *VidSourceMachine
+    vidViewers      map[string] *VidViewer // by vidViewerKey
     bridge          BridgeDev
     backupVideo     BackupVideo
-    backupActive    bool
     shuttingDown    bool
     alertMode       bool
     vidUp           bool
+    vidRunning      bool // ControlFloor was told video started
+    lastErr         string
+    lastErrAt       time.Time
 }
 
 func NewDevice( config *Config, devTracker *DeviceTracker, udid string, bdev BridgeDev ) (*Device) {
@@ -90,10 +108,8 @@ func NewDevice( config *Config, devTracker *DeviceTracker, udid string, bdev Bri
         cfaNngPort2:     devTracker.getPort(),
         vidPort:         devTracker.getPort(),
         vidLogPort:      devTracker.getPort(),
-        vidMode:         VID_NONE,
         vidControlPort:  devTracker.getPort(),
         backupVideoPort: devTracker.getPort(),
-        backupActive:    false,
         config:          config,
         udid:            udid,
         lock:            &sync.Mutex{},
@@ -102,10 +118,14 @@ func NewDevice( config *Config, devTracker *DeviceTracker, udid string, bdev Bri
         EventCh:         make( chan DevEvent ),
         BackupCh:        make( chan BackupEvent ),
         CFAFrameCh:      make( chan BackupEvent ),
+        cfaQueue:        NewCFAQueue( udid ),
         bridge:          bdev,
         cfaRunning:      false,
         versionParts:    []int{0,0,0},
+        vidViewers:      make( map[string] *VidViewer ),
+        vidRecLock:      &sync.Mutex{},
     }
+    dev.vidCast = NewVidBroadcaster( udid, config.vidViewerQueue, dev.onFirstViewer, dev.onLastViewer )
     if devConfig, ok := config.devs[udid]; ok {
         dev.devConfig = &devConfig
         if devConfig.wdaPort != 0 {
@@ -117,6 +137,23 @@ func NewDevice( config *Config, devTracker *DeviceTracker, udid string, bdev Bri
     } else {
         dev.wdaPort = devTracker.getPort()
     }
+    adaptConf := config.vidAdapt
+    if dev.devConfig != nil {
+        adaptConf = dev.devConfig.vidAdapt
+    }
+    dev.vidAdapt = NewVidAdapter( udid, adaptConf, dev.vidCast, dev.onVidLevel )
+    dev.vidDedup = NewVidDedup( config.vidDedup, config.vidKeyframe )
+    dev.vidSource = NewVidSourceMachine( udid, dev.vidSourceChain(), config.vidStall, config.vidProbe,
+        func() bool { return dev.vidCast.viewers() > 0 }, dev.onVidSource )
+    dev.addVidSources()
+    if config.uiEvents {
+        dev.uiWatch = NewUIWatcher( &dev, config.uiSettle, config.uiMaxChanges )
+        dev.cfaQueue.onRun = func( cmd *CFACommand ) {
+            if cmd.priority != CFA_PRI_LOW {
+                dev.uiWatch.poke("input")
+            }
+        }
+    }
     return &dev
 }
 
@@ -149,6 +186,33 @@ func ( self *Device ) stopProc( procName string ) {
     self.lock.Unlock()
 }
 
+// noteError records the latest problem with the device for its health.
+func ( self *Device ) noteError( text string ) {
+    self.lock.Lock()
+    self.lastErr = text
+    self.lastErrAt = time.Now()
+    self.lock.Unlock()
+}
+
+// restartProc restarts a running process by name. It returns false if there
+// is no such process.
+func ( self *Device ) restartProc( procName string ) bool {
+    self.lock.Lock()
+    proc := self.process[ procName ]
+    self.lock.Unlock()
+    if proc == nil || proc.cmd == nil {
+        return false
+    }
+    proc.Restart()
+    return true
+}
+
+// VidViewer is a viewer that asked a ControlFloor server for video.
+type VidViewer struct {
+    srv  *CFServer
+    name string
+}
+
 type BackupEvent struct {
     action int
 }
@@ -161,7 +225,15 @@ type DevEvent struct {
 }
 
 func (self *Device) shutdown() {
+    self.stopVidRecording()
     self.shutdownVidStream()
+    self.vidAdapt.stop()
+    go self.vidSource.stop()
+    self.cfaQueue.stop()
+    if self.uiWatch != nil {
+        self.uiWatch.stop()
+    }
+    self.stopRecording()
   
     go func() { self.endProcs() }()
     
@@ -175,7 +247,7 @@ func (self *Device) shutdown() {
             "proc": proc.name,
             "pid":  proc.pid,
         } ).Info("Shutting down " + proc.name + " process")
-        go func() { proc.Kill() }()
+        go func( proc *GenericProc ) { proc.Kill() }( proc )
     }
 }
 
@@ -186,24 +258,54 @@ func (self *Device) onCfaReady() {
     // start video streaming
     
     self.forwardVidPorts( self.udid, func() {
-        videoMode := self.devConfig.videoMode 
-        if videoMode == "app" {
+        if self.devConfig.videoMode == "app" {
             self.enableAppVideo()
-        } else if videoMode == "cfagent" {
-            self.enableCFAVideo()
-        } else {
-            // TODO error
         }
        
         self.startProcs2()
+        self.vidSource.begin()
     } )
 }
 
+// onCfaReconnect is onCfaReady for a CFAgent that came back after a
+// restart. The session is already restored and video forwarding is still
+// in place, so only ControlFloor needs to hear about it.
+func (self *Device) onCfaReconnect() {
+    self.cfaRunning = true
+    self.cf.notifyCfaStarted( self.udid )
+}
+
 func (self *Device) onWdaReady() {
     self.wdaRunning = true
     self.cf.notifyWdaStarted( self.udid, self.wdaPort )
 }
 
+// resync repeats to srv everything it has been told about the device, for
+// a ControlFloor that lost it by restarting or never knew it. A video
+// channel that was open is opened again, as the viewer is presumably still
+// watching.
+func (self *Device) resync( srv *CFServer ) {
+    udid := self.udid
+    cf := self.cf.forServer( srv )
+    cf.notifyDeviceExists( udid, self.width, self.height, self.clickWidth, self.clickHeight )
+    cf.notifyDeviceInfo( self, self.artworkTraits )
+    if self.cfaRunning {
+        cf.notifyCfaStarted( udid )
+    }
+    if self.wdaRunning {
+        cf.notifyWdaStarted( udid, self.wdaPort )
+    }
+    if self.vidRunning {
+        cf.notifyVideoStarted( udid )
+    }
+    if src := self.vidSource.stats(); src.State != vidSourceStates[ VSRC_OFF ] {
+        cf.notifyVideoSource( udid, src.Source, "", src.State, "resync" )
+    }
+    for _, viewer := range self.wantedViewers( srv ) {
+        self.startVidStream( srv, viewer )
+    }
+}
+
 func (self *Device) startEventLoop() {
     go func() {
         DEVEVENTLOOP:
@@ -219,23 +321,39 @@ func (self *Device) startEventLoop() {
                     self.onWdaReady()
                 } else if action == DEV_CFA_START_ERR {
                     fmt.Printf("Error starting/connecting to CFA.\n")
+                    self.noteError("CFA failed to start")
                     self.shutdown()
                     break DEVEVENTLOOP
                 } else if action == DEV_CFA_STOP { // CFA stopped
+                    if !self.shuttingDown {
+                        self.noteError("CFA stopped")
+                    }
                     self.cfaRunning = false
                     self.cf.notifyCfaStopped( self.udid )
-                } else if action == DEV_CFA_STOP { // CFA stopped
+                } else if action == DEV_CFA_RECONNECT { // CFA back after a restart
+                    self.onCfaReconnect()
+                } else if action == DEV_CFA_DEGRADED { // CFA missed its pings
+                    self.noteError( "CFA unresponsive: " + event.data )
+                    self.cf.notifyCfaDegraded( self.udid, event.data )
+                } else if action == DEV_CFA_HEALTHY { // CFA answering pings again
+                    self.cf.notifyCfaHealthy( self.udid )
+                } else if action == DEV_WDA_STOP { // WDA stopped
                     self.wdaRunning = false
                     self.cf.notifyWdaStopped( self.udid )
                 } else if action == DEV_VIDEO_START { // first video frame
+                    self.vidRunning = true
                     self.cf.notifyVideoStarted( self.udid )
                     self.onFirstFrame( &event )
+                    go self.startPreroll()
                 } else if action == DEV_VIDEO_STOP {
+                    self.vidRunning = false
                     self.cf.notifyVideoStopped( self.udid )
+                    self.vidSource.fail( VSRC_APP, "video app stream lost" )
                 } else if action == DEV_ALERT_APPEAR {
-                    self.enableBackupVideo()
+                    // The broadcast does not show alerts
+                    self.vidSource.hold( VSRC_SCREENSHOTR, "alert appeared" )
                 } else if action == DEV_ALERT_GONE {
-                    self.disableBackupVideo()
+                    self.vidSource.release("alert gone")
                 } else if action == DEV_APP_CHANGED {
                     self.devAppChanged( event.data ) 
                 }
@@ -298,58 +416,115 @@ func (self *Device) startCFAFrameProvider() {
     }()
 }
 
-func (self *Device) enableDefaultVideo() {
-    videoMode := self.devConfig.videoMode 
-    if videoMode == "app" {
-        self.vidMode = VID_APP
-        self.vidStreamer.forceOneFrame()
-    } else if videoMode == "cfagent" {
-        self.vidMode = VID_CFA
-    } else {
-        // TODO error
+// vidSourceChain is the order in which video sources are tried. The video
+// app is only set up when videoMode is "app".
+func (self *Device) vidSourceChain() []string {
+    names := self.config.vidSources
+    videoMode := ""
+    if self.devConfig != nil {
+        videoMode = self.devConfig.videoMode
+        if self.devConfig.vidSources != nil {
+            names = self.devConfig.vidSources
+        }
     }
+    chain := []string{}
+    for _, name := range names {
+        if name == VSRC_APP && videoMode != "app" {
+            continue
+        }
+        if name != VSRC_APP && name != VSRC_CFA && name != VSRC_SCREENSHOTR {
+            log.WithFields( log.Fields{
+                "type":   "vid_source_unknown",
+                "udid":   censorUuid( self.udid ),
+                "source": name,
+            } ).Warn("Unknown video source")
+            continue
+        }
+        chain = append( chain, name )
+    }
+    return chain
 }
 
-func (self *Device) disableBackupVideo() {
-    fmt.Printf("Sending vid_disable\n")
-    self.BackupCh <- BackupEvent{ action: VID_DISABLE }
-    fmt.Printf("Sent vid_disable\n")
-    self.backupActive = false
-    self.enableDefaultVideo()
-}
-
-func (self *Device) enableBackupVideo() {
-    fmt.Printf("Sending vid_enable\n")
-    self.BackupCh <- BackupEvent{ action: VID_ENABLE }
-    fmt.Printf("Sent vid_enable\n")
-    self.vidMode = VID_BRIDGE
-    self.backupActive = true
-}
-
-func (self *Device) disableCFAVideo() {
-    fmt.Printf("Sending vid_disable\n")
-    self.CFAFrameCh <- BackupEvent{ action: VID_DISABLE }
-    fmt.Printf("Sent vid_disable\n")
-    
-    self.enableDefaultVideo()
+// addVidSources tells vidSource how to start, stop and probe each source.
+// The screenshot sources are started and stopped through their frame
+// providers.
+func (self *Device) addVidSources() {
+    self.vidSource.add( VSRC_APP, &VidSourceFuncs{
+        onStart: func() error {
+            if self.vidStreamer == nil {
+                return errors.New("video app stream not set up")
+            }
+            if !self.vidAppIsAlive() {
+                return errors.New("video app not running")
+            }
+            self.vidStreamer.forceOneFrame()
+            return nil
+        },
+        onProbe: func() bool {
+            return self.vidStreamer != nil && self.vidAppIsAlive()
+        },
+        onPoke: func() {
+            self.vidStreamer.forceOneFrame()
+        },
+    } )
+    self.vidSource.add( VSRC_CFA, &VidSourceFuncs{
+        onStart: func() error {
+            if !self.cfaRunning {
+                return errors.New("CFA not running")
+            }
+            self.CFAFrameCh <- BackupEvent{ action: VID_ENABLE }
+            return nil
+        },
+        onStop: func() {
+            self.CFAFrameCh <- BackupEvent{ action: VID_DISABLE }
+        },
+        onProbe: func() bool {
+            if !self.cfaRunning {
+                return false
+            }
+            pngData, err := self.cfa.Screenshot()
+            return err == nil && len( pngData ) > 0
+        },
+    } )
+    self.vidSource.add( VSRC_SCREENSHOTR, &VidSourceFuncs{
+        onStart: func() error {
+            if self.backupVideo == nil {
+                return errors.New("backup video not set up")
+            }
+            self.BackupCh <- BackupEvent{ action: VID_ENABLE }
+            return nil
+        },
+        onStop: func() {
+            self.BackupCh <- BackupEvent{ action: VID_DISABLE }
+        },
+        onProbe: func() bool {
+            pngData, _ := self.getBackupFrame()
+            return len( pngData ) > 0
+        },
+    } )
 }
 
-func (self *Device) enableCFAVideo() {
-    fmt.Printf("Sending vid_enable\n")
-    self.CFAFrameCh <- BackupEvent{ action: VID_ENABLE }
-    fmt.Printf("Sent vid_enable\n")
-    self.vidMode = VID_CFA
-    self.backupActive = true
+// onVidSource passes a change of video source on to ControlFloor.
+func (self *Device) onVidSource( ev VidSourceEvent ) {
+    // Frames from the new source are encoded differently
+    self.vidDedup.reset()
+    if ev.State == vidSourceStates[ VSRC_DARK ] {
+        self.noteError( "No video source: " + ev.Reason )
+    }
+    self.cf.notifyVideoSource( self.udid, ev.To, ev.From, ev.State, ev.Reason )
 }
 
 func (self *Device) sendBackupFrame() {
-    vidOut := self.vidOut
-    if vidOut != nil {
+    if self.vidCast.count() > 0 {
+        self.vidAdapt.pace()
         fmt.Printf("Fetching frame - ")
         pngData := self.backupVideo.GetFrame()
         fmt.Printf("%d bytes\n", len( pngData ) )
-        if( len( pngData ) > 0 ) {
-            vidOut.WriteMessage( ws.BinaryMessage, pngData )
+        if len( pngData ) == 0 || !self.vidSource.frame( VSRC_SCREENSHOTR ) {
+            return
+        }
+        if self.vidDedup.fresh( frameKey( pngData ) ) {
+            self.vidCast.publish( "", self.vidAdapt.resample( pngData ) )
         }
     } else {
         time.Sleep( time.Millisecond * 100 )
@@ -357,12 +532,24 @@ func (self *Device) sendBackupFrame() {
 }
 
 func (self *Device) sendCFAFrame() {
-    vidOut := self.vidOut
-    if vidOut != nil {
-        pngData := self.cfa.Screenshot()
+    if self.vidCast.count() > 0 {
+        self.vidAdapt.pace()
+        pngData, err := self.cfa.Screenshot()
+        if err != nil {
+            log.WithFields( log.Fields{
+                "type": "cfa_frame_fail",
+                "udid": censorUuid( self.udid ),
+                "err":  err,
+            } ).Warn("Could not fetch CFA frame")
+            time.Sleep( time.Millisecond * 100 )
+            return
+        }
         //fmt.Printf("%d bytes\n", len( pngData ) )
-        if( len( pngData ) > 0 ) {
-            vidOut.WriteMessage( ws.BinaryMessage, pngData )
+        if len( pngData ) == 0 || !self.vidSource.frame( VSRC_CFA ) {
+            return
+        }
+        if self.vidDedup.fresh( frameKey( pngData ) ) {
+            self.vidCast.publish( "", self.vidAdapt.resample( pngData ) )
         }
     } else {
         time.Sleep( time.Millisecond * 100 )
@@ -387,8 +574,15 @@ func (self *Device) stopEventLoop() {
 }
 
 func (self *Device) startup() {
+    self.cfaQueue.start()
+    go self.vidAdapt.run()
+    go self.vidSource.run()
     self.startEventLoop()
     self.startProcs()
+    // The video app can only be started once it is up; see DEV_VIDEO_START
+    if self.devConfig == nil || self.devConfig.videoMode != "app" {
+        self.startPreroll()
+    }
 }
 
 func (self *Device) startBackupVideo() {
@@ -404,6 +598,10 @@ func (self *Device) devAppChanged( bundleId string ) {
     }
     
     self.cfa.AppChanged( bundleId )
+    
+    if self.uiWatch != nil {
+        self.uiWatch.appChanged( bundleId )
+    }
 }
 
 func (self *Device) startProcs() {
@@ -441,8 +639,10 @@ func (self *Device) startProcs() {
                                 alert.match, alert.response )
                             if self.cfaRunning {
                                 useAlertMode = false
-                                btn := self.cfa.GetEl( "button", alert.response, true, 0 )
-                                if btn == "" {
+                                btn, err := self.cfa.GetEl( "button", alert.response, true, 0 )
+                                if err != nil {
+                                    fmt.Printf("Could not look up alert button \"%s\": %s\n", alert.response, err )
+                                } else if btn == "" {
                                     fmt.Printf("Alert does not contain button \"%s\"\n", alert.response )
                                 } else {
                                     self.cfa.ElClick( btn )
@@ -528,7 +728,6 @@ func (self *Device) enableAppVideo() {
     
     // if it is running, go ahead and use it
     /*if vidPid != 0 {
-        self.vidMode = VID_APP
         return
     }*/
     
@@ -558,9 +757,12 @@ func (self *Device) enableAppVideo() {
             panic("Wrong vidstream version")
         }
       
-        self.cfa.StartBroadcastStream( self.config.vidAppName, bid, self.devConfig )
+        err := self.cfa.StartBroadcastStream( self.config.vidAppName, bid, self.devConfig )
+        if err != nil {
+            fmt.Printf("Could not start video app broadcast: %s\n", err )
+            return
+        }
         self.vidUp = true
-        self.vidMode = VID_APP
         return
     }
     
@@ -570,71 +772,160 @@ func (self *Device) enableAppVideo() {
     // install it, then start it
     success := self.bridge.InstallApp( "vidstream.xcarchive/Products/Applications/vidstream.app" )
     if success {
-        self.cfa.StartBroadcastStream( self.config.vidAppName, bid, self.devConfig )
-        self.vidMode = VID_APP
+        err := self.cfa.StartBroadcastStream( self.config.vidAppName, bid, self.devConfig )
+        if err != nil {
+            fmt.Printf("Could not start video app broadcast: %s\n", err )
+            return
+        }
         return
     }
     
     // if video app failed to start or install, just leave backup video running
 }
 
-func (self *Device) justStartBroadcast() {
+func (self *Device) justStartBroadcast() error {
     bid := self.config.vidAppBidPrefix + "." + self.config.vidAppBid
-    self.cfa.StartBroadcastStream( self.config.vidAppName, bid, self.devConfig )
+    return self.cfa.StartBroadcastStream( self.config.vidAppName, bid, self.devConfig )
 }
 
-func (self *Device) startVidStream() {
-    conn := self.cf.connectVidChannel( self.udid )
+// vidViewerKey names a viewer among those of every server.
+func vidViewerKey( srv *CFServer, viewer string ) string {
+    return srv.name + "/" + viewer
+}
+
+// startVidStream opens a video channel to srv for viewer and adds it to the
+// viewers of the device's video.
+func (self *Device) startVidStream( srv *CFServer, viewer string ) error {
+    conn := srv.connectVidChannel( self.udid, viewer )
+    if conn == nil {
+        return fmt.Errorf( "could not connect video channel for %s", censorUuid( self.udid ) )
+    }
     
-    imgData := self.cfa.Screenshot()
-    conn.WriteMessage( ws.BinaryMessage, imgData )
+    key := vidViewerKey( srv, viewer )
+    self.lock.Lock()
+    self.vidViewers[ key ] = &VidViewer{ srv: srv, name: viewer }
+    self.lock.Unlock()
     
-    var controlChan chan int
-    if self.vidStreamer != nil {
-        controlChan = self.vidStreamer.getControlChan()
+    self.watchVidSocket( key, conn )
+    return nil
+}
+
+// addViewer subscribes conn to the device's video under key.
+func (self *Device) addViewer( key string, conn VidConn ) *VidSubscriber {
+    var imgData []byte
+    if self.cfa != nil {
+        imgData, _ = self.cfa.Screenshot()
     }
     
+    sub := self.vidCast.subscribe( key, conn )
+    // The screen may be idle; the next frame goes out even if unchanged
+    self.vidDedup.reset()
+    // Something to look at until the stream gets going
+    if len( imgData ) > 0 {
+        sub.push( &VidFrame{ data: imgData } )
+    }
+    return sub
+}
+
+// watchVidSocket adds a video websocket as a viewer until it is closed.
+func (self *Device) watchVidSocket( key string, conn *ws.Conn ) *VidSubscriber {
+    sub := self.addViewer( key, conn )
+    
     // Necessary so that writes to the socket fail when the connection is lost
     go func() {
         for {
             if _, _, err := conn.NextReader(); err != nil {
-                conn.Close()
+                self.vidCast.unsubscribe( sub )
                 break
             }
         }
     }()
-    
-    self.vidOut = conn
-    
-    imgConsumer := NewImageConsumer( func( text string, data []byte ) (error) {
-        if self.vidMode != VID_APP { return nil }
-        //conn.WriteMessage( ws.TextMessage, []byte( fmt.Sprintf("{\"action\":\"normalFrame\"}") ) )
-        conn.WriteMessage( ws.TextMessage, []byte( text ) )
-        return conn.WriteMessage( ws.BinaryMessage, data )
+    return sub
+}
+
+// onFirstViewer starts the video app streaming to the broadcaster.
+func (self *Device) onFirstViewer() {
+    if self.vidStreamer == nil {
+        return
+    }
+    imgConsumer := NewImageConsumer( func( text string, data []byte, crc string ) (error) {
+        if !self.vidSource.frame( VSRC_APP ) { return nil }
+        if !self.vidAdapt.allow() { return nil }
+        if crc == "" {
+            crc = frameKey( data )
+        }
+        if !self.vidDedup.fresh( crc ) { return nil }
+        // data is in a message that is freed and reused once this returns,
+        // while subscribers write the frame later
+        self.vidCast.publish( text, append( []byte{}, data... ) )
+        return nil
     }, func() {
         // there are no frames to send
     } )
-    
-    if self.vidStreamer != nil {
-        self.vidStreamer.setImageConsumer( imgConsumer )
-        fmt.Printf("Telling video stream to start\n")
-        controlChan <- 1 // start
+    self.vidStreamer.setImageConsumer( imgConsumer )
+    self.vidStreamer.setLevel( self.vidAdapt.level() )
+    fmt.Printf("Telling video stream to start\n")
+    self.vidStreamer.getControlChan() <- 1 // start
+}
+
+// onVidLevel passes a new level from vidAdapt on to the video app.
+func (self *Device) onVidLevel( level VidLevel ) {
+    // The screen at the new level, even if it has not changed
+    self.vidDedup.reset()
+    if self.vidStreamer == nil {
+        return
     }
+    self.vidStreamer.setLevel( level )
 }
 
-func (self *Device) shutdownVidStream() {
-    if self.vidOut != nil {
-        self.stopVidStream()
+// onLastViewer pauses the video app once nobody is watching.
+func (self *Device) onLastViewer() {
+    if self.vidStreamer == nil || self.shuttingDown {
+        return
     }
+    fmt.Printf("Telling video stream to stop\n")
+    self.vidStreamer.getControlChan() <- 2 // stop
+}
+
+func (self *Device) shutdownVidStream() {
+    self.lock.Lock()
+    self.vidViewers = make( map[string] *VidViewer )
+    self.lock.Unlock()
+    self.vidCast.leaveAll()
+    
     ext_id := self.bridge.GetPid("vidstream_ext")
     if ext_id != 0 {
         self.bridge.Kill( ext_id )
     }
 }
 
-func (self *Device) stopVidStream() {
-    self.vidOut = nil
-    self.cf.destroyVidChannel( self.udid )
+func (self *Device) stopVidStream( srv *CFServer, viewer string ) {
+    key := vidViewerKey( srv, viewer )
+    self.lock.Lock()
+    delete( self.vidViewers, key )
+    self.lock.Unlock()
+    self.vidCast.leave( key )
+}
+
+// dropViewers stops video to every viewer of srv.
+func (self *Device) dropViewers( srv *CFServer ) {
+    for _, viewer := range self.wantedViewers( srv ) {
+        self.stopVidStream( srv, viewer )
+    }
+}
+
+// wantedViewers lists the viewers on srv that asked for video and have not
+// stopped it, even if their channel has since been lost.
+func (self *Device) wantedViewers( srv *CFServer ) []string {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    viewers := []string{}
+    for _, viewer := range self.vidViewers {
+        if viewer.srv == srv {
+            viewers = append( viewers, viewer.name )
+        }
+    }
+    return viewers
 }
 
 func (self *Device) forwardVidPorts( udid string, onready func() ) {
@@ -663,142 +954,160 @@ func (self *Device) onFirstFrame( event *DevEvent ) {
     } ).Info("Video - first frame")
 }
 
-func (self *Device) clickAt( x int, y int ) {
-    self.cfa.clickAt( x, y )
+func (self *Device) clickAt( x int, y int ) error {
+    return self.cfa.clickAt( x, y )
 }
 
-func (self *Device) mouseDown( x int, y int ) {
-    self.cfa.mouseDown( x, y )
+func (self *Device) mouseDown( x int, y int ) error {
+    return self.cfa.mouseDown( x, y )
 }
 
-func (self *Device) mouseUp( x int, y int ) {
-    self.cfa.mouseUp( x, y )
+func (self *Device) mouseUp( x int, y int ) error {
+    return self.cfa.mouseUp( x, y )
 }
 
-func (self *Device) hardPress( x int, y int ) {
-    self.cfa.hardPress( x, y )
+func (self *Device) hardPress( x int, y int ) error {
+    return self.cfa.hardPress( x, y )
 }
 
-func (self *Device) longPress( x int, y int, time float64 ) {
-    self.cfa.longPress( x, y, time )
+func (self *Device) longPress( x int, y int, time float64 ) error {
+    return self.cfa.longPress( x, y, time )
 }
 
-func (self *Device) home() {
-    self.cfa.home()
+func (self *Device) home() error {
+    return self.cfa.home()
 }
 
-func findNodeWithAtt( cur uj.JNode, att string, label string ) uj.JNode {
-    lNode := cur.Get(att)
-    if lNode != nil {
-        if lNode.String() == label { return cur }
+// findElements evaluates a selector against the source of the app with pid,
+// or of the whole screen when pid is 0.
+func (self *Device) findElements( sel string, pid int ) ( []*SourceNode, error ) {
+    selector, err := parseSelector( sel )
+    if err != nil {
+        return nil, err
     }
-
-    cNode := cur.Get("c")
-    if cNode == nil { return nil }
-    
-    var gotIt uj.JNode
-    cNode.ForEach( func( child uj.JNode ) {
-        res := findNodeWithAtt( child, att, label )
-        if res != nil { gotIt = res }
-    } )
-    return gotIt
+    var src string
+    if pid != 0 {
+        src, err = self.cfa.ElByPid( pid, true )
+    } else {
+        src, err = self.cfa.SourceJson()
+    }
+    if err != nil {
+        return nil, err
+    }
+    root, err := parseSourceTree( []byte( src ) )
+    if err != nil {
+        return nil, err
+    }
+    return selector.findAll( root ), nil
 }
 
-// Assumes AssistiveTouch is enabled already
-func (self *Device) openAssistiveTouch( pid int32 ) int {
-    y := 0
-    i := 0
-    for {
-        i++
-        if i>10 {
-            fmt.Printf("AssistiveTouch icon did not appear\n")
-            return 0
+// waitForElement fetches source up to tries times until sel matches in it.
+// It returns nil without error if the element never appeared.
+func waitForElement( sel string, tries int, delay time.Duration, fetch func() ( string, error ) ) ( *SourceNode, error ) {
+    selector, err := parseSelector( sel )
+    if err != nil {
+        return nil, err
+    }
+    for i := 0; i < tries; i++ {
+        if i > 0 {
+            time.Sleep( delay )
         }
-        json := self.cfa.ElByPid( int(pid), true )
-        // Todo; element may not be there
-        root, _ := uj.Parse( []byte(json) )
-        btnNode := findNodeWithAtt( root, "label", "AssistiveTouch menu" )
-        if btnNode == nil {
-            time.Sleep( time.Millisecond * 100 )
+        src, err := fetch()
+        if err != nil {
+            return nil, err
+        }
+        root, err := parseSourceTree( []byte( src ) )
+        if err != nil {
             continue
         }
-        x := btnNode.Get("x").Int()
-        y = btnNode.Get("y").Int()
-        x += 20
-        y += 20
-        time.Sleep( time.Millisecond * 100 )
-        self.cfa.clickAt( x / 2, y / 2 )
-        break
+        if node := selector.findFirst( root ); node != nil {
+            return node, nil
+        }
+    }
+    return nil, nil
+}
+
+// Assumes AssistiveTouch is enabled already
+func (self *Device) openAssistiveTouch( pid int32 ) ( int, error ) {
+    btnNode, err := waitForElement( `[label="AssistiveTouch menu"]`, 10, time.Millisecond * 100, func() ( string, error ) {
+        return self.cfa.ElByPid( int(pid), true )
+    } )
+    if err != nil {
+        return 0, err
+    }
+    if btnNode == nil {
+        fmt.Printf("AssistiveTouch icon did not appear\n")
+        return 0, nil
+    }
+    x := btnNode.Frame.X + 20
+    y := btnNode.Frame.Y + 20
+    time.Sleep( time.Millisecond * 100 )
+    if err := self.cfa.clickAt( x / 2, y / 2 ); err != nil {
+        return 0, err
     }
     
-    return y
+    return y, nil
 }
 
-func (self *Device) taskSwitcher() {
+func (self *Device) taskSwitcher() error {
     //self.cfa.Siri("activate assistivetouch")
     
-    self.enableAssistiveTouch()
+    if err := self.enableAssistiveTouch(); err != nil {
+        return err
+    }
     
     _, pid := self.isAssistiveTouchEnabled()
     
-    y := self.openAssistiveTouch( pid )
+    y, err := self.openAssistiveTouch( pid )
+    if err != nil {
+        return err
+    }
     
-    i := 0
-    for {
-        i++
-        if i>10 {
-            fmt.Printf("Could not find multitasking button")
-            return
-        }
-        
-        // TODO don't use hardcoded screen center
-        atJson := self.cfa.AppAtPoint( 187, y/2, true, true, false )
-        fmt.Println( atJson )
-        
-        root2, _ := uj.Parse( []byte(atJson) )
-        taskNode := findNodeWithAtt( root2, "label", "Multitasking" )
-        if taskNode == nil {
-            time.Sleep( time.Millisecond * 100 )
-            continue
-        }
-        x2 := taskNode.Get("x").Int()
-        y2 := taskNode.Get("y").Int()
-        x2 += 20
-        y2 += 20
-        time.Sleep( time.Millisecond * 200 )
-        self.cfa.clickAt( x2 / 2, y2 / 2 )
-        break
+    // TODO don't use hardcoded screen center
+    taskNode, err := waitForElement( `[label="Multitasking"]`, 10, time.Millisecond * 100, func() ( string, error ) {
+        return self.cfa.AppAtPoint( 187, y/2, true, true, false )
+    } )
+    if err != nil {
+        return err
+    }
+    if taskNode == nil {
+        fmt.Printf("Could not find multitasking button")
+        return nil
+    }
+    x2 := taskNode.Frame.X + 20
+    y2 := taskNode.Frame.Y + 20
+    time.Sleep( time.Millisecond * 200 )
+    if err := self.cfa.clickAt( x2 / 2, y2 / 2 ); err != nil {
+        return err
     }
     
     // Todo: Wait for task switcher to actually appear
     //time.Sleep( time.Millisecond * 600 )
     //self.cfa.GetEl("other", "SBSwitcherWindow", false, 1 )
-    i = 0
-    for {
-        i++
-        if i>20 {
-            fmt.Printf("Task Switcher did not appear\n")
-            return
-        }
-        centerScreenJson := self.cfa.AppAtPoint( 187, 333, true, true, true );
-        root3, _ := uj.Parse( []byte(centerScreenJson) )
-        closeBox := findNodeWithAtt( root3, "id", "appCloseBox" )
-        if closeBox != nil { break }
-        time.Sleep( time.Millisecond * 100 )
-        //fmt.Printf("Task switcher appeared\n")
+    closeBox, err := waitForElement( `[id=appCloseBox]`, 20, time.Millisecond * 100, func() ( string, error ) {
+        return self.cfa.AppAtPoint( 187, 333, true, true, true )
+    } )
+    if err != nil {
+        return err
+    }
+    if closeBox == nil {
+        fmt.Printf("Task Switcher did not appear\n")
+        return nil
     }
     
-    self.disableAssistiveTouch()
+    return self.disableAssistiveTouch()
 }
 
-func (self *Device) shake() {
-    self.enableAssistiveTouch()
+func (self *Device) shake() error {
+    if err := self.enableAssistiveTouch(); err != nil {
+        return err
+    }
     
-    self.disableAssistiveTouch()
+    return self.disableAssistiveTouch()
 }
 
-func (self *Device) cc() {
-    self.cfa.OpenControlCenter()
+func (self *Device) cc() error {
+    return self.cfa.OpenControlCenter()
 }
 
 func (self *Device) isAssistiveTouchEnabled() (bool, int32) {
@@ -814,9 +1123,10 @@ func (self *Device) isAssistiveTouchEnabled() (bool, int32) {
     return false, 0
 }
 
-func (self *Device) enableAssistiveTouch() {
+func (self *Device) enableAssistiveTouch() error {
     enabled, _ := self.isAssistiveTouchEnabled()
-    if !enabled { self.toggleAssistiveTouch() }
+    if !enabled { return self.toggleAssistiveTouch() }
+    return nil
     
     /*i := 0
     var pid int32
@@ -839,9 +1149,10 @@ func (self *Device) enableAssistiveTouch() {
     }*/
 }
 
-func (self *Device) disableAssistiveTouch() {
+func (self *Device) disableAssistiveTouch() error {
     enabled, _ := self.isAssistiveTouchEnabled()
-    if enabled { self.toggleAssistiveTouch() }
+    if enabled { return self.toggleAssistiveTouch() }
+    return nil
     
     /*i = 0
     for {
@@ -864,47 +1175,102 @@ func (self *Device) disableAssistiveTouch() {
     }*/
 }
 
-func (self *Device) toggleAssistiveTouch() {
+func (self *Device) toggleAssistiveTouch() error {
     cfa := self.cfa
-    self.cc()
-    shortcutsBtn := cfa.GetEl( "button", "Accessibility Shortcuts", true, 2 )
-    cfa.ElClick( shortcutsBtn )
-    atBtn := cfa.GetEl( "button", "AssistiveTouch", true, 2 )
-    cfa.ElClick( atBtn )
+    if err := self.cc(); err != nil {
+        return err
+    }
+    shortcutsBtn, err := cfa.GetEl( "button", "Accessibility Shortcuts", true, 2 )
+    if err != nil {
+        return err
+    }
+    if err := cfa.ElClick( shortcutsBtn ); err != nil {
+        return err
+    }
+    atBtn, err := cfa.GetEl( "button", "AssistiveTouch", true, 2 )
+    if err != nil {
+        return err
+    }
+    if err := cfa.ElClick( atBtn ); err != nil {
+        return err
+    }
     time.Sleep( time.Millisecond * 100 )
-    cfa.home()
+    if err := cfa.home(); err != nil {
+        return err
+    }
     time.Sleep( time.Millisecond * 300 )
-    cfa.home()
+    return cfa.home()
 }
 
-func (self *Device) iohid( page int, code int ) {
-    self.cfa.ioHid( page, code )
+func (self *Device) iohid( page int, code int ) error {
+    return self.cfa.ioHid( page, code )
 }
 
-func (self *Device) swipe( x1 int, y1 int, x2 int, y2 int, delayBy100 int ) {
+func (self *Device) swipe( x1 int, y1 int, x2 int, y2 int, delayBy100 int ) error {
     delay := float64( delayBy100 ) / 100.0
-    self.cfa.swipe( x1, y1, x2, y2, delay )
+    return self.cfa.swipe( x1, y1, x2, y2, delay )
+}
+
+// keys types a comma separated list of key codes.
+func (self *Device) keys( keys string ) error {
+    if self.cfa == nil {
+        return &CFAError{ Code: CFA_ERR_NOCONN, Action: "keys" }
+    }
+    return self.cfa.keys( parseKeyCodes( keys ) )
+}
+
+func (self *Device) gesture( gesture *Gesture ) error {
+    return self.cfa.gesture( gesture )
 }
 
-func (self *Device) keys( keys string ) {
+// keyDown holds a key, usually a modifier, until keyUp is called for it.
+// key is a modifier name such as "shift" or a HID usage number.
+func (self *Device) keyDown( key string ) error {
+    usage, ok := keyUsageByName( key )
+    if !ok {
+        return fmt.Errorf( "unknown key %s", key )
+    }
+    return self.cfa.keyDown( usage )
+}
+
+func (self *Device) keyUp( key string ) error {
+    usage, ok := keyUsageByName( key )
+    if !ok {
+        return fmt.Errorf( "unknown key %s", key )
+    }
+    return self.cfa.keyUp( usage )
+}
+
+// queueCfa runs action on the device's CFA queue. The returned channel
+// receives the result once it has run, or was cancelled.
+func (self *Device) queueCfa( name string, priority int, session string, action func() error ) chan error {
+    return self.cfaQueue.submit( &CFACommand{
+        name:     name,
+        priority: priority,
+        session:  session,
+        run:      func( *CFACommand ) error { return action() },
+    } )
+}
+
+func parseKeyCodes( keys string ) []int {
     parts := strings.Split( keys, "," )
     codes := []int{}
     for _, key := range parts {
         code, _ := strconv.Atoi( key )
         codes = append( codes, code )
     }
-    self.cfa.keys( codes )
+    return codes
 }
 
-func (self *Device) source() string {
+func (self *Device) source() ( string, error ) {
     return self.cfa.SourceJson()
 }
 
-func (self *Device) WifiIp() string {
+func (self *Device) WifiIp() ( string, error ) {
     return self.cfa.WifiIp()
 }
 
-func (self *Device) AppAtPoint(x int, y int) string {
+func (self *Device) AppAtPoint(x int, y int) ( string, error ) {
     return self.cfa.AppAtPoint(x,y,false,false,false)
 }
 
@@ -921,4 +1287,103 @@ func (self *Device) killBid( bid string ) {
 
 func (self *Device) launch( bid string ) {
     self.bridge.Launch( bid )
-}
\ No newline at end of file
+}
+
+// startRecording begins recording ControlFloor input to this device. It
+// returns the path of the recording.
+func (self *Device) startRecording( name string ) ( string, error ) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.recorder != nil {
+        return "", fmt.Errorf( "already recording to %s", self.recorder.path )
+    }
+    recorder, err := startRecording( self.config.recordPath, self.udid, name )
+    if err != nil {
+        return "", err
+    }
+    self.recorder = recorder
+    return recorder.path, nil
+}
+
+// stopRecording ends the current recording and returns its path and the
+// number of events in it.
+func (self *Device) stopRecording() ( string, int ) {
+    self.lock.Lock()
+    recorder := self.recorder
+    self.recorder = nil
+    self.lock.Unlock()
+    if recorder == nil {
+        return "", 0
+    }
+    return recorder.path, recorder.stop()
+}
+
+// startVidRecording begins recording the device's video, starting with the
+// pre-roll if one is kept. It returns the id of the recording.
+func (self *Device) startVidRecording( name string ) ( string, error ) {
+    self.vidRecLock.Lock()
+    defer self.vidRecLock.Unlock()
+    if self.vidRec != nil && self.vidRec.info().Active {
+        return "", fmt.Errorf( "already recording video to %s", self.vidRec.id )
+    }
+    preroll := []VidTimedFrame{}
+    if self.preroll != nil {
+        preroll = self.preroll.snapshot()
+    }
+    rec, err := self.devTracker.vidRecs.start( self.udid, name, preroll )
+    if err != nil {
+        return "", err
+    }
+    self.vidRec = rec
+    self.vidRecSub = self.vidCast.subscribeSink( "rec:" + rec.id, rec )
+    self.vidDedup.reset()
+    return rec.id, nil
+}
+
+// stopVidRecording ends the current video recording.
+func (self *Device) stopVidRecording() ( VidRecInfo, error ) {
+    self.vidRecLock.Lock()
+    defer self.vidRecLock.Unlock()
+    if self.vidRec == nil {
+        return VidRecInfo{}, errors.New("not recording video")
+    }
+    self.vidCast.unsubscribe( self.vidRecSub )
+    info := self.vidRec.info()
+    self.vidRec, self.vidRecSub = nil, nil
+    return info, nil
+}
+
+// startPreroll keeps the last seconds of video in memory for video
+// recordings to start with. The pre-roll is a viewer of its own, so the
+// video keeps streaming while it is kept.
+func (self *Device) startPreroll() {
+    if self.config.vidRecPreroll <= 0 {
+        return
+    }
+    self.vidRecLock.Lock()
+    if self.preroll != nil {
+        self.vidRecLock.Unlock()
+        return
+    }
+    self.preroll = NewVidPreroll( self.config.vidRecPreroll )
+    self.vidRecLock.Unlock()
+    self.vidCast.subscribeSink( "rec:preroll", self.preroll )
+}
+
+// recordInput adds a ControlFloor message to the current recording, if any.
+func (self *Device) recordInput( mType string, root uj.JNode ) {
+    self.lock.Lock()
+    recorder := self.recorder
+    self.lock.Unlock()
+    if recorder == nil {
+        return
+    }
+    ev, ok := recEventFromMsg( mType, root )
+    if !ok {
+        return
+    }
+    if self.uiWatch != nil && ( ev.X != 0 || ev.Y != 0 ) {
+        ev.El = recElementAt( self.uiWatch.tree(), ev.X, ev.Y )
+    }
+    recorder.record( ev )
+}
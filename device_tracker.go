@@ -29,6 +29,8 @@ type DeviceTracker struct {
     shuttingDown bool
     // only activate the specific list of ids
     idList       []string
+    healthSampler *HealthSampler
+    vidRecs      *VidRecStore
 }
 
 func NewDeviceTracker( config *Config, detect bool, idList []string ) (*DeviceTracker) {
@@ -56,7 +58,11 @@ func NewDeviceTracker( config *Config, detect bool, idList []string ) (*DeviceTr
         cf: cf,
         cfStop: cfStop,
         idList: idList,
+        healthSampler: NewHealthSampler(),
+        vidRecs: NewVidRecStore( config ),
     }
+    // Apply the retention limits to what was left by earlier runs
+    go self.vidRecs.prune()
     
     bridgeCreator := NewIIFBridge
     bridgeCli := config.iosIfPath
@@ -75,6 +81,7 @@ func NewDeviceTracker( config *Config, detect bool, idList []string ) (*DeviceTr
     )
     if detect {
         cf.DevTracker = self
+        go self.heartbeat( config.heartbeatInterval )
     }
     return self
 }
@@ -116,16 +123,40 @@ func (self *DeviceTracker) freePort( port int ) {
 }
 
 func (self *DeviceTracker) getDevice( udid string ) (*Device) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
     return self.DevMap[ udid ]
 }
 
+// devices is a snapshot of the tracked devices, to range over from other
+// goroutines while devices come and go.
+func (self *DeviceTracker) devices() []*Device {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    devs := make( []*Device, 0, len( self.DevMap ) )
+    for _, dev := range self.DevMap {
+        devs = append( devs, dev )
+    }
+    return devs
+}
+
+// cfReady starts the devices held back while logged out of ControlFloor.
+// It may be called by several servers' connect loops at once; each pending
+// device is taken by only one of them.
 func (self *DeviceTracker) cfReady() {
+    self.lock.Lock()
+    pending := self.pendingDevs
+    self.pendingDevs = []BridgeDev{}
+    self.lock.Unlock()
+
+    if len( pending ) == 0 {
+        return
+    }
     fmt.Println("Starting delayed devices:")
-    for _, bdev := range self.pendingDevs {
+    for _, bdev := range pending {
         fmt.Printf("Delayed device - udid: %s\n", bdev.getUdid() )
         self.onDeviceConnect1( bdev )
     }
-    self.pendingDevs = []BridgeDev{}
 }
 
 func (self *DeviceTracker) onDeviceConnect1( bdev BridgeDev ) *Device {
@@ -141,11 +172,16 @@ func (self *DeviceTracker) onDeviceConnect1( bdev BridgeDev ) *Device {
         if !devFound { return nil }
     }
     
-    if !self.cf.ready {
+    // Checked under the lock so that a device is not held back just after
+    // cfReady has taken the pending ones
+    self.lock.Lock()
+    if !self.cf.isReady() {
         self.pendingDevs = append( self.pendingDevs, bdev )
+        self.lock.Unlock()
         fmt.Printf("Device attached, but ControlFloor not ready.\n  udid=%s\n", udid )
         return nil
     }
+    self.lock.Unlock()
     
     //fmt.Printf("udid: %s\n", udid)
     //dev := self.DevMap[ udid ]
@@ -190,6 +226,10 @@ func (self *DeviceTracker) onDeviceConnect1( bdev BridgeDev ) *Device {
         
     self.cf.notifyDeviceExists( udid, width, height, clickWidth, clickHeight )
     dev := self.onDeviceConnect( udid, bdev )
+    // kept to tell ControlFloor again after it reconnects
+    dev.width, dev.height = width, height
+    dev.clickWidth, dev.clickHeight = clickWidth, clickHeight
+    dev.artworkTraits = mgInfo["ArtworkTraits"]
     self.cf.notifyDeviceInfo( dev, mgInfo["ArtworkTraits"] )
     bdev.setProcTracker( self )
     dev.startup()
@@ -198,7 +238,7 @@ func (self *DeviceTracker) onDeviceConnect1( bdev BridgeDev ) *Device {
 
 func (self *DeviceTracker) onDeviceDisconnect1( bdev BridgeDev ) {
     udid := bdev.getUdid()
-    dev := self.DevMap[ udid ]
+    dev := self.getDevice( udid )
     
     self.onDeviceDisconnect( dev )
     dev.stopEventLoop()
@@ -210,12 +250,12 @@ func (self *DeviceTracker) onDeviceDisconnect1( bdev BridgeDev ) {
 func (self *DeviceTracker) shutdown() {
     self.shuttingDown = true
     
-    for _,dev := range self.DevMap {
+    for _,dev := range self.devices() {
         dev.shuttingDown = true
         self.cf.notifyProvisionStopped( dev.udid )
     }
     
-    for _,dev := range self.DevMap {
+    for _,dev := range self.devices() {
         log.WithFields( log.Fields{
             "type": "shutdown_device",
             "uuid": censorUuid( dev.udid ),
@@ -229,7 +269,7 @@ func (self *DeviceTracker) shutdown() {
             "proc": proc.name,
             "pid":  proc.pid,
         } ).Info("Shutting down " + proc.name + " devproc")
-        go func() { proc.Kill() }()
+        go func( proc *GenericProc ) { proc.Kill() }( proc )
     }
     
     go func() { self.cfStop <- true }()
@@ -241,12 +281,13 @@ func (self *DeviceTracker) onDeviceConnect( uuid string, bdev BridgeDev ) (*Devi
         "uuid": censorUuid( uuid ),
     } ).Info("Device Present")
     
-    dev := self.DevMap[ uuid ]
+    dev := self.getDevice( uuid )
     if dev != nil {
         dev.connected = true
         return dev
     }
     dev = NewDevice( self.Config, self, uuid, bdev )
+    dev.connected = true
     bdev.SetDevice( dev )
     
     devInfo := getAllDeviceInfo( bdev )
@@ -280,7 +321,9 @@ func (self *DeviceTracker) onDeviceConnect( uuid string, bdev BridgeDev ) (*Devi
         dev.versionParts[2],_ = strconv.Atoi( minStr )
     }
     
+    self.lock.Lock()
     self.DevMap[ uuid ] = dev
+    self.lock.Unlock()
     return dev
 }
 
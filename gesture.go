@@ -0,0 +1,247 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    uj "github.com/nanoscopic/ujsonin/v2/mod"
+)
+
+const (
+    GESTURE_MAX_TOUCHES = 5
+    GESTURE_MAX_MS      = 30000
+    GESTURE_STEP_MS     = 20 // spacing of generated waypoints
+)
+
+// TouchPoint is a waypoint of one finger; t is ms since the gesture began.
+type TouchPoint struct {
+    x int
+    y int
+    t int
+}
+
+// Gesture is a set of fingers, each following its own path. All paths run
+// at the same time; a finger touches down at its first point and lifts at
+// its last.
+type Gesture struct {
+    kind    string
+    touches [][]TouchPoint
+}
+
+func (self *Gesture) duration() int {
+    dur := 0
+    for _, path := range self.touches {
+        if end := path[ len( path ) - 1 ].t; end > dur {
+            dur = end
+        }
+    }
+    return dur
+}
+
+func (self *Gesture) validate() error {
+    if len( self.touches ) == 0 {
+        return errors.New("gesture has no touches")
+    }
+    if len( self.touches ) > GESTURE_MAX_TOUCHES {
+        return fmt.Errorf( "gesture has %d touches; at most %d are allowed", len( self.touches ), GESTURE_MAX_TOUCHES )
+    }
+    for i, path := range self.touches {
+        if len( path ) == 0 {
+            return fmt.Errorf( "touch %d has no points", i )
+        }
+        last := -1
+        for _, point := range path {
+            if point.t < last {
+                return fmt.Errorf( "touch %d goes back in time at %dms", i, point.t )
+            }
+            if point.x < 0 || point.y < 0 {
+                return fmt.Errorf( "touch %d leaves the screen at %dms", i, point.t )
+            }
+            last = point.t
+        }
+    }
+    if self.duration() > GESTURE_MAX_MS {
+        return fmt.Errorf( "gesture lasts %dms; at most %dms is allowed", self.duration(), GESTURE_MAX_MS )
+    }
+    return nil
+}
+
+/*
+parseGesture reads a gesture from a websocket message or gesture file. Either
+explicit paths are given:
+
+    {
+        touches: [
+            [ { x: 100, y: 400, t: 0 }, { x: 100, y: 200, t: 300 } ]
+            [ { x: 200, y: 400, t: 0 }, { x: 200, y: 200, t: 300 } ]
+        ]
+    }
+
+or kind names a generated gesture along with its parameters:
+
+    pinch:  x, y ( center ), from, to ( finger distance ), ms
+    rotate: x, y ( center ), radius, degrees, ms
+    scroll: x, y ( start ), dx, dy, ms; two fingers side by side
+    drag:   x1, y1, cx, cy ( curve control point ), x2, y2, ms
+    flick:  x, y, vx, vy ( px per second ), ms
+*/
+func parseGesture( root uj.JNode ) ( *Gesture, error ) {
+    if root == nil {
+        return nil, gestureErr( errors.New("no gesture") )
+    }
+
+    kind := "path"
+    if kindNode := root.Get("kind"); kindNode != nil {
+        kind = kindNode.String()
+    }
+
+    num := func( name string, def int ) int {
+        node := root.Get( name )
+        if node == nil {
+            return def
+        }
+        return node.Int()
+    }
+    ms := num( "ms", 300 )
+
+    var gesture *Gesture
+    var err error
+    switch kind {
+        case "path":
+            gesture, err = parseGesturePaths( root.Get("touches") )
+        case "pinch":
+            gesture = gesturePinch( num( "x", 0 ), num( "y", 0 ), num( "from", 0 ), num( "to", 0 ), ms )
+        case "rotate":
+            gesture = gestureRotate( num( "x", 0 ), num( "y", 0 ), num( "radius", 100 ), num( "degrees", 90 ), ms )
+        case "scroll":
+            gesture = gestureScroll( num( "x", 0 ), num( "y", 0 ), num( "dx", 0 ), num( "dy", 0 ), ms )
+        case "drag":
+            gesture = gestureDrag( num( "x1", 0 ), num( "y1", 0 ), num( "cx", 0 ), num( "cy", 0 ), num( "x2", 0 ), num( "y2", 0 ), ms )
+        case "flick":
+            gesture = gestureFlick( num( "x", 0 ), num( "y", 0 ), num( "vx", 0 ), num( "vy", 0 ), num( "ms", 100 ) )
+        default:
+            err = fmt.Errorf( "unknown gesture kind %s", kind )
+    }
+    if err != nil {
+        return nil, gestureErr( err )
+    }
+
+    if err := gesture.validate(); err != nil {
+        return nil, gestureErr( err )
+    }
+    return gesture, nil
+}
+
+func parseGesturePaths( touchesNode uj.JNode ) ( *Gesture, error ) {
+    if touchesNode == nil {
+        return nil, errors.New("touches not set")
+    }
+    gesture := &Gesture{ kind: "path" }
+    var err error
+    touchesNode.ForEach( func( pathNode uj.JNode ) {
+        path := []TouchPoint{}
+        pathNode.ForEach( func( pointNode uj.JNode ) {
+            xNode := pointNode.Get("x")
+            yNode := pointNode.Get("y")
+            if xNode == nil || yNode == nil {
+                err = errors.New("touch point without x or y")
+                return
+            }
+            point := TouchPoint{ x: xNode.Int(), y: yNode.Int() }
+            if tNode := pointNode.Get("t"); tNode != nil {
+                point.t = tNode.Int()
+            }
+            path = append( path, point )
+        } )
+        gesture.touches = append( gesture.touches, path )
+    } )
+    if err != nil {
+        return nil, err
+    }
+    return gesture, nil
+}
+
+func gestureErr( err error ) error {
+    return &CFAError{ Code: CFA_ERR_REQUEST, Action: "gesture", Err: err }
+}
+
+// gesturePath samples fn from 0 to 1 over ms into a path of waypoints.
+func gesturePath( ms int, fn func( f float64 ) ( float64, float64 ) ) []TouchPoint {
+    steps := ms / GESTURE_STEP_MS
+    if steps < 1 {
+        steps = 1
+    }
+    path := []TouchPoint{}
+    for i := 0; i <= steps; i++ {
+        f := float64( i ) / float64( steps )
+        x, y := fn( f )
+        path = append( path, TouchPoint{
+            x: int( math.Round( x ) ),
+            y: int( math.Round( y ) ),
+            t: ms * i / steps,
+        } )
+    }
+    return path
+}
+
+// gesturePinch moves two fingers apart ( from < to ) or together along a
+// horizontal line through x,y.
+func gesturePinch( x int, y int, from int, to int, ms int ) *Gesture {
+    gesture := &Gesture{ kind: "pinch" }
+    for _, side := range []float64{ -1, 1 } {
+        side := side
+        gesture.touches = append( gesture.touches, gesturePath( ms, func( f float64 ) ( float64, float64 ) {
+            dist := float64( from ) + ( float64( to - from ) * f )
+            return float64( x ) + side * dist / 2, float64( y )
+        } ) )
+    }
+    return gesture
+}
+
+// gestureRotate turns two opposite fingers around x,y by degrees; positive
+// is clockwise on screen.
+func gestureRotate( x int, y int, radius int, degrees int, ms int ) *Gesture {
+    gesture := &Gesture{ kind: "rotate" }
+    for _, start := range []float64{ 0, math.Pi } {
+        start := start
+        gesture.touches = append( gesture.touches, gesturePath( ms, func( f float64 ) ( float64, float64 ) {
+            angle := start + float64( degrees ) * f * math.Pi / 180
+            return float64( x ) + float64( radius ) * math.Cos( angle ), float64( y ) + float64( radius ) * math.Sin( angle )
+        } ) )
+    }
+    return gesture
+}
+
+// gestureScroll moves two fingers, 40 pixels apart, by dx,dy.
+func gestureScroll( x int, y int, dx int, dy int, ms int ) *Gesture {
+    gesture := &Gesture{ kind: "scroll" }
+    for _, offset := range []float64{ -20, 20 } {
+        offset := offset
+        gesture.touches = append( gesture.touches, gesturePath( ms, func( f float64 ) ( float64, float64 ) {
+            return float64( x ) + offset + float64( dx ) * f, float64( y ) + float64( dy ) * f
+        } ) )
+    }
+    return gesture
+}
+
+// gestureDrag moves one finger along a quadratic bezier curve.
+func gestureDrag( x1 int, y1 int, cx int, cy int, x2 int, y2 int, ms int ) *Gesture {
+    path := gesturePath( ms, func( f float64 ) ( float64, float64 ) {
+        a := ( 1 - f ) * ( 1 - f )
+        b := 2 * ( 1 - f ) * f
+        c := f * f
+        return a * float64( x1 ) + b * float64( cx ) + c * float64( x2 ),
+            a * float64( y1 ) + b * float64( cy ) + c * float64( y2 )
+    } )
+    return &Gesture{ kind: "drag", touches: [][]TouchPoint{ path } }
+}
+
+// gestureFlick moves one finger at a steady velocity and lifts it while
+// still moving, so that scroll views keep going on momentum.
+func gestureFlick( x int, y int, vx int, vy int, ms int ) *Gesture {
+    secs := float64( ms ) / 1000
+    path := gesturePath( ms, func( f float64 ) ( float64, float64 ) {
+        return float64( x ) + float64( vx ) * secs * f, float64( y ) + float64( vy ) * secs * f
+    } )
+    return &Gesture{ kind: "flick", touches: [][]TouchPoint{ path } }
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+    "fmt"
+    "html"
+    "io"
+    "net/http"
+    "net/url"
+    "sort"
+    "sync"
+    ws "github.com/gorilla/websocket"
+    log "github.com/sirupsen/logrus"
+)
+
+const LIVE_BOUNDARY = "cfframe"
+
+/*
+The live view lets a device's video be watched straight from the provider,
+without ControlFloor, for debugging a provider host or from CI. Local
+viewers subscribe to the same VidBroadcaster as ControlFloor's, so they see
+the same frames and have the same per-viewer queues.
+
+    /live                   index of devices
+    /live/view?udid=...     page showing the websocket stream
+    /live/mjpeg?udid=...    multipart/x-mixed-replace stream
+    /live/ws?udid=...       websocket of binary frames, each preceded by a
+                            text message of metadata when there is any
+*/
+
+// liveViewerKey names a local viewer. It has no slash, so it cannot be
+// mistaken for a ControlFloor viewer.
+func liveViewerKey( kind string, r *http.Request ) string {
+    return fmt.Sprintf( "local:%s-%s", kind, r.RemoteAddr )
+}
+
+func liveDevice( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) *Device {
+    r.ParseForm()
+    udid := r.Form.Get("udid")
+
+    dev := devTracker.getDevice( udid )
+    if dev == nil {
+        http.Error( w, "Could not find device with udid", http.StatusNotFound )
+        return nil
+    }
+    return dev
+}
+
+func onLiveIndex( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    if r.URL.Path != "/live" && r.URL.Path != "/live/" {
+        http.NotFound( w, r )
+        return
+    }
+
+    devs := devTracker.devices()
+    sort.Slice( devs, func( i, j int ) bool { return devs[ i ].udid < devs[ j ].udid } )
+
+    w.Header().Set("Content-Type", "text/html")
+    fmt.Fprintf( w, "<html><head><title>Devices</title></head><body>\n<h3>Devices</h3>\n" )
+    if len( devs ) == 0 {
+        fmt.Fprintf( w, "No devices connected\n" )
+    }
+    fmt.Fprintf( w, "<table>\n" )
+    for _, dev := range devs {
+        query := "udid=" + url.QueryEscape( dev.udid )
+        fmt.Fprintf( w, "<tr><td>%s</td><td>%s</td><td>%d viewers</td>", html.EscapeString( dev.name ), html.EscapeString( dev.udid ), dev.vidCast.viewers() )
+        fmt.Fprintf( w, "<td><a href=\"/live/view?%s\">websocket</a></td><td><a href=\"/live/mjpeg?%s\">mjpeg</a></td></tr>\n", query, query )
+    }
+    fmt.Fprintf( w, "</table>\n</body></html>\n" )
+}
+
+func onLiveView( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    dev := liveDevice( w, r, devTracker )
+    if dev == nil {
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/html")
+    fmt.Fprintf( w, `<html>
+<head>
+  <title>%s</title>
+  <script>
+    function go() {
+      var img = document.getElementById("img");
+      var info = document.getElementById("info");
+      var proto = location.protocol == "https:" ? "wss://" : "ws://";
+      var sock = new WebSocket( proto + location.host + "/live/ws?udid=%s" );
+      sock.binaryType = "blob";
+      sock.onmessage = function( ev ) {
+        if( typeof( ev.data ) == "string" ) {
+          info.textContent = ev.data;
+          return;
+        }
+        var old = img.src;
+        img.src = URL.createObjectURL( ev.data );
+        if( old ) URL.revokeObjectURL( old );
+      };
+      sock.onclose = function() { info.textContent = "Stream closed"; };
+    }
+  </script>
+</head>
+<body onload="go()">
+  <div id="info"></div>
+  <img id="img" style="max-height: 95%%"/>
+</body>
+</html>
+`, html.EscapeString( dev.name ), url.QueryEscape( dev.udid ) )
+}
+
+func onLiveWs( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    dev := liveDevice( w, r, devTracker )
+    if dev == nil {
+        return
+    }
+
+    upgrader := ws.Upgrader{}
+    conn, err := upgrader.Upgrade( w, r, nil )
+    if err != nil {
+        log.WithFields( log.Fields{
+            "type":  "live_ws_fail",
+            "udid":  censorUuid( dev.udid ),
+            "error": err,
+        } ).Warn("Could not open live video websocket")
+        return
+    }
+    dev.watchVidSocket( liveViewerKey( "ws", r ), conn )
+}
+
+func onLiveMjpeg( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    dev := liveDevice( w, r, devTracker )
+    if dev == nil {
+        return
+    }
+    flusher, ok := w.( http.Flusher )
+    if !ok {
+        http.Error( w, "Streaming not supported", http.StatusInternalServerError )
+        return
+    }
+
+    w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=" + LIVE_BOUNDARY )
+    w.Header().Set("Cache-Control", "no-cache, must-revalidate")
+    w.WriteHeader( http.StatusOK )
+    flusher.Flush()
+
+    conn := &MjpegConn{
+        w:        w,
+        flusher:  flusher,
+        lock:     &sync.Mutex{},
+        doneChan: make( chan bool ),
+    }
+    sub := dev.addViewer( liveViewerKey( "mjpeg", r ), conn )
+    select {
+        case <- conn.doneChan:
+        case <- r.Context().Done():
+    }
+    dev.vidCast.unsubscribe( sub )
+}
+
+// MjpegConn is a VidConn writing each frame as one part of a
+// multipart/x-mixed-replace response. Frame metadata is not sent.
+type MjpegConn struct {
+    w         http.ResponseWriter
+    flusher   http.Flusher
+    lock      *sync.Mutex
+    closed    bool
+    doneChan  chan bool
+}
+
+func (self *MjpegConn) WriteMessage( mType int, data []byte ) error {
+    if mType != ws.BinaryMessage {
+        return nil
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    // The handler may have returned once closed, taking the response with it
+    if self.closed {
+        return io.ErrClosedPipe
+    }
+    _, err := fmt.Fprintf( self.w, "--%s\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n",
+        LIVE_BOUNDARY, http.DetectContentType( data ), len( data ) )
+    if err != nil {
+        return err
+    }
+    if _, err := self.w.Write( data ); err != nil {
+        return err
+    }
+    if _, err := self.w.Write( []byte("\r\n") ); err != nil {
+        return err
+    }
+    self.flusher.Flush()
+    return nil
+}
+
+func (self *MjpegConn) Close() error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if !self.closed {
+        self.closed = true
+        close( self.doneChan )
+    }
+    return nil
+}
@@ -2,10 +2,16 @@ package main
 
 import (
     "bytes"
+    "encoding/json"
+    "errors"
     "fmt"
+    "io/ioutil"
+    "net"
     "net/http"
+    "net/url"
     "strconv"
     "strings"
+    "time"
     
     uj "github.com/nanoscopic/ujsonin/v2/mod"
     log "github.com/sirupsen/logrus"
@@ -27,9 +33,70 @@ func startServer( devTracker *DeviceTracker, listen_addr string ) {
     backupFrameClosure := func( w http.ResponseWriter, r *http.Request ) {
         onBackupFrame( w, r, devTracker )
     }
+    cfaQueueClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onCfaQueue( w, r, devTracker )
+    }
+    cfaHealthClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onCfaHealth( w, r, devTracker )
+    }
+    healthClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onHealth( w, r, devTracker )
+    }
+    vidViewersClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onVidViewers( w, r, devTracker )
+    }
+    vidAdaptClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onVidAdapt( w, r, devTracker )
+    }
+    liveIndexClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onLiveIndex( w, r, devTracker )
+    }
+    liveViewClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onLiveView( w, r, devTracker )
+    }
+    liveMjpegClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onLiveMjpeg( w, r, devTracker )
+    }
+    liveWsClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onLiveWs( w, r, devTracker )
+    }
+    vidRecStartClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onVidRecStart( w, r, devTracker )
+    }
+    vidRecStopClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onVidRecStop( w, r, devTracker )
+    }
+    vidRecListClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onVidRecList( w, r, devTracker )
+    }
+    vidRecDownloadClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onVidRecDownload( w, r, devTracker )
+    }
+    cfReloadClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onCfReload( w, r, devTracker )
+    }
+    notifyQueueClosure := func( w http.ResponseWriter, r *http.Request ) {
+        onNotifyQueue( w, r, devTracker )
+    }
     
     http.HandleFunc( "/frame", frameClosure )
     http.HandleFunc( "/backupFrame", backupFrameClosure )
+    http.HandleFunc( "/cfaQueue", cfaQueueClosure )
+    http.HandleFunc( "/cfaHealth", cfaHealthClosure )
+    http.HandleFunc( "/notifyQueue", notifyQueueClosure )
+    http.HandleFunc( "/vidViewers", vidViewersClosure )
+    http.HandleFunc( "/vidAdapt", vidAdaptClosure )
+    http.HandleFunc( "/health", healthClosure )
+    http.HandleFunc( "/cfReload", cfReloadClosure )
+    http.HandleFunc( "/vidRec/start", vidRecStartClosure )
+    http.HandleFunc( "/vidRec/stop", vidRecStopClosure )
+    http.HandleFunc( "/vidRec/list", vidRecListClosure )
+    http.HandleFunc( "/vidRec/download", vidRecDownloadClosure )
+    http.HandleFunc( "/live", liveIndexClosure )
+    http.HandleFunc( "/live/", liveIndexClosure )
+    http.HandleFunc( "/live/view", liveViewClosure )
+    http.HandleFunc( "/live/mjpeg", liveMjpegClosure )
+    http.HandleFunc( "/live/ws", liveWsClosure )
     
     err := http.ListenAndServe( listen_addr, nil )
     log.WithFields( log.Fields{
@@ -53,7 +120,7 @@ func firstFrameJSON( devTracker *DeviceTracker, bytes []byte ) {
             height: height,
         }
         
-        dev := devTracker.DevMap[ uuid ]
+        dev := devTracker.getDevice( uuid )
         dev.EventCh <- devEvent
     } 
 }
@@ -84,8 +151,8 @@ func onBackupFrame( w http.ResponseWriter, r *http.Request, devTracker *DeviceTr
         w.Header().Set("Content-Type", "text/html")
         fmt.Fprintf(w, "Could not find device with udid: %s<br>", udid )
         fmt.Fprintf(w, "Available UDID:<br>")
-        for _, key := range devTracker.DevMap {
-            fmt.Fprintf(w, "%s<br>", key )
+        for _, dev := range devTracker.devices() {
+            fmt.Fprintf(w, "%s<br>", dev.udid )
         }
         return
     }
@@ -106,6 +173,194 @@ func onBackupFrame( w http.ResponseWriter, r *http.Request, devTracker *DeviceTr
     w.Write( pngData )
 }
 
+func onCfaQueue( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    r.ParseForm()
+    udid := r.Form.Get("udid")
+    
+    dev := devTracker.getDevice( udid )
+    if dev == nil {
+        http.Error( w, "Could not find device with udid", http.StatusNotFound )
+        return
+    }
+    
+    bytes, _ := json.Marshal( dev.cfaQueue.getMetrics() )
+    w.Header().Set("Content-Type", "application/json")
+    w.Write( bytes )
+}
+
+func onCfaHealth( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    r.ParseForm()
+    udid := r.Form.Get("udid")
+    
+    dev := devTracker.getDevice( udid )
+    if dev == nil || dev.cfa == nil {
+        http.Error( w, "Could not find device with udid", http.StatusNotFound )
+        return
+    }
+    
+    bytes, _ := json.Marshal( dev.cfa.health() )
+    w.Header().Set("Content-Type", "application/json")
+    w.Write( bytes )
+}
+
+func onHealth( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    bytes, _ := json.Marshal( devTracker.healthSampler.sample( devTracker ) )
+    w.Header().Set("Content-Type", "application/json")
+    w.Write( bytes )
+}
+
+func onVidViewers( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    r.ParseForm()
+    udid := r.Form.Get("udid")
+    
+    dev := devTracker.getDevice( udid )
+    if dev == nil {
+        http.Error( w, "Could not find device with udid", http.StatusNotFound )
+        return
+    }
+    
+    bytes, _ := json.Marshal( dev.vidCast.stats() )
+    w.Header().Set("Content-Type", "application/json")
+    w.Write( bytes )
+}
+
+func onVidAdapt( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    r.ParseForm()
+    udid := r.Form.Get("udid")
+    
+    dev := devTracker.getDevice( udid )
+    if dev == nil {
+        http.Error( w, "Could not find device with udid", http.StatusNotFound )
+        return
+    }
+    
+    bytes, _ := json.Marshal( dev.vidAdapt.stats() )
+    w.Header().Set("Content-Type", "application/json")
+    w.Write( bytes )
+}
+
+func onVidRecStart( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    r.ParseForm()
+    udid := r.Form.Get("udid")
+    
+    dev := devTracker.getDevice( udid )
+    if dev == nil {
+        http.Error( w, "Could not find device with udid", http.StatusNotFound )
+        return
+    }
+    
+    id, err := dev.startVidRecording( r.Form.Get("name") )
+    if err != nil {
+        http.Error( w, err.Error(), http.StatusConflict )
+        return
+    }
+    bytes, _ := json.Marshal( map[string] string{ "id": id } )
+    w.Header().Set("Content-Type", "application/json")
+    w.Write( bytes )
+}
+
+func onVidRecStop( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    r.ParseForm()
+    udid := r.Form.Get("udid")
+    
+    dev := devTracker.getDevice( udid )
+    if dev == nil {
+        http.Error( w, "Could not find device with udid", http.StatusNotFound )
+        return
+    }
+    
+    info, err := dev.stopVidRecording()
+    if err != nil {
+        http.Error( w, err.Error(), http.StatusConflict )
+        return
+    }
+    bytes, _ := json.Marshal( info )
+    w.Header().Set("Content-Type", "application/json")
+    w.Write( bytes )
+}
+
+func onVidRecList( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    infos, err := devTracker.vidRecs.list()
+    if err != nil {
+        http.Error( w, err.Error(), http.StatusInternalServerError )
+        return
+    }
+    bytes, _ := json.Marshal( infos )
+    w.Header().Set("Content-Type", "application/json")
+    w.Write( bytes )
+}
+
+// onVidRecDownload sends a video recording as a tar of its index and
+// segments.
+func onVidRecDownload( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    r.ParseForm()
+    id := r.Form.Get("id")
+    
+    if _, err := devTracker.vidRecs.path( id ); err != nil {
+        http.Error( w, err.Error(), http.StatusNotFound )
+        return
+    }
+    w.Header().Set("Content-Type", "application/x-tar")
+    w.Header().Set("Content-Disposition", fmt.Sprintf( "attachment; filename=\"%s.tar\"", id ) )
+    if err := devTracker.vidRecs.writeTar( w, id ); err != nil {
+        log.WithFields( log.Fields{
+            "type":  "vidrec_download_fail",
+            "id":    id,
+            "error": err,
+        } ).Warn("Could not send video recording")
+    }
+}
+
+// callProvider posts vals to path on the provider running on this host and
+// returns its reply.
+func callProvider( config *Config, path string, vals url.Values ) ( []byte, error ) {
+    client := &http.Client{ Timeout: 30 * time.Second }
+    resp, err := client.PostForm( fmt.Sprintf( "http://127.0.0.1:%d%s", config.httpPort, path ), vals )
+    if err != nil {
+        return nil, fmt.Errorf( "no running provider: %s", err )
+    }
+    defer resp.Body.Close()
+    body, _ := ioutil.ReadAll( resp.Body )
+    if resp.StatusCode != 200 {
+        return nil, errors.New( strings.TrimSpace( string( body ) ) )
+    }
+    return body, nil
+}
+
+// onCfReload is called by register and rotate-password after they save a
+// new password. Only local callers are listened to.
+func onCfReload( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    host, _, _ := net.SplitHostPort( r.RemoteAddr )
+    if ip := net.ParseIP( host ); ip == nil || !ip.IsLoopback() {
+        http.Error( w, "Only allowed from this host", http.StatusForbidden )
+        return
+    }
+    if devTracker.cf == nil {
+        http.Error( w, "Not connected to ControlFloor", http.StatusNotFound )
+        return
+    }
+    if err := devTracker.cf.reloadCreds(); err != nil {
+        http.Error( w, err.Error(), http.StatusInternalServerError )
+        return
+    }
+    w.Write( []byte("ok") )
+}
+
+func onNotifyQueue( w http.ResponseWriter, r *http.Request, devTracker *DeviceTracker ) {
+    if devTracker.cf == nil {
+        http.Error( w, "Not connected to ControlFloor", http.StatusNotFound )
+        return
+    }
+    
+    metrics := make( map[string] NotifyMetrics )
+    for _, srv := range devTracker.cf.servers {
+        metrics[ srv.name ] = srv.notifyQueue.getMetrics()
+    }
+    bytes, _ := json.Marshal( metrics )
+    w.Header().Set("Content-Type", "application/json")
+    w.Write( bytes )
+}
+
 func deviceConnect( w http.ResponseWriter, r *http.Request, eventCh chan<- Event ) {
     // signal device loop of device connect
     r.ParseForm()
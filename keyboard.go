@@ -0,0 +1,263 @@
+package main
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "strconv"
+    "strings"
+    uj "github.com/nanoscopic/ujsonin/v2/mod"
+    log "github.com/sirupsen/logrus"
+)
+
+const (
+    KEY_MOD_SHIFT = 1 << iota
+    KEY_MOD_ALT
+    KEY_MOD_CTRL
+    KEY_MOD_CMD
+)
+
+// HID usages of the left hand modifier keys, in KEY_MOD_* bit order
+var keyModUsages = []int{ 0xe1, 0xe2, 0xe0, 0xe3 }
+
+var keyModNames = map[string] int {
+    "shift":   KEY_MOD_SHIFT,
+    "alt":     KEY_MOD_ALT,
+    "option":  KEY_MOD_ALT,
+    "ctrl":    KEY_MOD_CTRL,
+    "control": KEY_MOD_CTRL,
+    "cmd":     KEY_MOD_CMD,
+    "command": KEY_MOD_CMD,
+    "meta":    KEY_MOD_CMD,
+}
+
+/*
+Keys that do not produce a character are the same in every layout. They are
+sent by ControlFloor as negative JS keyCodes.
+*/
+var keySpecialUsages = map[int] int {
+    -8:  0x2a, // backspace
+    -9:  0x2b, // tab
+    -13: 0x28, // enter
+    -27: 0x29, // esc
+    -33: 0x4b, // pageup
+    -34: 0x4e, // pagedown
+    -35: 0x4d, // end
+    -36: 0x4a, // home
+    -37: 0x50, // left
+    -38: 0x52, // up
+    -39: 0x4f, // right
+    -40: 0x51, // down
+    -46: 0x4c, // delete
+}
+
+const KEY_LAYOUT_FALLBACK = "us"
+
+// KeyStroke is a HID usage on the keyboard page along with the modifiers
+// that must be held while it is pressed.
+type KeyStroke struct {
+    usage int
+    mods  int
+}
+
+func (self KeyStroke) modUsages() []int {
+    usages := []int{}
+    for i, usage := range keyModUsages {
+        if self.mods & ( 1 << uint( i ) ) != 0 {
+            usages = append( usages, usage )
+        }
+    }
+    return usages
+}
+
+// keyModForUsage returns the KEY_MOD_* bit for a modifier usage, or 0.
+func keyModForUsage( usage int ) int {
+    for i, modUsage := range keyModUsages {
+        if usage == modUsage {
+            return 1 << uint( i )
+        }
+    }
+    return 0
+}
+
+// keyUsageByName resolves a key named by ControlFloor to a HID usage; either
+// a modifier name such as "shift" or a plain usage number.
+func keyUsageByName( name string ) ( int, bool ) {
+    if mod, ok := keyModNames[ strings.ToLower( name ) ]; ok {
+        return KeyStroke{ mods: mod }.modUsages()[0], true
+    }
+    usage, err := strconv.Atoi( name )
+    if err != nil || usage <= 0 {
+        return 0, false
+    }
+    return usage, true
+}
+
+type KeyLayout struct {
+    name    string
+    regions []string
+    keys    map[int] KeyStroke
+}
+
+func (self *KeyLayout) stroke( code int ) ( KeyStroke, bool ) {
+    if usage, ok := keySpecialUsages[ code ]; ok {
+        return KeyStroke{ usage: usage }, true
+    }
+    stroke, ok := self.keys[ code ]
+    return stroke, ok
+}
+
+/*
+loadKeyLayouts reads every .json file in dir. A layout file looks like:
+
+    {
+        name: "us"
+        regions: [ "LL" ]
+        keys: [
+            { usage: 4, chars: "abc" }
+            { usage: 4, chars: "ABC", mods: "shift" }
+            { usage: 52, code: 34, mods: "shift" }
+        ]
+    }
+
+Each entry of keys maps the characters of chars onto consecutive usages
+starting at usage. code gives a single character by its unicode value, for
+characters such as " that would need escaping. regions lists the prefixes
+of the lockdown RegionInfo value that default to the layout.
+*/
+func loadKeyLayouts( dir string ) map[string] *KeyLayout {
+    layouts := make( map[string] *KeyLayout )
+
+    files, _ := filepath.Glob( filepath.Join( dir, "*.json" ) )
+    if len( files ) == 0 {
+        log.WithFields( log.Fields{
+            "type": "keyboard_none",
+            "path": dir,
+        } ).Warn("No keyboard layouts found; keys will be typed as text")
+        return layouts
+    }
+
+    for _, file := range files {
+        layout, err := loadKeyLayout( file )
+        if err != "" {
+            log.WithFields( log.Fields{
+                "type":  "keyboard_bad",
+                "file":  file,
+                "error": err,
+            } ).Error("Could not load keyboard layout")
+            continue
+        }
+        layouts[ layout.name ] = layout
+    }
+    return layouts
+}
+
+func loadKeyLayout( file string ) ( *KeyLayout, string ) {
+    content, err := ioutil.ReadFile( file )
+    if err != nil {
+        return nil, err.Error()
+    }
+    root, _, perr := uj.ParseFull( content )
+    if perr != nil || root == nil {
+        return nil, "unparsable"
+    }
+
+    name := strings.TrimSuffix( filepath.Base( file ), ".json" )
+    if nameNode := root.Get("name"); nameNode != nil {
+        name = nameNode.String()
+    }
+    layout := &KeyLayout{
+        name: name,
+        keys: make( map[int] KeyStroke ),
+    }
+
+    if regionsNode := root.Get("regions"); regionsNode != nil {
+        regionsNode.ForEach( func( regionNode uj.JNode ) {
+            layout.regions = append( layout.regions, regionNode.String() )
+        } )
+    }
+
+    keysNode := root.Get("keys")
+    if keysNode == nil {
+        return nil, "keys not set"
+    }
+
+    errText := ""
+    keysNode.ForEach( func( keyNode uj.JNode ) {
+        usageNode := keyNode.Get("usage")
+        if usageNode == nil {
+            errText = "key without usage"
+            return
+        }
+        usage := usageNode.Int()
+
+        mods := 0
+        if modsNode := keyNode.Get("mods"); modsNode != nil {
+            for _, modName := range strings.Split( modsNode.String(), "+" ) {
+                mod, ok := keyModNames[ strings.TrimSpace( modName ) ]
+                if !ok {
+                    errText = "unknown modifier " + modName
+                    return
+                }
+                mods |= mod
+            }
+        }
+
+        if codeNode := keyNode.Get("code"); codeNode != nil {
+            layout.add( codeNode.Int(), KeyStroke{ usage: usage, mods: mods } )
+        }
+        if charsNode := keyNode.Get("chars"); charsNode != nil {
+            for i, char := range []rune( charsNode.String() ) {
+                layout.add( int( char ), KeyStroke{ usage: usage + i, mods: mods } )
+            }
+        }
+    } )
+    if errText != "" {
+        return nil, errText
+    }
+
+    return layout, ""
+}
+
+// add keeps the first stroke given for a character, so that when a layout
+// can type something more than one way the simplest entry listed wins.
+func (self *KeyLayout) add( code int, stroke KeyStroke ) {
+    if _, exists := self.keys[ code ]; !exists {
+        self.keys[ code ] = stroke
+    }
+}
+
+/*
+keyLayoutFor picks the layout for a device. A layout named in the device's
+config wins, then the provider wide one, then whichever layout claims the
+device's region.
+*/
+func keyLayoutFor( config *Config, devConfig *CDevice, regionInfo string ) *KeyLayout {
+    layouts := config.keyLayouts
+
+    name := config.keyLayout
+    if devConfig != nil && devConfig.keyLayout != "" {
+        name = devConfig.keyLayout
+    }
+    if name != "" {
+        if layout, ok := layouts[ name ]; ok {
+            return layout
+        }
+        log.WithFields( log.Fields{
+            "type":   "keyboard_missing",
+            "layout": name,
+        } ).Warn("Configured keyboard layout does not exist")
+    }
+
+    region := strings.Split( regionInfo, "/" )[0]
+    if region != "" {
+        for _, layout := range layouts {
+            for _, layoutRegion := range layout.regions {
+                if layoutRegion == region {
+                    return layout
+                }
+            }
+        }
+    }
+
+    return layouts[ KEY_LAYOUT_FALLBACK ]
+}
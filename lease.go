@@ -0,0 +1,160 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+    log "github.com/sirupsen/logrus"
+)
+
+// Lease transitions reported to ControlFloor
+const (
+    LEASE_GRANTED  = "granted"
+    LEASE_RENEWED  = "renewed"
+    LEASE_RELEASED = "released"
+    LEASE_EXPIRED  = "expired"
+)
+
+// Steps that can be listed in lease.cleanup
+const (
+    LEASE_CLEAN_KEYS = "releaseKeys" // let go of held modifier keys
+    LEASE_CLEAN_APP  = "killApp"     // kill the foreground app
+    LEASE_CLEAN_HOME = "home"        // return to the launcher
+)
+
+const SPRINGBOARD_BID = "com.apple.springboard"
+
+/*
+grantLease gives the device to user for dur. Input from anyone else is
+refused until the lease is released or expires. ControlFloor decides who
+gets a device, so a grant to a different user takes the device from the
+current owner, cleaning up after them first. A grant to the owner renews
+the lease.
+*/
+func (self *Device) grantLease( user string, dur time.Duration ) time.Time {
+    self.lock.Lock()
+    prev := self.owner
+    if self.leaseTimer != nil {
+        self.leaseTimer.Stop()
+    }
+    self.owner = user
+    self.leaseEnd = time.Now().Add( dur )
+    end := self.leaseEnd
+    self.leaseTimer = time.AfterFunc( dur, func() {
+        self.endLease( user, LEASE_EXPIRED )
+    } )
+    self.lock.Unlock()
+
+    if prev != "" && prev != user {
+        self.leaseEnded( prev, LEASE_RELEASED )
+    }
+
+    state := LEASE_GRANTED
+    if prev == user {
+        state = LEASE_RENEWED
+    }
+    self.leaseChanged( user, state, end )
+    return end
+}
+
+// endLease ends the lease held by user, or whoever holds the device when
+// user is empty. It returns false when there was no such lease.
+func (self *Device) endLease( user string, state string ) bool {
+    self.lock.Lock()
+    if self.owner == "" || ( user != "" && self.owner != user ) {
+        self.lock.Unlock()
+        return false
+    }
+    // An expiry that fired just as the lease was renewed
+    if state == LEASE_EXPIRED && time.Now().Before( self.leaseEnd ) {
+        self.lock.Unlock()
+        return false
+    }
+    user = self.owner
+    self.owner = ""
+    if self.leaseTimer != nil {
+        self.leaseTimer.Stop()
+        self.leaseTimer = nil
+    }
+    self.lock.Unlock()
+
+    self.leaseEnded( user, state )
+    return true
+}
+
+// mayUse reports whether user may send input to the device. Anyone may
+// while the device is not leased.
+func (self *Device) mayUse( user string ) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.owner == "" || self.owner == user
+}
+
+func (self *Device) leaseEnded( user string, state string ) {
+    self.leaseChanged( user, state, time.Time{} )
+
+    // Input user sent before the lease ended must not reach the next user
+    if self.cfaQueue != nil {
+        self.cfaQueue.cancelUser( user )
+    }
+
+    steps := self.config.leaseCleanup
+    if len( steps ) == 0 || self.cfa == nil {
+        return
+    }
+    // Ahead of input from the next owner
+    self.queueCfa( "leaseCleanup", CFA_PRI_HIGH, "lease", func() error {
+        return self.leaseCleanup( steps )
+    } )
+}
+
+// leaseCleanup leaves the device ready for its next user. Every step is
+// tried even if an earlier one fails.
+func (self *Device) leaseCleanup( steps []string ) error {
+    var errs []string
+    for _, step := range steps {
+        var err error
+        switch step {
+            case LEASE_CLEAN_KEYS:
+                err = self.cfa.releaseKeys()
+            case LEASE_CLEAN_APP:
+                bid := self.cfa.foregroundApp()
+                if bid != "" && bid != SPRINGBOARD_BID {
+                    self.killBid( bid )
+                }
+            case LEASE_CLEAN_HOME:
+                _, err = self.cfa.ToLauncher()
+            default:
+                err = errors.New("unknown step")
+        }
+        if err != nil {
+            errs = append( errs, fmt.Sprintf( "%s: %s", step, err ) )
+        }
+    }
+
+    fields := log.Fields{
+        "type":  "lease_cleanup",
+        "udid":  censorUuid( self.udid ),
+        "steps": steps,
+    }
+    if len( errs ) > 0 {
+        fields["errors"] = errs
+        log.WithFields( fields ).Warn("Device cleanup after lease was incomplete")
+        return fmt.Errorf( "lease cleanup: %s", strings.Join( errs, "; " ) )
+    }
+    log.WithFields( fields ).Info("Cleaned up device after lease")
+    return nil
+}
+
+func (self *Device) leaseChanged( user string, state string, end time.Time ) {
+    log.WithFields( log.Fields{
+        "type":  "lease_" + state,
+        "udid":  censorUuid( self.udid ),
+        "user":  user,
+    } ).Info("Device lease " + state)
+
+    if self.cf != nil {
+        self.cf.notifyLease( self.udid, user, state, end )
+    }
+}
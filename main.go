@@ -1,8 +1,11 @@
 package main
 
 import (
+    "encoding/json"
     "fmt"
+    "io/ioutil"
     "net/http"
+    "net/url"
     "os"
     "os/signal"
     //"runtime/pprof"
@@ -12,6 +15,7 @@ import (
     "time"
     log "github.com/sirupsen/logrus"
     uc "github.com/nanoscopic/uclop/mod"
+    uj "github.com/nanoscopic/ujsonin/v2/mod"
     "github.com/danielpaulus/go-ios/ios"
 )
 
@@ -36,8 +40,24 @@ func main() {
     )
     
     uclop.AddCmd( "run", "Run ControlFloor", runMain, runOpts )
-    uclop.AddCmd( "register", "Register against ControlFloor", runRegister, commonOpts )
+    serverOpts := append( commonOpts,
+        uc.OPT("-server","Name of the ControlFloor server; all if not set",0),
+    )
+    registerOpts := append( serverOpts,
+        uc.OPT("-pass","Registration password",0),
+        uc.OPT("-passFile","File holding the registration password",0),
+    )
+    uclop.AddCmd( "register", "Register against ControlFloor", runRegister, registerOpts )
+    uclop.AddCmd( "unregister", "Unregister from ControlFloor", runUnregister, serverOpts )
+    uclop.AddCmd( "rotate-password", "Replace the ControlFloor password", runRotatePassword, serverOpts )
     uclop.AddCmd( "cleanup", "Cleanup leftover processes", runCleanup, nil )
+    vidRecOpts := append( commonOpts,
+        uc.OPT("-id","Udid of device",uc.REQ),
+        uc.OPT("-name","Name to add to the recording",0),
+    )
+    uclop.AddCmd( "vidrec-start", "Start recording a device's video", runVidRecStart, vidRecOpts )
+    uclop.AddCmd( "vidrec-stop", "Stop recording a device's video", runVidRecStop, vidRecOpts )
+    uclop.AddCmd( "vidrec-list", "List video recordings", runVidRecList, commonOpts )
 
     //uclop.AddCmd( "wda",       "Just run WDA",                     runWDA,        idOpt )
     uclop.AddCmd( "cfa",       "Just run CFA",                     runCFA,        idOpt )
@@ -96,8 +116,38 @@ func main() {
     )
     uclop.AddCmd( "pidChildWithWidth", "Get element that is a child of pid with specified width", runPidChildWithWidth, pidChildWithWidthOpts )
     
+    findOpts := append( idOpt,
+        uc.OPT("-sel","Element selector",uc.REQ),
+        uc.OPT("-pid","PID of app to search; whole screen if not set",0),
+        uc.OPT("-file","Search a saved source JSON file instead of a device",0),
+    )
+    uclop.AddCmd( "find", "Find elements matching a selector", runFind, findOpts )
+    
+    gestureOpts := append( idOpt,
+        uc.OPT("-file","Gesture JSON file",uc.REQ),
+    )
+    uclop.AddCmd( "gesture", "Perform a gesture from a file", runGesture, gestureOpts )
+    
+    replayOpts := append( idOpt,
+        uc.OPT("-file","Recording to replay",uc.REQ),
+        uc.OPT("-timing","original or normalized",0),
+        uc.OPT("-gap","Milliseconds between events when normalized; default 500",0),
+        uc.OPT("-speed","Speed up original timing by this factor",0),
+        uc.OPT("-byElement","Aim at recorded elements rather than points",uc.FLAG),
+    )
+    uclop.AddCmd( "replay", "Replay a recorded input session", runReplay, replayOpts )
+    
     uclop.AddCmd( "vidtest", "Test backup video", runVidTest, idOpt ) 
     
+    mockOpts := uc.OPTS{
+        uc.OPT("-debug","Use debug log level",uc.FLAG),
+        uc.OPT("-port","Port to listen on; default 8080",0),
+        uc.OPT("-user","Provider username to accept; default first",0),
+        uc.OPT("-pass","Provider password to accept; default pass",0),
+        uc.OPT("-regPass","Registration password; default doreg",0),
+    }
+    uclop.AddCmd( "mockcf", "Run a mock ControlFloor for testing", runMockCF, mockOpts )
+    
     uclop.Run()
 }
 
@@ -261,7 +311,7 @@ func runVidTest( cmd *uc.Cmd ) {
 }
 
 func dotLoop( cmd *uc.Cmd, tracker *DeviceTracker ) {
-    c := make(chan os.Signal)
+    c := make(chan os.Signal, 1)
     stop := make(chan bool)
     signal.Notify(c, os.Interrupt, syscall.SIGTERM)
     go func() {
@@ -287,19 +337,21 @@ func dotLoop( cmd *uc.Cmd, tracker *DeviceTracker ) {
 }
 
 func runWindowSize( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        wid, heg := cfa.WindowSize()
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        wid, heg, err := cfa.WindowSize()
+        if err != nil { return err }
         fmt.Printf("Width: %d, Height: %d\n", wid, heg )
+        return nil
     } )
 }
 
 func runAddRec( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        cfa.AddRecordingToCC()
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        return cfa.AddRecordingToCC()
     } )
 }
 
-func cfaWrapped( cmd *uc.Cmd, appName string, doStuff func( cfa *CFA, dev *Device ) ) {
+func cfaWrapped( cmd *uc.Cmd, appName string, doStuff func( cfa *CFA, dev *Device ) error ) {
     config := NewConfig( "config.json", "default.json", "calculated.json" )
   
     runCleanup( cmd )
@@ -321,30 +373,30 @@ func cfaWrapped( cmd *uc.Cmd, appName string, doStuff func( cfa *CFA, dev *Devic
     devConfig := config.devs[ id ]
     fmt.Printf("%+v\n", devConfig )
     
-    startChan := make( chan int )
+    startChan := make( chan error )
     
     fmt.Printf("devCfaMethod:%s\n", devConfig.cfaMethod )
     var stopChan chan bool
     if config.cfaMethod == "manual" || devConfig.cfaMethod == "manual" {
         fmt.Printf("Manual CFA; connecting...\n")
         go func() {
-            cfa.startCfaNng( func( err int, AstopChan chan bool ) {
+            cfa.startCfaNng( func( err error, AstopChan chan bool ) {
                 stopChan = AstopChan
-                fmt.Printf("Manual CFA; connected; err: %d\n", err)
+                fmt.Printf("Manual CFA; connected; err: %v\n", err)
                 startChan <- err
             } )
         }()
     } else {
         //cfa.startChan = startChan
-        cfa.start( func( err int, AstopChan chan bool ) {
+        cfa.start( func( err error, AstopChan chan bool ) {
             stopChan = AstopChan
             startChan <- err
         } )
     }
     
     err := <- startChan
-    if err != 0 {
-        fmt.Printf("Could not start/connect to CFA. Exiting")
+    if err != nil {
+        fmt.Printf("Could not start/connect to CFA: %s. Exiting\n", err)
         runCleanup( cmd )
         return
     }
@@ -358,7 +410,9 @@ func cfaWrapped( cmd *uc.Cmd, appName string, doStuff func( cfa *CFA, dev *Devic
         //cfa.create_session( appName )
     }
     
-    doStuff( cfa, dev )
+    if err := doStuff( cfa, dev ); err != nil {
+        fmt.Printf("Error: %s\n", err )
+    }
     
     stopChan <- true
     
@@ -369,35 +423,39 @@ func cfaWrapped( cmd *uc.Cmd, appName string, doStuff func( cfa *CFA, dev *Devic
 }
 
 func runClickEl( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
         label := cmd.Get("-label").String()
         system := cmd.Get("-system").Bool()
-        btnName := cfa.GetEl( "any", label, system, 5 )
-        cfa.ElClick( btnName )
+        btnName, err := cfa.GetEl( "any", label, system, 5 )
+        if err != nil { return err }
+        return cfa.ElClick( btnName )
     } )
 }
 
 func runForceTouchEl( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
         label := cmd.Get("-label").String()
         system := cmd.Get("-system").Bool()
-        btnName := cfa.GetEl( "any", label, system, 5 )
-        cfa.ElForceTouch( btnName, 1 )
+        btnName, err := cfa.GetEl( "any", label, system, 5 )
+        if err != nil { return err }
+        return cfa.ElForceTouch( btnName, 1 )
     } )
 }
 
 func runLongTouchEl( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
         label := cmd.Get("-label").String()
         system := cmd.Get("-system").Bool()
-        btnName := cfa.GetEl( "any", label, system, 5 )
-        cfa.ElLongTouch( btnName )
+        btnName, err := cfa.GetEl( "any", label, system, 5 )
+        if err != nil { return err }
+        return cfa.ElLongTouch( btnName )
     } )
 }
 
 func runRunApp( cmd *uc.Cmd ) {
     appName := cmd.Get("-name").String()
-    cfaWrapped( cmd, appName, func( cfa *CFA, dev *Device ) {
+    cfaWrapped( cmd, appName, func( cfa *CFA, dev *Device ) error {
+        return nil
     } )
 }
 
@@ -408,19 +466,23 @@ func runSource( cmd *uc.Cmd ) {
     if pidStr != "" {
         pid, _ = strconv.Atoi( pidStr ) 
     }
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        xml := cfa.Source(bi,pid)
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        xml, err := cfa.Source(bi,pid)
+        if err != nil { return err }
         fmt.Println( xml )
+        return nil
     } )
 }
 
 func runScreenshot( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        bytes := cfa.Screenshot()
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        bytes, err := cfa.Screenshot()
+        if err != nil { return err }
         //os.Stdout.Write( bytes )
         f, _ := os.Create( "test.jpg" )
         f.Write( bytes )
         fmt.Printf("Write %d bytes\n", len( bytes ) )
+        return nil
     } )
 }
 
@@ -428,13 +490,13 @@ func runShotTest( cmd *uc.Cmd ) {
     cfaWrapped( cmd, "", shotServer )
 }
 
-func shotServer( cfa *CFA, dev *Device ) {
+func shotServer( cfa *CFA, dev *Device ) error {
     shotClosure := func( w http.ResponseWriter, r *http.Request ) {
         shotImg( w, r, cfa )
     }
     http.HandleFunc( "/shot", shotClosure )
     http.HandleFunc( "/", shotRoot )
-    http.ListenAndServe( "0.0.0.0:8081", nil )
+    return http.ListenAndServe( "0.0.0.0:8081", nil )
 }
 
 func shotRoot( w http.ResponseWriter, r *http.Request ) {
@@ -462,7 +524,11 @@ func shotRoot( w http.ResponseWriter, r *http.Request ) {
 }
 
 func shotImg( w http.ResponseWriter, r *http.Request, cfa *CFA ) {
-    bytes := cfa.Screenshot()
+    bytes, err := cfa.Screenshot()
+    if err != nil {
+        http.Error( w, err.Error(), http.StatusServiceUnavailable )
+        return
+    }
     w.Header().Set("Content-Type", "image/jpeg")
     w.Header().Set("Content-Length", strconv.Itoa( len( bytes ) ) )
     w.Header().Set("Cache-Control", "no-cache, must-revalidate" )
@@ -471,37 +537,44 @@ func shotImg( w http.ResponseWriter, r *http.Request, cfa *CFA ) {
 }
 
 func runAlertInfo( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        _, json := cfa.AlertInfo()
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        _, json, err := cfa.AlertInfo()
+        if err != nil { return err }
         fmt.Println( json )
+        return nil
     } )
 }
 
 func runWifiIp( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        ip := cfa.WifiIp()
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        ip, err := cfa.WifiIp()
+        if err != nil { return err }
         fmt.Println( ip )
+        return nil
     } )
 }
 
 func runSiri( cmd *uc.Cmd ) {
     cmdT := cmd.Get("-cmd").String()
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        cfa.Siri(cmdT)
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        return cfa.Siri(cmdT)
     } )
 }
 
 func runToLauncher( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        cfa.ToLauncher()
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        _, err := cfa.ToLauncher()
+        return err
     } )
 }
 
 func runElByPid( cmd *uc.Cmd ) {
     pid := cmd.Get("-pid").Int()
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        source := cfa.ElByPid(pid,true)
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        source, err := cfa.ElByPid(pid,true)
+        if err != nil { return err }
         fmt.Println(source)
+        return nil
     } )
 }
 
@@ -509,37 +582,143 @@ func runPidChildWithWidth( cmd *uc.Cmd ) {
     pid := cmd.Get("-pid").Int()
     width := cmd.Get("-width").Int()
     
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        source := cfa.PidChildWithWidth(pid,width)
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        source, err := cfa.PidChildWithWidth(pid,width)
+        if err != nil { return err }
         fmt.Println(source)
+        return nil
+    } )
+}
+
+func runFind( cmd *uc.Cmd ) {
+    sel := cmd.Get("-sel").String()
+    file := cmd.Get("-file").String()
+    pid := 0
+    if pidStr := cmd.Get("-pid").String(); pidStr != "" {
+        pid, _ = strconv.Atoi( pidStr )
+    }
+    
+    printEls := func( els []*SourceNode ) {
+        text, _ := json.MarshalIndent( els, "", "  " )
+        fmt.Println( string( text ) )
+    }
+    
+    if file != "" {
+        content, err := ioutil.ReadFile( file )
+        if err != nil {
+            fmt.Printf("Could not read %s: %s\n", file, err )
+            return
+        }
+        selector, err := parseSelector( sel )
+        if err != nil {
+            fmt.Printf("Error: %s\n", err )
+            return
+        }
+        root, err := parseSourceTree( content )
+        if err != nil {
+            fmt.Printf("Error: %s\n", err )
+            return
+        }
+        printEls( selector.findAll( root ) )
+        return
+    }
+    
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        els, err := dev.findElements( sel, pid )
+        if err != nil { return err }
+        printEls( els )
+        return nil
+    } )
+}
+
+func runGesture( cmd *uc.Cmd ) {
+    file := cmd.Get("-file").String()
+    content, err := ioutil.ReadFile( file )
+    if err != nil {
+        fmt.Printf("Could not read %s: %s\n", file, err )
+        return
+    }
+    root, _, perr := uj.ParseFull( content )
+    if perr != nil {
+        fmt.Printf("Could not parse %s\n", file )
+        return
+    }
+    gesture, err := parseGesture( root )
+    if err != nil {
+        fmt.Printf("Invalid gesture: %s\n", err )
+        return
+    }
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        return cfa.gesture( gesture )
+    } )
+}
+
+func runReplay( cmd *uc.Cmd ) {
+    file := cmd.Get("-file").String()
+    header, events, err := loadRecording( file )
+    if err != nil {
+        fmt.Printf("Could not load %s: %s\n", file, err )
+        return
+    }
+    
+    opts := ReplayOptions{
+        timing:    REPLAY_ORIGINAL,
+        gap:       time.Millisecond * 500,
+        speed:     1,
+        byElement: cmd.Get("-byElement").Bool(),
+    }
+    switch cmd.Get("-timing").String() {
+        case "", "original":
+        case "normalized":
+            opts.timing = REPLAY_NORMALIZED
+        default:
+            fmt.Printf("Timing must be original or normalized\n")
+            return
+    }
+    if gap := cmd.Get("-gap").String(); gap != "" {
+        ms, _ := strconv.Atoi( gap )
+        opts.gap = time.Duration( ms ) * time.Millisecond
+    }
+    if speed := cmd.Get("-speed").String(); speed != "" {
+        opts.speed, _ = strconv.ParseFloat( speed, 64 )
+    }
+    
+    fmt.Printf("Replaying %d events recorded from %s at %s\n", len( events ), header.Udid, header.Started )
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        return replayEvents( dev, events, opts )
     } )
 }
 
 func runAppAtPoint( cmd *uc.Cmd ) {
     x := cmd.Get("-x").Int()
     y := cmd.Get("-y").Int()
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        app := cfa.AppAtPoint(x,y,true,false,true)
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        app, err := cfa.AppAtPoint(x,y,true,false,true)
+        if err != nil { return err }
         fmt.Println( app )
+        return nil
     } )
 }
 
 func runWifiMac( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
         ip := dev.WifiMac()
         fmt.Println( ip )
+        return nil
     } )
 }
 
 func runActiveApps( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        ids := cfa.ActiveApps()
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        ids, err := cfa.ActiveApps()
+        if err != nil { return err }
         fmt.Println( ids )
+        return nil
     } )
 }
 
 func runAt( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
         //cfa.AT()
         
         /*cfa.Siri("is assistivetouch active")
@@ -550,28 +729,32 @@ func runAt( cmd *uc.Cmd ) {
         /*cfa.Siri("activate assistivetouch")
         time.Sleep( time.Millisecond * 600 )
         cfa.home()*/
-        dev.taskSwitcher()
+        return dev.taskSwitcher()
     } )
 }
 
 func runIsLocked( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
-        locked := cfa.IsLocked()
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
+        locked, err := cfa.IsLocked()
+        if err != nil { return err }
         if locked {
             fmt.Println("Device screen is locked")
         } else {
             fmt.Println("Device screen is unlocked")
         }
+        return nil
     } )
 }
 
 func runUnlock( cmd *uc.Cmd ) {
-    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) {
+    cfaWrapped( cmd, "", func( cfa *CFA, dev *Device ) error {
         //cfa.Unlock()
-        cfa.ioHid( 0x0c, 0x30 ) // power
+        if err := cfa.ioHid( 0x0c, 0x30 ); err != nil { // power
+            return err
+        }
         //time.Sleep(time.Second)
         //cfa.ioHid( 0x07, 0x4a ) // home keyboard button
-        cfa.Unlock()
+        return cfa.Unlock()
     } )
 }
 
@@ -590,6 +773,36 @@ func runListen( cmd *uc.Cmd ) {
     <-c
 }
 
+func runMockCF( cmd *uc.Cmd ) {
+    setupLog( cmd.Get("-debug").Bool(), false )
+    
+    optOr := func( name string, def string ) string {
+        if val := cmd.Get( name ).String(); val != "" {
+            return val
+        }
+        return def
+    }
+    
+    mock, err := NewCFMock( "0.0.0.0:" + optOr( "-port", "8080" ) )
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "Could not start mock ControlFloor: %s\n", err )
+        os.Exit(1)
+    }
+    mock.regPass = optOr( "-regPass", CF_DEFAULT_REGPASS )
+    mock.addUser( optOr( "-user", "first" ), optOr( "-pass", "pass" ) )
+    mock.onNote = func( note *CFMockNote ) {
+        fmt.Printf( "%s %s\n", note.Variant, note.Vals.Encode() )
+    }
+    fmt.Printf("Mock ControlFloor listening on %s\n", mock.host )
+    
+    go mock.console( os.Stdin, os.Stdout )
+    
+    c := make(chan os.Signal, syscall.SIGTERM)
+    signal.Notify(c, os.Interrupt)
+    <-c
+    mock.close()
+}
+
 func common( cmd *uc.Cmd ) *Config {
     debug := cmd.Get("-debug").Bool()
     warn  := cmd.Get("-warn").Bool()
@@ -618,7 +831,73 @@ func runCleanup( *uc.Cmd ) {
 func runRegister( cmd *uc.Cmd ) {
     config := common( cmd )
     
-    doregister( config )
+    // Given this way it need not be typed, so farms can register unattended
+    regPass, err := regPassFrom( cmd.Get("-pass").String(), cmd.Get("-passFile").String() )
+    if err == nil {
+        err = doregister( config, cmd.Get("-server").String(), regPass )
+    }
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "Could not register: %s\n", err )
+        os.Exit(1)
+    }
+}
+
+func runUnregister( cmd *uc.Cmd ) {
+    config := common( cmd )
+    
+    if err := dounregister( config, cmd.Get("-server").String() ); err != nil {
+        fmt.Fprintf( os.Stderr, "Could not unregister: %s\n", err )
+        os.Exit(1)
+    }
+}
+
+func runRotatePassword( cmd *uc.Cmd ) {
+    config := common( cmd )
+    
+    if err := dorotate( config, cmd.Get("-server").String() ); err != nil {
+        fmt.Fprintf( os.Stderr, "Could not rotate password: %s\n", err )
+        os.Exit(1)
+    }
+}
+
+// The vidrec commands ask the provider running on this host to do the work,
+// as it is the one with the video.
+func runVidRecStart( cmd *uc.Cmd ) {
+    config := common( cmd )
+    
+    body, err := callProvider( config, "/vidRec/start", url.Values{
+        "udid": {cmd.Get("-id").String()},
+        "name": {cmd.Get("-name").String()},
+    } )
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "Could not start recording: %s\n", err )
+        os.Exit(1)
+    }
+    fmt.Println( string( body ) )
+}
+
+func runVidRecStop( cmd *uc.Cmd ) {
+    config := common( cmd )
+    
+    body, err := callProvider( config, "/vidRec/stop", url.Values{
+        "udid": {cmd.Get("-id").String()},
+    } )
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "Could not stop recording: %s\n", err )
+        os.Exit(1)
+    }
+    fmt.Println( string( body ) )
+}
+
+func runVidRecList( cmd *uc.Cmd ) {
+    config := common( cmd )
+    
+    body, err := callProvider( config, "/vidRec/list", url.Values{} )
+    if err != nil {
+        fmt.Fprintf( os.Stderr, "Could not list recordings: %s\n", err )
+        os.Exit(1)
+    }
+    fmt.Println( string( body ) )
 }
 
 func runMain( cmd *uc.Cmd ) {
@@ -0,0 +1,306 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/url"
+    "os"
+    "sync"
+    "time"
+    log "github.com/sirupsen/logrus"
+)
+
+// Most updates kept while ControlFloor cannot be reached. Past it the
+// oldest are dropped.
+const NOTIFY_QUEUE_MAX = 1000
+
+// How long changes to the queue are gathered before it is saved
+const NOTIFY_SAVE_DELAY = time.Second
+
+// NotifyItem is one status update waiting to be posted to ControlFloor.
+type NotifyItem struct {
+    Key      string     `json:"key"`
+    Name     string     `json:"name"`
+    Udid     string     `json:"udid"`
+    Variant  string     `json:"variant"`
+    Vals     url.Values `json:"vals"`
+    Queued   time.Time  `json:"queued"`
+    Attempts int        `json:"attempts"`
+}
+
+type NotifyMetrics struct {
+    Depth     int   `json:"depth"`
+    OldestAge int64 `json:"oldestAge"` // ms the oldest pending update has waited
+    Sent      int   `json:"sent"`
+    Dropped   int   `json:"dropped"`   // rejected by ControlFloor
+    Merged    int   `json:"merged"`    // replaced by a later update before sending
+    Failures  int   `json:"failures"`  // attempts that will be retried
+    Overflow  int   `json:"overflow"`  // dropped to keep within NOTIFY_QUEUE_MAX
+}
+
+/*
+NotifyQueue sends status updates to ControlFloor in the order they were
+made, retrying with backoff while ControlFloor cannot be reached.
+
+Updates are keyed by device and variant; a new update replaces a pending
+one with the same key and moves to the back, since only the latest state
+matters. Updates that are not states but events are queued with a unique
+key so none are lost.
+
+At most NOTIFY_QUEUE_MAX updates are kept; when more are made while
+ControlFloor is away the oldest are dropped.
+
+When path is set the pending updates are written there, at most once every
+NOTIFY_SAVE_DELAY, and read back at startup, so they outlive a provider
+restart.
+*/
+type NotifyQueue struct {
+    lock    *sync.Mutex
+    items   []*NotifyItem
+    seq     int
+    path    string
+    saving  bool // a save is due within NOTIFY_SAVE_DELAY
+    send    func( item *NotifyItem ) error
+    wakeCh  chan bool
+    stopCh  chan bool
+    metrics NotifyMetrics
+}
+
+// NotifyRejected is a send that must not be retried; ControlFloor got the
+// update and refused it.
+type NotifyRejected struct {
+    status int
+}
+
+func (self *NotifyRejected) Error() string {
+    return fmt.Sprintf( "rejected with status %d", self.status )
+}
+
+func NewNotifyQueue( path string, send func( item *NotifyItem ) error ) *NotifyQueue {
+    self := &NotifyQueue{
+        lock:   &sync.Mutex{},
+        items:  []*NotifyItem{},
+        path:   path,
+        send:   send,
+        wakeCh: make( chan bool, 1 ),
+        stopCh: make( chan bool ),
+    }
+    self.load()
+    return self
+}
+
+// add queues an update. When coalesce is set it replaces any pending
+// update for the same device and variant.
+func (self *NotifyQueue) add( name string, udid string, variant string, vals url.Values, coalesce bool ) {
+    self.lock.Lock()
+    key := udid + "/" + variant
+    if coalesce {
+        for i, item := range self.items {
+            if item.Key == key {
+                self.items = append( self.items[:i], self.items[i+1:]... )
+                self.metrics.Merged++
+                break
+            }
+        }
+    } else {
+        self.seq++
+        key = fmt.Sprintf( "%s#%d.%d", key, time.Now().Unix(), self.seq )
+    }
+    self.items = append( self.items, &NotifyItem{
+        Key:     key,
+        Name:    name,
+        Udid:    udid,
+        Variant: variant,
+        Vals:    vals,
+        Queued:  time.Now(),
+    } )
+    if over := len( self.items ) - NOTIFY_QUEUE_MAX; over > 0 {
+        dropped := self.items[0]
+        self.items = self.items[over:]
+        self.metrics.Overflow += over
+        log.WithFields( log.Fields{
+            "type":    "cf_notify_overflow",
+            "name":    dropped.Name,
+            "udid":    censorUuid( dropped.Udid ),
+            "queued":  dropped.Queued,
+            "dropped": self.metrics.Overflow,
+        } ).Warn( "ControlFloor notification queue is full; dropped the oldest update" )
+    }
+    self.saveSoon()
+    self.lock.Unlock()
+
+    self.wake()
+}
+
+func (self *NotifyQueue) wake() {
+    select {
+        case self.wakeCh <- true:
+        default:
+    }
+}
+
+func (self *NotifyQueue) start() {
+    go self.run()
+}
+
+func (self *NotifyQueue) stop() {
+    close( self.stopCh )
+    self.lock.Lock()
+    self.save()
+    self.lock.Unlock()
+}
+
+func (self *NotifyQueue) run() {
+    failures := 0
+    for {
+        self.lock.Lock()
+        var item *NotifyItem
+        if len( self.items ) > 0 {
+            item = self.items[0]
+        }
+        self.lock.Unlock()
+
+        if item == nil {
+            select {
+                case <- self.stopCh: return
+                case <- self.wakeCh:
+            }
+            continue
+        }
+
+        err := self.send( item )
+
+        self.lock.Lock()
+        item.Attempts++
+        _, rejected := err.( *NotifyRejected )
+        if err == nil || rejected {
+            self.remove( item )
+            if err == nil {
+                self.metrics.Sent++
+            } else {
+                self.metrics.Dropped++
+            }
+        } else {
+            self.metrics.Failures++
+        }
+        self.saveSoon()
+        self.lock.Unlock()
+
+        if err == nil || rejected {
+            failures = 0
+            continue
+        }
+
+        wait := cfBackoff( failures )
+        failures++
+        log.WithFields( log.Fields{
+            "type":     "cf_notify_retry",
+            "name":     item.Name,
+            "udid":     censorUuid( item.Udid ),
+            "attempts": item.Attempts,
+            "wait":     wait.String(),
+            "error":    err,
+        } ).Warn( fmt.Sprintf("Could not notify CF of %s; will retry", item.Name) )
+        select {
+            case <- self.stopCh: return
+            case <- time.After( wait ):
+        }
+    }
+}
+
+// remove drops item unless a newer update already replaced it.
+func (self *NotifyQueue) remove( item *NotifyItem ) {
+    for i, one := range self.items {
+        if one == item {
+            self.items = append( self.items[:i], self.items[i+1:]... )
+            return
+        }
+    }
+}
+
+// clear drops every pending update.
+func (self *NotifyQueue) clear() {
+    self.lock.Lock()
+    self.metrics.Dropped += len( self.items )
+    self.items = []*NotifyItem{}
+    self.saveSoon()
+    self.lock.Unlock()
+}
+
+func (self *NotifyQueue) getMetrics() NotifyMetrics {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    metrics := self.metrics
+    metrics.Depth = len( self.items )
+    if len( self.items ) > 0 {
+        oldest := self.items[0].Queued
+        for _, item := range self.items {
+            if item.Queued.Before( oldest ) {
+                oldest = item.Queued
+            }
+        }
+        metrics.OldestAge = time.Since( oldest ).Milliseconds()
+    }
+    return metrics
+}
+
+// saveSoon saves the queue after NOTIFY_SAVE_DELAY, along with any other
+// changes made by then. Called with lock held.
+func (self *NotifyQueue) saveSoon() {
+    if self.path == "" || self.saving {
+        return
+    }
+    self.saving = true
+    time.AfterFunc( NOTIFY_SAVE_DELAY, func() {
+        self.lock.Lock()
+        self.save()
+        self.lock.Unlock()
+    } )
+}
+
+// save writes the pending updates to path. Called with lock held.
+func (self *NotifyQueue) save() {
+    if self.path == "" {
+        return
+    }
+    self.saving = false
+    bytes, _ := json.Marshal( self.items )
+    tmp := self.path + ".tmp"
+    err := ioutil.WriteFile( tmp, bytes, 0644 )
+    if err == nil {
+        err = os.Rename( tmp, self.path )
+    }
+    if err != nil {
+        log.WithFields( log.Fields{
+            "type":  "cf_notify_save_fail",
+            "path":  self.path,
+            "error": err,
+        } ).Error( "Could not save pending ControlFloor notifications" )
+    }
+}
+
+func (self *NotifyQueue) load() {
+    if self.path == "" {
+        return
+    }
+    bytes, err := ioutil.ReadFile( self.path )
+    if err != nil {
+        return
+    }
+    items := []*NotifyItem{}
+    if err := json.Unmarshal( bytes, &items ); err != nil {
+        log.WithFields( log.Fields{
+            "type":  "cf_notify_load_fail",
+            "path":  self.path,
+            "error": err,
+        } ).Error( "Could not read pending ControlFloor notifications" )
+        return
+    }
+    self.items = items
+    log.WithFields( log.Fields{
+        "type":  "cf_notify_load",
+        "count": len( items ),
+    } ).Info( "Loaded pending ControlFloor notifications" )
+}
@@ -5,6 +5,7 @@ import (
     log "github.com/sirupsen/logrus"
     gocmd "github.com/go-cmd/cmd"
     "os"
+    "sync"
     "time"
 )
 
@@ -41,6 +42,48 @@ type GenericProc struct {
     backoff   *Backoff
     pid       int
     cmd       *gocmd.Cmd
+    statLock  *sync.Mutex
+    starts    int
+    lastErr   string
+    lastErrAt time.Time
+}
+
+type ProcStats struct {
+    Name        string `json:"name"`
+    Pid         int    `json:"pid"`
+    Restarts    int    `json:"restarts"`
+    LastError   string `json:"lastError,omitempty"`
+    LastErrorAt int64  `json:"lastErrorAt,omitempty"` // unix time
+}
+
+func (self *GenericProc) noteStart() {
+    self.statLock.Lock()
+    self.starts++
+    self.statLock.Unlock()
+}
+
+func (self *GenericProc) noteError( text string ) {
+    self.statLock.Lock()
+    self.lastErr = text
+    self.lastErrAt = time.Now()
+    self.statLock.Unlock()
+}
+
+func (self *GenericProc) stats() ProcStats {
+    self.statLock.Lock()
+    defer self.statLock.Unlock()
+    stats := ProcStats{
+        Name:      self.name,
+        Pid:       self.pid,
+        LastError: self.lastErr,
+    }
+    if self.starts > 1 {
+        stats.Restarts = self.starts - 1
+    }
+    if !self.lastErrAt.IsZero() {
+        stats.LastErrorAt = self.lastErrAt.Unix()
+    }
+    return stats
 }
 
 func (self *GenericProc) Kill() {
@@ -63,6 +106,7 @@ func proc_generic( procTracker ProcTracker, wrapper interface{}, opt *ProcOption
     proc := GenericProc {
         controlCh: controlCh,
         name: opt.procName,
+        statLock: &sync.Mutex{},
     }
         
     var plog *log.Entry
@@ -131,6 +175,7 @@ func proc_generic( procTracker ProcTracker, wrapper interface{}, opt *ProcOption
         }
 
         backoff.markStart()
+        proc.noteStart()
         
         statCh := cmd.Start()
         
@@ -142,12 +187,13 @@ func proc_generic( procTracker ProcTracker, wrapper interface{}, opt *ProcOption
                 errStream := cmd.Stderr
                 
                 errText := ""
+                ERRLOOP:
                 for {
                   select {
                     case line, _ := <- errStream:
                       errText = errText + line
                     default:
-                      break
+                      break ERRLOOP
                   }
                 }
                 
@@ -156,6 +202,7 @@ func proc_generic( procTracker ProcTracker, wrapper interface{}, opt *ProcOption
                     "error": status.Error,
                     "text": errText,
                 } ).Error("Error starting - " + opt.procName)
+                proc.noteError( status.Error.Error() )
                 
                 return
             }
@@ -163,12 +210,13 @@ func proc_generic( procTracker ProcTracker, wrapper interface{}, opt *ProcOption
             if status.Exit != -1 {
                 errStream := cmd.Stderr
                 errText := ""
+                EXITLOOP:
                 for {
                   select {
                     case line, _ := <- errStream:
                       errText = errText + line
                     default:
-                      break
+                      break EXITLOOP
                   }
                 }
                 
@@ -178,6 +226,7 @@ func proc_generic( procTracker ProcTracker, wrapper interface{}, opt *ProcOption
                     "args": opt.args,
                     "text": errText,
                 } ).Error("Error starting - " + opt.procName)
+                proc.noteError( fmt.Sprintf( "exited %d on start", status.Exit ) )
                 
                 return
             }
@@ -232,6 +281,10 @@ func proc_generic( procTracker ProcTracker, wrapper interface{}, opt *ProcOption
             if runDone { break }
         }
         
+        if final := cmd.Status(); !stop && final.Exit > 0 {
+            proc.noteError( fmt.Sprintf( "exited %d", final.Exit ) )
+        }
+        
         proc.cmd = nil
         
         backoff.markEnd()
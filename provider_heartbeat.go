@@ -0,0 +1,297 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net/url"
+    "os/exec"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    si "github.com/elastic/go-sysinfo"
+    "github.com/elastic/go-sysinfo/types"
+    log "github.com/sirupsen/logrus"
+)
+
+// Set at build time with -ldflags "-X main.providerVersion=..."
+var providerVersion = "dev"
+
+var providerStart = time.Now()
+
+type HostHealth struct {
+    Name         string  `json:"name"`
+    Os           string  `json:"os"`
+    Cpu          float64 `json:"cpu"` // percent busy since the last sample
+    Cores        int     `json:"cores"`
+    MemTotal     uint64  `json:"memTotal"`
+    MemUsed      uint64  `json:"memUsed"`
+    MemAvailable uint64  `json:"memAvailable"`
+    Load1        float64 `json:"load1"`
+    Load5        float64 `json:"load5"`
+    Load15       float64 `json:"load15"`
+    ProviderRss  uint64  `json:"providerRss"` // memory held by the provider itself
+}
+
+type DeviceHealth struct {
+    Udid        string         `json:"udid"`
+    Name        string         `json:"name"`
+    CfaRunning  bool           `json:"cfaRunning"`
+    WdaRunning  bool           `json:"wdaRunning"`
+    VidRunning  bool           `json:"vidRunning"`
+    Cfa         *CFAHealth     `json:"cfa,omitempty"`
+    Fps         float64        `json:"fps"` // frames sent to viewers since the last sample
+    Viewers     int            `json:"viewers"`
+    Video       *VidAdaptStats `json:"video,omitempty"`
+    Dedup       *VidDedupStats `json:"dedup,omitempty"`
+    Source      *VidSourceStats `json:"source,omitempty"`
+    Owner       string         `json:"owner,omitempty"`
+    Procs       []ProcStats    `json:"procs"`
+    LastError   string         `json:"lastError,omitempty"`
+    LastErrorAt int64          `json:"lastErrorAt,omitempty"` // unix time
+}
+
+type ProviderHealth struct {
+    Version string         `json:"version"`
+    Uptime  int64          `json:"uptime"` // seconds
+    Time    int64          `json:"time"`   // unix time
+    Host    HostHealth     `json:"host"`
+    Devices []DeviceHealth `json:"devices"`
+}
+
+// HealthSampler builds health reports. Rates such as CPU use and fps are
+// measured between one report and the next.
+type HealthSampler struct {
+    lock     *sync.Mutex
+    lastCpu  *types.CPUTimes
+    lastTime time.Time
+    frames   map[string] int
+}
+
+func NewHealthSampler() *HealthSampler {
+    return &HealthSampler{
+        lock:   &sync.Mutex{},
+        frames: make( map[string] int ),
+    }
+}
+
+func (self *HealthSampler) sample( devTracker *DeviceTracker ) *ProviderHealth {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    now := time.Now()
+    elapsed := now.Sub( self.lastTime ).Seconds()
+    if self.lastTime.IsZero() {
+        elapsed = 0
+    }
+    self.lastTime = now
+
+    report := &ProviderHealth{
+        Version: providerVersion,
+        Uptime:  int64( time.Since( providerStart ).Seconds() ),
+        Time:    now.Unix(),
+        Host:    self.hostHealth(),
+        Devices: []DeviceHealth{},
+    }
+
+    // Rebuilt each time so that devices that have gone are forgotten
+    seen := make( map[string] int )
+    for _, dev := range devTracker.devices() {
+        if !dev.connected {
+            continue
+        }
+        health := dev.health()
+        frames := dev.vidCast.frameCount()
+        if last, ok := self.frames[ dev.udid ]; ok && elapsed > 0 {
+            health.Fps = float64( frames - last ) / elapsed
+        }
+        seen[ dev.udid ] = frames
+        report.Devices = append( report.Devices, health )
+    }
+    self.frames = seen
+    return report
+}
+
+func (self *HealthSampler) hostHealth() HostHealth {
+    health := HostHealth{
+        Cores: runtime.NumCPU(),
+    }
+
+    host, err := si.Host()
+    if err != nil {
+        return health
+    }
+    info := host.Info()
+    health.Name = info.Hostname
+    if info.OS != nil {
+        health.Os = info.OS.Name + " " + info.OS.Version
+    }
+
+    if mem, err := host.Memory(); err == nil {
+        health.MemTotal = mem.Total
+        health.MemUsed = mem.Used
+        health.MemAvailable = mem.Available
+    }
+
+    if cpu, err := host.CPUTime(); err == nil {
+        if self.lastCpu != nil {
+            total := cpu.Total() - self.lastCpu.Total()
+            idle := cpu.Idle - self.lastCpu.Idle
+            if total > 0 {
+                health.Cpu = float64( total - idle ) * 100 / float64( total )
+            }
+        }
+        self.lastCpu = &cpu
+    }
+
+    if load, err := hostLoad( host ); err == nil {
+        health.Load1, health.Load5, health.Load15 = load.One, load.Five, load.Fifteen
+    }
+
+    if proc, err := si.Self(); err == nil {
+        if mem, err := proc.Memory(); err == nil {
+            health.ProviderRss = mem.Resident
+        }
+    }
+    return health
+}
+
+// hostLoad gets the load average from go-sysinfo where it supports it. On
+// macOS it does not, so sysctl is asked instead.
+func hostLoad( host types.Host ) ( types.LoadAverageInfo, error ) {
+    if loader, ok := host.( types.LoadAverage ); ok {
+        return loader.LoadAverage(), nil
+    }
+    var text string
+    if content, err := ioutil.ReadFile( "/proc/loadavg" ); err == nil {
+        text = string( content )
+    } else {
+        out, err := exec.Command( "sysctl", "-n", "vm.loadavg" ).Output()
+        if err != nil {
+            return types.LoadAverageInfo{}, err
+        }
+        // "{ 1.23 1.45 1.67 }"
+        text = strings.Trim( string( out ), "{} \n" )
+    }
+    parts := strings.Fields( text )
+    if len( parts ) < 3 {
+        return types.LoadAverageInfo{}, errors.New("unexpected load average format")
+    }
+    load := types.LoadAverageInfo{}
+    load.One, _ = strconv.ParseFloat( parts[0], 64 )
+    load.Five, _ = strconv.ParseFloat( parts[1], 64 )
+    load.Fifteen, _ = strconv.ParseFloat( parts[2], 64 )
+    return load, nil
+}
+
+// health summarises how the device is doing. Fps is filled in by the
+// sampler.
+func (self *Device) health() DeviceHealth {
+    health := DeviceHealth{
+        Udid:       self.udid,
+        Name:       self.name,
+        CfaRunning: self.cfaRunning,
+        WdaRunning: self.wdaRunning,
+        VidRunning: self.vidRunning,
+        Viewers:    self.vidCast.viewers(),
+        Procs:      []ProcStats{},
+    }
+    if self.vidAdapt != nil {
+        vidStats := self.vidAdapt.stats()
+        health.Video = &vidStats
+    }
+    if self.vidDedup != nil {
+        dedupStats := self.vidDedup.stats()
+        health.Dedup = &dedupStats
+    }
+    if self.vidSource != nil {
+        sourceStats := self.vidSource.stats()
+        health.Source = &sourceStats
+    }
+    if self.cfa != nil {
+        cfaHealth := self.cfa.health()
+        health.Cfa = &cfaHealth
+    }
+
+    self.lock.Lock()
+    health.Owner = self.owner
+    health.LastError = self.lastErr
+    if !self.lastErrAt.IsZero() {
+        health.LastErrorAt = self.lastErrAt.Unix()
+    }
+    procs := []*GenericProc{}
+    for _, proc := range self.process {
+        procs = append( procs, proc )
+    }
+    self.lock.Unlock()
+
+    for _, proc := range procs {
+        health.Procs = append( health.Procs, proc.stats() )
+    }
+    return health
+}
+
+// heartbeat sends a health report to ControlFloor every interval until the
+// provider shuts down.
+func (self *DeviceTracker) heartbeat( interval time.Duration ) {
+    if interval <= 0 || self.cf == nil {
+        return
+    }
+    for {
+        time.Sleep( interval )
+        if self.shuttingDown {
+            return
+        }
+        report := self.healthSampler.sample( self )
+        if err := self.cf.sendHeartbeat( report ); err != nil {
+            log.WithFields( log.Fields{
+                "type":  "cf_heartbeat_fail",
+                "error": err,
+            } ).Warn("Could not send heartbeat to ControlFloor")
+        }
+    }
+}
+
+// sendHeartbeat posts a health report to each server in use.
+func (self *ControlFloor) sendHeartbeat( report *ProviderHealth ) error {
+    errs := []string{}
+    for _, srv := range self.targets() {
+        if err := srv.sendHeartbeat( report ); err != nil {
+            errs = append( errs, fmt.Sprintf( "%s: %s", srv.name, err ) )
+        }
+    }
+    if len( errs ) > 0 {
+        return errors.New( strings.Join( errs, "; " ) )
+    }
+    return nil
+}
+
+// sendHeartbeat posts a health report. A missed heartbeat is not retried;
+// the next one supersedes it.
+func (self *CFServer) sendHeartbeat( report *ProviderHealth ) error {
+    if !self.checkLogin() {
+        return errors.New("could not login")
+    }
+    text, _ := json.Marshal( report )
+    resp, err := self.httpClient().PostForm( self.base + "/provider/heartbeat", url.Values{
+        "health": {string( text )},
+    } )
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    ioutil.ReadAll( resp.Body )
+    if resp.StatusCode != 200 {
+        return fmt.Errorf( "status %d", resp.StatusCode )
+    }
+    log.WithFields( log.Fields{
+        "type":    "cf_heartbeat",
+        "server":  self.name,
+        "devices": len( report.Devices ),
+        "cpu":     report.Host.Cpu,
+    } ).Debug("Sent heartbeat to ControlFloor")
+    return nil
+}
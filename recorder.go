@@ -0,0 +1,292 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    uj "github.com/nanoscopic/ujsonin/v2/mod"
+    log "github.com/sirupsen/logrus"
+)
+
+const REC_VERSION = 1
+
+/*
+A recording is a JSON lines file. The first line is a RecHeader and every
+line after it is one RecEvent:
+
+    {"version":1,"udid":"...","started":"2021-06-01T10:00:00Z"}
+    {"t":0,"type":"click","x":120,"y":300,"el":{"type":"icon","label":"Mail","sel":"icon[label=\"Mail\"]"}}
+    {"t":1450,"type":"keys","keys":"104,105"}
+
+Lines are written as events arrive, so a recording cut short by a crash is
+still usable up to its last event.
+*/
+type RecHeader struct {
+    Version int    `json:"version"`
+    Udid    string `json:"udid"`
+    Name    string `json:"name,omitempty"`
+    Started string `json:"started"`
+}
+
+type RecEvent struct {
+    T       int64        `json:"t"` // ms since the recording started
+    Type    string       `json:"type"`
+    X       int          `json:"x,omitempty"`
+    Y       int          `json:"y,omitempty"`
+    X2      int          `json:"x2,omitempty"`
+    Y2      int          `json:"y2,omitempty"`
+    Delay   int          `json:"delay,omitempty"`
+    Time    float64      `json:"time,omitempty"`
+    Page    int          `json:"page,omitempty"`
+    Code    int          `json:"code,omitempty"`
+    Keys    string       `json:"keys,omitempty"`
+    Key     string       `json:"key,omitempty"`
+    Touches [][]RecTouch `json:"touches,omitempty"`
+    El      *RecElement  `json:"el,omitempty"`
+}
+
+type RecTouch struct {
+    X int `json:"x"`
+    Y int `json:"y"`
+    T int `json:"t"`
+}
+
+// RecElement is the element that was under the point when the event was
+// recorded, as far as the last UI snapshot knew.
+type RecElement struct {
+    Type  string `json:"type"`
+    Label string `json:"label,omitempty"`
+    Id    string `json:"id,omitempty"`
+    Sel   string `json:"sel,omitempty"`
+}
+
+type InputRecorder struct {
+    path  string
+    file  *os.File
+    enc   *json.Encoder
+    start time.Time
+    lock  *sync.Mutex
+    count int
+}
+
+func startRecording( dir string, udid string, name string ) ( *InputRecorder, error ) {
+    if err := os.MkdirAll( dir, 0755 ); err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    path := filepath.Join( dir, recBaseName( udid, name, now ) + ".rec" )
+
+    file, err := os.Create( path )
+    if err != nil {
+        return nil, err
+    }
+    self := &InputRecorder{
+        path:  path,
+        file:  file,
+        enc:   json.NewEncoder( file ),
+        start: now,
+        lock:  &sync.Mutex{},
+    }
+    self.enc.SetEscapeHTML( false )
+    err = self.enc.Encode( &RecHeader{
+        Version: REC_VERSION,
+        Udid:    udid,
+        Name:    name,
+        Started: now.UTC().Format( time.RFC3339 ),
+    } )
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+
+    log.WithFields( log.Fields{
+        "type": "rec_start",
+        "udid": censorUuid( udid ),
+        "file": path,
+    } ).Info("Recording input")
+    return self, nil
+}
+
+// recBaseName names a recording of udid started at when. name, if given,
+// is added with anything that could leave the directory replaced.
+func recBaseName( udid string, name string, when time.Time ) string {
+    base := fmt.Sprintf( "%s-%s", udid, when.Format("20060102-150405") )
+    if name != "" {
+        base = base + "-" + strings.Map( func( r rune ) rune {
+            if r == '/' || r == '\\' || r == '.' || r < 32 {
+                return '_'
+            }
+            return r
+        }, name )
+    }
+    return base
+}
+
+func (self *InputRecorder) record( ev RecEvent ) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.file == nil {
+        return
+    }
+    ev.T = time.Since( self.start ).Milliseconds()
+    if err := self.enc.Encode( &ev ); err != nil {
+        log.WithFields( log.Fields{
+            "type": "rec_write_fail",
+            "file": self.path,
+            "err":  err,
+        } ).Error("Could not write recorded event")
+        return
+    }
+    self.count++
+}
+
+// stop closes the file and returns how many events were recorded.
+func (self *InputRecorder) stop() int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.file != nil {
+        self.file.Close()
+        self.file = nil
+        log.WithFields( log.Fields{
+            "type":   "rec_stop",
+            "file":   self.path,
+            "events": self.count,
+        } ).Info("Stopped recording input")
+    }
+    return self.count
+}
+
+// recEventFromMsg picks the fields of a ControlFloor input message worth
+// keeping. ok is false for messages that are not input.
+func recEventFromMsg( mType string, root uj.JNode ) ( RecEvent, bool ) {
+    num := func( name string ) int {
+        if node := root.Get( name ); node != nil {
+            return node.Int()
+        }
+        return 0
+    }
+    str := func( name string ) string {
+        if node := root.Get( name ); node != nil {
+            return node.String()
+        }
+        return ""
+    }
+
+    ev := RecEvent{ Type: mType }
+    switch mType {
+        case "click", "mouseDown", "mouseUp", "hardPress":
+            ev.X, ev.Y = num("x"), num("y")
+        case "longPress":
+            ev.X, ev.Y = num("x"), num("y")
+            ev.Time, _ = strconv.ParseFloat( str("time"), 64 )
+        case "swipe":
+            ev.X, ev.Y, ev.X2, ev.Y2 = num("x1"), num("y1"), num("x2"), num("y2")
+            ev.Delay = num("delay")
+        case "iohid":
+            ev.Page, ev.Code = num("page"), num("code")
+        case "keys":
+            ev.Keys = str("keys")
+        case "keyDown", "keyUp":
+            ev.Key = str("key")
+        case "gesture":
+            gesture, err := parseGesture( root )
+            if err != nil {
+                return ev, false
+            }
+            for _, path := range gesture.touches {
+                touches := []RecTouch{}
+                for _, point := range path {
+                    touches = append( touches, RecTouch{ X: point.x, Y: point.y, T: point.t } )
+                }
+                ev.Touches = append( ev.Touches, touches )
+            }
+            ev.X, ev.Y = gesture.touches[0][0].x, gesture.touches[0][0].y
+        case "home", "taskSwitcher", "shake", "cc", "assistiveTouch":
+        default:
+            return ev, false
+    }
+    return ev, true
+}
+
+// recElementAt finds the innermost visible element of tree containing x,y.
+func recElementAt( tree *SourceNode, x int, y int ) *RecElement {
+    if tree == nil {
+        return nil
+    }
+    var found *SourceNode
+    tree.walk( func( node *SourceNode ) {
+        if node.Visible && node.Frame.contains( x, y ) {
+            found = node
+        }
+    } )
+    if found == nil {
+        return nil
+    }
+    return &RecElement{
+        Type:  found.Type,
+        Label: found.Label,
+        Id:    found.Id,
+        Sel:   selectorFor( found ),
+    }
+}
+
+// selectorFor builds a selector that picks out node by its id, or failing
+// that its label. It returns "" for elements with neither.
+func selectorFor( node *SourceNode ) string {
+    quote := func( str string ) string {
+        str = strings.ReplaceAll( str, `\`, `\\` )
+        return `"` + strings.ReplaceAll( str, `"`, `\"` ) + `"`
+    }
+    if node.Id != "" {
+        return fmt.Sprintf( "%s[id=%s]", node.Type, quote( node.Id ) )
+    }
+    if node.Label != "" {
+        return fmt.Sprintf( "%s[label=%s]", node.Type, quote( node.Label ) )
+    }
+    return ""
+}
+
+// loadRecording reads a recording made by InputRecorder.
+func loadRecording( path string ) ( *RecHeader, []RecEvent, error ) {
+    file, err := os.Open( path )
+    if err != nil {
+        return nil, nil, err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner( file )
+    scanner.Buffer( make( []byte, 64 * 1024 ), 16 * 1024 * 1024 )
+
+    if !scanner.Scan() {
+        return nil, nil, errors.New("recording is empty")
+    }
+    header := &RecHeader{}
+    if err := json.Unmarshal( scanner.Bytes(), header ); err != nil {
+        return nil, nil, fmt.Errorf( "bad header: %s", err )
+    }
+    if header.Version < 1 || header.Version > REC_VERSION {
+        return nil, nil, fmt.Errorf( "recording version %d is not supported", header.Version )
+    }
+
+    events := []RecEvent{}
+    line := 1
+    for scanner.Scan() {
+        line++
+        if len( strings.TrimSpace( scanner.Text() ) ) == 0 {
+            continue
+        }
+        ev := RecEvent{}
+        if err := json.Unmarshal( scanner.Bytes(), &ev ); err != nil {
+            return nil, nil, fmt.Errorf( "line %d: %s", line, err )
+        }
+        events = append( events, ev )
+    }
+    return header, events, scanner.Err()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "fmt"
+    "time"
+)
+
+const (
+    REPLAY_ORIGINAL = iota // keep the recorded gaps between events
+    REPLAY_NORMALIZED      // the same gap between every event
+)
+
+type ReplayOptions struct {
+    timing    int
+    gap       time.Duration // between events when normalized
+    speed     float64       // divides recorded gaps when original
+    byElement bool          // aim at the recorded element rather than the point
+}
+
+// replayEvents runs a recording against dev, stopping at the first event
+// that fails.
+func replayEvents( dev *Device, events []RecEvent, opts ReplayOptions ) error {
+    if opts.speed <= 0 {
+        opts.speed = 1
+    }
+    var last int64
+    for i, ev := range events {
+        if i > 0 {
+            wait := opts.gap
+            if opts.timing == REPLAY_ORIGINAL {
+                wait = time.Duration( float64( ev.T - last ) / opts.speed ) * time.Millisecond
+            }
+            time.Sleep( wait )
+        }
+        last = ev.T
+
+        fmt.Printf( "%d/%d %s\n", i + 1, len( events ), ev.Type )
+        if err := replayOne( dev, ev, opts.byElement ); err != nil {
+            return fmt.Errorf( "event %d ( %s at %dms ): %s", i + 1, ev.Type, ev.T, err )
+        }
+    }
+    return nil
+}
+
+func replayOne( dev *Device, ev RecEvent, byElement bool ) error {
+    x, y := ev.X, ev.Y
+    if byElement && ev.El != nil && ev.El.Sel != "" {
+        els, err := dev.findElements( ev.El.Sel, 0 )
+        if err != nil {
+            return err
+        }
+        if len( els ) == 0 {
+            return fmt.Errorf( "no element matches %s", ev.El.Sel )
+        }
+        x, y = els[0].center()
+    }
+
+    switch ev.Type {
+        case "click":          return dev.clickAt( x, y )
+        case "mouseDown":      return dev.mouseDown( x, y )
+        case "mouseUp":        return dev.mouseUp( x, y )
+        case "hardPress":      return dev.hardPress( x, y )
+        case "longPress":      return dev.longPress( x, y, ev.Time )
+        case "swipe":          return dev.swipe( x, y, ev.X2 + x - ev.X, ev.Y2 + y - ev.Y, ev.Delay )
+        case "iohid":          return dev.iohid( ev.Page, ev.Code )
+        case "keys":           return dev.keys( ev.Keys )
+        case "keyDown":        return dev.keyDown( ev.Key )
+        case "keyUp":          return dev.keyUp( ev.Key )
+        case "home":           return dev.home()
+        case "taskSwitcher":   return dev.taskSwitcher()
+        case "shake":          return dev.shake()
+        case "cc":             return dev.cc()
+        case "assistiveTouch": return dev.toggleAssistiveTouch()
+        case "gesture":
+            gesture := &Gesture{ kind: "path" }
+            for _, path := range ev.Touches {
+                points := []TouchPoint{}
+                for _, touch := range path {
+                    points = append( points, TouchPoint{ x: touch.X + x - ev.X, y: touch.Y + y - ev.Y, t: touch.T } )
+                }
+                gesture.touches = append( gesture.touches, points )
+            }
+            if err := gesture.validate(); err != nil {
+                return gestureErr( err )
+            }
+            return dev.gesture( gesture )
+    }
+    return fmt.Errorf( "unknown event type %s", ev.Type )
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    uj "github.com/nanoscopic/ujsonin/v2/mod"
+)
+
+// ElFrame is the bounding box of an element in the units CFAgent reports.
+type ElFrame struct {
+    X int `json:"x"`
+    Y int `json:"y"`
+    W int `json:"w"`
+    H int `json:"h"`
+}
+
+func (self ElFrame) contains( x int, y int ) bool {
+    return x >= self.X && x < self.X + self.W && y >= self.Y && y < self.Y + self.H
+}
+
+func (self ElFrame) inside( other ElFrame ) bool {
+    return self.X >= other.X && self.Y >= other.Y &&
+        self.X + self.W <= other.X + other.W && self.Y + self.H <= other.Y + other.H
+}
+
+// SourceNode is one element of the tree returned by SourceJson, ElByPid and
+// AppAtPoint. It is also the record handed back to selector callers, so the
+// exported fields are what ControlFloor and the CLI see.
+type SourceNode struct {
+    Type     string  `json:"type"`
+    Label    string  `json:"label,omitempty"`
+    Id       string  `json:"id,omitempty"`
+    Value    string  `json:"value,omitempty"`
+    Frame    ElFrame `json:"frame"`
+    Visible  bool    `json:"visible"`
+    Path     string  `json:"path"` // child indexes from the root, eg "0/3/1"
+    parent   *SourceNode
+    children []*SourceNode
+}
+
+// center is the point to tap to hit the element.
+func (self *SourceNode) center() ( int, int ) {
+    return self.Frame.X + self.Frame.W / 2, self.Frame.Y + self.Frame.H / 2
+}
+
+func (self *SourceNode) attr( name string ) ( string, bool ) {
+    switch name {
+        case "type":  return self.Type, true
+        case "label": return self.Label, true
+        case "id":    return self.Id, true
+        case "value": return self.Value, true
+    }
+    return "", false
+}
+
+func (self *SourceNode) walk( fn func( node *SourceNode ) ) {
+    fn( self )
+    for _, child := range self.children {
+        child.walk( fn )
+    }
+}
+
+// parseSourceTree reads CFAgent source JSON. Children are under "c".
+func parseSourceTree( data []byte ) ( *SourceNode, error ) {
+    root, _, perr := uj.ParseFull( data )
+    if perr != nil || root == nil {
+        return nil, &CFAError{ Code: CFA_ERR_RESPONSE, Action: "source", Err: fmt.Errorf("unparsable source") }
+    }
+    return sourceNodeFrom( root, nil, "0" ), nil
+}
+
+func sourceNodeFrom( jnode uj.JNode, parent *SourceNode, path string ) *SourceNode {
+    str := func( name string ) string {
+        if node := jnode.Get( name ); node != nil {
+            return node.String()
+        }
+        return ""
+    }
+    num := func( name string ) int {
+        if node := jnode.Get( name ); node != nil {
+            return node.Int()
+        }
+        return 0
+    }
+
+    node := &SourceNode{
+        Type:   str("type"),
+        Label:  str("label"),
+        Id:     str("id"),
+        Value:  str("value"),
+        Frame:  ElFrame{ X: num("x"), Y: num("y"), W: num("w"), H: num("h") },
+        Path:   path,
+        parent: parent,
+    }
+    if visNode := jnode.Get("visible"); visNode != nil {
+        node.Visible = visNode.Bool()
+    } else {
+        node.Visible = node.Frame.W > 0 && node.Frame.H > 0
+    }
+
+    if cNode := jnode.Get("c"); cNode != nil {
+        i := 0
+        cNode.ForEach( func( child uj.JNode ) {
+            node.children = append( node.children, sourceNodeFrom( child, node, fmt.Sprintf( "%s/%d", path, i ) ) )
+            i++
+        } )
+    }
+    return node
+}
+
+/*
+Selectors are CSS-like:
+
+    button[label="AssistiveTouch menu"]
+    window > other button:visible
+    [id=appCloseBox]
+    cell[label^="Wi-Fi"]:nth(0)
+    *:at(187,333)
+    image:within(0,0,375,100)
+
+A step is an optional element type ( or * ) followed by any number of
+attribute tests and pseudo classes. Steps separated by a space match
+descendants, steps separated by > match direct children.
+
+Attributes are type, label, id and value. [attr] tests for a non-empty
+value; the operators are = != ^= ( prefix ) $= ( suffix ) and *= ( substring ).
+
+Pseudo classes:
+  :visible :hidden     visibility
+  :nth(n)              the nth ( from 0 ) element matched so far
+  :at(x,y)             the element's frame contains the point
+  :within(x,y,w,h)     the element's frame lies inside the box
+  :has(selector)       the element has a descendant matching selector
+*/
+type Selector struct {
+    text  string
+    steps []*selStep
+}
+
+type selStep struct {
+    child  bool // > rather than descendant
+    elType string
+    attrs  []selAttr
+    pseudo []selPseudo
+}
+
+type selAttr struct {
+    name  string
+    op    string
+    value string
+}
+
+type selPseudo struct {
+    name string
+    args []int
+    sub  *Selector
+}
+
+func parseSelector( text string ) ( *Selector, error ) {
+    p := &selParser{ text: text }
+    sel, err := p.parse()
+    if err != nil {
+        return nil, &CFAError{ Code: CFA_ERR_REQUEST, Action: "selector", Err: err }
+    }
+    return sel, nil
+}
+
+// findAll returns every element under root matching the selector, in
+// document order.
+func (self *Selector) findAll( root *SourceNode ) []*SourceNode {
+    cur := []*SourceNode{}
+    for i, step := range self.steps {
+        cands := []*SourceNode{}
+        seen := map[*SourceNode] bool{}
+        add := func( node *SourceNode ) {
+            if !seen[ node ] && step.matches( node ) {
+                seen[ node ] = true
+                cands = append( cands, node )
+            }
+        }
+        if i == 0 {
+            root.walk( add )
+        } else if step.child {
+            for _, node := range cur {
+                for _, child := range node.children {
+                    add( child )
+                }
+            }
+        } else {
+            for _, node := range cur {
+                for _, child := range node.children {
+                    child.walk( add )
+                }
+            }
+        }
+        cands = sortByPath( root, cands )
+        cur = step.applyNth( cands )
+    }
+    return cur
+}
+
+func (self *Selector) findFirst( root *SourceNode ) *SourceNode {
+    res := self.findAll( root )
+    if len( res ) == 0 {
+        return nil
+    }
+    return res[0]
+}
+
+// sortByPath puts nodes back into document order after gathering them from
+// several subtrees.
+func sortByPath( root *SourceNode, nodes []*SourceNode ) []*SourceNode {
+    if len( nodes ) < 2 {
+        return nodes
+    }
+    want := map[*SourceNode] bool{}
+    for _, node := range nodes {
+        want[ node ] = true
+    }
+    sorted := []*SourceNode{}
+    root.walk( func( node *SourceNode ) {
+        if want[ node ] {
+            sorted = append( sorted, node )
+        }
+    } )
+    return sorted
+}
+
+func (self *selStep) matches( node *SourceNode ) bool {
+    if self.elType != "" && self.elType != "*" && !strings.EqualFold( self.elType, node.Type ) {
+        return false
+    }
+    for _, attr := range self.attrs {
+        val, _ := node.attr( attr.name )
+        ok := false
+        switch attr.op {
+            case "":   ok = val != ""
+            case "=":  ok = val == attr.value
+            case "!=": ok = val != attr.value
+            case "^=": ok = strings.HasPrefix( val, attr.value )
+            case "$=": ok = strings.HasSuffix( val, attr.value )
+            case "*=": ok = strings.Contains( val, attr.value )
+        }
+        if !ok {
+            return false
+        }
+    }
+    for _, pseudo := range self.pseudo {
+        ok := true
+        switch pseudo.name {
+            case "visible": ok = node.Visible
+            case "hidden":  ok = !node.Visible
+            case "at":      ok = node.Frame.contains( pseudo.args[0], pseudo.args[1] )
+            case "within":
+                ok = node.Frame.inside( ElFrame{ X: pseudo.args[0], Y: pseudo.args[1], W: pseudo.args[2], H: pseudo.args[3] } )
+            case "has":
+                ok = false
+                for _, child := range node.children {
+                    if len( pseudo.sub.findAll( child ) ) > 0 {
+                        ok = true
+                        break
+                    }
+                }
+        }
+        if !ok {
+            return false
+        }
+    }
+    return true
+}
+
+func (self *selStep) applyNth( nodes []*SourceNode ) []*SourceNode {
+    for _, pseudo := range self.pseudo {
+        if pseudo.name != "nth" {
+            continue
+        }
+        n := pseudo.args[0]
+        if n < 0 {
+            n += len( nodes )
+        }
+        if n < 0 || n >= len( nodes ) {
+            return []*SourceNode{}
+        }
+        nodes = []*SourceNode{ nodes[ n ] }
+    }
+    return nodes
+}
+
+var selPseudoArgs = map[string] int {
+    "visible": 0,
+    "hidden":  0,
+    "nth":     1,
+    "at":      2,
+    "within":  4,
+    "has":     -1, // takes a selector
+}
+
+type selParser struct {
+    text string
+    pos  int
+}
+
+func (self *selParser) peek() byte {
+    if self.pos >= len( self.text ) {
+        return 0
+    }
+    return self.text[ self.pos ]
+}
+
+func (self *selParser) skipSpace() bool {
+    skipped := false
+    for self.pos < len( self.text ) && self.text[ self.pos ] == ' ' {
+        self.pos++
+        skipped = true
+    }
+    return skipped
+}
+
+func (self *selParser) fail( msg string ) error {
+    return fmt.Errorf( "%s at %d in selector %q", msg, self.pos, self.text )
+}
+
+func (self *selParser) parse() ( *Selector, error ) {
+    sel := &Selector{ text: self.text }
+    self.skipSpace()
+    child := false
+    for self.pos < len( self.text ) {
+        step, err := self.parseStep()
+        if err != nil {
+            return nil, err
+        }
+        step.child = child
+        sel.steps = append( sel.steps, step )
+
+        child = false
+        self.skipSpace()
+        if self.peek() == '>' {
+            self.pos++
+            child = true
+            self.skipSpace()
+        }
+    }
+    if len( sel.steps ) == 0 {
+        return nil, self.fail("empty selector")
+    }
+    if child {
+        return nil, self.fail("selector ends with >")
+    }
+    return sel, nil
+}
+
+func isSelWordChar( c byte ) bool {
+    return c == '_' || c == '-' ||
+        ( c >= 'a' && c <= 'z' ) || ( c >= 'A' && c <= 'Z' ) || ( c >= '0' && c <= '9' )
+}
+
+func (self *selParser) word() string {
+    start := self.pos
+    for self.pos < len( self.text ) && isSelWordChar( self.text[ self.pos ] ) {
+        self.pos++
+    }
+    return self.text[ start:self.pos ]
+}
+
+func (self *selParser) parseStep() ( *selStep, error ) {
+    step := &selStep{}
+    if self.peek() == '*' {
+        self.pos++
+        step.elType = "*"
+    } else {
+        step.elType = self.word()
+    }
+    for {
+        switch self.peek() {
+            case '[':
+                attr, err := self.parseAttr()
+                if err != nil { return nil, err }
+                step.attrs = append( step.attrs, attr )
+            case ':':
+                pseudo, err := self.parsePseudo()
+                if err != nil { return nil, err }
+                step.pseudo = append( step.pseudo, pseudo )
+            default:
+                if step.elType == "" && len( step.attrs ) == 0 && len( step.pseudo ) == 0 {
+                    return nil, self.fail("expected element")
+                }
+                return step, nil
+        }
+    }
+}
+
+func (self *selParser) parseAttr() ( selAttr, error ) {
+    self.pos++ // [
+    self.skipSpace()
+    attr := selAttr{ name: self.word() }
+    if _, ok := (&SourceNode{}).attr( attr.name ); !ok {
+        return attr, self.fail( "unknown attribute " + attr.name )
+    }
+    self.skipSpace()
+    if self.peek() == ']' {
+        self.pos++
+        return attr, nil
+    }
+    for _, op := range []string{ "=", "!=", "^=", "$=", "*=" } {
+        if strings.HasPrefix( self.text[ self.pos: ], op ) {
+            attr.op = op
+        }
+    }
+    if attr.op == "" {
+        return attr, self.fail("expected operator")
+    }
+    self.pos += len( attr.op )
+    self.skipSpace()
+    value, err := self.value()
+    if err != nil {
+        return attr, err
+    }
+    attr.value = value
+    self.skipSpace()
+    if self.peek() != ']' {
+        return attr, self.fail("expected ]")
+    }
+    self.pos++
+    return attr, nil
+}
+
+// value reads a quoted string, with \ escaping the next character, or a
+// bare word.
+func (self *selParser) value() ( string, error ) {
+    quote := self.peek()
+    if quote != '"' && quote != '\'' {
+        return self.word(), nil
+    }
+    self.pos++
+    var out strings.Builder
+    for self.pos < len( self.text ) {
+        c := self.text[ self.pos ]
+        self.pos++
+        if c == '\\' && self.pos < len( self.text ) {
+            out.WriteByte( self.text[ self.pos ] )
+            self.pos++
+            continue
+        }
+        if c == quote {
+            return out.String(), nil
+        }
+        out.WriteByte( c )
+    }
+    return "", self.fail("unterminated string")
+}
+
+func (self *selParser) parsePseudo() ( selPseudo, error ) {
+    self.pos++ // :
+    pseudo := selPseudo{ name: self.word() }
+    argCount, ok := selPseudoArgs[ pseudo.name ]
+    if !ok {
+        return pseudo, self.fail( "unknown pseudo class " + pseudo.name )
+    }
+    if argCount == 0 {
+        return pseudo, nil
+    }
+    if self.peek() != '(' {
+        return pseudo, self.fail("expected (")
+    }
+    self.pos++
+    end := self.matchingParen()
+    if end < 0 {
+        return pseudo, self.fail("expected )")
+    }
+    inner := self.text[ self.pos:end ]
+    self.pos = end + 1
+
+    if argCount < 0 {
+        sub, err := ( &selParser{ text: inner } ).parse()
+        if err != nil {
+            return pseudo, err
+        }
+        pseudo.sub = sub
+        return pseudo, nil
+    }
+    for _, part := range strings.Split( inner, "," ) {
+        num, err := strconv.Atoi( strings.TrimSpace( part ) )
+        if err != nil {
+            return pseudo, self.fail( "bad number " + part )
+        }
+        pseudo.args = append( pseudo.args, num )
+    }
+    if len( pseudo.args ) != argCount {
+        return pseudo, self.fail( fmt.Sprintf( ":%s takes %d numbers", pseudo.name, argCount ) )
+    }
+    return pseudo, nil
+}
+
+// matchingParen finds the ) closing the ( just before pos, skipping quoted
+// strings so that labels may contain parentheses.
+func (self *selParser) matchingParen() int {
+    depth := 1
+    var quote byte
+    for i := self.pos; i < len( self.text ); i++ {
+        c := self.text[ i ]
+        if quote != 0 {
+            if c == '\\' {
+                i++
+            } else if c == quote {
+                quote = 0
+            }
+            continue
+        }
+        switch c {
+            case '"', '\'': quote = c
+            case '(': depth++
+            case ')':
+                depth--
+                if depth == 0 {
+                    return i
+                }
+        }
+    }
+    return -1
+}
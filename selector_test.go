@@ -0,0 +1,139 @@
+package main
+
+import (
+    "io/ioutil"
+    "testing"
+)
+
+func loadSourceFixture( t *testing.T, name string ) *SourceNode {
+    t.Helper()
+    content, err := ioutil.ReadFile( "testdata/" + name )
+    if err != nil {
+        t.Fatalf( "read fixture: %s", err )
+    }
+    root, err := parseSourceTree( content )
+    if err != nil {
+        t.Fatalf( "parse fixture: %s", err )
+    }
+    return root
+}
+
+func labelsOf( nodes []*SourceNode ) []string {
+    labels := []string{}
+    for _, node := range nodes {
+        if node.Label != "" {
+            labels = append( labels, node.Label )
+        } else {
+            labels = append( labels, "#" + node.Id )
+        }
+    }
+    return labels
+}
+
+func TestSelectorHome( t *testing.T ) {
+    root := loadSourceFixture( t, "source_home.json" )
+
+    tests := []struct {
+        sel  string
+        want []string
+    }{
+        { `icon[label=Mail]`, []string{ "Mail" } },
+        { `ICON[label="Safari"]`, []string{ "Safari" } },
+        { `[label^="M"]`, []string{ "Mail", "Messages", "Music" } },
+        { `icon[label$=ar]`, []string{ "Calendar" } },
+        { `icon[label*="Hi"]`, []string{ `Say "Hi" (beta)`, "Hidden App" } },
+        { `icon[label="Say \"Hi\" (beta)"]`, []string{ `Say "Hi" (beta)` } },
+        { `[value]`, []string{ "Calendar", "Settings", "#pageIndicator" } },
+        { `icon[value="1 notification"]`, []string{ "Settings" } },
+        { `[id=SBDock] icon`, []string{ "Phone", "Safari", "Messages", "Music" } },
+        { `[id=SBDock] > icon:nth(1)`, []string{ "Safari" } },
+        { `[id=SBDock] icon:nth(-1)`, []string{ "Music" } },
+        { `icon:nth(20)`, []string{} },
+        { `window > icon`, []string{} },
+        { `window > other > scrollView > icon:hidden`, []string{ "Hidden App", "Offscreen" } },
+        { `scrollView icon:visible:nth(4)`, []string{ `Say "Hi" (beta)` } },
+        { `icon:at(300,1200)`, []string{ "Safari" } },
+        { `icon:within(0,0,750,240)`, []string{ "Mail", "Calendar", "Photos", "Settings" } },
+        { `other:has(icon[label=Phone])`, []string{ "#SBDock" } },
+        { `other[id!=SBDock]:has(icon) > pageIndicator`, []string{ "#pageIndicator" } },
+        { `[label=Nothing]`, []string{} },
+    }
+
+    for _, test := range tests {
+        sel, err := parseSelector( test.sel )
+        if err != nil {
+            t.Errorf( "%s: %s", test.sel, err )
+            continue
+        }
+        got := labelsOf( sel.findAll( root ) )
+        if len( got ) != len( test.want ) {
+            t.Errorf( "%s: got %q, want %q", test.sel, got, test.want )
+            continue
+        }
+        for i := range got {
+            if got[i] != test.want[i] {
+                t.Errorf( "%s: got %q, want %q", test.sel, got, test.want )
+                break
+            }
+        }
+    }
+}
+
+func TestSelectorRecord( t *testing.T ) {
+    root := loadSourceFixture( t, "source_assistivetouch.json" )
+
+    sel, _ := parseSelector( `[label="AssistiveTouch menu"]` )
+    btn := sel.findFirst( root )
+    if btn == nil {
+        t.Fatalf( "AssistiveTouch menu not found" )
+    }
+    if btn.Type != "button" || btn.Id != "assistiveTouchButton" || !btn.Visible {
+        t.Errorf( "unexpected record %+v", btn )
+    }
+    if btn.Frame != ( ElFrame{ X: 652, Y: 600, W: 90, H: 90 } ) {
+        t.Errorf( "unexpected frame %+v", btn.Frame )
+    }
+    if x, y := btn.center(); x != 697 || y != 645 {
+        t.Errorf( "center is %d,%d", x, y )
+    }
+    if btn.Path != "0/0/0" {
+        t.Errorf( "path is %s", btn.Path )
+    }
+
+    sel, _ = parseSelector( `button:has([id=multitaskingIcon])` )
+    if task := sel.findFirst( root ); task == nil || task.Label != "Multitasking" {
+        t.Errorf( "has() found %+v", task )
+    }
+}
+
+func TestSelectorErrors( t *testing.T ) {
+    bad := []string{
+        ``,
+        `   `,
+        `button >`,
+        `[label="unterminated]`,
+        `[color=red]`,
+        `[label~=x]`,
+        `button:shiny`,
+        `button:nth`,
+        `button:nth(a)`,
+        `button:at(1)`,
+        `button:within(1,2,3)`,
+        `button:has()`,
+        `button:has(icon`,
+        `$`,
+    }
+    for _, text := range bad {
+        if _, err := parseSelector( text ); err == nil {
+            t.Errorf( "%q parsed without error", text )
+        } else if cfaErrCode( err ) != CFA_ERR_REQUEST {
+            t.Errorf( "%q gave %v", text, err )
+        }
+    }
+}
+
+func TestSourceTreeBad( t *testing.T ) {
+    if _, err := parseSourceTree( []byte("") ); err == nil {
+        t.Errorf( "empty source parsed" )
+    }
+}
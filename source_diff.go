@@ -0,0 +1,135 @@
+package main
+
+import (
+    "fmt"
+)
+
+/*
+SourceChange is one difference between two snapshots of the UI tree. Adds
+and removes are reported only for the top of a subtree that came or went;
+Count says how many elements that subtree holds. Path is the element's
+path in the newer tree, except for removes where it is the path in the
+older one.
+*/
+type SourceChange struct {
+    Op     string                 `json:"op"` // add, remove or change
+    Path   string                 `json:"path"`
+    Type   string                 `json:"type"`
+    Label  string                 `json:"label,omitempty"`
+    Id     string                 `json:"id,omitempty"`
+    Value  string                 `json:"value,omitempty"`
+    Frame  *ElFrame               `json:"frame,omitempty"`
+    Count  int                    `json:"count,omitempty"`
+    Fields []string               `json:"fields,omitempty"` // changed attributes
+    Old    map[string]interface{} `json:"old,omitempty"`    // their previous values
+}
+
+// diffSourceTrees compares two trees from parseSourceTree. Either may be
+// nil.
+func diffSourceTrees( old *SourceNode, cur *SourceNode ) []SourceChange {
+    changes := []SourceChange{}
+    if old == nil && cur == nil {
+        return changes
+    }
+    if old == nil {
+        return append( changes, sourceSubtreeChange( "add", cur ) )
+    }
+    if cur == nil || sourceKey( old ) != sourceKey( cur ) {
+        changes = append( changes, sourceSubtreeChange( "remove", old ) )
+        if cur != nil {
+            changes = append( changes, sourceSubtreeChange( "add", cur ) )
+        }
+        return changes
+    }
+    diffSourceNode( old, cur, &changes )
+    return changes
+}
+
+/*
+sourceKey is what makes two elements "the same" from one snapshot to the
+next. The accessibility id is used when there is one; otherwise only the
+type is, so that a button whose label changes shows up as a change rather
+than as a remove and an add. Siblings with equal keys are told apart by
+their order.
+*/
+func sourceKey( node *SourceNode ) string {
+    if node.Id != "" {
+        return node.Type + "#" + node.Id
+    }
+    return node.Type
+}
+
+func diffSourceNode( old *SourceNode, cur *SourceNode, changes *[]SourceChange ) {
+    if change, changed := sourceAttrChange( old, cur ); changed {
+        *changes = append( *changes, change )
+    }
+
+    oldByKey := make( map[string] *SourceNode )
+    seen := make( map[string] int )
+    for _, child := range old.children {
+        key := sourceKey( child )
+        oldByKey[ fmt.Sprintf( "%s@%d", key, seen[ key ] ) ] = child
+        seen[ key ]++
+    }
+
+    matched := make( map[*SourceNode] bool )
+    seen = make( map[string] int )
+    for _, child := range cur.children {
+        key := sourceKey( child )
+        oldChild := oldByKey[ fmt.Sprintf( "%s@%d", key, seen[ key ] ) ]
+        seen[ key ]++
+        if oldChild == nil {
+            *changes = append( *changes, sourceSubtreeChange( "add", child ) )
+            continue
+        }
+        matched[ oldChild ] = true
+        diffSourceNode( oldChild, child, changes )
+    }
+
+    for _, child := range old.children {
+        if !matched[ child ] {
+            *changes = append( *changes, sourceSubtreeChange( "remove", child ) )
+        }
+    }
+}
+
+func sourceAttrChange( old *SourceNode, cur *SourceNode ) ( SourceChange, bool ) {
+    change := sourceChangeFor( "change", cur )
+    change.Old = make( map[string]interface{} )
+    if old.Label != cur.Label {
+        change.Fields = append( change.Fields, "label" )
+        change.Old["label"] = old.Label
+    }
+    if old.Value != cur.Value {
+        change.Fields = append( change.Fields, "value" )
+        change.Old["value"] = old.Value
+    }
+    if old.Frame != cur.Frame {
+        change.Fields = append( change.Fields, "frame" )
+        change.Old["frame"] = old.Frame
+    }
+    if old.Visible != cur.Visible {
+        change.Fields = append( change.Fields, "visible" )
+        change.Old["visible"] = old.Visible
+    }
+    return change, len( change.Fields ) > 0
+}
+
+func sourceSubtreeChange( op string, node *SourceNode ) SourceChange {
+    change := sourceChangeFor( op, node )
+    node.walk( func( *SourceNode ) { change.Count++ } )
+    return change
+}
+
+func sourceChangeFor( op string, node *SourceNode ) SourceChange {
+    frame := node.Frame
+    return SourceChange{
+        Op:    op,
+        Path:  node.Path,
+        Type:  node.Type,
+        Label: node.Label,
+        Id:    node.Id,
+        Value: node.Value,
+        Frame: &frame,
+    }
+}
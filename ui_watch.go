@@ -0,0 +1,137 @@
+package main
+
+import (
+    "encoding/json"
+    "sync"
+    "time"
+    log "github.com/sirupsen/logrus"
+)
+
+/*
+UIWatcher pushes changes to the UI tree of a device to ControlFloor so that
+inspectors do not need to poll the full source. A snapshot is taken once
+the screen has settled: settle after the last input command ran, or after
+the foreground app changed. Each snapshot is diffed against the one before.
+*/
+type UIWatcher struct {
+    dev        *Device
+    settle     time.Duration
+    maxChanges int
+    lock       *sync.Mutex
+    snapLock   *sync.Mutex
+    timer      *time.Timer
+    reason     string
+    bundleId   string
+    last       *SourceNode
+    stopped    bool
+}
+
+func NewUIWatcher( dev *Device, settle time.Duration, maxChanges int ) *UIWatcher {
+    return &UIWatcher{
+        dev:        dev,
+        settle:     settle,
+        maxChanges: maxChanges,
+        lock:       &sync.Mutex{},
+        snapLock:   &sync.Mutex{},
+    }
+}
+
+// poke schedules a snapshot settle from now, pushing back any that is
+// already scheduled.
+func (self *UIWatcher) poke( reason string ) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.stopped {
+        return
+    }
+    // An app change is the more useful reason to report; keep it over input
+    if self.timer == nil || self.reason != "app" {
+        self.reason = reason
+    }
+    if self.timer != nil {
+        self.timer.Stop()
+    }
+    self.timer = time.AfterFunc( self.settle, self.snapshot )
+}
+
+func (self *UIWatcher) appChanged( bundleId string ) {
+    self.lock.Lock()
+    self.bundleId = bundleId
+    self.lock.Unlock()
+    self.poke("app")
+}
+
+// tree returns the latest snapshot, or nil if none has been taken.
+func (self *UIWatcher) tree() *SourceNode {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.last
+}
+
+func (self *UIWatcher) stop() {
+    self.lock.Lock()
+    self.stopped = true
+    if self.timer != nil {
+        self.timer.Stop()
+    }
+    self.lock.Unlock()
+}
+
+func (self *UIWatcher) snapshot() {
+    self.snapLock.Lock()
+    defer self.snapLock.Unlock()
+
+    self.lock.Lock()
+    reason := self.reason
+    bundleId := self.bundleId
+    self.timer = nil
+    stopped := self.stopped
+    self.lock.Unlock()
+    if stopped || self.dev.cfa == nil || !self.dev.cfaRunning {
+        return
+    }
+
+    var source string
+    done := self.dev.queueCfa( "uiSnapshot", CFA_PRI_LOW, "ui", func() error {
+        var err error
+        source, err = self.dev.cfa.SourceJson()
+        return err
+    } )
+    if err := <- done; err != nil {
+        log.WithFields( log.Fields{
+            "type": "ui_snapshot_fail",
+            "udid": censorUuid( self.dev.udid ),
+            "err":  err,
+        } ).Debug("Could not snapshot UI tree")
+        return
+    }
+
+    tree, err := parseSourceTree( []byte( source ) )
+    if err != nil {
+        return
+    }
+    self.lock.Lock()
+    changes := diffSourceTrees( self.last, tree )
+    self.last = tree
+    self.lock.Unlock()
+    if len( changes ) == 0 {
+        return
+    }
+
+    truncated := false
+    if self.maxChanges > 0 && len( changes ) > self.maxChanges {
+        changes = changes[ :self.maxChanges ]
+        truncated = true
+    }
+    changesJson, _ := json.Marshal( changes )
+
+    log.WithFields( log.Fields{
+        "type":      "ui_changed",
+        "udid":      censorUuid( self.dev.udid ),
+        "reason":    reason,
+        "changes":   len( changes ),
+        "truncated": truncated,
+    } ).Debug("UI tree changed")
+
+    self.dev.cf.notifyUiChanged( self.dev.udid, bundleId, reason, string( changesJson ), truncated )
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+    "bytes"
+    "image"
+    "image/jpeg"
+    _ "image/png"
+    "sync"
+    "time"
+    nr "github.com/nfnt/resize"
+    log "github.com/sirupsen/logrus"
+)
+
+// Steps between full quality and the lowest configured level
+const VID_ADAPT_STEPS = 6
+
+// Checks in a row the links must look healthy before video is turned up
+const VID_ADAPT_RECOVER = 3
+
+// VidLevel is what a device's video is currently sent at.
+type VidLevel struct {
+    Step    int `json:"step"`    // 0 is full quality, VID_ADAPT_STEPS the lowest
+    Fps     int `json:"fps"`
+    Quality int `json:"quality"` // JPEG quality
+    Scale   int `json:"scale"`   // percent of full resolution
+}
+
+type VidAdaptStats struct {
+    Enabled bool     `json:"enabled"`
+    Level   VidLevel `json:"level"`
+    Bitrate int      `json:"bitrate"` // kbit/s to the busiest viewer at the last check
+    Latency int64    `json:"latency"` // ms per frame written to the slowest viewer
+    Queued  int      `json:"queued"`  // most frames waiting for any one viewer
+    Dropped int      `json:"dropped"` // frames dropped since the check before
+    Changes int      `json:"changes"` // times the level has changed
+}
+
+/*
+VidAdapter turns a device's video down while its viewers cannot keep up and
+back up once they can. Every conf.interval it looks at how long writes to
+the viewers take, how full their queues are, how many frames were dropped
+and the bitrate. The slowest viewer decides, as all viewers get the same
+frames.
+
+Frames pushed by the video app are thinned to the current fps, and the app
+is told the new level through onChange so it can encode less. Frames the
+provider fetches itself, from CFAgent or backup video, are paced to the fps
+and resampled here.
+*/
+type VidAdapter struct {
+    udid        string
+    conf        VidAdaptConfig
+    cast        *VidBroadcaster
+    lock        *sync.Mutex
+    step        int
+    healthy     int // checks in a row the links looked fine
+    lastPub     time.Time
+    lastCheck   time.Time
+    last        map[*VidSubscriber] VidSubStats // at the last check
+    stat        VidAdaptStats
+    onChange    func( VidLevel )
+    stopChan    chan bool
+    stopOnce    sync.Once
+}
+
+func NewVidAdapter( udid string, conf VidAdaptConfig, cast *VidBroadcaster, onChange func( VidLevel ) ) *VidAdapter {
+    if conf.maxFps < 1 {
+        conf.maxFps = 30
+    }
+    if conf.minFps < 1 || conf.minFps > conf.maxFps {
+        conf.minFps = conf.maxFps
+    }
+    if conf.maxQuality < 1 || conf.maxQuality > 100 {
+        conf.maxQuality = 80
+    }
+    if conf.minQuality < 1 || conf.minQuality > conf.maxQuality {
+        conf.minQuality = conf.maxQuality
+    }
+    if conf.minScale < 1 || conf.minScale > 100 {
+        conf.minScale = 100
+    }
+    if conf.interval <= 0 {
+        conf.interval = time.Second
+    }
+    return &VidAdapter{
+        udid:        udid,
+        conf:        conf,
+        cast:        cast,
+        lock:        &sync.Mutex{},
+        last:        make( map[*VidSubscriber] VidSubStats ),
+        onChange:    onChange,
+        stopChan:    make( chan bool ),
+    }
+}
+
+// run checks the viewers' links until stop is called. The level stays at
+// full quality when adapting is disabled; maxFps still applies.
+func (self *VidAdapter) run() {
+    if !self.conf.enabled {
+        return
+    }
+    ticker := time.NewTicker( self.conf.interval )
+    defer ticker.Stop()
+    for {
+        select {
+            case <- self.stopChan:
+                return
+            case <- ticker.C:
+                self.check()
+        }
+    }
+}
+
+func (self *VidAdapter) stop() {
+    self.stopOnce.Do( func() {
+        close( self.stopChan )
+    } )
+}
+
+func (self *VidAdapter) levelAt( step int ) VidLevel {
+    conf := self.conf
+    return VidLevel{
+        Step:    step,
+        Fps:     conf.maxFps - ( conf.maxFps - conf.minFps ) * step / VID_ADAPT_STEPS,
+        Quality: conf.maxQuality - ( conf.maxQuality - conf.minQuality ) * step / VID_ADAPT_STEPS,
+        Scale:   100 - ( 100 - conf.minScale ) * step / VID_ADAPT_STEPS,
+    }
+}
+
+func (self *VidAdapter) level() VidLevel {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.levelAt( self.step )
+}
+
+func (self *VidAdapter) stats() VidAdaptStats {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    stat := self.stat
+    stat.Enabled = self.conf.enabled
+    stat.Level = self.levelAt( self.step )
+    return stat
+}
+
+func (self *VidAdapter) frameGap() time.Duration {
+    return time.Second / time.Duration( self.levelAt( self.step ).Fps )
+}
+
+// allow reports whether a frame pushed by the video app should go out,
+// thinning frames to the current fps.
+func (self *VidAdapter) allow() bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    now := time.Now()
+    // Frames from the app do not arrive evenly, so a little early will do
+    if now.Sub( self.lastPub ) < self.frameGap() * 3 / 4 {
+        return false
+    }
+    self.lastPub = now
+    return true
+}
+
+// pace waits until the next frame is due at the current fps. It is for
+// sources that fetch frames themselves.
+func (self *VidAdapter) pace() {
+    self.lock.Lock()
+    wait := time.Until( self.lastPub.Add( self.frameGap() ) )
+    self.lock.Unlock()
+    if wait > 0 {
+        time.Sleep( wait )
+    }
+    self.lock.Lock()
+    self.lastPub = time.Now()
+    self.lock.Unlock()
+}
+
+// resample re-encodes a frame at the current quality and scale. At full
+// quality frames are sent as they are.
+func (self *VidAdapter) resample( data []byte ) []byte {
+    level := self.level()
+    if level.Step == 0 {
+        return data
+    }
+    img, _, err := image.Decode( bytes.NewReader( data ) )
+    if err != nil {
+        return data
+    }
+    if level.Scale < 100 {
+        width := uint( img.Bounds().Dx() * level.Scale / 100 )
+        img = nr.Resize( width, 0, img, nr.Bilinear )
+    }
+    buf := bytes.Buffer{}
+    if err := jpeg.Encode( &buf, img, &jpeg.Options{ Quality: level.Quality } ); err != nil {
+        return data
+    }
+    return buf.Bytes()
+}
+
+// check measures the viewers' links since the last check and moves the
+// level one step: down at once when a link is struggling, up only after
+// VID_ADAPT_RECOVER checks with room to spare, so that the level does not
+// flap at the edge of what a link can take.
+func (self *VidAdapter) check() {
+    // By subscriber rather than by name, so that a viewer that reconnected
+    // is not compared with its old connection
+    subs := self.cast.subscribers()
+    conf := self.conf
+    now := time.Now()
+
+    self.lock.Lock()
+    elapsed := now.Sub( self.lastCheck ).Seconds()
+    self.lastCheck = now
+
+    stat := VidAdaptStats{ Changes: self.stat.Changes }
+    written := 0
+    watchers := 0
+    last := self.last
+    self.last = make( map[*VidSubscriber] VidSubStats )
+    for _, subscriber := range subs {
+        // Recordings write to disk; only viewers' links matter here
+        if subscriber.passive {
+            continue
+        }
+        watchers++
+        sub := subscriber.stats()
+        prev, seen := last[ subscriber ]
+        self.last[ subscriber ] = sub
+        if seen && elapsed > 0 {
+            rate := int( float64( sub.Bytes - prev.Bytes ) * 8 / 1000 / elapsed )
+            if rate > stat.Bitrate {
+                stat.Bitrate = rate
+            }
+        }
+        // Drops from before a viewer's first check did not happen in this
+        // interval
+        if seen {
+            stat.Dropped += sub.Dropped - prev.Dropped
+        }
+
+        latency := int64( 0 )
+        sent := sub.Sent - prev.Sent
+        written += sent
+        if sent > 0 {
+            latency = ( sub.Busy - prev.Busy ) / int64( sent )
+        } else if sub.Queued > 0 && seen {
+            // Stuck in a write since the last check
+            latency = int64( elapsed * 1000 )
+        }
+        if latency > stat.Latency {
+            stat.Latency = latency
+        }
+        if sub.Queued > stat.Queued {
+            stat.Queued = sub.Queued
+        }
+    }
+    self.stat = stat
+
+    latency := time.Duration( stat.Latency ) * time.Millisecond
+    slow := stat.Dropped > 0 ||
+        stat.Queued * 2 > self.cast.depth ||
+        latency > conf.maxLatency ||
+        ( conf.targetBitrate > 0 && stat.Bitrate > conf.targetBitrate )
+    // With nothing written since the last check there is nothing to go on
+    fine := written > 0 &&
+        stat.Dropped == 0 &&
+        stat.Queued <= 1 &&
+        latency <= conf.maxLatency / 2 &&
+        ( conf.targetBitrate == 0 || stat.Bitrate < conf.targetBitrate * 3 / 4 )
+
+    step := self.step
+    if watchers == 0 {
+        // The next viewer starts over at full quality
+        step = 0
+        self.healthy = 0
+    } else if slow {
+        if step < VID_ADAPT_STEPS {
+            step++
+        }
+        self.healthy = 0
+    } else if fine {
+        self.healthy++
+        if self.healthy >= VID_ADAPT_RECOVER && step > 0 {
+            step--
+            self.healthy = 0
+        }
+    } else if written > 0 {
+        self.healthy = 0
+    }
+
+    if step == self.step {
+        self.lock.Unlock()
+        return
+    }
+    self.step = step
+    self.stat.Changes++
+    level := self.levelAt( step )
+    self.lock.Unlock()
+
+    log.WithFields( log.Fields{
+        "type":    "vid_adapt",
+        "udid":    censorUuid( self.udid ),
+        "step":    level.Step,
+        "fps":     level.Fps,
+        "quality": level.Quality,
+        "scale":   level.Scale,
+        "bitrate": stat.Bitrate,
+        "latency": stat.Latency,
+        "dropped": stat.Dropped,
+    } ).Info("Changed video level")
+
+    if self.onChange != nil {
+        self.onChange( level )
+    }
+}
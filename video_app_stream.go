@@ -21,6 +21,7 @@ type VideoStreamer interface {
     getControlChan() ( chan int )
     setImageConsumer( imgConsumer *ImageConsumer )
     forceOneFrame()
+    setLevel( level VidLevel )
 }
 
 type AppStream struct {
@@ -54,7 +55,7 @@ func (self *AppStream) setImageConsumer( imgConsumer *ImageConsumer ) {
     self.imgHandler.setImageConsumer( imgConsumer )
     if self.controlSocket != nil {
         self.controlMutex.Lock()
-        self.controlSocket.Send([]byte(`{"action": "oneframe"}`))
+        self.controlSocket.Send(appStreamMsg("oneframe"))
         self.controlSocket.Recv()
         self.controlMutex.Unlock()
     }
@@ -63,7 +64,18 @@ func (self *AppStream) setImageConsumer( imgConsumer *ImageConsumer ) {
 func (self *AppStream) forceOneFrame() {
     if self.controlSocket != nil {
         self.controlMutex.Lock()
-        self.controlSocket.Send([]byte(`{"action": "oneframe"}`))
+        self.controlSocket.Send(appStreamMsg("oneframe"))
+        self.controlSocket.Recv()
+        self.controlMutex.Unlock()
+    }
+}
+
+// setLevel asks the video app to send at most level.Fps frames a second, at
+// level.Quality and scaled to level.Scale percent.
+func (self *AppStream) setLevel( level VidLevel ) {
+    if self.controlSocket != nil {
+        self.controlMutex.Lock()
+        self.controlSocket.Send(appStreamLevelMsg(level))
         self.controlSocket.Recv()
         self.controlMutex.Unlock()
     }
@@ -108,7 +120,7 @@ func (self *AppStream) openControl() (mangos.Socket,bool,chan bool) {
                 time.Sleep( time.Second * 1 )
                 continue
             }
-            err := self.controlSocket.Send([]byte(`{"action": "ping"}`))
+            err := self.controlSocket.Send(appStreamMsg("ping"))
             if err != nil {
                 fmt.Printf("video ping -> fail\n" )
                 self.controlMutex.Unlock()
@@ -212,14 +224,14 @@ func (self *AppStream) mainLoop() {
         self.imgHandler.setEnableStream( func() {
             fmt.Printf("Sending start to vidapp\n")
             self.controlMutex.Lock()
-            self.controlSocket.Send([]byte(`{"action": "start"}`))
+            self.controlSocket.Send(appStreamMsg("start"))
             self.controlSocket.Recv()
             self.controlMutex.Unlock()
         } )
         self.imgHandler.setDisableStream( func() {
             fmt.Printf("Sending stop to vidapp\n")
             self.controlMutex.Lock()
-            self.controlSocket.Send([]byte(`{"action": "stop"}`))
+            self.controlSocket.Send(appStreamMsg("stop"))
             self.controlSocket.Recv()
             self.controlMutex.Unlock()
         } )
@@ -244,7 +256,7 @@ func (self *AppStream) mainLoop() {
             self.imgHandler.setSource( imgSocket )
             if firstConnect {
                 self.controlMutex.Lock()
-                self.controlSocket.Send([]byte(`{"action": "start"}`))
+                self.controlSocket.Send(appStreamMsg("start"))
                 self.controlSocket.Recv()
                 self.controlMutex.Unlock()
                 firstConnect = false
@@ -270,7 +282,10 @@ func (self *AppStream) mainLoop() {
                             // TODO: panic.
                         }
                     }
-                    self.device.justStartBroadcast()
+                    if err := self.device.justStartBroadcast(); err != nil {
+                        fmt.Printf("Could not restart video broadcast: %s\n", err )
+                        self.device.vidSource.fail( VSRC_APP, "could not restart broadcast" )
+                    }
                     self.controlSocket = nil
                     imgSocket = nil
                     self.logSocket = nil
@@ -281,7 +296,7 @@ func (self *AppStream) mainLoop() {
             if res == 4 { // lost send socket
                 fmt.Printf("Lost send socket; disabling video stream\n")
                 self.controlMutex.Lock()
-                self.controlSocket.Send([]byte(`{"action": "stop"}`))
+                self.controlSocket.Send(appStreamMsg("stop"))
                 self.controlSocket.Recv()
                 self.controlMutex.Unlock()
             }
@@ -0,0 +1,331 @@
+package main
+
+import (
+    "sync"
+    "time"
+    ws "github.com/gorilla/websocket"
+    log "github.com/sirupsen/logrus"
+)
+
+// VidConn is the part of a video websocket a subscriber writes to.
+type VidConn interface {
+    WriteMessage( int, []byte ) error
+    Close() error
+}
+
+// VidFrame is one frame on its way to viewers. text, when set, is sent
+// ahead of the image as its metadata.
+type VidFrame struct {
+    text string
+    data []byte
+}
+
+type VidSubStats struct {
+    Viewer    string `json:"viewer"`
+    Sent      int    `json:"sent"`
+    Dropped   int    `json:"dropped"`   // frames pushed out of the queue by newer ones
+    Queued    int    `json:"queued"`
+    Connected int64  `json:"connected"` // ms since the viewer subscribed
+    LastSent  int64  `json:"lastSent"`  // ms since a frame was last written; -1 for never
+    Bytes     int64  `json:"bytes"`
+    Busy      int64  `json:"busy"`      // ms spent writing frames in all
+    Passive   bool   `json:"passive,omitempty"`
+}
+
+// VidSubscriber is one viewer's connection. Frames wait in a bounded queue
+// that drops the oldest frame when full, so a slow viewer only falls behind
+// itself.
+type VidSubscriber struct {
+    viewer    string
+    conn      VidConn
+    passive   bool // a sink such as a recording rather than someone watching
+    queue     chan *VidFrame
+    lock      *sync.Mutex
+    sent      int
+    dropped   int
+    connected time.Time
+    lastSent  time.Time
+    bytes     int64
+    busy      time.Duration
+    doneChan  chan bool
+    closeOnce sync.Once
+}
+
+/*
+VidBroadcaster fans frames from the device's video source out to every
+subscribed viewer. onFirst is called when the first viewer subscribes and
+onEmpty when the last one leaves, so the source only streams while someone
+is watching. The two always alternate, starting with onFirst.
+*/
+type VidBroadcaster struct {
+    udid      string
+    lock      *sync.Mutex
+    subs      map[string] *VidSubscriber
+    depth     int
+    frames    int // published since the start
+    onFirst   func()
+    onEmpty   func()
+    edgeLock  *sync.Mutex // held while deciding on and calling onFirst / onEmpty
+    streaming bool        // onFirst was called last
+}
+
+func NewVidBroadcaster( udid string, depth int, onFirst func(), onEmpty func() ) *VidBroadcaster {
+    if depth < 1 {
+        depth = 1
+    }
+    return &VidBroadcaster{
+        udid:    udid,
+        lock:    &sync.Mutex{},
+        subs:    make( map[string] *VidSubscriber ),
+        depth:    depth,
+        onFirst:  onFirst,
+        onEmpty:  onEmpty,
+        edgeLock: &sync.Mutex{},
+    }
+}
+
+// settle calls onFirst or onEmpty if whether there are viewers has changed
+// since either was last called. Viewers may come and go meanwhile, so it
+// looks at who is subscribed now rather than at what changed.
+func (self *VidBroadcaster) settle() {
+    self.edgeLock.Lock()
+    defer self.edgeLock.Unlock()
+    watched := self.count() > 0
+    if watched == self.streaming {
+        return
+    }
+    self.streaming = watched
+    if watched && self.onFirst != nil {
+        self.onFirst()
+    } else if !watched && self.onEmpty != nil {
+        self.onEmpty()
+    }
+}
+
+// subscribe adds a viewer, replacing its previous connection if it had one.
+func (self *VidBroadcaster) subscribe( viewer string, conn VidConn ) *VidSubscriber {
+    return self.add( viewer, conn, false )
+}
+
+// subscribeSink adds a subscriber that takes frames without anyone
+// watching them. Sinks keep the source streaming but are not counted by
+// viewers.
+func (self *VidBroadcaster) subscribeSink( name string, conn VidConn ) *VidSubscriber {
+    return self.add( name, conn, true )
+}
+
+func (self *VidBroadcaster) add( viewer string, conn VidConn, passive bool ) *VidSubscriber {
+    sub := &VidSubscriber{
+        viewer:    viewer,
+        conn:      conn,
+        passive:   passive,
+        queue:     make( chan *VidFrame, self.depth ),
+        lock:      &sync.Mutex{},
+        connected: time.Now(),
+        doneChan:  make( chan bool ),
+    }
+
+    self.lock.Lock()
+    old := self.subs[ viewer ]
+    self.subs[ viewer ] = sub
+    self.lock.Unlock()
+
+    if old != nil {
+        old.close()
+    }
+    go self.writeLoop( sub )
+
+    log.WithFields( log.Fields{
+        "type":    "vid_subscribe",
+        "udid":    censorUuid( self.udid ),
+        "viewer":  viewer,
+        "viewers": self.count(),
+    } ).Info("Video viewer subscribed")
+
+    self.settle()
+    return sub
+}
+
+// unsubscribe removes sub if it is still the viewer's connection.
+func (self *VidBroadcaster) unsubscribe( sub *VidSubscriber ) {
+    self.lock.Lock()
+    if self.subs[ sub.viewer ] != sub {
+        self.lock.Unlock()
+        sub.close()
+        return
+    }
+    delete( self.subs, sub.viewer )
+    self.lock.Unlock()
+
+    sub.close()
+
+    stats := sub.stats()
+    log.WithFields( log.Fields{
+        "type":    "vid_unsubscribe",
+        "udid":    censorUuid( self.udid ),
+        "viewer":  sub.viewer,
+        "sent":    stats.Sent,
+        "dropped": stats.Dropped,
+    } ).Info("Video viewer left")
+
+    self.settle()
+}
+
+// leave removes a viewer by name.
+func (self *VidBroadcaster) leave( viewer string ) {
+    self.lock.Lock()
+    sub := self.subs[ viewer ]
+    self.lock.Unlock()
+    if sub != nil {
+        self.unsubscribe( sub )
+    }
+}
+
+func (self *VidBroadcaster) leaveAll() {
+    for _, sub := range self.subscribers() {
+        self.unsubscribe( sub )
+    }
+}
+
+func (self *VidBroadcaster) subscribers() []*VidSubscriber {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    subs := []*VidSubscriber{}
+    for _, sub := range self.subs {
+        subs = append( subs, sub )
+    }
+    return subs
+}
+
+// count is how many subscribers there are, sinks included.
+func (self *VidBroadcaster) count() int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return len( self.subs )
+}
+
+// viewers is how many subscribers are someone watching.
+func (self *VidBroadcaster) viewers() int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    count := 0
+    for _, sub := range self.subs {
+        if !sub.passive {
+            count++
+        }
+    }
+    return count
+}
+
+// publish hands a frame to every viewer. It never blocks on a viewer.
+func (self *VidBroadcaster) publish( text string, data []byte ) {
+    self.lock.Lock()
+    self.frames++
+    self.lock.Unlock()
+    
+    frame := &VidFrame{ text: text, data: data }
+    for _, sub := range self.subscribers() {
+        sub.push( frame )
+    }
+}
+
+func (self *VidBroadcaster) frameCount() int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.frames
+}
+
+func (self *VidBroadcaster) stats() []VidSubStats {
+    stats := []VidSubStats{}
+    for _, sub := range self.subscribers() {
+        stats = append( stats, sub.stats() )
+    }
+    return stats
+}
+
+func (self *VidBroadcaster) writeLoop( sub *VidSubscriber ) {
+    for {
+        select {
+            case <- sub.doneChan:
+                return
+            case frame := <- sub.queue:
+                if err := sub.write( frame ); err != nil {
+                    log.WithFields( log.Fields{
+                        "type":   "vid_write_fail",
+                        "udid":   censorUuid( self.udid ),
+                        "viewer": sub.viewer,
+                        "error":  err,
+                    } ).Warn("Could not send video to viewer")
+                    self.unsubscribe( sub )
+                    return
+                }
+        }
+    }
+}
+
+// push queues a frame, dropping the oldest queued one if there is no room.
+func (self *VidSubscriber) push( frame *VidFrame ) {
+    for {
+        select {
+            case self.queue <- frame:
+                return
+            default:
+        }
+        select {
+            case <- self.queue:
+                self.lock.Lock()
+                self.dropped++
+                self.lock.Unlock()
+            default:
+        }
+    }
+}
+
+func (self *VidSubscriber) write( frame *VidFrame ) error {
+    start := time.Now()
+    if frame.text != "" {
+        if err := self.conn.WriteMessage( ws.TextMessage, []byte( frame.text ) ); err != nil {
+            return err
+        }
+    }
+    if err := self.conn.WriteMessage( ws.BinaryMessage, frame.data ); err != nil {
+        return err
+    }
+    took := time.Since( start )
+    self.lock.Lock()
+    self.sent++
+    self.lastSent = time.Now()
+    self.bytes += int64( len( frame.text ) + len( frame.data ) )
+    // A websocket write blocks once the viewer's link is full, so time
+    // spent writing shows how far behind the link is.
+    self.busy += took
+    self.lock.Unlock()
+    return nil
+}
+
+func (self *VidSubscriber) close() {
+    self.closeOnce.Do( func() {
+        close( self.doneChan )
+        self.conn.Close()
+    } )
+}
+
+func (self *VidSubscriber) stats() VidSubStats {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    lastSent := int64( -1 )
+    if !self.lastSent.IsZero() {
+        lastSent = time.Since( self.lastSent ).Milliseconds()
+    }
+    return VidSubStats{
+        Viewer:    self.viewer,
+        Sent:      self.sent,
+        Dropped:   self.dropped,
+        Queued:    len( self.queue ),
+        Connected: time.Since( self.connected ).Milliseconds(),
+        LastSent:  lastSent,
+        Bytes:     self.bytes,
+        Busy:      self.busy.Milliseconds(),
+        Passive:   self.passive,
+    }
+}
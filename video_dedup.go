@@ -0,0 +1,84 @@
+package main
+
+import (
+    "fmt"
+    "hash/crc32"
+    "sync"
+    "time"
+)
+
+var dedupTable = crc32.MakeTable( crc32.Castagnoli )
+
+type VidDedupStats struct {
+    Frames     int     `json:"frames"`     // frames offered since the start
+    Suppressed int     `json:"suppressed"` // of those, not sent as unchanged
+    Keyframes  int     `json:"keyframes"`  // unchanged frames sent anyway to refresh viewers
+    Ratio      float64 `json:"ratio"`      // suppressed / frames
+}
+
+/*
+VidDedup stops a device sending the same screen over and over. Each frame
+has a key: the CRC the video app sends with it, or frameKey of the image
+for screenshot sources. A frame with the same key as the last one sent is
+suppressed, except once every keyframe, so that viewers that missed a frame
+still catch up on an idle screen.
+*/
+type VidDedup struct {
+    enabled   bool
+    keyframe  time.Duration // 0 for no refreshes
+    lock      *sync.Mutex
+    last      string // key of the last frame sent
+    lastSent  time.Time
+    stat      VidDedupStats
+}
+
+func NewVidDedup( enabled bool, keyframe time.Duration ) *VidDedup {
+    return &VidDedup{
+        enabled:  enabled,
+        keyframe: keyframe,
+        lock:     &sync.Mutex{},
+    }
+}
+
+// frameKey is a cheap hash of a frame for sources without a CRC of their
+// own.
+func frameKey( data []byte ) string {
+    return fmt.Sprintf( "%08x-%d", crc32.Checksum( data, dedupTable ), len( data ) )
+}
+
+// fresh reports whether a frame with key should be sent. An empty key is
+// always sent.
+func (self *VidDedup) fresh( key string ) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.stat.Frames++
+    now := time.Now()
+    if self.enabled && key != "" && key == self.last {
+        if self.keyframe <= 0 || now.Sub( self.lastSent ) < self.keyframe {
+            self.stat.Suppressed++
+            return false
+        }
+        self.stat.Keyframes++
+    }
+    self.last = key
+    self.lastSent = now
+    return true
+}
+
+// reset lets the next frame through whatever it is, for a viewer that has
+// just joined or a change in how frames are encoded.
+func (self *VidDedup) reset() {
+    self.lock.Lock()
+    self.last = ""
+    self.lock.Unlock()
+}
+
+func (self *VidDedup) stats() VidDedupStats {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    stat := self.stat
+    if stat.Frames > 0 {
+        stat.Ratio = float64( stat.Suppressed ) / float64( stat.Frames )
+    }
+    return stat
+}
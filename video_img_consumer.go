@@ -1,12 +1,14 @@
 package main
 
 type ImageConsumer struct {
-    consumer  func( string, []byte ) (error)
+    consumer  func( string, []byte, string ) (error)
     noframesf func()
     udid      string
 }
 
-func NewImageConsumer( consumer func( string, []byte ) (error), noframes func() ) (*ImageConsumer) {
+// consumer is given each frame's metadata, image and the CRC the video app
+// sent with it, or "" if none.
+func NewImageConsumer( consumer func( string, []byte, string ) (error), noframes func() ) (*ImageConsumer) {
     self := &ImageConsumer{
         consumer: consumer,
         noframesf: noframes,
@@ -14,8 +16,8 @@ func NewImageConsumer( consumer func( string, []byte ) (error), noframes func()
     return self
 }
 
-func (self *ImageConsumer) consume( text string, bytes []byte ) (error) {
-    return self.consumer( text, bytes )
+func (self *ImageConsumer) consume( text string, bytes []byte, crc string ) (error) {
+    return self.consumer( text, bytes, crc )
 }
 
 func (self *ImageConsumer) noframes() {
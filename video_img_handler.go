@@ -84,6 +84,7 @@ func ( self *ImgHandler ) processImgMsg() (int) {
     }
     
     text := ""
+    crc := ""
     data := []byte{}
     // image is prepended by some JSON metadata
     
@@ -125,11 +126,14 @@ func ( self *ImgHandler ) processImgMsg() (int) {
         if causeNode != nil { cause = causeNode.Int() }
         
         crcNode := root.Get("crc")
-        crc := "n/a"
-        if crcNode != nil { crc = crcNode.String() }
+        crcText := "n/a"
+        if crcNode != nil {
+            crc = crcNode.String()
+            crcText = crc
+        }
         
         text = fmt.Sprintf("{\"Width\": %d, \"Height\": %d, \"Size\": %d, \"Cause\": %d, \"Crc\": \"%s\"}",
-          dw, dh, len( msg.Body ), cause, crc )
+          dw, dh, len( msg.Body ), cause, crcText )
         
         if !self.isUp {
             self.isUp = true
@@ -146,7 +150,7 @@ func ( self *ImgHandler ) processImgMsg() (int) {
     }
     
     if !self.discard {
-        err := self.imgConsumer.consume( text, data )
+        err := self.imgConsumer.consume( text, data, crc )
         msg.Free()
         if err != nil {
             // might as well begin discarding since we can't send
@@ -0,0 +1,552 @@
+package main
+
+import (
+    "archive/tar"
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image"
+    "image/jpeg"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    ws "github.com/gorilla/websocket"
+    log "github.com/sirupsen/logrus"
+)
+
+const VIDREC_VERSION = 1
+
+const VIDREC_INDEX = "index.jsonl"
+
+/*
+A video recording is a directory holding the frames in segment files and
+an index of them. Each segment is the frames as JPEGs one after another,
+which ffplay and VLC play as MJPEG. The index is JSON lines: a VidRecHeader
+and then a VidRecFrame for each frame, in order.
+
+    vidrecordings/<udid>-20210601-100000-login/
+        index.jsonl
+        seg-00001.mjpeg
+        seg-00002.mjpeg
+
+    {"version":1,"udid":"...","started":"2021-06-01T10:00:00.120Z","trigger":5000}
+    {"t":0,"seg":1,"off":0,"len":48211}
+    {"t":33,"seg":1,"off":48211,"len":48177}
+
+Frames with t less than the header's trigger came from the pre-roll buffer,
+from before the recording was asked for.
+*/
+type VidRecHeader struct {
+    Version int    `json:"version"`
+    Udid    string `json:"udid"`
+    Name    string `json:"name,omitempty"`
+    Started string `json:"started"` // time of the first frame
+    Trigger int64  `json:"trigger"` // ms from the first frame to when recording started
+}
+
+type VidRecFrame struct {
+    T   int64 `json:"t"` // ms since the first frame
+    Seg int   `json:"seg"`
+    Off int64 `json:"off"`
+    Len int   `json:"len"`
+}
+
+// VidRecInfo describes a recording for listing.
+type VidRecInfo struct {
+    Id      string `json:"id"`
+    Udid    string `json:"udid"`
+    Name    string `json:"name,omitempty"`
+    Started string `json:"started"`
+    Frames  int    `json:"frames"`
+    Size    int64  `json:"size"`
+    Active  bool   `json:"active"`
+}
+
+// VidTimedFrame is a frame and when it was seen.
+type VidTimedFrame struct {
+    at   time.Time
+    data []byte
+}
+
+/*
+VidRecStore keeps the video recordings of every device under one directory,
+deleting the oldest once they take more than maxSize or are older than
+maxAge. Recordings in progress are never deleted.
+*/
+type VidRecStore struct {
+    dir     string
+    segLen  time.Duration
+    maxSize int64
+    maxAge  time.Duration
+    lock    *sync.Mutex
+    active  map[string] *VidRecorder // by id
+}
+
+func NewVidRecStore( config *Config ) *VidRecStore {
+    self := &VidRecStore{
+        dir:     config.vidRecPath,
+        segLen:  config.vidRecSegment,
+        maxSize: config.vidRecMaxSize,
+        maxAge:  config.vidRecMaxAge,
+        lock:    &sync.Mutex{},
+        active:  make( map[string] *VidRecorder ),
+    }
+    if self.segLen <= 0 {
+        self.segLen = time.Minute
+    }
+    return self
+}
+
+// start begins a recording of udid, beginning with the pre-roll frames.
+func (self *VidRecStore) start( udid string, name string, preroll []VidTimedFrame ) ( *VidRecorder, error ) {
+    if err := os.MkdirAll( self.dir, 0755 ); err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    base := recBaseName( udid, name, now )
+    id := base
+    for n := 2; ; n++ {
+        err := os.Mkdir( filepath.Join( self.dir, id ), 0755 )
+        if err == nil {
+            break
+        }
+        if !os.IsExist( err ) {
+            return nil, err
+        }
+        id = fmt.Sprintf( "%s-%d", base, n )
+    }
+
+    rec, err := newVidRecorder( self, id, udid, name, now, preroll )
+    if err != nil {
+        os.RemoveAll( filepath.Join( self.dir, id ) )
+        return nil, err
+    }
+    self.lock.Lock()
+    self.active[ id ] = rec
+    self.lock.Unlock()
+
+    log.WithFields( log.Fields{
+        "type":    "vidrec_start",
+        "udid":    censorUuid( udid ),
+        "id":      id,
+        "preroll": len( preroll ),
+    } ).Info("Recording video")
+
+    self.prune()
+    return rec, nil
+}
+
+func (self *VidRecStore) finished( rec *VidRecorder ) {
+    self.lock.Lock()
+    delete( self.active, rec.id )
+    self.lock.Unlock()
+    self.prune()
+}
+
+func (self *VidRecStore) isActive( id string ) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.active[ id ] != nil
+}
+
+// path finds the directory of recording id, refusing ids that would reach
+// outside the store.
+func (self *VidRecStore) path( id string ) ( string, error ) {
+    if id == "" || id != filepath.Base( id ) || strings.HasPrefix( id, "." ) {
+        return "", fmt.Errorf( "bad recording id %q", id )
+    }
+    path := filepath.Join( self.dir, id )
+    if _, err := os.Stat( filepath.Join( path, VIDREC_INDEX ) ); err != nil {
+        return "", fmt.Errorf( "no recording %s", id )
+    }
+    return path, nil
+}
+
+// list describes every recording, newest first.
+func (self *VidRecStore) list() ( []VidRecInfo, error ) {
+    infos := []VidRecInfo{}
+    entries, err := ioutil.ReadDir( self.dir )
+    if os.IsNotExist( err ) {
+        return infos, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    for _, entry := range entries {
+        if !entry.IsDir() {
+            continue
+        }
+        info, err := self.info( entry.Name() )
+        if err != nil {
+            continue
+        }
+        infos = append( infos, info )
+    }
+    sort.Slice( infos, func( i, j int ) bool {
+        return infos[i].Started > infos[j].Started
+    } )
+    return infos, nil
+}
+
+func (self *VidRecStore) info( id string ) ( VidRecInfo, error ) {
+    info := VidRecInfo{ Id: id, Active: self.isActive( id ) }
+    dir := filepath.Join( self.dir, id )
+
+    file, err := os.Open( filepath.Join( dir, VIDREC_INDEX ) )
+    if err != nil {
+        return info, err
+    }
+    defer file.Close()
+    scanner := bufio.NewScanner( file )
+    if !scanner.Scan() {
+        return info, errors.New("index is empty")
+    }
+    header := VidRecHeader{}
+    if err := json.Unmarshal( scanner.Bytes(), &header ); err != nil {
+        return info, err
+    }
+    info.Udid, info.Name, info.Started = header.Udid, header.Name, header.Started
+    for scanner.Scan() {
+        info.Frames++
+    }
+
+    size, _ := dirSize( dir )
+    info.Size = size
+    return info, nil
+}
+
+// dirSize adds up the files in dir and finds when it last changed.
+func dirSize( dir string ) ( int64, time.Time ) {
+    var size int64
+    var changed time.Time
+    entries, _ := ioutil.ReadDir( dir )
+    for _, entry := range entries {
+        size += entry.Size()
+        if entry.ModTime().After( changed ) {
+            changed = entry.ModTime()
+        }
+    }
+    return size, changed
+}
+
+// prune deletes finished recordings older than maxAge, then the oldest
+// finished ones until all of them fit in maxSize.
+func (self *VidRecStore) prune() {
+    if self.maxSize <= 0 && self.maxAge <= 0 {
+        return
+    }
+    entries, err := ioutil.ReadDir( self.dir )
+    if err != nil {
+        return
+    }
+
+    type recDir struct {
+        id      string
+        size    int64
+        changed time.Time
+    }
+    dirs := []recDir{}
+    var total int64
+    for _, entry := range entries {
+        if !entry.IsDir() {
+            continue
+        }
+        size, changed := dirSize( filepath.Join( self.dir, entry.Name() ) )
+        total += size
+        if self.isActive( entry.Name() ) {
+            continue
+        }
+        dirs = append( dirs, recDir{ entry.Name(), size, changed } )
+    }
+    sort.Slice( dirs, func( i, j int ) bool {
+        return dirs[i].changed.Before( dirs[j].changed )
+    } )
+
+    for _, dir := range dirs {
+        old := self.maxAge > 0 && time.Since( dir.changed ) > self.maxAge
+        over := self.maxSize > 0 && total > self.maxSize
+        if !old && !over {
+            continue
+        }
+        if err := os.RemoveAll( filepath.Join( self.dir, dir.id ) ); err != nil {
+            continue
+        }
+        total -= dir.size
+        reason := "size"
+        if old {
+            reason = "age"
+        }
+        log.WithFields( log.Fields{
+            "type":   "vidrec_prune",
+            "id":     dir.id,
+            "size":   dir.size,
+            "reason": reason,
+        } ).Info("Deleted old video recording")
+    }
+}
+
+// writeTar writes recording id to w as a tar of its directory.
+func (self *VidRecStore) writeTar( w io.Writer, id string ) error {
+    dir, err := self.path( id )
+    if err != nil {
+        return err
+    }
+    entries, err := ioutil.ReadDir( dir )
+    if err != nil {
+        return err
+    }
+    tw := tar.NewWriter( w )
+    for _, entry := range entries {
+        if entry.IsDir() {
+            continue
+        }
+        file, err := os.Open( filepath.Join( dir, entry.Name() ) )
+        if err != nil {
+            return err
+        }
+        // A recording in progress keeps growing; take it as it was when listed
+        err = tw.WriteHeader( &tar.Header{
+            Name:    id + "/" + entry.Name(),
+            Mode:    0644,
+            Size:    entry.Size(),
+            ModTime: entry.ModTime(),
+        } )
+        if err == nil {
+            _, err = io.CopyN( tw, file, entry.Size() )
+        }
+        file.Close()
+        if err != nil {
+            return err
+        }
+    }
+    return tw.Close()
+}
+
+/*
+VidRecorder writes one recording. It is a VidConn, so it is subscribed to
+the device's video like any viewer and gets the same frames.
+*/
+type VidRecorder struct {
+    store    *VidRecStore
+    id       string
+    udid     string
+    name     string
+    dir      string
+    lock     *sync.Mutex
+    index    *os.File
+    enc      *json.Encoder
+    seg      *os.File
+    segNum   int
+    segStart time.Time
+    segOff   int64
+    first    time.Time
+    frames   int
+    size     int64
+    closed   bool
+}
+
+func newVidRecorder( store *VidRecStore, id string, udid string, name string, now time.Time, preroll []VidTimedFrame ) ( *VidRecorder, error ) {
+    dir := filepath.Join( store.dir, id )
+    index, err := os.Create( filepath.Join( dir, VIDREC_INDEX ) )
+    if err != nil {
+        return nil, err
+    }
+    self := &VidRecorder{
+        store: store,
+        id:    id,
+        udid:  udid,
+        name:  name,
+        dir:   dir,
+        lock:  &sync.Mutex{},
+        index: index,
+        enc:   json.NewEncoder( index ),
+        first: now,
+    }
+    if len( preroll ) > 0 {
+        self.first = preroll[0].at
+    }
+    err = self.enc.Encode( &VidRecHeader{
+        Version: VIDREC_VERSION,
+        Udid:    udid,
+        Name:    name,
+        Started: self.first.UTC().Format( time.RFC3339Nano ),
+        Trigger: now.Sub( self.first ).Milliseconds(),
+    } )
+    if err != nil {
+        index.Close()
+        return nil, err
+    }
+    for _, frame := range preroll {
+        if err := self.add( frame.at, frame.data ); err != nil {
+            self.Close()
+            return nil, err
+        }
+    }
+    return self, nil
+}
+
+func (self *VidRecorder) WriteMessage( mType int, data []byte ) error {
+    if mType != ws.BinaryMessage {
+        return nil
+    }
+    return self.add( time.Now(), data )
+}
+
+// add appends a frame, starting a new segment when the current one is full.
+func (self *VidRecorder) add( at time.Time, data []byte ) error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.closed {
+        return io.ErrClosedPipe
+    }
+
+    if self.seg == nil || at.Sub( self.segStart ) >= self.store.segLen {
+        if err := self.nextSegment( at ); err != nil {
+            return err
+        }
+    }
+
+    data = asJpeg( data )
+    if _, err := self.seg.Write( data ); err != nil {
+        return err
+    }
+    err := self.enc.Encode( &VidRecFrame{
+        T:   at.Sub( self.first ).Milliseconds(),
+        Seg: self.segNum,
+        Off: self.segOff,
+        Len: len( data ),
+    } )
+    if err != nil {
+        return err
+    }
+    self.segOff += int64( len( data ) )
+    self.size += int64( len( data ) )
+    self.frames++
+    return nil
+}
+
+func (self *VidRecorder) nextSegment( at time.Time ) error {
+    if self.seg != nil {
+        self.seg.Close()
+        // Keeps a long recording inside the size limit as it grows
+        go self.store.prune()
+    }
+    self.segNum++
+    seg, err := os.Create( filepath.Join( self.dir, fmt.Sprintf( "seg-%05d.mjpeg", self.segNum ) ) )
+    if err != nil {
+        self.seg = nil
+        return err
+    }
+    self.seg = seg
+    self.segStart = at
+    self.segOff = 0
+    return nil
+}
+
+// Close ends the recording.
+func (self *VidRecorder) Close() error {
+    self.lock.Lock()
+    if self.closed {
+        self.lock.Unlock()
+        return nil
+    }
+    self.closed = true
+    if self.seg != nil {
+        self.seg.Close()
+    }
+    self.index.Close()
+    frames, size := self.frames, self.size
+    self.lock.Unlock()
+
+    log.WithFields( log.Fields{
+        "type":   "vidrec_stop",
+        "id":     self.id,
+        "frames": frames,
+        "size":   size,
+    } ).Info("Stopped recording video")
+
+    self.store.finished( self )
+    return nil
+}
+
+func (self *VidRecorder) info() VidRecInfo {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return VidRecInfo{
+        Id:      self.id,
+        Udid:    self.udid,
+        Name:    self.name,
+        Started: self.first.UTC().Format( time.RFC3339Nano ),
+        Frames:  self.frames,
+        Size:    self.size,
+        Active:  !self.closed,
+    }
+}
+
+// asJpeg converts frames in other formats, such as PNG screenshots, so
+// that a segment stays playable as MJPEG.
+func asJpeg( data []byte ) []byte {
+    if http.DetectContentType( data ) == "image/jpeg" {
+        return data
+    }
+    img, _, err := image.Decode( bytes.NewReader( data ) )
+    if err != nil {
+        return data
+    }
+    buf := bytes.Buffer{}
+    if err := jpeg.Encode( &buf, img, &jpeg.Options{ Quality: 90 } ); err != nil {
+        return data
+    }
+    return buf.Bytes()
+}
+
+// VidPreroll holds the last keep of a device's video, so that a recording
+// can start with what happened just before it was asked for.
+type VidPreroll struct {
+    keep   time.Duration
+    lock   *sync.Mutex
+    frames []VidTimedFrame
+}
+
+func NewVidPreroll( keep time.Duration ) *VidPreroll {
+    return &VidPreroll{
+        keep: keep,
+        lock: &sync.Mutex{},
+    }
+}
+
+func (self *VidPreroll) WriteMessage( mType int, data []byte ) error {
+    if mType != ws.BinaryMessage {
+        return nil
+    }
+    now := time.Now()
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.frames = append( self.frames, VidTimedFrame{ at: now, data: data } )
+    drop := 0
+    for drop < len( self.frames ) && now.Sub( self.frames[ drop ].at ) > self.keep {
+        drop++
+    }
+    if drop > 0 {
+        self.frames = append( []VidTimedFrame{}, self.frames[ drop: ]... )
+    }
+    return nil
+}
+
+func (self *VidPreroll) Close() error {
+    return nil
+}
+
+func (self *VidPreroll) snapshot() []VidTimedFrame {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return append( []VidTimedFrame{}, self.frames... )
+}
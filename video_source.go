@@ -0,0 +1,523 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    log "github.com/sirupsen/logrus"
+)
+
+// Names of video sources, as used in video.sources
+const (
+    VSRC_APP         = "app"         // broadcast from the video app
+    VSRC_CFA         = "cfagent"     // screenshots taken by CFAgent
+    VSRC_SCREENSHOTR = "screenshotr" // screenshots over usbmux
+)
+
+// States of a VidSourceMachine
+const (
+    VSRC_OFF      = iota // not begun
+    VSRC_STARTING        // a source was started and has sent no frame yet
+    VSRC_LIVE            // frames are arriving from the source
+    VSRC_DARK            // every source has failed
+)
+
+var vidSourceStates = []string{ "off", "starting", "live", "dark" }
+
+// Longest wait between probes of a failed source, in probe intervals
+const VSRC_MAX_BACKOFF = 8
+
+// VidSource is one way of getting frames from a device. Frames are handed
+// to VidSourceMachine.frame however the source produces them.
+type VidSource interface {
+    start() error // begin producing frames
+    stop()
+    probe() bool  // whether the source looks usable again, without starting it
+    poke()        // ask for a frame now, for sources that only send changes
+}
+
+// VidSourceFuncs is a VidSource made of functions. A missing probe never
+// succeeds.
+type VidSourceFuncs struct {
+    onStart func() error
+    onStop  func()
+    onProbe func() bool
+    onPoke  func()
+}
+
+func (self *VidSourceFuncs) start() error {
+    if self.onStart == nil {
+        return nil
+    }
+    return self.onStart()
+}
+
+func (self *VidSourceFuncs) stop() {
+    if self.onStop != nil {
+        self.onStop()
+    }
+}
+
+func (self *VidSourceFuncs) probe() bool {
+    if self.onProbe == nil {
+        return false
+    }
+    return self.onProbe()
+}
+
+func (self *VidSourceFuncs) poke() {
+    if self.onPoke != nil {
+        self.onPoke()
+    }
+}
+
+// VidSourceEvent is one transition of a VidSourceMachine.
+type VidSourceEvent struct {
+    From   string // source before; blank for none
+    To     string // source after; blank when dark
+    State  string
+    Reason string
+}
+
+type VidSourceStats struct {
+    Source  string   `json:"source"`
+    State   string   `json:"state"`
+    Held    string   `json:"held,omitempty"`
+    Down    []string `json:"down,omitempty"`    // sources waiting to be probed
+    Changes int      `json:"changes"`
+}
+
+type vidSourceSlot struct {
+    src       VidSource
+    lastFrame time.Time
+    down      bool
+    downAt    time.Time
+    pokedAt   time.Time
+    retryAt   time.Time     // when to probe next while down
+    backoff   time.Duration // wait before the probe after that
+}
+
+/*
+VidSourceMachine decides where a device's video comes from. Sources are
+tried in the order of chain, best first. A source that sends no frame for
+stall while anyone is watching is marked down and the next one is started.
+Half way there it is poked, as a source may be quiet only because the screen
+has not changed. Sources above the current one that are down are probed
+every probe, backing off to VSRC_MAX_BACKOFF probes while they keep failing,
+and video moves back up to the best one that recovers. A source that sends
+frames while it is not the current one counts as recovered without a probe.
+
+hold puts a source ahead of the chain until release, for when one source is
+known to be better for a while, such as screenshotr while an alert is up.
+
+Transitions are passed to onChange, which must not call back into the
+machine. Only one transition is made at a time; frame never waits on one.
+*/
+type VidSourceMachine struct {
+    udid        string
+    chain       []string
+    slots       map[string] *vidSourceSlot
+    stall       time.Duration
+    probe       time.Duration
+    watching    func() bool
+    onChange    func( VidSourceEvent )
+    now         func() time.Time
+    stepLock    *sync.Mutex // held for the whole of a transition
+    lock        *sync.Mutex // guards the fields below
+    active      string
+    state       int
+    held        string
+    since       time.Time // the active source started or viewers came back
+    wasWatching bool
+    changes     int
+    stopped     bool
+    stopChan    chan bool
+    stopOnce    sync.Once
+}
+
+func NewVidSourceMachine( udid string, chain []string, stall time.Duration, probe time.Duration,
+        watching func() bool, onChange func( VidSourceEvent ) ) *VidSourceMachine {
+    if stall <= 0 {
+        stall = 5 * time.Second
+    }
+    if probe <= 0 {
+        probe = 10 * time.Second
+    }
+    return &VidSourceMachine{
+        udid:     udid,
+        chain:    chain,
+        slots:    make( map[string] *vidSourceSlot ),
+        stall:    stall,
+        probe:    probe,
+        watching: watching,
+        onChange: onChange,
+        now:      time.Now,
+        stepLock: &sync.Mutex{},
+        lock:     &sync.Mutex{},
+        stopChan: make( chan bool ),
+    }
+}
+
+// add registers a source. Sources not in the chain are only used when held.
+func (self *VidSourceMachine) add( name string, src VidSource ) {
+    self.lock.Lock()
+    self.slots[ name ] = &vidSourceSlot{ src: src, backoff: self.probe }
+    self.lock.Unlock()
+}
+
+// begin starts the best source.
+func (self *VidSourceMachine) begin() {
+    self.stepLock.Lock()
+    defer self.stepLock.Unlock()
+    watching := self.watching == nil || self.watching()
+    self.lock.Lock()
+    if self.stopped || self.state != VSRC_OFF {
+        self.lock.Unlock()
+        return
+    }
+    self.wasWatching = watching
+    self.lock.Unlock()
+    self.reselect("started")
+}
+
+// run checks for stalls and probes until stop is called.
+func (self *VidSourceMachine) run() {
+    tick := self.stall / 4
+    if tick > time.Second {
+        tick = time.Second
+    }
+    ticker := time.NewTicker( tick )
+    defer ticker.Stop()
+    for {
+        select {
+            case <- self.stopChan:
+                return
+            case <- ticker.C:
+                self.check()
+        }
+    }
+}
+
+// stop ends run and stops the current source.
+func (self *VidSourceMachine) stop() {
+    self.stopOnce.Do( func() {
+        close( self.stopChan )
+        self.stepLock.Lock()
+        defer self.stepLock.Unlock()
+        self.lock.Lock()
+        self.stopped = true
+        slot := self.slots[ self.active ]
+        self.lock.Unlock()
+        if slot != nil {
+            slot.src.stop()
+        }
+    } )
+}
+
+// frame notes a frame from source name and reports whether it should be
+// sent on, which it should only if name is the current source.
+func (self *VidSourceMachine) frame( name string ) bool {
+    self.lock.Lock()
+    slot := self.slots[ name ]
+    if slot == nil {
+        self.lock.Unlock()
+        return false
+    }
+    slot.lastFrame = self.now()
+    if name != self.active || self.stopped {
+        self.lock.Unlock()
+        return false
+    }
+    if self.state == VSRC_STARTING {
+        self.state = VSRC_LIVE
+        slot.backoff = self.probe
+        self.changes++
+        self.emit( VidSourceEvent{ From: name, To: name, State: vidSourceStates[ VSRC_LIVE ], Reason: "first frame" } )
+    }
+    self.lock.Unlock()
+    return true
+}
+
+// current is the source frames are being taken from; blank for none.
+func (self *VidSourceMachine) current() string {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.active
+}
+
+func (self *VidSourceMachine) stats() VidSourceStats {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    stat := VidSourceStats{
+        Source:  self.active,
+        State:   vidSourceStates[ self.state ],
+        Held:    self.held,
+        Changes: self.changes,
+    }
+    for _, name := range self.order() {
+        if self.slots[ name ].down {
+            stat.Down = append( stat.Down, name )
+        }
+    }
+    return stat
+}
+
+// hold puts source name ahead of the chain, giving it another try even if
+// it was down.
+func (self *VidSourceMachine) hold( name string, reason string ) {
+    self.stepLock.Lock()
+    defer self.stepLock.Unlock()
+    self.lock.Lock()
+    slot := self.slots[ name ]
+    if slot == nil || self.stopped {
+        self.lock.Unlock()
+        return
+    }
+    self.held = name
+    slot.down = false
+    begun := self.state != VSRC_OFF
+    self.lock.Unlock()
+    // Before begin the hold is just where begin will start
+    if begun {
+        self.reselect( reason )
+    }
+}
+
+// release undoes hold. Video goes to the best source that is not down,
+// not back to the top of the chain.
+func (self *VidSourceMachine) release( reason string ) {
+    self.stepLock.Lock()
+    defer self.stepLock.Unlock()
+    self.lock.Lock()
+    if self.held == "" || self.stopped {
+        self.lock.Unlock()
+        return
+    }
+    self.held = ""
+    begun := self.state != VSRC_OFF
+    self.lock.Unlock()
+    if begun {
+        self.reselect( reason )
+    }
+}
+
+// fail marks source name down without waiting for it to stall, for when
+// it is known to be gone.
+func (self *VidSourceMachine) fail( name string, reason string ) {
+    self.stepLock.Lock()
+    defer self.stepLock.Unlock()
+    self.lock.Lock()
+    slot := self.slots[ name ]
+    if slot == nil || self.stopped || self.state == VSRC_OFF {
+        self.lock.Unlock()
+        return
+    }
+    self.markDown( name, slot, reason )
+    self.lock.Unlock()
+    self.reselect( reason )
+}
+
+// check falls back from a stalled source and moves up to any source above
+// it that has recovered. Nothing is checked while nobody is watching, as
+// sources do not send frames then.
+func (self *VidSourceMachine) check() {
+    self.stepLock.Lock()
+    defer self.stepLock.Unlock()
+
+    watching := self.watching == nil || self.watching()
+    now := self.now()
+
+    self.lock.Lock()
+    if self.stopped || self.state == VSRC_OFF {
+        self.lock.Unlock()
+        return
+    }
+    if !watching {
+        self.wasWatching = false
+        self.lock.Unlock()
+        return
+    }
+    if !self.wasWatching {
+        // The active source gets a full stall timeout to start sending again
+        self.wasWatching = true
+        self.since = now
+    }
+
+    reason := ""
+    var poke VidSource
+    if slot := self.slots[ self.active ]; slot != nil {
+        last := slot.lastFrame
+        if last.Before( self.since ) {
+            last = self.since
+        }
+        quiet := now.Sub( last )
+        if quiet > self.stall {
+            reason = fmt.Sprintf( "no frame from %s for %s", self.active, self.stall )
+            self.markDown( self.active, slot, reason )
+        } else if quiet > self.stall / 2 && slot.pokedAt.Before( last ) {
+            slot.pokedAt = now
+            poke = slot.src
+        }
+    }
+
+    // Sources to probe, best first, stopping at the active one
+    probes := []string{}
+    for _, name := range self.order() {
+        if name == self.active && reason == "" {
+            break
+        }
+        slot := self.slots[ name ]
+        if !slot.down {
+            continue
+        }
+        if slot.lastFrame.After( slot.downAt ) && now.Sub( slot.lastFrame ) <= self.stall {
+            slot.down = false
+            if reason == "" {
+                reason = name + " is sending frames again"
+            }
+            continue
+        }
+        if !now.Before( slot.retryAt ) {
+            probes = append( probes, name )
+        }
+    }
+    self.lock.Unlock()
+
+    if poke != nil {
+        poke.poke()
+    }
+
+    for _, name := range probes {
+        slot := self.slot( name )
+        ok := slot.src.probe()
+
+        self.lock.Lock()
+        if ok {
+            slot.down = false
+            if reason == "" {
+                reason = name + " recovered"
+            }
+        } else {
+            if slot.backoff < self.probe * VSRC_MAX_BACKOFF {
+                slot.backoff *= 2
+            }
+            slot.retryAt = now.Add( slot.backoff )
+        }
+        self.lock.Unlock()
+    }
+
+    if reason != "" {
+        self.reselect( reason )
+    }
+}
+
+// order is the held source, if any, then the chain. lock must be held.
+func (self *VidSourceMachine) order() []string {
+    order := []string{}
+    if self.held != "" {
+        order = append( order, self.held )
+    }
+    for _, name := range self.chain {
+        if name != self.held && self.slots[ name ] != nil {
+            order = append( order, name )
+        }
+    }
+    return order
+}
+
+// markDown takes a source out of use until it is probed. lock must be held.
+func (self *VidSourceMachine) markDown( name string, slot *vidSourceSlot, reason string ) {
+    if !slot.down {
+        log.WithFields( log.Fields{
+            "type":   "vid_source_down",
+            "udid":   censorUuid( self.udid ),
+            "source": name,
+            "reason": reason,
+        } ).Warn("Video source down")
+    }
+    slot.down = true
+    slot.downAt = self.now()
+    slot.retryAt = slot.downAt.Add( slot.backoff )
+}
+
+// reselect moves to the best source that is not down and will start, or
+// goes dark if there is none. stepLock must be held.
+func (self *VidSourceMachine) reselect( reason string ) {
+    self.lock.Lock()
+    prev := self.active
+    dark := self.state == VSRC_DARK
+    order := self.order()
+    self.lock.Unlock()
+
+    prevStopped := false
+    stopPrev := func() {
+        if !prevStopped && prev != "" {
+            self.slot( prev ).src.stop()
+        }
+        prevStopped = true
+    }
+
+    for _, name := range order {
+        slot := self.slot( name )
+        self.lock.Lock()
+        down := slot.down
+        self.lock.Unlock()
+        if down {
+            continue
+        }
+        if name == prev {
+            // Already the best there is
+            return
+        }
+        stopPrev()
+
+        // Frames from name are not sent on until it has started
+        err := slot.src.start()
+        self.lock.Lock()
+        if err == nil {
+            self.active = name
+            self.state = VSRC_STARTING
+            self.since = self.now()
+            self.changes++
+            self.emit( VidSourceEvent{ From: prev, To: name, State: vidSourceStates[ VSRC_STARTING ], Reason: reason } )
+            self.lock.Unlock()
+            return
+        }
+        self.active = ""
+        self.markDown( name, slot, err.Error() )
+        self.lock.Unlock()
+        reason = fmt.Sprintf( "%s would not start: %s", name, err )
+    }
+
+    stopPrev()
+    self.lock.Lock()
+    self.active = ""
+    self.state = VSRC_DARK
+    if !dark {
+        self.changes++
+        self.emit( VidSourceEvent{ From: prev, To: "", State: vidSourceStates[ VSRC_DARK ], Reason: reason } )
+    }
+    self.lock.Unlock()
+}
+
+func (self *VidSourceMachine) slot( name string ) *vidSourceSlot {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.slots[ name ]
+}
+
+// emit reports a transition. lock must be held, so that events are passed
+// on in the order they happened.
+func (self *VidSourceMachine) emit( ev VidSourceEvent ) {
+    log.WithFields( log.Fields{
+        "type":   "vid_source",
+        "udid":   censorUuid( self.udid ),
+        "from":   ev.From,
+        "to":     ev.To,
+        "state":  ev.State,
+        "reason": ev.Reason,
+    } ).Info("Video source changed")
+    if self.onChange != nil {
+        self.onChange( ev )
+    }
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+    "errors"
+    "strings"
+    "testing"
+    "time"
+)
+
+const (
+    testStall = 4 * time.Second
+    testProbe = 10 * time.Second
+)
+
+// fakeVidSource is a simulated source whose frames are sent by the test.
+type fakeVidSource struct {
+    name     string
+    m        *VidSourceMachine
+    startErr error
+    probeOk  bool
+    starts   int
+    stops    int
+    probes   int
+    pokes    int
+}
+
+func (self *fakeVidSource) start() error {
+    self.starts++
+    return self.startErr
+}
+
+func (self *fakeVidSource) stop() { self.stops++ }
+
+func (self *fakeVidSource) probe() bool {
+    self.probes++
+    return self.probeOk
+}
+
+func (self *fakeVidSource) poke() { self.pokes++ }
+
+// send delivers a frame and reports whether it would have gone to viewers.
+func (self *fakeVidSource) send() bool {
+    return self.m.frame( self.name )
+}
+
+type vidSourceTest struct {
+    t        *testing.T
+    m        *VidSourceMachine
+    clock    time.Time
+    watching bool
+    events   []VidSourceEvent
+    srcs     map[string] *fakeVidSource
+}
+
+func newVidSourceTest( t *testing.T, chain ...string ) *vidSourceTest {
+    vt := &vidSourceTest{
+        t:        t,
+        clock:    time.Unix( 1000000, 0 ),
+        watching: true,
+        srcs:     make( map[string] *fakeVidSource ),
+    }
+    vt.m = NewVidSourceMachine( "00000000-TEST", chain, testStall, testProbe,
+        func() bool { return vt.watching },
+        func( ev VidSourceEvent ) { vt.events = append( vt.events, ev ) } )
+    vt.m.now = func() time.Time { return vt.clock }
+    for _, name := range []string{ VSRC_APP, VSRC_CFA, VSRC_SCREENSHOTR } {
+        src := &fakeVidSource{ name: name, m: vt.m }
+        vt.srcs[ name ] = src
+        vt.m.add( name, src )
+    }
+    return vt
+}
+
+// wait moves the clock on and runs a check.
+func (self *vidSourceTest) wait( d time.Duration ) {
+    self.clock = self.clock.Add( d )
+    self.m.check()
+}
+
+// keep moves the clock on by d, with source sending a frame before each
+// check so that it does not stall. It stops early if source is left.
+func (self *vidSourceTest) keep( source string, d time.Duration ) {
+    for step := testStall / 2; d > 0; d -= step {
+        self.srcs[ source ].send()
+        self.wait( step )
+        if self.m.current() != source {
+            return
+        }
+    }
+}
+
+func (self *vidSourceTest) expect( source string, state int ) {
+    self.t.Helper()
+    stat := self.m.stats()
+    if stat.Source != source || stat.State != vidSourceStates[ state ] {
+        self.t.Fatalf( "at %s/%s, want %s/%s", stat.Source, stat.State, source, vidSourceStates[ state ] )
+    }
+}
+
+func (self *vidSourceTest) lastEvent() VidSourceEvent {
+    self.t.Helper()
+    if len( self.events ) == 0 {
+        self.t.Fatalf( "no events" )
+    }
+    return self.events[ len( self.events ) - 1 ]
+}
+
+// live begins the machine and has the first source send a frame.
+func (self *vidSourceTest) live( source string ) {
+    self.t.Helper()
+    self.m.begin()
+    self.expect( source, VSRC_STARTING )
+    if !self.srcs[ source ].send() {
+        self.t.Fatalf( "frame from %s not sent on", source )
+    }
+    self.expect( source, VSRC_LIVE )
+}
+
+func TestVidSourceStartsBest( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_APP, VSRC_CFA, VSRC_SCREENSHOTR )
+    vt.live( VSRC_APP )
+
+    if len( vt.events ) != 2 {
+        t.Fatalf( "expected 2 events, got %+v", vt.events )
+    }
+    if ev := vt.events[0]; ev.From != "" || ev.To != VSRC_APP || ev.State != "starting" {
+        t.Errorf( "unexpected first event %+v", ev )
+    }
+    if ev := vt.events[1]; ev.To != VSRC_APP || ev.State != "live" {
+        t.Errorf( "unexpected second event %+v", ev )
+    }
+    if vt.srcs[ VSRC_CFA ].send() {
+        t.Errorf( "frame from an inactive source sent on" )
+    }
+    if vt.srcs[ VSRC_CFA ].starts != 0 {
+        t.Errorf( "lower source started" )
+    }
+}
+
+func TestVidSourceFallsBackOnStall( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_APP, VSRC_CFA, VSRC_SCREENSHOTR )
+    vt.live( VSRC_APP )
+
+    // Frames keep it up
+    for i := 0; i < 5; i++ {
+        vt.wait( testStall / 2 )
+        vt.srcs[ VSRC_APP ].send()
+    }
+    vt.expect( VSRC_APP, VSRC_LIVE )
+
+    vt.wait( testStall + time.Second )
+    vt.expect( VSRC_CFA, VSRC_STARTING )
+    ev := vt.lastEvent()
+    if ev.From != VSRC_APP || ev.To != VSRC_CFA || !strings.Contains( ev.Reason, "no frame" ) {
+        t.Errorf( "unexpected event %+v", ev )
+    }
+    if vt.srcs[ VSRC_APP ].stops != 1 || vt.srcs[ VSRC_CFA ].starts != 1 {
+        t.Errorf( "app stopped %d times, cfagent started %d times", vt.srcs[ VSRC_APP ].stops, vt.srcs[ VSRC_CFA ].starts )
+    }
+    if down := vt.m.stats().Down; len( down ) != 1 || down[0] != VSRC_APP {
+        t.Errorf( "expected app down, got %v", down )
+    }
+
+    // A new source that never sends falls back too
+    vt.wait( testStall + time.Second )
+    vt.expect( VSRC_SCREENSHOTR, VSRC_STARTING )
+}
+
+func TestVidSourcePokesQuietSource( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_APP, VSRC_CFA )
+    vt.live( VSRC_APP )
+    app := vt.srcs[ VSRC_APP ]
+
+    vt.wait( testStall / 4 )
+    if app.pokes != 0 {
+        t.Fatalf( "poked too soon" )
+    }
+    vt.wait( testStall / 2 )
+    vt.wait( testStall / 8 )
+    if app.pokes != 1 {
+        t.Fatalf( "expected 1 poke, got %d", app.pokes )
+    }
+    // The poke gets a frame out of an idle screen
+    app.send()
+    vt.wait( testStall * 3 / 4 )
+    vt.expect( VSRC_APP, VSRC_LIVE )
+    if app.pokes != 2 {
+        t.Errorf( "expected a second poke, got %d", app.pokes )
+    }
+}
+
+func TestVidSourceStartFailure( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_APP, VSRC_CFA, VSRC_SCREENSHOTR )
+    vt.srcs[ VSRC_APP ].startErr = errors.New("not running")
+    vt.live( VSRC_CFA )
+
+    ev := vt.events[0]
+    if ev.To != VSRC_CFA || !strings.Contains( ev.Reason, "not running" ) {
+        t.Errorf( "unexpected event %+v", ev )
+    }
+    if vt.srcs[ VSRC_APP ].send() {
+        t.Errorf( "frame from failed source sent on" )
+    }
+}
+
+func TestVidSourceFail( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_APP, VSRC_CFA )
+    vt.live( VSRC_APP )
+
+    vt.m.fail( VSRC_APP, "socket lost" )
+    vt.expect( VSRC_CFA, VSRC_STARTING )
+    if ev := vt.lastEvent(); ev.Reason != "socket lost" {
+        t.Errorf( "unexpected event %+v", ev )
+    }
+
+    // Failing a source that is not in use changes nothing
+    count := len( vt.events )
+    vt.m.fail( VSRC_SCREENSHOTR, "gone" )
+    if len( vt.events ) != count {
+        t.Errorf( "unexpected event %+v", vt.lastEvent() )
+    }
+}
+
+func TestVidSourceDarkAndProbe( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_CFA, VSRC_SCREENSHOTR )
+    vt.live( VSRC_CFA )
+
+    vt.wait( testStall + time.Second )
+    vt.expect( VSRC_SCREENSHOTR, VSRC_STARTING )
+    vt.wait( testStall + time.Second )
+    vt.expect( "", VSRC_DARK )
+    ev := vt.lastEvent()
+    if ev.From != VSRC_SCREENSHOTR || ev.To != "" || ev.State != "dark" {
+        t.Errorf( "unexpected event %+v", ev )
+    }
+    // Staying dark is not another transition
+    count := len( vt.events )
+    vt.wait( time.Second )
+    if len( vt.events ) != count {
+        t.Errorf( "unexpected event %+v", vt.lastEvent() )
+    }
+
+    // cfagent went down first so is probed first
+    cfa := vt.srcs[ VSRC_CFA ]
+    cfa.probeOk = true
+    vt.wait( testProbe )
+    vt.expect( VSRC_CFA, VSRC_STARTING )
+    if cfa.probes != 1 || cfa.starts != 2 {
+        t.Errorf( "cfagent probed %d times, started %d times", cfa.probes, cfa.starts )
+    }
+    if ev := vt.lastEvent(); ev.From != "" || !strings.Contains( ev.Reason, "recovered" ) {
+        t.Errorf( "unexpected event %+v", ev )
+    }
+}
+
+func TestVidSourceMovesBackUp( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_APP, VSRC_CFA )
+    vt.live( VSRC_APP )
+    vt.wait( testStall + time.Second )
+    vt.expect( VSRC_CFA, VSRC_STARTING )
+    vt.srcs[ VSRC_CFA ].send()
+
+    // The app comes back by itself
+    vt.wait( time.Second )
+    vt.srcs[ VSRC_CFA ].send()
+    if vt.srcs[ VSRC_APP ].send() {
+        t.Errorf( "frame from the app sent on before moving back" )
+    }
+    vt.wait( time.Second )
+    vt.expect( VSRC_APP, VSRC_STARTING )
+    if ev := vt.lastEvent(); ev.From != VSRC_CFA || !strings.Contains( ev.Reason, "sending frames again" ) {
+        t.Errorf( "unexpected event %+v", ev )
+    }
+    if vt.srcs[ VSRC_APP ].probes != 0 {
+        t.Errorf( "app probed though it was sending frames" )
+    }
+    if vt.srcs[ VSRC_CFA ].stops != 1 {
+        t.Errorf( "cfagent not stopped" )
+    }
+}
+
+func TestVidSourceProbeBackoff( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_APP, VSRC_CFA )
+    vt.live( VSRC_APP )
+    vt.wait( testStall + time.Second )
+    vt.expect( VSRC_CFA, VSRC_STARTING )
+    app := vt.srcs[ VSRC_APP ]
+
+    // Probes at 1, 1+2, 1+2+4 and then every 8 probe intervals
+    want := []int{ 1, 3, 7, 15, 23 }
+    for i := 0; i < 25; i++ {
+        vt.keep( VSRC_CFA, testProbe )
+        probes := 0
+        for _, n := range want {
+            if i + 1 >= n {
+                probes++
+            }
+        }
+        if app.probes != probes {
+            t.Fatalf( "after %d intervals, %d probes; want %d", i + 1, app.probes, probes )
+        }
+    }
+    vt.expect( VSRC_CFA, VSRC_LIVE )
+
+    // Once the app is back, it gets a probe interval again
+    app.probeOk = true
+    vt.keep( VSRC_CFA, testProbe * VSRC_MAX_BACKOFF )
+    vt.expect( VSRC_APP, VSRC_STARTING )
+    app.send()
+    app.probeOk = false
+    vt.wait( testStall + time.Second )
+    vt.expect( VSRC_CFA, VSRC_STARTING )
+    probes := app.probes
+    vt.keep( VSRC_CFA, testProbe )
+    if app.probes != probes + 1 {
+        t.Errorf( "backoff not reset after recovering" )
+    }
+}
+
+func TestVidSourceHold( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_APP, VSRC_CFA, VSRC_SCREENSHOTR )
+    vt.live( VSRC_APP )
+    vt.m.fail( VSRC_APP, "gone" )
+    vt.expect( VSRC_CFA, VSRC_STARTING )
+
+    vt.m.hold( VSRC_SCREENSHOTR, "alert appeared" )
+    vt.expect( VSRC_SCREENSHOTR, VSRC_STARTING )
+    if vt.m.stats().Held != VSRC_SCREENSHOTR {
+        t.Errorf( "hold not in stats" )
+    }
+    if vt.srcs[ VSRC_CFA ].send() {
+        t.Errorf( "frame from cfagent sent on while held" )
+    }
+
+    // Back to the best source still up, not the top of the chain
+    vt.m.release("alert gone")
+    vt.expect( VSRC_CFA, VSRC_STARTING )
+    if ev := vt.lastEvent(); ev.From != VSRC_SCREENSHOTR || ev.Reason != "alert gone" {
+        t.Errorf( "unexpected event %+v", ev )
+    }
+    if vt.srcs[ VSRC_APP ].starts != 1 {
+        t.Errorf( "app restarted on release" )
+    }
+}
+
+func TestVidSourceHeldStall( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_CFA, VSRC_SCREENSHOTR )
+    vt.live( VSRC_CFA )
+    vt.m.hold( VSRC_SCREENSHOTR, "alert appeared" )
+
+    // A held source that stalls is left like any other
+    vt.wait( testStall + time.Second )
+    vt.expect( VSRC_CFA, VSRC_STARTING )
+}
+
+func TestVidSourceHoldBeforeBegin( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_APP, VSRC_CFA )
+    vt.m.hold( VSRC_CFA, "alert appeared" )
+    if len( vt.events ) != 0 || vt.srcs[ VSRC_CFA ].starts != 0 {
+        t.Fatalf( "hold started a source before begin" )
+    }
+    vt.live( VSRC_CFA )
+}
+
+func TestVidSourceIdleWithoutViewers( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_APP, VSRC_CFA )
+    vt.live( VSRC_APP )
+
+    vt.watching = false
+    vt.wait( testStall * 10 )
+    vt.expect( VSRC_APP, VSRC_LIVE )
+    if vt.srcs[ VSRC_APP ].pokes != 0 {
+        t.Errorf( "poked with nobody watching" )
+    }
+
+    // A viewer arriving gives the source a full stall timeout to get going
+    vt.watching = true
+    vt.wait( time.Second )
+    vt.wait( testStall - time.Second )
+    vt.expect( VSRC_APP, VSRC_LIVE )
+    vt.wait( 2 * time.Second )
+    vt.expect( VSRC_CFA, VSRC_STARTING )
+}
+
+func TestVidSourceStop( t *testing.T ) {
+    vt := newVidSourceTest( t, VSRC_APP, VSRC_CFA )
+    vt.live( VSRC_APP )
+    vt.m.stop()
+    vt.m.stop()
+
+    if vt.srcs[ VSRC_APP ].stops != 1 {
+        t.Errorf( "app stopped %d times", vt.srcs[ VSRC_APP ].stops )
+    }
+    if vt.srcs[ VSRC_APP ].send() {
+        t.Errorf( "frame sent on after stop" )
+    }
+    vt.wait( testStall * 2 )
+    vt.m.fail( VSRC_APP, "gone" )
+    if vt.srcs[ VSRC_CFA ].starts != 0 {
+        t.Errorf( "source started after stop" )
+    }
+}
+
+func TestVidSourceRun( t *testing.T ) {
+    m := NewVidSourceMachine( "00000000-TEST", []string{ VSRC_CFA, VSRC_SCREENSHOTR }, 40 * time.Millisecond, time.Hour, nil, nil )
+    cfa := &fakeVidSource{ name: VSRC_CFA, m: m }
+    m.add( VSRC_CFA, cfa )
+    m.add( VSRC_SCREENSHOTR, &fakeVidSource{ name: VSRC_SCREENSHOTR, m: m } )
+    m.begin()
+    go m.run()
+    defer m.stop()
+
+    deadline := time.Now().Add( 2 * time.Second )
+    for m.current() != VSRC_SCREENSHOTR {
+        if time.Now().After( deadline ) {
+            t.Fatalf( "did not fall back; at %+v", m.stats() )
+        }
+        time.Sleep( 10 * time.Millisecond )
+    }
+}